@@ -0,0 +1,437 @@
+package phoenix
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+)
+
+const (
+	//Stream value compared to the threshold
+	AlertConditionThreshold = "threshold"
+	//Change of the stream value per second compared to the threshold
+	AlertConditionRate = "rate"
+	//No stream value for the duration of the rule
+	AlertConditionMissing = "missing"
+	//Device offline for the duration of the rule
+	AlertConditionOffline = "offline"
+
+	AlertStatusPending      = "pending"
+	AlertStatusFiring       = "firing"
+	AlertStatusAcknowledged = "acknowledged"
+	AlertStatusResolved     = "resolved"
+)
+
+var (
+	AlertConditions = []string{
+		AlertConditionThreshold,
+		AlertConditionRate,
+		AlertConditionMissing,
+		AlertConditionOffline,
+	}
+
+	AlertOperators = []string{">", ">=", "<", "<=", "==", "!="}
+
+	//Alerts which are not resolved
+	alertOpenStatuses = []string{AlertStatusPending, AlertStatusFiring, AlertStatusAcknowledged}
+)
+
+// AlertRule is a condition on a stream or the online status of a device. It
+// applies to a single device, the devices of a device type, or all devices
+// when neither is set. The condition must hold for For seconds before the
+// alert fires.
+type AlertRule struct {
+	Id           uint64    `db:"id" json:"id" table:"alert_rules"`
+	Name         string    `db:"name" json:"name"`
+	DeviceId     *uint64   `db:"device_id" json:"device_id,omitempty"`
+	DeviceTypeId *uint64   `db:"device_type_id" json:"device_type_id,omitempty"`
+	Stream       *string   `db:"stream" json:"stream,omitempty"`
+	Condition    string    `db:"condition_type" json:"condition"`
+	Operator     *string   `db:"operator" json:"operator,omitempty"`
+	Threshold    *float64  `db:"threshold" json:"threshold,omitempty"`
+	For          int       `db:"for_seconds" json:"for"`
+	Enabled      bool      `db:"enabled" json:"enabled"`
+	Created      time.Time `db:"created" json:"created"`
+}
+
+type AlertRuleCriteria struct {
+	Id           uint64 `schema:"id" db:"id"`
+	DeviceId     uint64 `schema:"device_id" db:"device_id"`
+	DeviceTypeId uint64 `schema:"device_type_id" db:"device_type_id"`
+	Stream       string `schema:"stream" db:"stream"`
+	Condition    string `schema:"condition" db:"condition_type"`
+	Enabled      bool   `schema:"enabled" db:"enabled"`
+
+	Limit int `schema:"limit"`
+}
+
+// Alert is the state of a rule on a device, there is at most one alert per
+// rule and device which is not resolved
+type Alert struct {
+	Id             uint64     `db:"id" json:"id" table:"alerts"`
+	RuleId         uint64     `db:"rule_id" json:"rule_id"`
+	DeviceId       uint64     `db:"device_id" json:"device_id"`
+	Status         string     `db:"status" json:"status"`
+	Value          *float64   `db:"value" json:"value"`
+	Started        time.Time  `db:"started" json:"started"`
+	Fired          *time.Time `db:"fired" json:"fired"`
+	Acknowledged   *time.Time `db:"acknowledged" json:"acknowledged"`
+	AcknowledgedBy *string    `db:"acknowledged_by" json:"acknowledged_by"`
+	Resolved       *time.Time `db:"resolved" json:"resolved"`
+	Updated        time.Time  `db:"updated" json:"updated"`
+	//Generated, set while the alert is not resolved. Unique per rule and
+	//device, so there is only one open alert.
+	OpenKey *int `db:"open_key" json:"-"`
+}
+
+type AlertCriteria struct {
+	Id       uint64 `schema:"id" db:"id"`
+	RuleId   uint64 `schema:"rule_id" db:"rule_id"`
+	DeviceId uint64 `schema:"device_id" db:"device_id"`
+	Status   string `schema:"status" db:"status"`
+
+	Limit int `schema:"limit"`
+}
+
+func (r *AlertRule) Validate() error {
+	if len(r.Name) == 0 {
+		return fmt.Errorf("Alert rule needs a name")
+	}
+
+	if r.For < 0 {
+		return fmt.Errorf("Duration cannot be negative")
+	}
+
+	switch r.Condition {
+	case AlertConditionThreshold, AlertConditionRate:
+		if r.Operator == nil || r.Threshold == nil {
+			return fmt.Errorf("%s rule needs an operator and a threshold", r.Condition)
+		}
+
+		valid := false
+		for _, o := range AlertOperators {
+			valid = valid || o == *r.Operator
+		}
+		if !valid {
+			return fmt.Errorf("Unknown operator: %s", *r.Operator)
+		}
+	case AlertConditionMissing:
+		if r.For == 0 {
+			return fmt.Errorf("Missing data rule needs a duration")
+		}
+	case AlertConditionOffline:
+	default:
+		return fmt.Errorf("Unknown condition: %s", r.Condition)
+	}
+
+	if r.Condition != AlertConditionOffline && (r.Stream == nil || len(*r.Stream) == 0) {
+		return fmt.Errorf("%s rule needs a stream", r.Condition)
+	}
+
+	return nil
+}
+
+// Compare applies the operator of the rule to the value and the threshold
+func (r *AlertRule) Compare(value float64) bool {
+	if r.Operator == nil || r.Threshold == nil {
+		return false
+	}
+
+	threshold := *r.Threshold
+	switch *r.Operator {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case "==":
+		return value == threshold
+	case "!=":
+		return value != threshold
+	}
+
+	return false
+}
+
+func (r *AlertRule) Duration() time.Duration {
+	return time.Duration(r.For) * time.Second
+}
+
+// Applies returns true if the rule applies to the device
+func (r *AlertRule) Applies(d *Device) bool {
+	if r.DeviceId != nil {
+		return *r.DeviceId == d.Id
+	}
+
+	if r.DeviceTypeId != nil {
+		return d.DeviceTypeId != nil && *d.DeviceTypeId == *r.DeviceTypeId
+	}
+
+	return true
+}
+
+func (devices *Devices) AlertRuleInsert(r *AlertRule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	r.Created = time.Now().UTC()
+	return devices.db.Insert(r, "alert_rules")
+}
+
+func (devices *Devices) AlertRuleUpdate(r *AlertRule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	_, err := devices.db.Update(*r)
+	return err
+}
+
+func (devices *Devices) AlertRuleDelete(r *AlertRule) error {
+	if _, err := devices.db.Exec("DELETE FROM alert_rule_samples WHERE rule_id = ?", r.Id); err != nil {
+		return err
+	}
+
+	if _, err := devices.db.Exec("DELETE FROM alerts WHERE rule_id = ?", r.Id); err != nil {
+		return err
+	}
+
+	_, err := devices.db.Exec("DELETE FROM alert_rules WHERE id = ?", r.Id)
+	return err
+}
+
+func (devices *Devices) AlertRuleGet(c AlertRuleCriteria) (*AlertRule, error) {
+	var r AlertRule
+	if err := devices.db.MatchOne(&r, "alert_rules", c); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func (devices *Devices) AlertRuleList(c AlertRuleCriteria) ([]AlertRule, error) {
+	var rules []AlertRule
+	if err := devices.db.Match(&rules, "alert_rules", c); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// AlertRules returns the enabled rules with one of the conditions which
+// apply to the device
+func (d *Device) AlertRules(conditions ...string) ([]AlertRule, error) {
+	query := squirrel.Select("*").From("alert_rules").Where(squirrel.Eq{
+		"enabled":        true,
+		"condition_type": conditions,
+	})
+
+	scope := squirrel.Or{
+		squirrel.Eq{"device_id": d.Id},
+		squirrel.And{squirrel.Eq{"device_id": nil}, squirrel.Eq{"device_type_id": nil}},
+	}
+	if d.DeviceTypeId != nil {
+		scope = append(scope, squirrel.Eq{"device_type_id": *d.DeviceTypeId})
+	}
+
+	sql_query, args, err := query.Where(scope).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []AlertRule
+	if err := d.db.Select(&rules, sql_query, args...); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (devices *Devices) AlertGet(c AlertCriteria) (*Alert, error) {
+	var a Alert
+	if err := devices.db.MatchOne(&a, "alerts", c); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func (devices *Devices) AlertList(c AlertCriteria) ([]Alert, error) {
+	var alerts []Alert
+	if err := devices.db.Match(&alerts, "alerts", c); err != nil {
+		return nil, err
+	}
+
+	return alerts, nil
+}
+
+// AlertPendingList returns the alerts waiting for the duration of their rule
+func (devices *Devices) AlertPendingList() ([]Alert, error) {
+	return devices.AlertList(AlertCriteria{Status: AlertStatusPending})
+}
+
+// AlertOpen returns the alert of the rule on the device which is not
+// resolved, nil if there is none
+func (d *Device) AlertOpen(r *AlertRule) (*Alert, error) {
+	query, args, err := squirrel.Select("*").From("alerts").Where(squirrel.Eq{
+		"rule_id":   r.Id,
+		"device_id": d.Id,
+		"status":    alertOpenStatuses,
+	}).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var a Alert
+	err = d.db.Get(&a, query, args...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// AlertInsert opens the alert, unless the rule already has an open alert on
+// the device. The alert is set to the open alert in both cases, so handlers
+// opening the alert at the same time end up with the same one.
+func (d *Device) AlertInsert(a *Alert) error {
+	a.DeviceId = d.Id
+	a.Updated = time.Now().UTC()
+
+	//LAST_INSERT_ID(id) returns the id of the open alert as well
+	result, err := d.db.Exec("INSERT INTO alerts (rule_id, device_id, status, value, started, updated) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)",
+		a.RuleId, a.DeviceId, a.Status, a.Value, a.Started, a.Updated)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	return d.db.MatchOne(a, "alerts", AlertCriteria{Id: uint64(id)})
+}
+
+func (d *Device) AlertUpdate(a *Alert) error {
+	a.Updated = time.Now().UTC()
+	_, err := d.db.Exec("UPDATE alerts SET status = ?, value = ?, fired = ?, acknowledged = ?, acknowledged_by = ?, resolved = ?, updated = ? WHERE id = ? AND device_id = ?",
+		a.Status,
+		a.Value,
+		a.Fired,
+		a.Acknowledged,
+		a.AcknowledgedBy,
+		a.Resolved,
+		a.Updated,
+		a.Id,
+		d.Id)
+	return err
+}
+
+// AlertFire moves the pending alert to firing. Every instance checks the
+// pending alerts, so false is returned if another instance fired or resolved
+// the alert first.
+func (d *Device) AlertFire(a *Alert) (bool, error) {
+	now := time.Now().UTC()
+	result, err := d.db.Exec("UPDATE alerts SET status = ?, value = ?, fired = ?, updated = ? WHERE id = ? AND device_id = ? AND status = ?",
+		AlertStatusFiring, a.Value, now, now, a.Id, d.Id, AlertStatusPending)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil || affected != 1 {
+		return false, err
+	}
+
+	a.Status = AlertStatusFiring
+	a.Fired = &now
+	a.Updated = now
+	return true, nil
+}
+
+// AlertResolve resolves the open alert, false is returned if another
+// instance resolved it first
+func (d *Device) AlertResolve(a *Alert) (bool, error) {
+	now := time.Now().UTC()
+	result, err := d.db.Exec("UPDATE alerts SET status = ?, value = ?, resolved = ?, updated = ? WHERE id = ? AND device_id = ? AND status != ?",
+		AlertStatusResolved, a.Value, now, now, a.Id, d.Id, AlertStatusResolved)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil || affected != 1 {
+		return false, err
+	}
+
+	a.Status = AlertStatusResolved
+	a.Resolved = &now
+	a.Updated = now
+	return true, nil
+}
+
+// AlertRuleDevices returns the devices the rule applies to
+func (devices *Devices) AlertRuleDevices(r *AlertRule) (*[]Device, error) {
+	if r.DeviceId != nil {
+		return devices.List(DeviceCriteria{Id: *r.DeviceId})
+	}
+
+	if r.DeviceTypeId != nil {
+		return devices.List(DeviceCriteria{DeviceTypeId: *r.DeviceTypeId})
+	}
+
+	return devices.List(DeviceCriteria{})
+}
+
+// AlertAcknowledge marks a firing alert as acknowledged, it stays open until
+// the condition is resolved
+func (devices *Devices) AlertAcknowledge(a *Alert, by string) error {
+	if a.Status != AlertStatusFiring {
+		return fmt.Errorf("Only firing alerts can be acknowledged, alert is %s", a.Status)
+	}
+
+	now := time.Now().UTC()
+	a.Status = AlertStatusAcknowledged
+	a.Acknowledged = &now
+	a.AcknowledgedBy = &by
+	a.Updated = now
+
+	_, err := devices.db.Exec("UPDATE alerts SET status = ?, acknowledged = ?, acknowledged_by = ?, updated = ? WHERE id = ? AND status = ?",
+		a.Status, a.Acknowledged, a.AcknowledgedBy, a.Updated, a.Id, AlertStatusFiring)
+	return err
+}
+
+// AlertRuleSample returns the previous value seen by a rate rule on the
+// device and stores the new value
+func (d *Device) AlertRuleSample(r *AlertRule, value float64, timestamp time.Time) (*float64, *time.Time, error) {
+	var previous struct {
+		Value     float64   `db:"value"`
+		Timestamp time.Time `db:"timestamp"`
+	}
+
+	err := d.db.Get(&previous, "SELECT value, timestamp FROM alert_rule_samples WHERE rule_id = ? AND device_id = ?", r.Id, d.Id)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+
+	if _, err := d.db.Exec("INSERT INTO alert_rule_samples (rule_id, device_id, value, timestamp) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value), timestamp = VALUES(timestamp)",
+		r.Id, d.Id, value, timestamp); err != nil {
+		return nil, nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+
+	return &previous.Value, &previous.Timestamp, nil
+}
@@ -0,0 +1,102 @@
+package phoenix
+
+import (
+	"testing"
+)
+
+func uint64Ptr(i uint64) *uint64 {
+	return &i
+}
+
+func TestAlertRuleCompare(t *testing.T) {
+	tests := []struct {
+		operator  string
+		value     float64
+		threshold float64
+		expected  bool
+	}{
+		{">", 11, 10, true},
+		{">", 10, 10, false},
+		{">=", 10, 10, true},
+		{">=", 9.9, 10, false},
+		{"<", 9, 10, true},
+		{"<", 10, 10, false},
+		{"<=", 10, 10, true},
+		{"<=", 10.1, 10, false},
+		{"==", 10, 10, true},
+		{"==", 10.1, 10, false},
+		{"!=", 10.1, 10, true},
+		{"!=", 10, 10, false},
+		{"=~", 10, 10, false},
+	}
+
+	for _, test := range tests {
+		r := AlertRule{Operator: stringPtr(test.operator), Threshold: floatPtr(test.threshold)}
+		if compared := r.Compare(test.value); compared != test.expected {
+			t.Errorf("%v %s %v: expected %t, got %t", test.value, test.operator, test.threshold, test.expected, compared)
+		}
+	}
+
+	if (&AlertRule{Operator: stringPtr(">")}).Compare(1) {
+		t.Error("Rule without threshold compared true")
+	}
+}
+
+func TestAlertRuleValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  AlertRule
+		valid bool
+	}{
+		{"threshold", AlertRule{Name: "hot", Condition: AlertConditionThreshold, Stream: stringPtr("temperature"), Operator: stringPtr(">"), Threshold: floatPtr(80)}, true},
+		{"rate", AlertRule{Name: "rising", Condition: AlertConditionRate, Stream: stringPtr("temperature"), Operator: stringPtr(">="), Threshold: floatPtr(1), For: 60}, true},
+		{"missing", AlertRule{Name: "silent", Condition: AlertConditionMissing, Stream: stringPtr("temperature"), For: 600}, true},
+		{"offline", AlertRule{Name: "offline", Condition: AlertConditionOffline, For: 300}, true},
+		{"no name", AlertRule{Condition: AlertConditionOffline}, false},
+		{"negative duration", AlertRule{Name: "offline", Condition: AlertConditionOffline, For: -1}, false},
+		{"unknown condition", AlertRule{Name: "odd", Condition: "flapping"}, false},
+		{"threshold without operator", AlertRule{Name: "hot", Condition: AlertConditionThreshold, Stream: stringPtr("temperature"), Threshold: floatPtr(80)}, false},
+		{"threshold without threshold", AlertRule{Name: "hot", Condition: AlertConditionThreshold, Stream: stringPtr("temperature"), Operator: stringPtr(">")}, false},
+		{"unknown operator", AlertRule{Name: "hot", Condition: AlertConditionThreshold, Stream: stringPtr("temperature"), Operator: stringPtr("=>"), Threshold: floatPtr(80)}, false},
+		{"threshold without stream", AlertRule{Name: "hot", Condition: AlertConditionThreshold, Operator: stringPtr(">"), Threshold: floatPtr(80)}, false},
+		{"missing without duration", AlertRule{Name: "silent", Condition: AlertConditionMissing, Stream: stringPtr("temperature")}, false},
+		{"missing with empty stream", AlertRule{Name: "silent", Condition: AlertConditionMissing, Stream: stringPtr(""), For: 600}, false},
+	}
+
+	for _, test := range tests {
+		err := test.rule.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: expected valid, got %v", test.name, err)
+		}
+
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestAlertRuleApplies(t *testing.T) {
+	typed := Device{Id: 1, DeviceTypeId: uint64Ptr(7)}
+	untyped := Device{Id: 2}
+
+	tests := []struct {
+		name     string
+		rule     AlertRule
+		device   Device
+		expected bool
+	}{
+		{"all devices", AlertRule{}, untyped, true},
+		{"device", AlertRule{DeviceId: uint64Ptr(1)}, typed, true},
+		{"other device", AlertRule{DeviceId: uint64Ptr(1)}, untyped, false},
+		{"device type", AlertRule{DeviceTypeId: uint64Ptr(7)}, typed, true},
+		{"other device type", AlertRule{DeviceTypeId: uint64Ptr(8)}, typed, false},
+		{"device type on untyped device", AlertRule{DeviceTypeId: uint64Ptr(7)}, untyped, false},
+		{"device before device type", AlertRule{DeviceId: uint64Ptr(2), DeviceTypeId: uint64Ptr(7)}, untyped, true},
+	}
+
+	for _, test := range tests {
+		if applies := test.rule.Applies(&test.device); applies != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, applies)
+		}
+	}
+}
@@ -1,7 +1,8 @@
 package app
 
 import (
-	"crypto/rsa"
+	"context"
+	"crypto"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
@@ -10,10 +11,16 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"reflect"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Masterminds/squirrel"
+	"github.com/cmodk/phoenix/pipe"
+	"github.com/cmodk/phoenix/storage"
+	"github.com/cmodk/phoenix/webhook"
 	"github.com/go-redis/redis/v8"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gocql/gocql"
@@ -27,9 +34,11 @@ import (
 )
 
 var (
-	app_certificate_generate    = flag.Bool("certificate-generate", false, "Generate private and public key for server, (And CA if not found)")
-	app_certificate_path        = flag.String("certificate-path", "./certificates", "Search path for certificates")
-	app_certificate_common_name = flag.String("common-name", "localhost", "DNS name for certificates")
+	app_certificate_generate      = flag.Bool("certificate-generate", false, "Generate private and public key for server, (And CA if not found)")
+	app_certificate_path          = flag.String("certificate-path", "./certificates", "Search path for certificates")
+	app_certificate_common_name   = flag.String("common-name", "localhost", "DNS name for certificates")
+	app_certificate_key_algorithm = flag.String("certificate-key-algorithm", KeyAlgorithmRSA, "Key algorithm for generated CA and server keys: rsa, ecdsa or ed25519")
+	app_certificate_key_size      = flag.Int("certificate-key-size", 0, "RSA key bits or ECDSA curve size (256, 384, 521) for generated keys, 0 selects the default")
 
 	http_address         = flag.String("http-address", "0.0.0.0", "Listening address for http connections")
 	http_port            = flag.Int("http-port", 4010, "Listening post for http connections")
@@ -73,12 +82,22 @@ type App struct {
 	Command *CommandBus
 	Event   *EventBus
 
+	//Context is done when the app is shutting down
+	Context        context.Context
+	cancel         context.CancelFunc
+	workers        sync.WaitGroup
+	shutdown_once  sync.Once
+	shutdown_lock  sync.Mutex
+	shutdown_hooks []func()
+
 	EnableHttp bool
 	UseTLS     bool
 
 	CertificatePath string
 	CACertificate   *x509.Certificate
-	CAPrivateKey    *rsa.PrivateKey
+	CAPrivateKey    crypto.Signer
+	CAChain         []*x509.Certificate
+	TrustBundle     *x509.CertPool
 }
 
 type Database struct {
@@ -293,14 +312,18 @@ func structToQueryMap(s interface{}, ignore map[string]bool) map[string]interfac
 }
 
 type Config struct {
-	LogLevel   string           `yaml:"LogLevel"`
-	MariaDb    *string          `yaml:"MariaDB"`
-	NsqTopic   *string          `yaml:"NsqTopic"`
-	NsqLookupd *string          `yaml:"NsqLookupd"`
-	Nsqd       *string          `yaml:"Nsqd"`
-	Redis      *string          `yaml:"Redis"`
-	Cassandra  *CassandraConfig `yaml:"Cassandra"`
-	EventBus   *EventBusConfig  `yaml:"EventBus"`
+	LogLevel   string              `yaml:"LogLevel"`
+	MariaDb    *string             `yaml:"MariaDB"`
+	NsqTopic   *string             `yaml:"NsqTopic"`
+	NsqLookupd *string             `yaml:"NsqLookupd"`
+	Nsqd       *string             `yaml:"Nsqd"`
+	Redis      *string             `yaml:"Redis"`
+	Cassandra  *CassandraConfig    `yaml:"Cassandra"`
+	EventBus   *EventBusConfig     `yaml:"EventBus"`
+	CommandBus *CommandBusConfig   `yaml:"CommandBus"`
+	Storage    *storage.Config     `yaml:"Storage"`
+	Pipes      []pipe.Config       `yaml:"Pipes"`
+	Webhooks   *webhook.HostPolicy `yaml:"Webhooks"`
 }
 
 func New() *App {
@@ -331,6 +354,8 @@ func New() *App {
 		CertificatePath: *app_certificate_path,
 	}
 
+	app.Context, app.cancel = signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+
 	app.Logger.Level, err = logrus.ParseLevel(config.LogLevel)
 	if err != nil {
 		panic(err)
@@ -363,6 +388,32 @@ func New() *App {
 		}
 	}
 
+	app.Event.broker, err = NewBroker(app)
+	if err != nil {
+		panic(err)
+	}
+
+	if app.Redis != nil {
+		ttl := DefaultEventDedupTTL
+		if config.EventBus != nil && config.EventBus.DedupTTL > 0 {
+			ttl = config.EventBus.DedupTTL
+		}
+
+		app.Event.dedup = NewRedisDedup(app.Redis, ttl)
+	}
+
+	if app.Command.config.Durable {
+		if config.EventBus != nil && config.EventBus.Broker == BrokerMemory {
+			panic(fmt.Errorf("Durable commands need the nsq or redis broker"))
+		}
+
+		//A broker of its own, so commands are drained after events on shutdown
+		app.Command.broker, err = NewBroker(app)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	if config.MariaDb != nil {
 		app.ConnectMariadb()
 	}
@@ -388,11 +439,21 @@ func LoadConfig(env string) (*Config, error) {
 
 }
 
+// ReloadConfig reads the config of the environment again, for settings which
+// can change while running. App.Config is left untouched.
+func (app *App) ReloadConfig() (*Config, error) {
+	return LoadConfig(app.Environment)
+}
+
 func (app *App) Run() {
 
 	app.Negroni.UseHandler(app.Router)
 
-	go app.Command.Listen()
+	//Durable commands are only handled by the application listening for
+	//them, every application listening would split the shards
+	if !app.Command.Durable() {
+		go app.Command.Listen()
+	}
 	log.Printf("Running application\n")
 
 	app.Http = &http.Server{
@@ -402,24 +463,36 @@ func (app *App) Run() {
 		ReadTimeout:  time.Duration(*http_timeout) * time.Second,
 	}
 	if app.EnableHttp {
-		if app.UseTLS {
-			log.Fatal(app.Http.ListenAndServeTLS(*http_tls_certificate, *http_tls_key))
-		} else {
-			app.Logger.Info("Listening for http connections")
-			log.Fatal(app.Http.ListenAndServe())
-		}
+		go func() {
+			var err error
+			if app.UseTLS {
+				err = app.Http.ListenAndServeTLS(*http_tls_certificate, *http_tls_key)
+			} else {
+				app.Logger.Info("Listening for http connections")
+				err = app.Http.ListenAndServe()
+			}
 
-	} else {
-		for {
-			time.Sleep(time.Second * 60)
-		}
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
 	}
 
+	<-app.Context.Done()
+	app.Shutdown()
 }
 
 func (app *App) LoadCertificates(load_private_key bool) error {
 	log.Printf("Loading certificates\n")
-	caPublicKeyFile, err := ioutil.ReadFile(app.CertificatePath + "/server.pem")
+
+	//Certificates are issued by the intermediate CA, older installations
+	//without one issue them from the server certificate
+	issuer_certificate, issuer_key := INTERMEDIATE_CERTIFICATE_FILENAME, INTERMEDIATE_KEY_FILENAME
+	if _, err := os.Stat(app.CertificatePath + "/" + issuer_certificate); os.IsNotExist(err) {
+		issuer_certificate, issuer_key = SERVER_CERTIFICATE_FILENAME, SERVER_KEY_FILENAME
+	}
+
+	caPublicKeyFile, err := ioutil.ReadFile(app.CertificatePath + "/" + issuer_certificate)
 	if err != nil {
 		return err
 	}
@@ -432,9 +505,31 @@ func (app *App) LoadCertificates(load_private_key bool) error {
 		return err
 	}
 
+	app.CAChain = nil
+	if issuer_certificate == INTERMEDIATE_CERTIFICATE_FILENAME {
+		app.CAChain, err = loadCAChain(app.CACertificate)
+		if err != nil {
+			return err
+		}
+	}
+
+	//The trust bundle holds every CA devices may be issued by, including
+	//the previous ones while a rotation is in progress
+	bundle, err := loadPemCertificates(CA_BUNDLE_FILENAME)
+	if os.IsNotExist(err) {
+		bundle = []*x509.Certificate{app.CACertificate}
+	} else if err != nil {
+		return err
+	}
+
+	app.TrustBundle = x509.NewCertPool()
+	for _, c := range bundle {
+		app.TrustBundle.AddCert(c)
+	}
+
 	if load_private_key {
 		//      private key
-		caPrivateKeyFile, err := ioutil.ReadFile(app.CertificatePath + "/server.key.pem")
+		caPrivateKeyFile, err := ioutil.ReadFile(app.CertificatePath + "/" + issuer_key)
 		if err != nil {
 			panic(err)
 		}
@@ -453,23 +548,23 @@ func (app *App) LoadCertificates(load_private_key bool) error {
 			if err != nil {
 				panic(err)
 			}*/
-		privateKey, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+		app.CAPrivateKey, err = parsePemKey(pemBlock)
 		if err != nil {
 			panic(err)
 		}
-
-		app.CAPrivateKey = privateKey.(*rsa.PrivateKey)
 	}
 
 	return nil
 }
 
+// ListenEvents handles events until the app is shutting down
 func (app *App) ListenEvents() {
 	app.Event.Listen()
+	app.Shutdown()
 }
 
-func (app *App) HandleEvent(event interface{}, handler EventHandlerFunc) {
-	app.Event.Handle(event, handler)
+func (app *App) HandleEvent(event interface{}, name string, handler EventHandlerFunc) {
+	app.Event.Handle(event, name, handler)
 }
 
 func (app *App) HandleCommand(cmd interface{}, handler func(interface{}) error) {
@@ -491,6 +586,16 @@ func (app *App) Post(path string, handler http.HandlerFunc) {
 
 }
 
+func (app *App) Patch(path string, handler http.HandlerFunc) {
+	app.EnableHttp = true
+	app.Router.HandleFunc(path, handler).Methods("PATCH")
+}
+
+func (app *App) Delete(path string, handler http.HandlerFunc) {
+	app.EnableHttp = true
+	app.Router.HandleFunc(path, handler).Methods("DELETE")
+}
+
 func (app *App) PathPrefix(path string, handler http.HandlerFunc) {
 	app.EnableHttp = true
 	app.Router.PathPrefix(path).Handler(handler)
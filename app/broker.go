@@ -0,0 +1,58 @@
+package app
+
+import (
+	"fmt"
+)
+
+const (
+	BrokerNsq    = "nsq"
+	BrokerMemory = "memory"
+	BrokerRedis  = "redis"
+
+	DefaultEventTopic = "phoenix.events"
+)
+
+// BrokerHandler handles an encoded message, the message is delivered again
+// later if an error is returned. Attempts is 1 on the first delivery, brokers
+// never give up on a message, that is left to the handler.
+type BrokerHandler func(msg []byte, attempts int) error
+
+// Broker moves encoded events between the applications. Every channel on a
+// topic gets a copy of each message, consumers on the same channel share the
+// messages between them.
+type Broker interface {
+	Publish(topic string, msg []byte) error
+	// Subscribe starts concurrency handlers for the messages of the channel
+	Subscribe(topic string, channel string, concurrency int, handler BrokerHandler) error
+	// Stop stops the subscriptions
+	Stop()
+}
+
+// NewBroker returns the broker selected in the event bus config, nsq if none
+// is selected
+func NewBroker(app *App) (Broker, error) {
+	broker := BrokerNsq
+	if app.Config.EventBus != nil && app.Config.EventBus.Broker != "" {
+		broker = app.Config.EventBus.Broker
+	}
+
+	switch broker {
+	case BrokerNsq:
+		return NewNsqBroker(app.NsqProducer, app.Config.NsqLookupd), nil
+	case BrokerMemory:
+		return NewMemoryBroker(), nil
+	case BrokerRedis:
+		if app.Redis == nil {
+			return nil, fmt.Errorf("The redis broker needs a redis connection")
+		}
+
+		max_len := int64(RedisBrokerDefaultMaxLen)
+		if app.Config.EventBus.StreamMaxLen > 0 {
+			max_len = app.Config.EventBus.StreamMaxLen
+		}
+
+		return NewRedisBroker(app.Redis, max_len), nil
+	}
+
+	return nil, fmt.Errorf("Unknown event broker: %s", broker)
+}
@@ -0,0 +1,182 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	MemoryBrokerRetryDelay = time.Second
+	//Messages kept for a topic without channels, the oldest are dropped
+	//when a process only publishes to the topic
+	MemoryBrokerMaxBacklog = 1000
+)
+
+// MemoryBroker passes messages between handlers in the same process, for
+// tests and installations running every handler in one binary. Messages are
+// lost when the process stops.
+type MemoryBroker struct {
+	lock    sync.Mutex
+	topics  map[string]*memoryTopic
+	stopped bool
+	wg      sync.WaitGroup
+
+	retry_delay time.Duration
+	max_backlog int
+}
+
+type memoryTopic struct {
+	channels map[string]*memoryChannel
+	//Messages published before the first channel subscribed
+	backlog [][]byte
+	dropped int
+}
+
+type memoryMessage struct {
+	body     []byte
+	attempts int
+}
+
+// memoryChannel is an unbounded queue, so handlers publishing to their own
+// topic never block on a full queue
+type memoryChannel struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	queue   []memoryMessage
+	stopped bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		topics:      make(map[string]*memoryTopic),
+		retry_delay: MemoryBrokerRetryDelay,
+		max_backlog: MemoryBrokerMaxBacklog,
+	}
+}
+
+func (b *MemoryBroker) topic(name string) *memoryTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &memoryTopic{channels: make(map[string]*memoryChannel)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+func (b *MemoryBroker) Publish(topic string, msg []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	t := b.topic(topic)
+	if len(t.channels) == 0 {
+		if len(t.backlog) >= b.max_backlog {
+			if t.dropped == 0 {
+				log.WithField("topic", topic).WithField("backlog", len(t.backlog)).Warning("Topic has no channels, dropping the oldest messages")
+			}
+			t.backlog = t.backlog[1:]
+			t.dropped++
+		}
+
+		t.backlog = append(t.backlog, msg)
+		return nil
+	}
+
+	for _, c := range t.channels {
+		c.push(memoryMessage{body: msg})
+	}
+
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(topic string, channel string, concurrency int, handler BrokerHandler) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	t := b.topic(topic)
+	c, ok := t.channels[channel]
+	if !ok {
+		c = &memoryChannel{}
+		c.cond = sync.NewCond(&c.lock)
+		c.stopped = b.stopped
+		t.channels[channel] = c
+
+		for _, msg := range t.backlog {
+			c.push(memoryMessage{body: msg})
+		}
+		t.backlog = nil
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	for i := 0; i < concurrency; i++ {
+		b.wg.Add(1)
+		go b.consume(c, handler)
+	}
+
+	return nil
+}
+
+func (b *MemoryBroker) consume(c *memoryChannel, handler BrokerHandler) {
+	defer b.wg.Done()
+
+	for {
+		m, ok := c.pop()
+		if !ok {
+			return
+		}
+
+		m.attempts++
+		if err := handler(m.body, m.attempts); err != nil {
+			time.AfterFunc(b.retry_delay*time.Duration(m.attempts), func() {
+				c.push(m)
+			})
+		}
+	}
+}
+
+// Stop waits for the messages being handled, queued messages are dropped
+func (b *MemoryBroker) Stop() {
+	b.lock.Lock()
+	b.stopped = true
+	for _, t := range b.topics {
+		for _, c := range t.channels {
+			c.stop()
+		}
+	}
+	b.lock.Unlock()
+
+	b.wg.Wait()
+}
+
+func (c *memoryChannel) push(m memoryMessage) {
+	c.lock.Lock()
+	c.queue = append(c.queue, m)
+	c.lock.Unlock()
+	c.cond.Signal()
+}
+
+func (c *memoryChannel) pop() (memoryMessage, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(c.queue) == 0 && !c.stopped {
+		c.cond.Wait()
+	}
+
+	if c.stopped {
+		return memoryMessage{}, false
+	}
+
+	m := c.queue[0]
+	c.queue = c.queue[1:]
+	return m, true
+}
+
+func (c *memoryChannel) stop() {
+	c.lock.Lock()
+	c.stopped = true
+	c.lock.Unlock()
+	c.cond.Broadcast()
+}
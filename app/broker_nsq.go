@@ -0,0 +1,71 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// NsqBroker publishes to nsqd and consumes through nsqlookupd
+type NsqBroker struct {
+	producer *nsq.Producer
+	lookupd  *string
+
+	lock      sync.Mutex
+	consumers []*nsq.Consumer
+}
+
+func NewNsqBroker(producer *nsq.Producer, lookupd *string) *NsqBroker {
+	return &NsqBroker{
+		producer: producer,
+		lookupd:  lookupd,
+	}
+}
+
+func (b *NsqBroker) Publish(topic string, msg []byte) error {
+	if b.producer == nil {
+		return fmt.Errorf("Missing nsqd in config, cannot publish to %s", topic)
+	}
+
+	return b.producer.Publish(topic, msg)
+}
+
+func (b *NsqBroker) Subscribe(topic string, channel string, concurrency int, handler BrokerHandler) error {
+	if b.lookupd == nil {
+		return fmt.Errorf("Missing nsqlookupd in config, cannot subscribe to %s", topic)
+	}
+
+	config := nsq.NewConfig()
+	config.MaxAttempts = 0
+
+	consumer, err := nsq.NewConsumer(topic, channel, config)
+	if err != nil {
+		return err
+	}
+
+	consumer.AddConcurrentHandlers(nsq.HandlerFunc(func(m *nsq.Message) error {
+		return handler(m.Body, int(m.Attempts))
+	}), concurrency)
+
+	if err := consumer.ConnectToNSQLookupd(*b.lookupd); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	b.consumers = append(b.consumers, consumer)
+	b.lock.Unlock()
+
+	return nil
+}
+
+func (b *NsqBroker) Stop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, c := range b.consumers {
+		c.Stop()
+		<-c.StopChan
+	}
+	b.consumers = nil
+}
@@ -0,0 +1,199 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	RedisBrokerDefaultMaxLen = 100000
+	RedisBrokerRetryDelay    = 30 * time.Second
+
+	redisBrokerBlock = 5 * time.Second
+	redisBrokerBatch = 10
+	redisBrokerField = "msg"
+)
+
+// RedisBroker keeps the topics in redis streams and the channels as consumer
+// groups on the stream. Messages are acknowledged when handled, failed
+// messages stay pending and are claimed again after the retry delay, also
+// when the consumer holding them has died.
+type RedisBroker struct {
+	client  *redis.Client
+	max_len int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	retry_delay time.Duration
+}
+
+func NewRedisBroker(client *redis.Client, max_len int64) *RedisBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &RedisBroker{
+		client:      client,
+		max_len:     max_len,
+		ctx:         ctx,
+		cancel:      cancel,
+		retry_delay: RedisBrokerRetryDelay,
+	}
+}
+
+func (b *RedisBroker) Publish(topic string, msg []byte) error {
+	return b.client.XAdd(b.ctx, &redis.XAddArgs{
+		Stream:       topic,
+		MaxLenApprox: b.max_len,
+		Values:       map[string]interface{}{redisBrokerField: msg},
+	}).Err()
+}
+
+func (b *RedisBroker) Subscribe(topic string, channel string, concurrency int, handler BrokerHandler) error {
+	//New groups start at the end of the stream, like a new nsq channel
+	err := b.client.XGroupCreateMkStream(b.ctx, topic, channel, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	for i := 0; i < concurrency; i++ {
+		consumer := fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), i)
+
+		b.wg.Add(1)
+		go b.consume(topic, channel, consumer, handler)
+	}
+
+	b.wg.Add(1)
+	go b.reclaim(topic, channel, fmt.Sprintf("%s-%d-reclaim", hostname, os.Getpid()), handler)
+
+	return nil
+}
+
+func (b *RedisBroker) consume(topic string, channel string, consumer string, handler BrokerHandler) {
+	defer b.wg.Done()
+
+	for b.ctx.Err() == nil {
+		streams, err := b.client.XReadGroup(b.ctx, &redis.XReadGroupArgs{
+			Group:    channel,
+			Consumer: consumer,
+			Streams:  []string{topic, ">"},
+			Count:    redisBrokerBatch,
+			Block:    redisBrokerBlock,
+		}).Result()
+		if err == redis.Nil || b.ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			log.WithField("error", err).WithField("topic", topic).Error("Error reading from redis stream")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, s := range streams {
+			for _, m := range s.Messages {
+				b.handle(topic, channel, m, 1, handler)
+			}
+		}
+	}
+}
+
+// reclaim handles the messages which have been pending for longer than the
+// retry delay
+func (b *RedisBroker) reclaim(topic string, channel string, consumer string, handler BrokerHandler) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.retry_delay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pending, err := b.client.XPendingExt(b.ctx, &redis.XPendingExtArgs{
+			Stream: topic,
+			Group:  channel,
+			Start:  "-",
+			End:    "+",
+			Count:  100,
+		}).Result()
+		if err != nil {
+			log.WithField("error", err).WithField("topic", topic).Error("Error listing pending messages")
+			continue
+		}
+
+		ids := []string{}
+		deliveries := map[string]int{}
+		for _, p := range pending {
+			if p.Idle < b.retry_delay {
+				continue
+			}
+
+			ids = append(ids, p.ID)
+			deliveries[p.ID] = int(p.RetryCount)
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		//Only messages still idle are claimed, another consumer may have
+		//claimed them in the meantime
+		messages, err := b.client.XClaim(b.ctx, &redis.XClaimArgs{
+			Stream:   topic,
+			Group:    channel,
+			Consumer: consumer,
+			MinIdle:  b.retry_delay,
+			Messages: ids,
+		}).Result()
+		if err != nil {
+			log.WithField("error", err).WithField("topic", topic).Error("Error claiming pending messages")
+			continue
+		}
+
+		//Claiming is another delivery
+		for _, m := range messages {
+			b.handle(topic, channel, m, deliveries[m.ID]+1, handler)
+		}
+	}
+}
+
+func (b *RedisBroker) handle(topic string, channel string, m redis.XMessage, attempts int, handler BrokerHandler) {
+	body, ok := m.Values[redisBrokerField].(string)
+	if !ok {
+		log.WithField("id", m.ID).WithField("topic", topic).Error("Dropping message without body")
+		b.client.XAck(b.ctx, topic, channel, m.ID)
+		return
+	}
+
+	//Failed messages are left pending for the reclaimer
+	if err := handler([]byte(body), attempts); err != nil {
+		return
+	}
+
+	if err := b.client.XAck(b.ctx, topic, channel, m.ID).Err(); err != nil {
+		log.WithField("error", err).WithField("id", m.ID).Error("Could not acknowledge message")
+	}
+}
+
+func (b *RedisBroker) Stop() {
+	b.cancel()
+	b.wg.Wait()
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func receive(t *testing.T, c chan string) string {
+	select {
+	case msg := <-c:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+	return ""
+}
+
+func TestMemoryBroker(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Stop()
+
+	//Published before any channel, kept for the first one
+	if err := b.Publish("events", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	a := make(chan string, 10)
+	if err := b.Subscribe("events", "a", 2, func(msg []byte, attempts int) error {
+		a <- string(msg)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	other := make(chan string, 10)
+	if err := b.Subscribe("events", "other", 1, func(msg []byte, attempts int) error {
+		other <- string(msg)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := receive(t, a); msg != "first" {
+		t.Errorf("Wrong backlog message: %s", msg)
+	}
+
+	b.Publish("events", []byte("second"))
+	if msg := receive(t, a); msg != "second" {
+		t.Errorf("Wrong message on a: %s", msg)
+	}
+	if msg := receive(t, other); msg != "second" {
+		t.Errorf("Wrong message on other: %s", msg)
+	}
+
+	select {
+	case msg := <-other:
+		t.Errorf("Unexpected message on other: %s", msg)
+	default:
+	}
+}
+
+func TestMemoryBrokerBacklog(t *testing.T) {
+	log = logrus.New()
+
+	b := NewMemoryBroker()
+	b.max_backlog = 3
+	defer b.Stop()
+
+	for i := 0; i < 5; i++ {
+		b.Publish("events", []byte(fmt.Sprintf("%d", i)))
+	}
+
+	if backlog := len(b.topics["events"].backlog); backlog != 3 {
+		t.Fatalf("Backlog not capped: %d", backlog)
+	}
+
+	c := make(chan string, 10)
+	if err := b.Subscribe("events", "c", 1, func(msg []byte, attempts int) error {
+		c <- string(msg)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	//The oldest messages are dropped
+	for _, expected := range []string{"2", "3", "4"} {
+		if msg := receive(t, c); msg != expected {
+			t.Errorf("Expected %s, got %s", expected, msg)
+		}
+	}
+}
+
+func TestMemoryBrokerRetry(t *testing.T) {
+	b := NewMemoryBroker()
+	b.retry_delay = time.Millisecond
+	defer b.Stop()
+
+	attempts := make(chan int, 10)
+	b.Subscribe("events", "retry", 1, func(msg []byte, attempt int) error {
+		attempts <- attempt
+		if attempt < 3 {
+			return fmt.Errorf("Failed")
+		}
+		return nil
+	})
+
+	b.Publish("events", []byte("retried"))
+	for i := 1; i <= 3; i++ {
+		select {
+		case attempt := <-attempts:
+			if attempt != i {
+				t.Errorf("Wrong attempt %d, expected %d", attempt, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for retry")
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package app
 
 import (
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
@@ -15,9 +15,16 @@ import (
 )
 
 const (
-	CA_CERTIFICATE_FILENAME = "ca.pem"
-	CA_KEY_FILENAME         = "ca.key.pem"
-	CA_KEY_BITSIZE          = 2048
+	CA_CERTIFICATE_FILENAME           = "ca.pem"
+	CA_KEY_FILENAME                   = "ca.key.pem"
+	CA_BUNDLE_FILENAME                = "ca-bundle.pem"
+	CA_CROSS_CERTIFICATE_FILENAME     = "ca-cross.pem"
+	INTERMEDIATE_CERTIFICATE_FILENAME = "intermediate.pem"
+	INTERMEDIATE_KEY_FILENAME         = "intermediate.key.pem"
+	SERVER_CERTIFICATE_FILENAME       = "server.pem"
+	SERVER_KEY_FILENAME               = "server.key.pem"
+	FIRMWARE_KEY_FILENAME             = "firmware.key.pem"
+	CA_KEY_BITSIZE                    = 2048
 )
 
 func loadPemFile(path string) (*pem.Block, error) {
@@ -47,21 +54,16 @@ func loadPemCertificate(path string) (*x509.Certificate, error) {
 	return certificate, nil
 }
 
-func loadPemKey(path string) (*rsa.PrivateKey, error) {
+func loadPemKey(path string) (crypto.Signer, error) {
 	pemBlock, err := loadPemFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	key, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
-	if err != nil {
-		return nil, err
-	}
-
-	return key.(*rsa.PrivateKey), nil
+	return parsePemKey(pemBlock)
 }
 
-func savePemKey(key *rsa.PrivateKey, path string) error {
+func savePemKey(key crypto.Signer, path string) error {
 	keyOut, err := os.OpenFile(*app_certificate_path+"/"+path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
@@ -93,7 +95,7 @@ func savePemCertificate(cert []byte, path string) error {
 	return nil
 }
 
-func generateX509Certificate(privateKey *rsa.PrivateKey, days int, isCA bool, caCert *x509.Certificate, caKey *rsa.PrivateKey) ([]byte, error) {
+func generateX509Certificate(privateKey crypto.Signer, commonName string, days int, isCA bool, caCert *x509.Certificate, caKey crypto.Signer) ([]byte, error) {
 	keyUsage := x509.KeyUsageDigitalSignature
 	notBefore := time.Now()
 	notAfter := notBefore.AddDate(0, 0, days)
@@ -109,7 +111,7 @@ func generateX509Certificate(privateKey *rsa.PrivateKey, days int, isCA bool, ca
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: hosts,
-			CommonName:   hosts[0],
+			CommonName:   commonName,
 		},
 		NotBefore: notBefore,
 		NotAfter:  notAfter,
@@ -122,18 +124,23 @@ func generateX509Certificate(privateKey *rsa.PrivateKey, days int, isCA bool, ca
 		BasicConstraintsValid: true,
 	}
 
-	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
-		} else {
-			template.DNSNames = append(template.DNSNames, h)
-		}
-	}
-
 	if isCA {
 		template.IsCA = true
-		template.KeyUsage |= x509.KeyUsageCertSign
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
 
+		//Intermediates may only sign end entity certificates
+		if caCert != nil {
+			template.MaxPathLen = 0
+			template.MaxPathLenZero = true
+		}
+	} else {
+		for _, h := range hosts {
+			if ip := net.ParseIP(h); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, h)
+			}
+		}
 	}
 
 	if caCert == nil {
@@ -148,69 +155,346 @@ func generateX509Certificate(privateKey *rsa.PrivateKey, days int, isCA bool, ca
 	return x509.CreateCertificate(rand.Reader, &template, caCert, privateKey.Public(), caKey)
 }
 
-func generateKey() (*rsa.PrivateKey, error) {
-	return rsa.GenerateKey(rand.Reader, CA_KEY_BITSIZE)
+func generateKey() (crypto.Signer, error) {
+	return GenerateKey(*app_certificate_key_algorithm, *app_certificate_key_size)
 }
 
-func generateCertificates() error {
-	CACertificate, err := loadPemCertificate(CA_CERTIFICATE_FILENAME)
-	if err != nil && !os.IsNotExist(err) {
+func savePemCertificates(certs []*x509.Certificate, path string) error {
+	certOut, err := os.Create(*app_certificate_path + "/" + path)
+	if err != nil {
 		return err
+	}
+	for _, c := range certs {
+		if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}); err != nil {
+			certOut.Close()
+			return err
+		}
+	}
+	return certOut.Close()
+}
 
+// loadPemCertificates reads every certificate in a pem file, used for the
+// trust bundle and certificate chains
+func loadPemCertificates(path string) ([]*x509.Certificate, error) {
+	pemFile, err := ioutil.ReadFile(*app_certificate_path + "/" + path)
+	if err != nil {
+		return nil, err
 	}
 
-	var CAKey *rsa.PrivateKey
+	var certs []*x509.Certificate
+	for {
+		var pemBlock *pem.Block
+		pemBlock, pemFile = pem.Decode(pemFile)
+		if pemBlock == nil {
+			break
+		}
 
-	if CACertificate == nil {
-		log.Printf("CA missing, generating\n")
-		CAKey, err = loadPemKey(CA_KEY_FILENAME)
-		if err != nil && !os.IsNotExist(err) {
-			return err
+		if pemBlock.Type != "CERTIFICATE" {
+			continue
 		}
 
-		if CAKey == nil {
-			log.Printf("CA key missing, generating\n")
-			CAKey, err = generateKey()
-			if err != nil {
-				return err
-			}
+		c, err := x509.ParseCertificate(pemBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
 
-			if err := savePemKey(CAKey, CA_KEY_FILENAME); err != nil {
-				return err
-			}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("No certificates found in %s", path)
+	}
+
+	return certs, nil
+}
+
+// archiveFile keeps a copy of a certificate or key about to be replaced
+func archiveFile(path string) error {
+	old := *app_certificate_path + "/" + path
+	if _, err := os.Stat(old); os.IsNotExist(err) {
+		return nil
+	}
+
+	archived := fmt.Sprintf("%s.%s", old, time.Now().UTC().Format("20060102150405"))
+	log.Printf("Archiving %s as %s\n", old, archived)
+	return os.Rename(old, archived)
+}
+
+func loadOrGenerateRoot() (*x509.Certificate, crypto.Signer, error) {
+	CACertificate, err := loadPemCertificate(CA_CERTIFICATE_FILENAME)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	CAKey, err := loadPemKey(CA_KEY_FILENAME)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	if CACertificate != nil {
+		if CAKey == nil {
+			return nil, nil, fmt.Errorf("CA certificate found without its key %s", CA_KEY_FILENAME)
 		}
+		return CACertificate, CAKey, nil
+	}
 
-		new_cert, err := generateX509Certificate(CAKey, 3650, true, nil, nil)
+	log.Printf("CA missing, generating\n")
+	if CAKey == nil {
+		log.Printf("CA key missing, generating\n")
+		CAKey, err = generateKey()
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
-		if err := savePemCertificate(new_cert, CA_CERTIFICATE_FILENAME); err != nil {
-			return err
+		if err := savePemKey(CAKey, CA_KEY_FILENAME); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	new_cert, err := generateX509Certificate(CAKey, *app_certificate_common_name+" Root CA", 3650, true, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := savePemCertificate(new_cert, CA_CERTIFICATE_FILENAME); err != nil {
+		return nil, nil, err
+	}
+
+	CACertificate, err = x509.ParseCertificate(new_cert)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return CACertificate, CAKey, nil
+}
+
+func generateIntermediate(root *x509.Certificate, rootKey crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
+	log.Printf("Generating intermediate CA\n")
+	key, err := generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	name := fmt.Sprintf("%s Intermediate CA %s", *app_certificate_common_name, time.Now().UTC().Format("2006-01-02"))
+	raw, err := generateX509Certificate(key, name, 1825, true, root, rootKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := savePemKey(key, INTERMEDIATE_KEY_FILENAME); err != nil {
+		return nil, nil, err
+	}
+
+	if err := savePemCertificate(raw, INTERMEDIATE_CERTIFICATE_FILENAME); err != nil {
+		return nil, nil, err
+	}
+
+	intermediate, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return intermediate, key, nil
+}
+
+// crossSignRoot issues the new root again from the old root, so devices only
+// trusting the old root can verify chains from the new root
+func crossSignRoot(root *x509.Certificate, oldRoot *x509.Certificate, oldRootKey crypto.Signer) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := root.NotAfter
+	if oldRoot.NotAfter.Before(notAfter) {
+		notAfter = oldRoot.NotAfter
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               root.Subject,
+		SubjectKeyId:          root.SubjectKeyId,
+		NotBefore:             root.NotBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              root.KeyUsage,
+		ExtKeyUsage:           root.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, &template, oldRoot, root.PublicKey, oldRootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := savePemCertificate(raw, CA_CROSS_CERTIFICATE_FILENAME); err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(raw)
+}
+
+// loadCrossCertificate returns the cross signed root while a root rotation
+// is in progress, nil otherwise
+func loadCrossCertificate() (*x509.Certificate, error) {
+	cross, err := loadPemCertificate(CA_CROSS_CERTIFICATE_FILENAME)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return cross, err
+}
+
+// loadCAChain returns the chain of the intermediate up to the root, with the
+// cross signed root first while a root rotation is in progress, so devices
+// trusting either root can verify it
+func loadCAChain(intermediate *x509.Certificate) ([]*x509.Certificate, error) {
+	chain := []*x509.Certificate{intermediate}
+
+	cross, err := loadCrossCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if cross != nil {
+		chain = append(chain, cross)
+	}
+
+	root, err := loadPemCertificate(CA_CERTIFICATE_FILENAME)
+	if os.IsNotExist(err) {
+		return chain, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return append(chain, root), nil
+}
+
+// generateServer creates the server certificate, stored with the
+// intermediate so clients get the full chain. While a root rotation is in
+// progress the cross signed root is included, so clients only trusting the
+// old root can verify the chain.
+func generateServer(intermediate *x509.Certificate, intermediateKey crypto.Signer) error {
+	serverKey, err := generateKey()
+	if err != nil {
+		return err
+	}
+
+	raw, err := generateX509Certificate(serverKey, *app_certificate_common_name, 3650, false, intermediate, intermediateKey)
+	if err != nil {
+		return err
+	}
+
+	serverCertificate, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return err
+	}
+
+	if err := savePemKey(serverKey, SERVER_KEY_FILENAME); err != nil {
+		return err
+	}
+
+	return saveServerChain(serverCertificate, intermediate)
+}
+
+func saveServerChain(serverCertificate *x509.Certificate, intermediate *x509.Certificate) error {
+	chain := []*x509.Certificate{serverCertificate, intermediate}
+
+	cross, err := loadCrossCertificate()
+	if err != nil {
+		return err
+	}
+	if cross != nil {
+		chain = append(chain, cross)
+	}
+
+	return savePemCertificates(chain, SERVER_CERTIFICATE_FILENAME)
+}
+
+// updateTrustBundle adds the certificates to the trust bundle, keeping the
+// ones already trusted so devices issued by an earlier CA still connect
+func updateTrustBundle(certs ...*x509.Certificate) error {
+	bundle, err := loadPemCertificates(CA_BUNDLE_FILENAME)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, c := range certs {
+		found := false
+		for _, b := range bundle {
+			if b.Equal(c) {
+				found = true
+				break
+			}
 		}
 
-		CACertificate, err = x509.ParseCertificate(new_cert)
+		if !found {
+			bundle = append(bundle, c)
+		}
+	}
+
+	return savePemCertificates(bundle, CA_BUNDLE_FILENAME)
+}
+
+// seedTrustBundle adds the CAs currently in use to the trust bundle before
+// anything is replaced. Older installations issued device certificates from
+// the server certificate, so it is kept as well if it is a CA.
+func seedTrustBundle() error {
+	var current []*x509.Certificate
+	for _, path := range []string{CA_CERTIFICATE_FILENAME, INTERMEDIATE_CERTIFICATE_FILENAME, SERVER_CERTIFICATE_FILENAME} {
+		c, err := loadPemCertificate(path)
+		if os.IsNotExist(err) {
+			continue
+		}
 		if err != nil {
 			return err
 		}
 
+		if c.IsCA {
+			current = append(current, c)
+		}
 	}
 
-	serverKey, err := generateKey()
+	if len(current) == 0 {
+		return nil
+	}
+
+	return updateTrustBundle(current...)
+}
+
+func generateCertificates() error {
+	if err := seedTrustBundle(); err != nil {
+		return err
+	}
+
+	CACertificate, CAKey, err := loadOrGenerateRoot()
 	if err != nil {
 		return err
 	}
 
-	serverCertificate, err := generateX509Certificate(serverKey, 3650, true, CACertificate, CAKey)
+	intermediate, err := loadPemCertificate(INTERMEDIATE_CERTIFICATE_FILENAME)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var intermediateKey crypto.Signer
+	if intermediate == nil {
+		intermediate, intermediateKey, err = generateIntermediate(CACertificate, CAKey)
+	} else {
+		intermediateKey, err = loadPemKey(INTERMEDIATE_KEY_FILENAME)
+	}
 	if err != nil {
 		return err
 	}
 
-	if err := savePemKey(serverKey, "server.key.pem"); err != nil {
+	if err := generateServer(intermediate, intermediateKey); err != nil {
+		return err
+	}
+
+	if err := updateTrustBundle(CACertificate, intermediate); err != nil {
 		return err
 	}
 
-	if err := savePemCertificate(serverCertificate, "server.pem"); err != nil {
+	if err := generateFirmwareKey(); err != nil {
 		return err
 	}
 
@@ -219,3 +503,109 @@ func generateCertificates() error {
 
 	return nil
 }
+
+// generateFirmwareKey creates the key firmware images are signed with, an
+// existing key is kept as devices only know its public part
+func generateFirmwareKey() error {
+	if _, err := loadPemKey(FIRMWARE_KEY_FILENAME); !os.IsNotExist(err) {
+		return err
+	}
+
+	log.Printf("Firmware signing key missing, generating\n")
+	key, err := generateKey()
+	if err != nil {
+		return err
+	}
+
+	return savePemKey(key, FIRMWARE_KEY_FILENAME)
+}
+
+// LoadFirmwareKey loads the firmware signing key stored with the CA
+func (app *App) LoadFirmwareKey() (crypto.Signer, error) {
+	return loadPemKey(FIRMWARE_KEY_FILENAME)
+}
+
+// RotateCertificates replaces the intermediate CA, and the root CA as well
+// if newRoot is set. The replaced certificates are archived and stay in the
+// trust bundle until PruneTrustBundle is called. A new root is cross signed
+// by the old one, so devices only trusting the old root still connect.
+func RotateCertificates(newRoot bool) error {
+	if err := seedTrustBundle(); err != nil {
+		return err
+	}
+
+	var oldRoot *x509.Certificate
+	var oldRootKey crypto.Signer
+	if newRoot {
+		var err error
+		oldRoot, oldRootKey, err = loadOrGenerateRoot()
+		if err != nil {
+			return err
+		}
+
+		for _, path := range []string{CA_CERTIFICATE_FILENAME, CA_KEY_FILENAME, CA_CROSS_CERTIFICATE_FILENAME} {
+			if err := archiveFile(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	root, rootKey, err := loadOrGenerateRoot()
+	if err != nil {
+		return err
+	}
+
+	if oldRoot != nil {
+		if _, err := crossSignRoot(root, oldRoot, oldRootKey); err != nil {
+			return err
+		}
+	}
+
+	if err := archiveFile(INTERMEDIATE_CERTIFICATE_FILENAME); err != nil {
+		return err
+	}
+	if err := archiveFile(INTERMEDIATE_KEY_FILENAME); err != nil {
+		return err
+	}
+
+	intermediate, intermediateKey, err := generateIntermediate(root, rootKey)
+	if err != nil {
+		return err
+	}
+
+	if err := generateServer(intermediate, intermediateKey); err != nil {
+		return err
+	}
+
+	return updateTrustBundle(root, intermediate)
+}
+
+// PruneTrustBundle removes every CA from the trust bundle except the
+// current root and intermediate, and the cross signed root from the server
+// chain
+func PruneTrustBundle() error {
+	root, err := loadPemCertificate(CA_CERTIFICATE_FILENAME)
+	if err != nil {
+		return err
+	}
+
+	intermediate, err := loadPemCertificate(INTERMEDIATE_CERTIFICATE_FILENAME)
+	if err != nil {
+		return err
+	}
+
+	if err := archiveFile(CA_CROSS_CERTIFICATE_FILENAME); err != nil {
+		return err
+	}
+
+	server, err := loadPemCertificate(SERVER_CERTIFICATE_FILENAME)
+	if err != nil {
+		return err
+	}
+
+	if err := saveServerChain(server, intermediate); err != nil {
+		return err
+	}
+
+	return savePemCertificates([]*x509.Certificate{root, intermediate}, CA_BUNDLE_FILENAME)
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRotateRoot(t *testing.T) {
+	log = logrus.New()
+
+	path := t.TempDir()
+	app_certificate_path = &path
+	algorithm := KeyAlgorithmECDSA
+	app_certificate_key_algorithm = &algorithm
+
+	oldRoot, oldRootKey, err := loadOrGenerateRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	intermediate, intermediateKey, err := generateIntermediate(oldRoot, oldRootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generateServer(intermediate, intermediateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RotateCertificates(true); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := loadPemCertificate(CA_CERTIFICATE_FILENAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if root.Equal(oldRoot) {
+		t.Fatal("Root not rotated")
+	}
+
+	chain, err := loadPemCertificates(SERVER_CERTIFICATE_FILENAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+
+	//Devices with either root verify the server
+	for _, trusted := range []*x509.Certificate{oldRoot, root} {
+		roots := x509.NewCertPool()
+		roots.AddCert(trusted)
+
+		if _, err := chain[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+			t.Errorf("Server chain not valid under %s: %v", trusted.Subject.CommonName, err)
+		}
+	}
+
+	ca_chain, err := loadCAChain(chain[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ca_chain) != 3 || !ca_chain[2].Equal(root) {
+		t.Errorf("CA chain is not intermediate, cross signed and root: %d certificates", len(ca_chain))
+	}
+
+	if err := PruneTrustBundle(); err != nil {
+		t.Fatal(err)
+	}
+
+	if chain, err = loadPemCertificates(SERVER_CERTIFICATE_FILENAME); err != nil || len(chain) != 2 {
+		t.Errorf("Cross signed root still in the server chain: %d, %v", len(chain), err)
+	}
+}
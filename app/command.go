@@ -1,51 +1,365 @@
 package app
 
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 const (
 	CommandBusChannelSize = 1000
+
+	DefaultCommandShards        = 8
+	DefaultCommandMaxAttempts   = 5
+	DefaultCommandRetryBase     = 100 * time.Millisecond
+	DefaultCommandRetryMax      = 5 * time.Second
+	DefaultCommandCreateTimeout = time.Second
+	DefaultCommandTopic         = "phoenix.commands"
+
+	commandChannel = "phoenix-commands"
 )
 
 type CommandHandler func(cmd interface{}) error
 
+// KeyedCommand is implemented by commands which must be handled in order with
+// the other commands of the same key, like the commands of a device. Commands
+// with different keys are handled in parallel.
+type KeyedCommand interface {
+	CommandKey() string
+}
+
+type CommandBusConfig struct {
+	//Number of commands handled in parallel
+	Shards      int `yaml:"Shards"`
+	QueueSize   int `yaml:"QueueSize"`
+	MaxAttempts int `yaml:"MaxAttempts"`
+	//Delay before the first retry, doubled for every attempt up to RetryMax
+	RetryBase time.Duration `yaml:"RetryBase"`
+	RetryMax  time.Duration `yaml:"RetryMax"`
+	//Max time Create waits for room in a full queue
+	CreateTimeout time.Duration `yaml:"CreateTimeout"`
+
+	//Keep the queued commands in the event broker, so they survive a crash.
+	//Needs the nsq or redis broker. Durable commands are only handled by
+	//the application calling Listen, App.Run does not listen for them, so
+	//the commands of a key stay in order. Commands the handlers give up on
+	//are sent to the dead letter topic, the command topic with a .dead
+	//suffix.
+	Durable bool   `yaml:"Durable"`
+	Topic   string `yaml:"Topic"`
+}
+
 type CommandBus struct {
 	app      *App
-	queue    chan interface{}
+	shards   []chan interface{}
 	handlers map[string][]CommandHandler
+	types    map[string]reflect.Type
+	broker   Broker
+	next     uint32
+
+	config CommandBusConfig
+
+	lock      sync.Mutex
+	listening bool
+	stop      chan struct{}
+	done      chan struct{}
+
+	//Held by Create while queueing, so no command is queued after the
+	//workers are told to stop
+	create_lock sync.RWMutex
+	stopping    bool
+	stop_once   sync.Once
+}
+
+// commandMessage is a command in the durable backing
+type commandMessage struct {
+	Command string          `json:"c"`
+	Message json.RawMessage `json:"msg"`
+}
+
+// CommandDeadLetter is a durable command a handler gave up on
+type CommandDeadLetter struct {
+	Command  string          `json:"c"`
+	Message  json.RawMessage `json:"msg"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	Failed   time.Time       `json:"failed"`
 }
 
 func NewCommandBus(app *App) *CommandBus {
-	return &CommandBus{
+	config := CommandBusConfig{}
+	if app.Config != nil && app.Config.CommandBus != nil {
+		config = *app.Config.CommandBus
+	}
+
+	if config.Shards <= 0 {
+		config.Shards = DefaultCommandShards
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = CommandBusChannelSize
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultCommandMaxAttempts
+	}
+	if config.RetryBase <= 0 {
+		config.RetryBase = DefaultCommandRetryBase
+	}
+	if config.RetryMax <= 0 {
+		config.RetryMax = DefaultCommandRetryMax
+	}
+	if config.CreateTimeout <= 0 {
+		config.CreateTimeout = DefaultCommandCreateTimeout
+	}
+	if config.Topic == "" {
+		config.Topic = DefaultCommandTopic
+	}
+
+	bus := &CommandBus{
 		app:      app,
-		queue:    make(chan interface{}, CommandBusChannelSize),
 		handlers: make(map[string][]CommandHandler),
+		types:    make(map[string]reflect.Type),
+		config:   config,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for i := 0; i < config.Shards; i++ {
+		bus.shards = append(bus.shards, make(chan interface{}, config.QueueSize))
 	}
+
+	return bus
 }
 
 func (bus *CommandBus) Handle(command interface{}, handler CommandHandler) {
 	cmd_id := getEventId(command)
 	bus.handlers[cmd_id] = append(bus.handlers[cmd_id], handler)
+	bus.types[cmd_id] = reflect.TypeOf(command)
+}
+
+// HandleCommand registers a typed handler for commands of type T
+func HandleCommand[T any](app *App, handler func(cmd T) error) {
+	var cmd T
+	app.Command.Handle(cmd, func(c interface{}) error {
+		return handler(c.(T))
+	})
+}
+
+// shard returns the shard of the command, commands with the same key always
+// end up in the same shard
+func (bus *CommandBus) shard(cmd interface{}) int {
+	keyed, ok := cmd.(KeyedCommand)
+	if !ok {
+		return int(atomic.AddUint32(&bus.next, 1) % uint32(len(bus.shards)))
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(keyed.CommandKey()))
+	return int(h.Sum32() % uint32(len(bus.shards)))
 }
 
+func (bus *CommandBus) shardTopic(shard int) string {
+	return fmt.Sprintf("%s.%d", bus.config.Topic, shard)
+}
+
+func (bus *CommandBus) deadLetterTopic() string {
+	return bus.config.Topic + ".dead"
+}
+
+// Durable returns true if the commands are queued in the event broker
+func (bus *CommandBus) Durable() bool {
+	return bus.broker != nil
+}
+
+// Listen handles the commands until Stop is called, it must only be called
+// once
 func (bus *CommandBus) Listen() {
+	bus.lock.Lock()
+	bus.listening = true
+	bus.lock.Unlock()
+	defer close(bus.done)
 
 	log.Printf("Listening for commands\n")
 
+	if bus.broker != nil {
+		for i := range bus.shards {
+			//One handler per shard keeps the commands in order
+			if err := bus.broker.Subscribe(bus.shardTopic(i), commandChannel, 1, bus.handleMessage); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		<-bus.stop
+		bus.broker.Stop()
+		return
+	}
+
+	var workers sync.WaitGroup
+	for _, shard := range bus.shards {
+		workers.Add(1)
+		go func(shard chan interface{}) {
+			defer workers.Done()
+			bus.work(shard)
+		}(shard)
+	}
+
+	workers.Wait()
+}
+
+func (bus *CommandBus) work(shard chan interface{}) {
 	for {
-		cmd := <-bus.queue
-		cmd_id := getEventId(cmd)
-
-		handlers, ok := bus.handlers[cmd_id]
-		if ok {
-			for _, handler := range handlers {
-				if err := handler(cmd); err != nil {
-					bus.app.Logger.WithField("error", err).Errorf("Error handling command: %s -> %v\n", cmd_id, cmd)
+		select {
+		case cmd := <-shard:
+			bus.handle(cmd)
+		case <-bus.stop:
+			//Handle the commands already queued
+			for {
+				select {
+				case cmd := <-shard:
+					bus.handle(cmd)
+				default:
+					return
 				}
 			}
 		}
+	}
+}
+
+func (bus *CommandBus) handleMessage(body []byte, attempts int) error {
+	var m commandMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		log.WithField("error", err).Error("Dropping invalid command")
+		return nil
+	}
+
+	t, ok := bus.types[m.Command]
+	if !ok {
+		return nil
+	}
+
+	cmd := reflect.New(t).Interface()
+	if err := json.Unmarshal(m.Message, cmd); err != nil {
+		log.WithField("error", err).WithField("command", m.Command).Error("Dropping invalid command")
+		return nil
+	}
+
+	if err := bus.handle(reflect.ValueOf(cmd).Elem().Interface()); err != nil {
+		return bus.deadLetter(m, err)
+	}
+
+	return nil
+}
 
+// deadLetter keeps a durable command the handlers gave up on. The broker
+// delivers the command again if the dead letter is lost.
+func (bus *CommandBus) deadLetter(m commandMessage, cause error) error {
+	msg, err := json.Marshal(CommandDeadLetter{
+		Command:  m.Command,
+		Message:  m.Message,
+		Error:    cause.Error(),
+		Attempts: bus.config.MaxAttempts,
+		Failed:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
 	}
+
+	return bus.broker.Publish(bus.deadLetterTopic(), msg)
 }
 
+// handle calls the handlers of the command, retrying each failed handler with
+// backoff. The shard waits while retrying, to keep the commands in order. The
+// error of the last handler given up on is returned.
+func (bus *CommandBus) handle(cmd interface{}) error {
+	cmd_id := getEventId(cmd)
+
+	var failed error
+	for _, handler := range bus.handlers[cmd_id] {
+		delay := bus.config.RetryBase
+		for attempt := 1; ; attempt++ {
+			err := handler(cmd)
+			if err == nil {
+				break
+			}
+
+			if attempt >= bus.config.MaxAttempts {
+				bus.app.Logger.WithField("error", err).Errorf("Giving up on command after %d attempts: %s -> %v\n", attempt, cmd_id, cmd)
+				failed = err
+				break
+			}
+
+			bus.app.Logger.WithField("error", err).Warningf("Error handling command, retrying in %s: %s\n", delay, cmd_id)
+			time.Sleep(delay)
+
+			delay *= 2
+			if delay > bus.config.RetryMax {
+				delay = bus.config.RetryMax
+			}
+		}
+	}
+
+	return failed
+}
+
+// Stop handles the queued commands and stops listening, commands created
+// after that are refused
+func (bus *CommandBus) Stop() {
+	bus.stop_once.Do(func() {
+		bus.create_lock.Lock()
+		bus.stopping = true
+		close(bus.stop)
+		bus.create_lock.Unlock()
+	})
+
+	bus.lock.Lock()
+	listening := bus.listening
+	bus.lock.Unlock()
+
+	if listening {
+		<-bus.done
+	}
+}
+
+// Create queues the command, waiting up to the create timeout when the queue
+// is full. An error means the command was not queued, so the caller can
+// refuse whatever caused it.
 func (bus *CommandBus) Create(cmd interface{}) error {
-	bus.queue <- cmd
-	return nil
+	bus.create_lock.RLock()
+	defer bus.create_lock.RUnlock()
+
+	if bus.stopping {
+		return fmt.Errorf("Command bus is stopped")
+	}
+
+	shard := bus.shard(cmd)
+
+	if bus.broker != nil {
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			return err
+		}
+
+		msg, err := json.Marshal(commandMessage{
+			Command: getEventId(cmd),
+			Message: data,
+		})
+		if err != nil {
+			return err
+		}
+
+		return bus.broker.Publish(bus.shardTopic(shard), msg)
+	}
+
+	timeout := time.NewTimer(bus.config.CreateTimeout)
+	defer timeout.Stop()
+
+	select {
+	case bus.shards[shard] <- cmd:
+		return nil
+	case <-timeout.C:
+		return fmt.Errorf("Command queue is full, gave up after %s", bus.config.CreateTimeout)
+	}
 }
@@ -0,0 +1,213 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type testCommand struct {
+	Device string `json:"device"`
+	Seq    int    `json:"seq"`
+}
+
+func (cmd testCommand) CommandKey() string {
+	return cmd.Device
+}
+
+func newTestCommandBus(config CommandBusConfig) *App {
+	log = logrus.New()
+
+	app := &App{Config: &Config{CommandBus: &config}, Logger: log}
+	app.Command = NewCommandBus(app)
+	return app
+}
+
+// listen starts the bus and waits for it to listen, so Stop waits for it
+func listen(bus *CommandBus) {
+	go bus.Listen()
+
+	for {
+		bus.lock.Lock()
+		listening := bus.listening
+		bus.lock.Unlock()
+
+		if listening {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCommandOrder(t *testing.T) {
+	app := newTestCommandBus(CommandBusConfig{Shards: 4})
+
+	var lock sync.Mutex
+	handled := map[string][]int{}
+	HandleCommand(app, func(cmd testCommand) error {
+		lock.Lock()
+		defer lock.Unlock()
+		handled[cmd.Device] = append(handled[cmd.Device], cmd.Seq)
+		return nil
+	})
+
+	listen(app.Command)
+
+	for seq := 0; seq < 100; seq++ {
+		for _, device := range []string{"a", "b", "c"} {
+			if err := app.Command.Create(testCommand{device, seq}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	app.Command.Stop()
+
+	for device, seqs := range handled {
+		if len(seqs) != 100 {
+			t.Errorf("Device %s has %d commands", device, len(seqs))
+		}
+		for i, seq := range seqs {
+			if seq != i {
+				t.Fatalf("Device %s out of order at %d: %v", device, i, seqs)
+			}
+		}
+	}
+
+	if err := app.Command.Create(testCommand{"a", 100}); err == nil {
+		t.Errorf("Command created on stopped bus")
+	}
+}
+
+func TestCommandRetry(t *testing.T) {
+	app := newTestCommandBus(CommandBusConfig{MaxAttempts: 3, RetryBase: time.Millisecond})
+
+	attempts := 0
+	HandleCommand(app, func(cmd testCommand) error {
+		attempts++
+		return fmt.Errorf("Failed")
+	})
+
+	listen(app.Command)
+	app.Command.Create(testCommand{"a", 0})
+	app.Command.Stop()
+
+	if attempts != 3 {
+		t.Errorf("Handler attempted %d times", attempts)
+	}
+}
+
+func TestCommandCreateTimeout(t *testing.T) {
+	app := newTestCommandBus(CommandBusConfig{Shards: 1, QueueSize: 1, CreateTimeout: time.Millisecond})
+
+	if err := app.Command.Create(testCommand{"a", 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Nothing is listening, so the queue stays full
+	if err := app.Command.Create(testCommand{"a", 1}); err == nil {
+		t.Errorf("Create did not fail on a full queue")
+	}
+}
+
+func TestDurableCommands(t *testing.T) {
+	app := newTestCommandBus(CommandBusConfig{Shards: 2})
+	app.Command.broker = NewMemoryBroker()
+
+	received := make(chan testCommand, 10)
+	HandleCommand(app, func(cmd testCommand) error {
+		received <- cmd
+		return nil
+	})
+
+	listen(app.Command)
+	defer app.Command.Stop()
+
+	for seq := 0; seq < 3; seq++ {
+		if err := app.Command.Create(testCommand{"a", seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for seq := 0; seq < 3; seq++ {
+		select {
+		case cmd := <-received:
+			if cmd.Device != "a" || cmd.Seq != seq {
+				t.Errorf("Wrong command: %v", cmd)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for command")
+		}
+	}
+}
+
+func TestDurableCommandDeadLetter(t *testing.T) {
+	app := newTestCommandBus(CommandBusConfig{Shards: 1, MaxAttempts: 2, RetryBase: time.Millisecond})
+	app.Command.broker = NewMemoryBroker()
+
+	HandleCommand(app, func(cmd testCommand) error {
+		return fmt.Errorf("Failed")
+	})
+
+	dead := make(chan CommandDeadLetter, 1)
+	app.Command.broker.Subscribe(app.Command.deadLetterTopic(), "test", 1, func(msg []byte, attempts int) error {
+		var d CommandDeadLetter
+		if err := json.Unmarshal(msg, &d); err != nil {
+			t.Error(err)
+		}
+		dead <- d
+		return nil
+	})
+
+	listen(app.Command)
+	defer app.Command.Stop()
+
+	if err := app.Command.Create(testCommand{"a", 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case d := <-dead:
+		if d.Error != "Failed" || d.Attempts != 2 {
+			t.Errorf("Wrong dead letter: %+v", d)
+		}
+
+		var cmd testCommand
+		if err := json.Unmarshal(d.Message, &cmd); err != nil || cmd.Device != "a" {
+			t.Errorf("Wrong dead letter command: %s", d.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for dead letter")
+	}
+}
+
+func TestCommandStop(t *testing.T) {
+	app := newTestCommandBus(CommandBusConfig{Shards: 2})
+
+	handled := make(chan testCommand, 10)
+	HandleCommand(app, func(cmd testCommand) error {
+		handled <- cmd
+		return nil
+	})
+
+	listen(app.Command)
+
+	if err := app.Command.Create(testCommand{"a", 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	app.Command.Stop()
+	app.Command.Stop()
+
+	if err := app.Command.Create(testCommand{"a", 1}); err == nil {
+		t.Errorf("Command created on stopped bus")
+	}
+
+	if len(handled) != 1 {
+		t.Errorf("Handled %d commands", len(handled))
+	}
+}
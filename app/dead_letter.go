@@ -0,0 +1,211 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DeadLetterChannel = "phoenix-dead-letters"
+
+	//Redis hash with the handler counters of each application
+	EventMetricsKeyPrefix = "event_metrics:"
+)
+
+// DeadLetter is an event a handler gave up on, with the original envelope so
+// it can be replayed after the cause is fixed
+type DeadLetter struct {
+	Event       NsqEvent  `json:"event"`
+	Application string    `json:"application"`
+	Handler     string    `json:"handler,omitempty"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	Failed      time.Time `json:"failed"`
+}
+
+// EventHandlerMetrics counts the results of a handler since the application
+// started. Only the failures are shared in redis.
+type EventHandlerMetrics struct {
+	Handled      uint64 `json:"handled,omitempty"`
+	Failed       uint64 `json:"failed"`
+	DeadLettered uint64 `json:"dead_lettered"`
+}
+
+func (bus *EventBus) deadLetterTopic() string {
+	if bus.config != nil && bus.config.DeadLetterTopic != "" {
+		return bus.config.DeadLetterTopic
+	}
+	return bus.topic() + ".dead"
+}
+
+// deadLetter publishes the event to the dead letter topic, an empty handler
+// means the event could not be decoded for any handler
+func (bus *EventBus) deadLetter(e NsqEvent, handler string, cause error, attempts int) error {
+	e.Application = ""
+	e.Handler = ""
+
+	msg, err := json.Marshal(DeadLetter{
+		Event:       e,
+		Application: bus.application(),
+		Handler:     handler,
+		Error:       cause.Error(),
+		Attempts:    attempts,
+		Failed:      time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	bus.app.Logger.WithField("error", cause).WithField("handler", handler).WithField("event", e.Event).Error("Giving up on event, sending it to the dead letters")
+
+	//The broker delivers the event again if the dead letter is lost
+	if err := bus.broker.Publish(bus.deadLetterTopic(), msg); err != nil {
+		return err
+	}
+
+	bus.countDeadLetter(handler)
+	return nil
+}
+
+// Replay publishes the event of the dead letter again, only for the
+// application and handler which gave up on it
+func (bus *EventBus) Replay(dead DeadLetter) error {
+	e := dead.Event
+	e.Application = dead.Application
+	e.Handler = dead.Handler
+
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return bus.broker.Publish(bus.topic(), msg)
+}
+
+// SubscribeDeadLetters calls the handler for every dead letter of all the
+// applications
+func (bus *EventBus) SubscribeDeadLetters(handler func(dead DeadLetter) error) error {
+	return bus.broker.Subscribe(bus.deadLetterTopic(), DeadLetterChannel, 1, func(body []byte, attempts int) error {
+		var dead DeadLetter
+		if err := json.Unmarshal(body, &dead); err != nil {
+			log.WithField("error", err).Error("Dropping invalid dead letter")
+			return nil
+		}
+
+		return handler(dead)
+	})
+}
+
+// Metrics returns the counters of the handlers, by handler name
+func (bus *EventBus) Metrics() map[string]EventHandlerMetrics {
+	bus.metrics_lock.Lock()
+	defer bus.metrics_lock.Unlock()
+
+	metrics := make(map[string]EventHandlerMetrics)
+	for name, m := range bus.metrics {
+		metrics[name] = *m
+	}
+
+	return metrics
+}
+
+func (bus *EventBus) handlerMetrics(handler string) *EventHandlerMetrics {
+	m, ok := bus.metrics[handler]
+	if !ok {
+		m = &EventHandlerMetrics{}
+		bus.metrics[handler] = m
+	}
+	return m
+}
+
+func (bus *EventBus) count(handler string, err error) {
+	bus.metrics_lock.Lock()
+	m := bus.handlerMetrics(handler)
+	if err == nil {
+		m.Handled++
+	} else {
+		m.Failed++
+	}
+	bus.metrics_lock.Unlock()
+
+	if err != nil {
+		bus.countShared(handler, "failed")
+	}
+}
+
+func (bus *EventBus) countDeadLetter(handler string) {
+	bus.metrics_lock.Lock()
+	bus.handlerMetrics(handler).DeadLettered++
+	bus.metrics_lock.Unlock()
+
+	bus.countShared(handler, "dead_lettered")
+}
+
+// countShared counts the failures in redis as well, so they can be read for
+// all the applications
+func (bus *EventBus) countShared(handler string, counter string) {
+	if bus.app.Redis == nil {
+		return
+	}
+
+	key := EventMetricsKeyPrefix + bus.application()
+	field := fmt.Sprintf("%s:%s", handler, counter)
+	if err := bus.app.Redis.HIncrBy(context.Background(), key, field, 1).Err(); err != nil {
+		log.WithField("error", err).Warning("Could not count event handler failure")
+	}
+}
+
+// SharedMetrics returns the failures counted in redis, by application and
+// handler
+func (bus *EventBus) SharedMetrics(ctx context.Context) (map[string]map[string]EventHandlerMetrics, error) {
+	if bus.app.Redis == nil {
+		return nil, fmt.Errorf("Event metrics need a redis connection")
+	}
+
+	metrics := make(map[string]map[string]EventHandlerMetrics)
+
+	iter := bus.app.Redis.Scan(ctx, 0, EventMetricsKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+
+		counters, err := bus.app.Redis.HGetAll(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		handlers := make(map[string]EventHandlerMetrics)
+		for field, value := range counters {
+			i := strings.LastIndex(field, ":")
+			if i < 0 {
+				continue
+			}
+
+			count, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+
+			handler := field[:i]
+			m := handlers[handler]
+			switch field[i+1:] {
+			case "failed":
+				m.Failed = count
+			case "dead_lettered":
+				m.DeadLettered = count
+			}
+			handlers[handler] = m
+		}
+
+		metrics[strings.TrimPrefix(key, EventMetricsKeyPrefix)] = handlers
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+}
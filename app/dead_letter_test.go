@@ -0,0 +1,124 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func failingHandler(e testEvent) error {
+	return fmt.Errorf("Failed %d", e.Value)
+}
+
+func TestDeadLetter(t *testing.T) {
+	log = logrus.New()
+
+	name := "test"
+	app := &App{Config: &Config{EventBus: &EventBusConfig{NumHandlers: 1, MaxAttempts: 3, ListenName: &name}}, Logger: log}
+	app.Context, app.cancel = context.WithCancel(context.Background())
+	app.Event = NewEventBus(app)
+
+	broker := NewMemoryBroker()
+	broker.retry_delay = time.Millisecond
+	app.Event.broker = broker
+	defer app.Event.Stop()
+
+	var handled int32
+	HandleEvent(app, "failingHandler", failingHandler)
+	HandleEvent(app, "counter", func(e testEvent) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+
+	dead := make(chan DeadLetter, 2)
+	if err := app.Event.SubscribeDeadLetters(func(d DeadLetter) error {
+		dead <- d
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := broker.Subscribe(app.Event.topic(), name, 1, app.Event.HandleMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Event.Publish(testEvent{Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var d DeadLetter
+	select {
+	case d = <-dead:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for dead letter")
+	}
+
+	if d.Handler != "failingHandler" || d.Application != name || d.Attempts != 3 || d.Error != "Failed 1" {
+		t.Errorf("Wrong dead letter: %+v", d)
+	}
+
+	if d.Event.Event != "test.event" || string(d.Event.Message) != `{"value":1}` {
+		t.Errorf("Wrong dead letter event: %+v", d.Event)
+	}
+
+	metrics := app.Event.Metrics()[d.Handler]
+	if metrics.Failed != 3 || metrics.DeadLettered != 1 {
+		t.Errorf("Wrong metrics: %+v", metrics)
+	}
+
+	//Replays only reach the failed handler
+	before := atomic.LoadInt32(&handled)
+	if err := app.Event.Replay(d); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case d = <-dead:
+		if d.Attempts != 3 {
+			t.Errorf("Wrong attempts for replay: %d", d.Attempts)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for replayed dead letter")
+	}
+
+	if handled := atomic.LoadInt32(&handled); handled != before {
+		t.Errorf("Replay handled by other handler: %d -> %d", before, handled)
+	}
+}
+
+func TestDeadLetterInvalidEvent(t *testing.T) {
+	log = logrus.New()
+
+	app := &App{Config: &Config{EventBus: &EventBusConfig{}}, Logger: log}
+	app.Event = NewEventBus(app)
+
+	broker := NewMemoryBroker()
+	app.Event.broker = broker
+	defer broker.Stop()
+
+	HandleEvent(app, "failingHandler", failingHandler)
+
+	dead := make(chan DeadLetter, 1)
+	app.Event.SubscribeDeadLetters(func(d DeadLetter) error {
+		dead <- d
+		return nil
+	})
+
+	//Decoding fails on every attempt, so the first is the last
+	if err := app.Event.HandleMessage([]byte(`{"e":"test.event","msg":[1,2]}`), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case d := <-dead:
+		if d.Handler != "" || d.Attempts != 1 {
+			t.Errorf("Wrong dead letter: %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for dead letter")
+	}
+}
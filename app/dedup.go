@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	DefaultEventDedupTTL = 24 * time.Hour
+	//How long a handler holds the claim on an event while handling it
+	DefaultEventClaimTTL = time.Minute
+
+	EventDedupKeyPrefix = "event_dedup:"
+
+	eventClaimHandling = "handling"
+	eventClaimHandled  = "handled"
+)
+
+var (
+	//ErrEventInProgress means another delivery of the event is being handled
+	ErrEventInProgress = errors.New("Event is being handled by another delivery")
+)
+
+// EventDedup remembers the events each handler has handled, so events
+// delivered again are skipped. A handler claims the event before handling
+// it, so two deliveries of the event are never handled at the same time.
+type EventDedup interface {
+	//Claim returns false if the event is handled, and ErrEventInProgress
+	//if it is being handled
+	Claim(key string) (bool, error)
+	MarkHandled(key string) error
+	//Release gives up the claim of a handler which failed
+	Release(key string) error
+}
+
+// RedisDedup keeps the handled events as keys expiring after the ttl, events
+// delivered again after that are handled again. The claim of a handler
+// expires after the claim ttl, so a crashed instance does not hold on to the
+// event; a handler running longer than that may see the event twice.
+type RedisDedup struct {
+	client    *redis.Client
+	ttl       time.Duration
+	claim_ttl time.Duration
+}
+
+func NewRedisDedup(client *redis.Client, ttl time.Duration) *RedisDedup {
+	return &RedisDedup{
+		client:    client,
+		ttl:       ttl,
+		claim_ttl: DefaultEventClaimTTL,
+	}
+}
+
+func (d *RedisDedup) Claim(key string) (bool, error) {
+	ctx := context.Background()
+
+	claimed, err := d.client.SetNX(ctx, EventDedupKeyPrefix+key, eventClaimHandling, d.claim_ttl).Result()
+	if err != nil || claimed {
+		return claimed, err
+	}
+
+	state, err := d.client.Get(ctx, EventDedupKeyPrefix+key).Result()
+	if err == redis.Nil {
+		//The claim expired in between, try again on the next delivery
+		return false, ErrEventInProgress
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if state == eventClaimHandling {
+		return false, ErrEventInProgress
+	}
+
+	return false, nil
+}
+
+func (d *RedisDedup) MarkHandled(key string) error {
+	return d.client.Set(context.Background(), EventDedupKeyPrefix+key, eventClaimHandled, d.ttl).Err()
+}
+
+func (d *RedisDedup) Release(key string) error {
+	return d.client.Del(context.Background(), EventDedupKeyPrefix+key).Err()
+}
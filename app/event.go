@@ -6,12 +6,14 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
-
-	"github.com/nsqio/go-nsq"
+	"sync"
+	"time"
 )
 
 const (
 	EventBusChannelSize = 1000
+
+	DefaultEventMaxAttempts = 5
 )
 
 type EventHandlerFunc func(event interface{}) error
@@ -19,19 +21,44 @@ type EventHandlerFunc func(event interface{}) error
 type EventHandler struct {
 	f EventHandlerFunc
 	t reflect.Type
+	//Name the handler is registered with, for dead letters and metrics
+	name string
 }
 
 type EventBusConfig struct {
 	NumHandlers int `yaml:"NumHandlers"`
 	ListenName  *string
+
+	//Broker is nsq, memory or redis
+	Broker string `yaml:"Broker"`
+	//Approximate max length of the redis streams
+	StreamMaxLen int64 `yaml:"StreamMaxLen"`
+
+	//Publish under the Go type names instead of the registered names, while
+	//consumers from before the registered names are still running
+	PublishLegacyNames bool `yaml:"PublishLegacyNames"`
+
+	//Deliveries of an event before a failing handler gives up on it and the
+	//event goes to the dead letter topic, default topic + ".dead"
+	MaxAttempts     int    `yaml:"MaxAttempts"`
+	DeadLetterTopic string `yaml:"DeadLetterTopic"`
+
+	//How long the handled events are remembered in redis, to skip them when
+	//they are delivered again
+	DedupTTL time.Duration `yaml:"DedupTTL"`
 }
 
 type EventBus struct {
 	app      *App
 	queue    chan interface{}
 	handlers map[string][]EventHandler
+	broker   Broker
+	dedup    EventDedup
 
 	config *EventBusConfig
+
+	metrics_lock sync.Mutex
+	metrics      map[string]*EventHandlerMetrics
 }
 
 func NewEventBus(app *App) *EventBus {
@@ -41,48 +68,193 @@ func NewEventBus(app *App) *EventBus {
 		queue:    make(chan interface{}, EventBusChannelSize),
 		handlers: make(map[string][]EventHandler),
 		config:   app.Config.EventBus,
+		metrics:  make(map[string]*EventHandlerMetrics),
 	}
 }
 
+// NsqEvent is the envelope of events on the wire, for every broker
 type NsqEvent struct {
-	Event   string          `json:"e"`
+	//Stable id of the event, missing from publishers before ids
+	Id    uint64 `json:"id,omitempty"`
+	Event string `json:"e"`
+	//Schema version of the message, missing for version 1 from before
+	//versioning
+	Version int             `json:"v,omitempty"`
 	Message json.RawMessage `json:"msg"`
+
+	//Replayed dead letters are only handled by the application and handler
+	//which gave up on them
+	Application string `json:"app,omitempty"`
+	Handler     string `json:"handler,omitempty"`
 }
 
 func (bus *EventBus) SetListenName(name string) {
 	bus.config.ListenName = &name
 }
 
-func (bus *EventBus) HandleMessage(m *nsq.Message) error {
+func (bus *EventBus) topic() string {
+	if bus.app.Config.NsqTopic != nil {
+		return *bus.app.Config.NsqTopic
+	}
+	return DefaultEventTopic
+}
+
+// application is the name of the listening application, it is also the
+// channel of the application on the event topic
+func (bus *EventBus) application() string {
+	if bus.config != nil && bus.config.ListenName != nil {
+		return *bus.config.ListenName
+	}
+	return filepath.Base(os.Args[0])
+}
+
+func (bus *EventBus) maxAttempts() int {
+	if bus.config != nil && bus.config.MaxAttempts > 0 {
+		return bus.config.MaxAttempts
+	}
+	return DefaultEventMaxAttempts
+}
+
+// HandleMessage calls the handlers of the event. Failed handlers are retried
+// by returning the error to the broker, until the max attempts where the
+// event is dead lettered for each handler still failing.
+func (bus *EventBus) HandleMessage(body []byte, attempts int) error {
 	var e NsqEvent
 
-	if err := json.Unmarshal(m.Body, &e); err != nil {
-		return err
+	if err := json.Unmarshal(body, &e); err != nil {
+		log.WithField("error", err).Error("Dropping invalid event")
+		return nil
+	}
+
+	if e.Application != "" && e.Application != bus.application() {
+		return nil
 	}
 
-	handlers, ok := bus.handlers[e.Event]
-	if ok {
-		//Type is the same for all
-		msg := reflect.New(handlers[0].t).Interface()
+	et, ok := LookupEventName(e.Event)
+	if !ok {
+		return nil
+	}
 
-		if err := json.Unmarshal(e.Message, msg); err != nil {
-			return err
+	handlers, ok := bus.handlers[et.Name]
+	if !ok {
+		return nil
+	}
+
+	//Type is the same for all
+	event, err := bus.decode(et, handlers[0].t, e)
+	if err != nil {
+		//Retrying will not fix the message
+		return bus.deadLetter(e, "", err, attempts)
+	}
+
+	var failed error
+	for _, h := range handlers {
+		if e.Handler != "" && e.Handler != h.name {
+			continue
+		}
+
+		dedup_key := bus.dedupKey(e, h.name)
+		claimed, err := bus.claim(dedup_key)
+		if err != nil {
+			//Handled again once the other delivery is done or gave up
+			failed = err
+			continue
 		}
 
-		event := reflect.ValueOf(msg).Elem().Interface()
+		if !claimed {
+			continue
+		}
 
-		for _, h := range handlers {
-			if err := h.f(event); err != nil {
-				event_data, _ := json.Marshal(event)
-				bus.app.Logger.WithField("error", err).WithField("event", string(event_data)).Error("Error handling event")
-				return err
-			}
+		err = h.f(event)
+		bus.count(h.name, err)
+		if err == nil {
+			bus.markHandled(dedup_key)
+			continue
+		}
+
+		bus.release(dedup_key)
+
+		event_data, _ := json.Marshal(event)
+		bus.app.Logger.WithField("error", err).WithField("handler", h.name).WithField("attempts", attempts).WithField("event", string(event_data)).Error("Error handling event")
+
+		if attempts < bus.maxAttempts() {
+			failed = err
+			continue
+		}
+
+		if err := bus.deadLetter(e, h.name, err, attempts); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	return failed
+}
+
+// dedupKey returns the key of the event for the handler, events without an
+// id are not deduplicated
+func (bus *EventBus) dedupKey(e NsqEvent, handler string) string {
+	if bus.dedup == nil || e.Id == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%s:%s:%s:%d", bus.application(), handler, e.Event, e.Id)
+}
+
+// claim returns true if the handler should handle the event, and
+// ErrEventInProgress if another delivery of the event is being handled. If
+// the dedup store fails the event is handled again.
+func (bus *EventBus) claim(key string) (bool, error) {
+	if key == "" {
+		return true, nil
+	}
+
+	claimed, err := bus.dedup.Claim(key)
+	if err == ErrEventInProgress {
+		return false, err
+	}
+	if err != nil {
+		log.WithField("error", err).WithField("key", key).Warning("Could not claim event")
+		return true, nil
+	}
+
+	return claimed, nil
 }
 
+func (bus *EventBus) markHandled(key string) {
+	if key == "" {
+		return
+	}
+
+	if err := bus.dedup.MarkHandled(key); err != nil {
+		log.WithField("error", err).WithField("key", key).Warning("Could not mark event as handled")
+	}
+}
+
+func (bus *EventBus) release(key string) {
+	if key == "" {
+		return
+	}
+
+	if err := bus.dedup.Release(key); err != nil {
+		log.WithField("error", err).WithField("key", key).Warning("Could not release event")
+	}
+}
+
+func (bus *EventBus) decode(et *EventType, t reflect.Type, e NsqEvent) (interface{}, error) {
+	message, err := et.Upgrade(e.Version, e.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := reflect.New(t).Interface()
+	if err := json.Unmarshal(message, msg); err != nil {
+		return nil, err
+	}
+
+	return reflect.ValueOf(msg).Elem().Interface(), nil
+}
+
+// Listen handles events until the app is shutting down
 func (bus *EventBus) Listen() {
 	if bus.config == nil {
 		panic(fmt.Errorf("Missing config for eventbus\n"))
@@ -94,75 +266,105 @@ func (bus *EventBus) Listen() {
 		}
 	}
 
-	application := filepath.Base(os.Args[0])
-
-	if bus.config.ListenName != nil {
-		application = *bus.config.ListenName
+	if err := bus.broker.Subscribe(bus.topic(), bus.application(), bus.config.NumHandlers, bus.HandleMessage); err != nil {
+		log.Fatal(err)
 	}
 
-	config := nsq.NewConfig()
-	consumer, err := nsq.NewConsumer(*bus.app.Config.NsqTopic, application, config)
+	<-bus.app.Context.Done()
+}
+
+// Stop stops the consumers, waiting for the events being handled
+func (bus *EventBus) Stop() {
+	bus.broker.Stop()
+}
+
+// Handle registers a handler for the type of event, the event type must have
+// a registered name. The handler name is stored with dead letters, metrics
+// and handled events, so it must not change between releases.
+func (bus *EventBus) Handle(event interface{}, name string, handler EventHandlerFunc) {
+	et, err := LookupEventType(event)
 	if err != nil {
-		log.Fatal(err)
+		panic(err)
 	}
 
-	// Set the Handler for messages received by this Consumer. Can be called multiple times.
-	// See also AddConcurrentHandlers.
-	consumer.AddConcurrentHandlers(bus, bus.config.NumHandlers)
+	bus.handle(et, name, handler)
+}
 
-	// Use nsqlookupd to discover nsqd instances.
-	// See also ConnectToNSQD, ConnectToNSQDs, ConnectToNSQLookupds.
-	err = consumer.ConnectToNSQLookupd(*bus.app.Config.NsqLookupd)
-	if err != nil {
-		log.Fatal(err)
+func (bus *EventBus) handle(et *EventType, name string, handler EventHandlerFunc) {
+	if name == "" {
+		panic(fmt.Sprintf("Handler for %s without a name", et.Name))
+	}
+
+	for _, h := range bus.handlers[et.Name] {
+		if h.name == name {
+			panic(fmt.Sprintf("Handler %s registered twice for %s", name, et.Name))
+		}
 	}
 
-	// wait for signal to exit
-	sigChan := make(chan os.Signal, 1)
-	<-sigChan
+	h := EventHandler{handler, et.Type, name}
+	bus.handlers[et.Name] = append(bus.handlers[et.Name], h)
+}
+
+// HandleEvent registers a typed handler for events of type T, see
+// EventBus.Handle for the name
+func HandleEvent[T any](app *App, name string, handler func(event T) error) {
+	var event T
+	et, err := LookupEventType(event)
+	if err != nil {
+		panic(err)
+	}
 
-	// Gracefully stop the consumer.
-	consumer.Stop()
+	app.Event.handle(et, name, func(e interface{}) error {
+		return handler(e.(T))
+	})
 }
 
-func (bus *EventBus) Handle(event interface{}, handler EventHandlerFunc) {
-	event_id := getEventId(event)
-	h := EventHandler{handler, reflect.TypeOf(event)}
-	bus.handlers[event_id] = append(bus.handlers[event_id], h)
+// Type returns the registered name and version of the event
+func (bus *EventBus) Type(event interface{}) (*EventType, error) {
+	return LookupEventType(event)
 }
 
 func (bus *EventBus) Publish(event interface{}) error {
+	return bus.PublishToTopic(bus.topic(), event)
+}
 
-	data, err := json.Marshal(event)
+func (bus *EventBus) PublishToTopic(topic string, event interface{}) error {
+	et, err := LookupEventType(event)
 	if err != nil {
 		return err
 	}
 
-	msg, err := json.Marshal(NsqEvent{
-		Event:   getEventId(event),
-		Message: json.RawMessage(data),
-	})
+	data, err := json.Marshal(event)
 	if err != nil {
 		return err
 	}
 
-	return bus.app.NsqProducer.Publish(*bus.app.Config.NsqTopic, msg)
+	return bus.PublishMessageToTopic(topic, et, EventId(event), json.RawMessage(data))
 }
 
-func (bus *EventBus) PublishToTopic(topic string, event interface{}) error {
-
-	data, err := json.Marshal(event)
-	if err != nil {
-		return err
+// PublishMessageToTopic publishes an already encoded event of the type, like
+// a projected event from a pipe
+func (bus *EventBus) PublishMessageToTopic(topic string, et *EventType, id uint64, message json.RawMessage) error {
+	name := et.Name
+	if bus.config != nil && bus.config.PublishLegacyNames {
+		name = et.Legacy
 	}
 
+	return bus.PublishNamedMessageToTopic(topic, name, et, id, message)
+}
+
+// PublishNamedMessageToTopic publishes an already encoded event under the
+// given name, the registered or the legacy name of the type
+func (bus *EventBus) PublishNamedMessageToTopic(topic string, name string, et *EventType, id uint64, message json.RawMessage) error {
 	msg, err := json.Marshal(NsqEvent{
-		Event:   getEventId(event),
-		Message: json.RawMessage(data),
+		Id:      id,
+		Event:   name,
+		Version: et.Version,
+		Message: message,
 	})
 	if err != nil {
 		return err
 	}
 
-	return bus.app.NsqProducer.Publish(topic, msg)
+	return bus.broker.Publish(topic, msg)
 }
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+
+	"github.com/cmodk/go-simpleflake"
+)
+
+// IdentifiedEvent is implemented by events with a stable id, like the id of
+// the notification they were created from. Publishing the event again gives
+// it the same id, so handlers can skip what they already handled.
+type IdentifiedEvent interface {
+	EventId() uint64
+}
+
+// EventId returns the stable id of the event, or a new id for events without
+// one
+func EventId(event interface{}) uint64 {
+	if e, ok := event.(IdentifiedEvent); ok {
+		if id := e.EventId(); id != 0 {
+			return id
+		}
+	}
+
+	return simpleflake.Next()
+}
+
+// EventIdAt returns the id of the event at the time with the key, the same
+// time and key always give the same id. The id is a 64 bit hash of both, so
+// ids of different events only collide by chance.
+func EventIdAt(t time.Time, key string) uint64 {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(t.UnixNano()))
+
+	return eventIdHash(buf, key)
+}
+
+// DeriveEventId returns the id of an event created while handling the parent
+// event, a handler running again derives the same ids
+func DeriveEventId(parent uint64, key string) uint64 {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, parent)
+
+	return eventIdHash(buf, key)
+}
+
+func eventIdHash(prefix []byte, key string) uint64 {
+	h := fnv.New64a()
+	h.Write(prefix)
+	h.Write([]byte(key))
+
+	//Zero means the event has no id
+	if id := h.Sum64(); id != 0 {
+		return id
+	}
+	return 1
+}
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cmodk/go-simpleflake"
+	"github.com/sirupsen/logrus"
+)
+
+type testDedup struct {
+	lock    sync.Mutex
+	handled map[string]string
+}
+
+func (d *testDedup) Claim(key string) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	switch d.handled[key] {
+	case eventClaimHandling:
+		return false, ErrEventInProgress
+	case eventClaimHandled:
+		return false, nil
+	}
+
+	d.handled[key] = eventClaimHandling
+	return true, nil
+}
+
+func (d *testDedup) MarkHandled(key string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.handled[key] = eventClaimHandled
+	return nil
+}
+
+func (d *testDedup) Release(key string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.handled, key)
+	return nil
+}
+
+func TestEventIds(t *testing.T) {
+	now := time.Now()
+
+	id := EventIdAt(now, "a")
+	if id != EventIdAt(now, "a") || id == EventIdAt(now, "b") || id == EventIdAt(now.Add(time.Millisecond), "a") {
+		t.Errorf("Ids not stable for the time and key")
+	}
+
+	//Samples of many devices at the same time get their own ids
+	ids := make(map[uint64]string)
+	for i := 0; i < 100000; i++ {
+		key := fmt.Sprintf("device-%d/temperature/21.5", i)
+		id := EventIdAt(now, key)
+		if other, ok := ids[id]; ok {
+			t.Fatalf("Id of %s collides with %s", key, other)
+		}
+		ids[id] = key
+	}
+
+	parent := simpleflake.Next()
+	derived := DeriveEventId(parent, "0")
+	if derived != DeriveEventId(parent, "0") || derived == DeriveEventId(parent, "1") || derived == DeriveEventId(parent+1, "0") {
+		t.Errorf("Derived ids not stable for the parent and key")
+	}
+}
+
+func TestEventDedup(t *testing.T) {
+	log = logrus.New()
+
+	app := &App{Config: &Config{EventBus: &EventBusConfig{}}, Logger: log}
+	app.Context, app.cancel = context.WithCancel(context.Background())
+	app.Event = NewEventBus(app)
+	app.Event.dedup = &testDedup{handled: map[string]string{}}
+
+	handled := 0
+	HandleEvent(app, "received", func(e testEvent) error {
+		handled++
+		return nil
+	})
+
+	msg := func(id uint64) []byte {
+		data, _ := json.Marshal(NsqEvent{Id: id, Event: "test.event", Message: json.RawMessage(`{"value":1}`)})
+		return data
+	}
+
+	for _, body := range [][]byte{msg(1), msg(1), msg(2), msg(0), msg(0)} {
+		if err := app.Event.HandleMessage(body, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Events without an id are always handled
+	if handled != 4 {
+		t.Errorf("Handled %d events", handled)
+	}
+}
+
+func TestEventDedupInProgress(t *testing.T) {
+	log = logrus.New()
+
+	app := &App{Config: &Config{EventBus: &EventBusConfig{}}, Logger: log}
+	app.Context, app.cancel = context.WithCancel(context.Background())
+	app.Event = NewEventBus(app)
+	dedup := &testDedup{handled: map[string]string{}}
+	app.Event.dedup = dedup
+
+	handled := 0
+	HandleEvent(app, "received", func(e testEvent) error {
+		handled++
+		if handled == 1 {
+			return fmt.Errorf("Failed")
+		}
+		return nil
+	})
+
+	body, _ := json.Marshal(NsqEvent{Id: 1, Event: "test.event", Message: json.RawMessage(`{"value":1}`)})
+
+	//Another delivery holds the claim
+	dedup.Claim(app.Event.dedupKey(NsqEvent{Id: 1, Event: "test.event"}, "received"))
+	if err := app.Event.HandleMessage(body, 1); err != ErrEventInProgress || handled != 0 {
+		t.Errorf("Event in progress handled: %v, %d", err, handled)
+	}
+
+	//A failed handler releases the claim, so the event is handled again
+	dedup.Release(app.Event.dedupKey(NsqEvent{Id: 1, Event: "test.event"}, "received"))
+	if err := app.Event.HandleMessage(body, 1); err == nil {
+		t.Errorf("Failed handler not retried")
+	}
+
+	if err := app.Event.HandleMessage(body, 2); err != nil || handled != 2 {
+		t.Errorf("Released event not handled: %v, %d", err, handled)
+	}
+
+	if err := app.Event.HandleMessage(body, 3); err != nil || handled != 2 {
+		t.Errorf("Handled event handled again: %v, %d", err, handled)
+	}
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EventType is the stable name and schema version of an event on the wire,
+// so the Go type can be renamed or moved without breaking consumers
+type EventType struct {
+	Name    string
+	Version int
+	//The reflected Go type name, used on the wire before names were registered
+	Legacy string
+	Type   reflect.Type
+
+	upgrades map[int]EventUpgrade
+}
+
+// EventUpgrade converts a message of an older schema version to the next
+// version
+type EventUpgrade func(msg json.RawMessage) (json.RawMessage, error)
+
+var (
+	event_types_lock sync.RWMutex
+	event_types      = map[reflect.Type]*EventType{}
+	//Stable and legacy names
+	event_names = map[string]*EventType{}
+)
+
+// RegisterEvent gives the event type T a stable name. Names must never change
+// once released, bump the version and register an upgrade instead when the
+// schema changes in a way old messages can not be decoded.
+func RegisterEvent[T any](name string, version int) {
+	var event T
+	t := reflect.TypeOf(event)
+
+	if name == "" || version < 1 {
+		panic(fmt.Errorf("Invalid registration of event %s: '%s' version %d", t, name, version))
+	}
+
+	event_types_lock.Lock()
+	defer event_types_lock.Unlock()
+
+	if _, ok := event_types[t]; ok {
+		panic(fmt.Errorf("Event %s is already registered", t))
+	}
+
+	et := &EventType{
+		Name:     name,
+		Version:  version,
+		Legacy:   t.String(),
+		Type:     t,
+		upgrades: make(map[int]EventUpgrade),
+	}
+
+	for _, n := range []string{et.Name, et.Legacy} {
+		if other, ok := event_names[n]; ok {
+			panic(fmt.Errorf("Event name %s of %s is already used by %s", n, t, other.Type))
+		}
+	}
+
+	event_types[t] = et
+	event_names[et.Name] = et
+	event_names[et.Legacy] = et
+}
+
+// RegisterEventUpgrade registers the conversion of messages of version from
+// to version from+1 for the event type T
+func RegisterEventUpgrade[T any](from int, upgrade EventUpgrade) {
+	var event T
+
+	et, err := LookupEventType(event)
+	if err != nil {
+		panic(err)
+	}
+
+	if from < 1 || from >= et.Version {
+		panic(fmt.Errorf("Invalid upgrade of %s from version %d, current version is %d", et.Name, from, et.Version))
+	}
+
+	event_types_lock.Lock()
+	defer event_types_lock.Unlock()
+	et.upgrades[from] = upgrade
+}
+
+// LookupEventType returns the registration of the type of the event
+func LookupEventType(event interface{}) (*EventType, error) {
+	t := reflect.TypeOf(event)
+
+	event_types_lock.RLock()
+	defer event_types_lock.RUnlock()
+
+	et, ok := event_types[t]
+	if !ok {
+		return nil, fmt.Errorf("Event %s has no registered name", t)
+	}
+
+	return et, nil
+}
+
+// LookupEventName returns the registration of a stable or legacy name
+func LookupEventName(name string) (*EventType, bool) {
+	event_types_lock.RLock()
+	defer event_types_lock.RUnlock()
+
+	et, ok := event_names[name]
+	return et, ok
+}
+
+// EventTypes returns the registered events sorted by name
+func EventTypes() []*EventType {
+	event_types_lock.RLock()
+	defer event_types_lock.RUnlock()
+
+	types := []*EventType{}
+	for _, et := range event_types {
+		types = append(types, et)
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].Name < types[j].Name
+	})
+
+	return types
+}
+
+// CheckEvents returns an error naming every event without a registered name
+func CheckEvents(events ...interface{}) error {
+	missing := []string{}
+	for _, e := range events {
+		if _, err := LookupEventType(e); err != nil {
+			missing = append(missing, reflect.TypeOf(e).String())
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Events without a registered name: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// Upgrade converts a message of the given version to the current version.
+// Messages from newer versions are rejected, so they are left for consumers
+// knowing the version.
+func (et *EventType) Upgrade(version int, msg json.RawMessage) (json.RawMessage, error) {
+	//Messages from before versioning are version 1
+	if version == 0 {
+		version = 1
+	}
+
+	if version > et.Version {
+		return nil, fmt.Errorf("Event %s version %d is newer than the supported version %d", et.Name, version, et.Version)
+	}
+
+	for v := version; v < et.Version; v++ {
+		event_types_lock.RLock()
+		upgrade, ok := et.upgrades[v]
+		event_types_lock.RUnlock()
+
+		//Versions without an upgrade are compatible
+		if !ok {
+			continue
+		}
+
+		var err error
+		msg, err = upgrade(msg)
+		if err != nil {
+			return nil, fmt.Errorf("Error upgrading %s from version %d: %s", et.Name, v, err)
+		}
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	Value int `json:"value"`
+}
+
+type testEventV2 struct {
+	Total int `json:"total"`
+}
+
+type testUnregistered struct{}
+
+func init() {
+	RegisterEvent[testEvent]("test.event", 1)
+	RegisterEvent[testEventV2]("test.event.v2", 2)
+	RegisterEventUpgrade[testEventV2](1, func(msg json.RawMessage) (json.RawMessage, error) {
+		var v1 testEvent
+		if err := json.Unmarshal(msg, &v1); err != nil {
+			return nil, err
+		}
+		return json.Marshal(testEventV2{Total: v1.Value})
+	})
+}
+
+func TestEventRegistry(t *testing.T) {
+	et, err := LookupEventType(testEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if et.Name != "test.event" || et.Legacy != "app.testEvent" {
+		t.Errorf("Wrong registration: %s, %s", et.Name, et.Legacy)
+	}
+
+	if legacy, ok := LookupEventName("app.testEvent"); !ok || legacy != et {
+		t.Errorf("Legacy name not registered")
+	}
+
+	if err := CheckEvents(testEvent{}, testEventV2{}); err != nil {
+		t.Error(err)
+	}
+
+	if err := CheckEvents(testEvent{}, testUnregistered{}); err == nil {
+		t.Errorf("Unregistered event not detected")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Duplicate name not rejected")
+		}
+	}()
+	RegisterEvent[testUnregistered]("test.event", 1)
+}
+
+func TestEventUpgrade(t *testing.T) {
+	et, err := LookupEventType(testEventV2{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Version 0 is a message from before versioning
+	for _, version := range []int{0, 1} {
+		msg, err := et.Upgrade(version, json.RawMessage(`{"value":3}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(msg) != `{"total":3}` {
+			t.Errorf("Wrong upgrade from version %d: %s", version, msg)
+		}
+	}
+
+	msg, err := et.Upgrade(2, json.RawMessage(`{"total":4}`))
+	if err != nil || string(msg) != `{"total":4}` {
+		t.Errorf("Current version changed: %s, %v", msg, err)
+	}
+
+	if _, err := et.Upgrade(3, json.RawMessage(`{}`)); err == nil {
+		t.Errorf("Newer version accepted")
+	}
+}
+
+func TestTypedEventHandler(t *testing.T) {
+	app := &App{Config: &Config{EventBus: &EventBusConfig{NumHandlers: 1}}}
+	app.Context, app.cancel = context.WithCancel(context.Background())
+	app.Event = NewEventBus(app)
+	app.Event.broker = NewMemoryBroker()
+	defer app.Event.Stop()
+
+	received := make(chan testEventV2, 2)
+	HandleEvent(app, "received", func(e testEventV2) error {
+		received <- e
+		return nil
+	})
+
+	if err := app.Event.broker.Subscribe(app.Event.topic(), "test", 1, app.Event.HandleMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Event.Publish(testEventV2{Total: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Legacy name and version from an old publisher
+	app.Event.broker.Publish(app.Event.topic(), []byte(`{"e":"app.testEventV2","msg":{"value":2}}`))
+
+	for _, expected := range []int{1, 2} {
+		select {
+		case e := <-received:
+			if e.Total != expected {
+				t.Errorf("Wrong event: %v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for event")
+		}
+	}
+
+	if err := app.Event.Publish(testUnregistered{}); err == nil {
+		t.Errorf("Unregistered event published")
+	}
+}
+
+func TestEventHandlerNames(t *testing.T) {
+	app := &App{Config: &Config{EventBus: &EventBusConfig{NumHandlers: 1}}}
+	app.Event = NewEventBus(app)
+
+	handler := func(e testEventV2) error { return nil }
+
+	registers := func(name string) (registered bool) {
+		defer func() {
+			if recover() != nil {
+				registered = false
+			}
+		}()
+
+		HandleEvent(app, name, handler)
+		return true
+	}
+
+	if registers("") {
+		t.Errorf("Handler without a name registered")
+	}
+
+	if !registers("first") {
+		t.Errorf("Named handler not registered")
+	}
+
+	if registers("first") {
+		t.Errorf("Handler name registered twice")
+	}
+
+	if !registers("second") {
+		t.Errorf("Second named handler not registered")
+	}
+}
@@ -0,0 +1,195 @@
+package app
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+const (
+	KeyAlgorithmRSA     = "rsa"
+	KeyAlgorithmECDSA   = "ecdsa"
+	KeyAlgorithmEd25519 = "ed25519"
+)
+
+// GenerateKey creates a private key. The size is the RSA bit size or the
+// ECDSA curve size, zero selects 2048 bit RSA and P-256.
+func GenerateKey(algorithm string, size int) (crypto.Signer, error) {
+	switch algorithm {
+	case KeyAlgorithmRSA:
+		if size == 0 {
+			size = CA_KEY_BITSIZE
+		}
+		return rsa.GenerateKey(rand.Reader, size)
+	case KeyAlgorithmECDSA:
+		var curve elliptic.Curve
+		switch size {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported ECDSA curve size: %d", size)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case KeyAlgorithmEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+
+	return nil, fmt.Errorf("Unknown key algorithm: %s", algorithm)
+}
+
+// parsePemKey accepts PKCS8 keys and the legacy PKCS1 and SEC1 encodings
+func parsePemKey(pemBlock *pem.Block) (crypto.Signer, error) {
+	switch pemBlock.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(pemBlock.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type: %T", key)
+	}
+
+	return signer, nil
+}
+
+// PublicKeyAlgorithm returns the algorithm name and size of a public key,
+// the size is the RSA bit size or the ECDSA curve name
+func PublicKeyAlgorithm(pub crypto.PublicKey) (string, string, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return KeyAlgorithmRSA, fmt.Sprintf("%d", k.N.BitLen()), nil
+	case *ecdsa.PublicKey:
+		return KeyAlgorithmECDSA, k.Curve.Params().Name, nil
+	case ed25519.PublicKey:
+		return KeyAlgorithmEd25519, "", nil
+	}
+
+	return "", "", fmt.Errorf("Unsupported public key type: %T", pub)
+}
+
+// SignDigest signs a sha256 digest. Ed25519 signs the digest as the message,
+// the other algorithms sign it as a pre-hashed sha256.
+func SignDigest(key crypto.Signer, digest []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+
+	return key.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+// VerifyDigest checks a signature made by SignDigest
+func VerifyDigest(pub crypto.PublicKey, digest []byte, signature []byte) error {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest, signature) {
+			return fmt.Errorf("Invalid ECDSA signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, digest, signature) {
+			return fmt.Errorf("Invalid Ed25519 signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unsupported public key type: %T", pub)
+}
+
+// PublicKeyPem encodes the public key as PEM, for distribution to devices
+func PublicKeyPem(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// KeyPolicy decides which keys are accepted in certificate requests
+type KeyPolicy struct {
+	Algorithms  []string
+	MinRSABits  int
+	ECDSACurves []string
+}
+
+// ParseKeyPolicy builds a policy from comma separated lists of algorithms
+// and curves
+func ParseKeyPolicy(algorithms string, minRSABits int, curves string) (KeyPolicy, error) {
+	policy := KeyPolicy{
+		MinRSABits: minRSABits,
+	}
+
+	for _, a := range strings.Split(algorithms, ",") {
+		a = strings.TrimSpace(a)
+		switch a {
+		case KeyAlgorithmRSA, KeyAlgorithmECDSA, KeyAlgorithmEd25519:
+			policy.Algorithms = append(policy.Algorithms, a)
+		case "":
+		default:
+			return policy, fmt.Errorf("Unknown key algorithm: %s", a)
+		}
+	}
+
+	for _, c := range strings.Split(curves, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			policy.ECDSACurves = append(policy.ECDSACurves, c)
+		}
+	}
+
+	return policy, nil
+}
+
+func (policy KeyPolicy) Check(pub crypto.PublicKey) error {
+	algorithm, size, err := PublicKeyAlgorithm(pub)
+	if err != nil {
+		return err
+	}
+
+	if !contains(policy.Algorithms, algorithm) {
+		return fmt.Errorf("Key algorithm %s not allowed", algorithm)
+	}
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < policy.MinRSABits {
+			return fmt.Errorf("RSA key size %d below minimum %d", k.N.BitLen(), policy.MinRSABits)
+		}
+	case *ecdsa.PublicKey:
+		if !contains(policy.ECDSACurves, size) {
+			return fmt.Errorf("ECDSA curve %s not allowed", size)
+		}
+	}
+
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
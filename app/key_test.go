@@ -0,0 +1,92 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestKeyPolicy(t *testing.T) {
+	policy, err := ParseKeyPolicy("rsa,ecdsa", 2048, "P-256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		algorithm string
+		size      int
+		allowed   bool
+	}{
+		{KeyAlgorithmRSA, 2048, true},
+		{KeyAlgorithmRSA, 1024, false},
+		{KeyAlgorithmECDSA, 256, true},
+		{KeyAlgorithmECDSA, 384, false},
+		{KeyAlgorithmEd25519, 0, false},
+	}
+
+	for _, test := range tests {
+		key, err := GenerateKey(test.algorithm, test.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = policy.Check(key.Public())
+		if (err == nil) != test.allowed {
+			t.Errorf("%s %d: allowed %v, got %v", test.algorithm, test.size, test.allowed, err)
+		}
+	}
+
+	if _, err := ParseKeyPolicy("rsa,dsa", 2048, ""); err == nil {
+		t.Errorf("Unknown algorithm accepted")
+	}
+}
+
+func TestParsePemKey(t *testing.T) {
+	for _, algorithm := range []string{KeyAlgorithmRSA, KeyAlgorithmECDSA, KeyAlgorithmEd25519} {
+		key, err := GenerateKey(algorithm, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := parsePemKey(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err != nil {
+			t.Fatalf("%s: %s", algorithm, err)
+		}
+
+		name, _, err := PublicKeyAlgorithm(parsed.Public())
+		if err != nil || name != algorithm {
+			t.Errorf("%s: parsed as %s, %v", algorithm, name, err)
+		}
+	}
+}
+
+func TestSignDigest(t *testing.T) {
+	digest := sha256.Sum256([]byte("firmware"))
+
+	for _, algorithm := range []string{KeyAlgorithmRSA, KeyAlgorithmECDSA, KeyAlgorithmEd25519} {
+		key, err := GenerateKey(algorithm, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signature, err := SignDigest(key, digest[:])
+		if err != nil {
+			t.Fatalf("%s: %s", algorithm, err)
+		}
+
+		if err := VerifyDigest(key.Public(), digest[:], signature); err != nil {
+			t.Errorf("%s: %s", algorithm, err)
+		}
+
+		signature[len(signature)-1] ^= 0xFF
+		if err := VerifyDigest(key.Public(), digest[:], signature); err == nil {
+			t.Errorf("%s: modified signature accepted", algorithm)
+		}
+	}
+}
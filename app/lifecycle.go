@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"time"
+)
+
+var (
+	shutdown_timeout = flag.Int("shutdown-timeout", 25, "Seconds to wait for handlers and connections to finish on shutdown, keep it below the termination grace period")
+)
+
+// Go runs a background worker, the shutdown waits for it to return. Workers
+// must return when App.Context is done.
+func (app *App) Go(worker func()) {
+	app.workers.Add(1)
+	go func() {
+		defer app.workers.Done()
+		worker()
+	}()
+}
+
+// Sleep waits for d or until the app is shutting down, false is returned
+// when shutting down
+func (app *App) Sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-app.Context.Done():
+		return false
+	}
+}
+
+// OnShutdown registers f to be called on shutdown, after the http server is
+// drained and before the event consumers are stopped. Hooks are called in
+// reverse order of registration.
+func (app *App) OnShutdown(f func()) {
+	app.shutdown_lock.Lock()
+	defer app.shutdown_lock.Unlock()
+
+	app.shutdown_hooks = append(app.shutdown_hooks, f)
+}
+
+// Shutdown stops the app, it is called when SIGTERM or SIGINT is received.
+// Only the first call shuts down, other calls wait for it to finish.
+func (app *App) Shutdown() {
+	app.shutdown_once.Do(app.shutdown)
+}
+
+func (app *App) shutdown() {
+	//Stop listening for signals, a second signal kills the process
+	app.cancel()
+
+	timeout := time.Duration(*shutdown_timeout) * time.Second
+	log.Printf("Shutting down, waiting up to %s\n", timeout)
+
+	deadline, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		if app.Http != nil {
+			if err := app.Http.Shutdown(deadline); err != nil && err != http.ErrServerClosed {
+				log.WithField("error", err).Error("Error draining http connections")
+			}
+		}
+
+		app.shutdown_lock.Lock()
+		hooks := app.shutdown_hooks
+		app.shutdown_lock.Unlock()
+		for i := len(hooks) - 1; i >= 0; i-- {
+			hooks[i]()
+		}
+
+		app.Event.Stop()
+		app.workers.Wait()
+		app.Command.Stop()
+
+		//Flushes the messages still in flight
+		if app.NsqProducer != nil {
+			app.NsqProducer.Stop()
+		}
+
+		if app.Cassandra != nil {
+			app.Cassandra.Close()
+		}
+
+		if app.Redis != nil {
+			if err := app.Redis.Close(); err != nil {
+				log.WithField("error", err).Error("Error closing redis")
+			}
+		}
+
+		if app.Database != nil {
+			if err := app.Database.Close(); err != nil {
+				log.WithField("error", err).Error("Error closing database")
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+		log.Printf("Shutdown complete\n")
+	case <-deadline.Done():
+		log.Errorf("Shutdown timed out after %s\n", timeout)
+	}
+}
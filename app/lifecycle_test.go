@@ -0,0 +1,64 @@
+package app
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestShutdown(t *testing.T) {
+	log = logrus.New()
+
+	app := &App{}
+	app.Context, app.cancel = context.WithCancel(context.Background())
+	app.Command = NewCommandBus(app)
+	app.Event = &EventBus{app: app, broker: NewMemoryBroker()}
+
+	var handled int32
+	listening := make(chan bool, 3)
+	app.HandleCommand("", func(cmd interface{}) error {
+		atomic.AddInt32(&handled, 1)
+		listening <- true
+		return nil
+	})
+
+	for i := 0; i < 3; i++ {
+		app.Command.Create("")
+	}
+	go app.Command.Listen()
+	<-listening
+
+	worker_stopped := false
+	app.Go(func() {
+		for app.Sleep(time.Hour) {
+		}
+		worker_stopped = true
+	})
+
+	hooks := []int{}
+	app.OnShutdown(func() { hooks = append(hooks, 1) })
+	app.OnShutdown(func() { hooks = append(hooks, 2) })
+
+	app.Shutdown()
+	//Later calls are ignored
+	app.Shutdown()
+
+	if app.Context.Err() == nil {
+		t.Errorf("Context not done after shutdown")
+	}
+
+	if !worker_stopped {
+		t.Errorf("Shutdown did not wait for the worker")
+	}
+
+	if handled := atomic.LoadInt32(&handled); handled != 3 {
+		t.Errorf("Queued commands not handled, handled %d", handled)
+	}
+
+	if len(hooks) != 2 || hooks[0] != 2 || hooks[1] != 1 {
+		t.Errorf("Wrong hook order: %v", hooks)
+	}
+}
@@ -0,0 +1,359 @@
+package phoenix
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Revocation reasons from RFC 5280
+var (
+	RevocationReasons = map[string]int{
+		"unspecified":          0,
+		"keyCompromise":        1,
+		"cACompromise":         2,
+		"affiliationChanged":   3,
+		"superseded":           4,
+		"cessationOfOperation": 5,
+		"certificateHold":      6,
+	}
+)
+
+const (
+	RevocationReasonSuperseded = 4
+)
+
+type DeviceCertificate struct {
+	Id               uint64     `db:"id" json:"id" table:"device_certificates"`
+	DeviceId         uint64     `db:"device_id" json:"device_id"`
+	Serial           string     `db:"serial" json:"serial"`
+	Fingerprint      string     `db:"fingerprint" json:"fingerprint"`
+	NotBefore        time.Time  `db:"not_before" json:"not_before"`
+	NotAfter         time.Time  `db:"not_after" json:"not_after"`
+	Created          time.Time  `db:"created" json:"created"`
+	RevokedAt        *time.Time `db:"revoked_at" json:"revoked_at"`
+	RevocationReason *int       `db:"revocation_reason" json:"revocation_reason"`
+	ExpiryNotified   *time.Time `db:"expiry_notified" json:"expiry_notified"`
+	Issuer           *string    `db:"issuer" json:"issuer"`
+}
+
+// DeviceCertificateExpiry is a line in the certificate expiry report
+type DeviceCertificateExpiry struct {
+	DeviceCertificate
+	DeviceGuid string `db:"device_guid" json:"device_guid"`
+	Expired    bool   `db:"-" json:"expired"`
+}
+
+const (
+	CertificateRequestIssued   = "issued"
+	CertificateRequestRejected = "rejected"
+	//Rejected by the rate limit, not counted towards it
+	CertificateRequestRateLimited = "rate_limited"
+)
+
+// CertificateRequest is the audit log of certificate signing requests
+type CertificateRequest struct {
+	Id         uint64    `db:"id" json:"id" table:"certificate_requests"`
+	DeviceId   uint64    `db:"device_id" json:"device_id"`
+	Created    time.Time `db:"created" json:"created"`
+	RemoteAddr string    `db:"remote_addr" json:"remote_addr"`
+	Renewal    bool      `db:"renewal" json:"renewal"`
+	//The renewal token was checked, only these and issued requests count
+	//towards the rate limit
+	Authenticated bool    `db:"authenticated" json:"authenticated"`
+	Subject       *string `db:"subject" json:"subject"`
+	Status        string  `db:"status" json:"status"`
+	Reason        *string `db:"reason" json:"reason"`
+	Serial        *string `db:"serial" json:"serial"`
+	Fingerprint   *string `db:"fingerprint" json:"fingerprint"`
+}
+
+type CertificateRequestCriteria struct {
+	DeviceId uint64 `schema:"device_id" db:"device_id"`
+	Status   string `schema:"status" db:"status"`
+
+	Limit int `schema:"limit"`
+}
+
+type DeviceCertificateCriteria struct {
+	Id          uint64 `schema:"id" db:"id"`
+	DeviceId    uint64 `schema:"device_id" db:"device_id"`
+	Serial      string `schema:"serial" db:"serial"`
+	Fingerprint string `schema:"fingerprint" db:"fingerprint"`
+
+	Limit int `schema:"limit"`
+}
+
+// CertificateFingerprint is the sha256 of the raw certificate, which is also
+// what is stored as the device token
+func CertificateFingerprint(raw []byte) string {
+	h := sha256.Sum256(raw)
+	return fmt.Sprintf("%x", h[:])
+}
+
+func CertificateSerial(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+func (c *DeviceCertificate) Revoked() bool {
+	return c.RevokedAt != nil
+}
+
+func (c *DeviceCertificate) SerialNumber() (*big.Int, error) {
+	serial, ok := new(big.Int).SetString(c.Serial, 16)
+	if !ok {
+		return nil, fmt.Errorf("Bad certificate serial: %s", c.Serial)
+	}
+
+	return serial, nil
+}
+
+func (devices *Devices) CertificateGet(c DeviceCertificateCriteria) (*DeviceCertificate, error) {
+	var certificate DeviceCertificate
+	if err := devices.db.MatchOne(&certificate, "device_certificates", c); err != nil {
+		return nil, err
+	}
+
+	return &certificate, nil
+}
+
+func (devices *Devices) CertificateRevokedList() ([]DeviceCertificate, error) {
+	var certificates []DeviceCertificate
+	if err := devices.db.Select(&certificates, "SELECT * FROM device_certificates WHERE revoked_at IS NOT NULL"); err != nil {
+		return nil, err
+	}
+
+	return certificates, nil
+}
+
+// CertificateActiveList returns the active certificates of all devices
+func (devices *Devices) CertificateActiveList() ([]DeviceCertificateExpiry, error) {
+	var certificates []DeviceCertificateExpiry
+	if err := devices.db.Select(&certificates, "SELECT c.*, d.guid AS device_guid FROM device_certificates c JOIN devices d ON d.id = c.device_id WHERE c.revoked_at IS NULL ORDER BY c.not_after"); err != nil {
+		return nil, err
+	}
+
+	return certificates, nil
+}
+
+// CertificateExpiringList returns the active certificates expiring before
+// the given time, including the ones already expired
+func (devices *Devices) CertificateExpiringList(before time.Time) ([]DeviceCertificateExpiry, error) {
+	var certificates []DeviceCertificateExpiry
+	if err := devices.db.Select(&certificates, "SELECT c.*, d.guid AS device_guid FROM device_certificates c JOIN devices d ON d.id = c.device_id WHERE c.revoked_at IS NULL AND c.not_after < ? ORDER BY c.not_after", before); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range certificates {
+		certificates[i].Expired = certificates[i].NotAfter.Before(now)
+	}
+
+	return certificates, nil
+}
+
+// CertificateExpiryNotified marks the certificate as notified. It returns
+// false if somebody else already did, so only one notification is sent.
+func (devices *Devices) CertificateExpiryNotified(c *DeviceCertificate) (bool, error) {
+	now := time.Now().UTC()
+	result, err := devices.db.Exec("UPDATE device_certificates SET expiry_notified = ? WHERE id = ? AND expiry_notified IS NULL", now, c.Id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	c.ExpiryNotified = &now
+	return affected == 1, nil
+}
+
+// IssuedBy tells if the certificate was signed by the issuer, certificates
+// recorded before issuers were tracked never match
+func (c *DeviceCertificate) IssuedBy(issuer *x509.Certificate) bool {
+	return c.Issuer != nil && *c.Issuer == CertificateFingerprint(issuer.Raw)
+}
+
+// CertificateInsert records a certificate issued to the device. The earlier
+// certificates stay active until the device uses the new one, so a device
+// which never received the new certificate can still connect and renew, see
+// CertificateUsed.
+func (d *Device) CertificateInsert(certificate *x509.Certificate, issuer *x509.Certificate) (*DeviceCertificate, error) {
+	issuer_fingerprint := CertificateFingerprint(issuer.Raw)
+	c := DeviceCertificate{
+		DeviceId:    d.Id,
+		Serial:      CertificateSerial(certificate.SerialNumber),
+		Fingerprint: CertificateFingerprint(certificate.Raw),
+		NotBefore:   certificate.NotBefore,
+		NotAfter:    certificate.NotAfter,
+		Created:     time.Now().UTC(),
+		Issuer:      &issuer_fingerprint,
+	}
+
+	if err := d.db.Insert(&c, "device_certificates"); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (d *Device) CertificateList(c DeviceCertificateCriteria) ([]DeviceCertificate, error) {
+	c.DeviceId = d.Id
+
+	var certificates []DeviceCertificate
+	if err := d.db.Match(&certificates, "device_certificates", c); err != nil {
+		return nil, err
+	}
+
+	return certificates, nil
+}
+
+// CertificateActive returns the newest certificate of the device that is not
+// revoked
+func (d *Device) CertificateActive() (*DeviceCertificate, error) {
+	var certificate DeviceCertificate
+	if err := d.db.Get(&certificate, "SELECT * FROM device_certificates WHERE device_id = ? AND revoked_at IS NULL ORDER BY not_after DESC LIMIT 1", d.Id); err != nil {
+		return nil, err
+	}
+
+	return &certificate, nil
+}
+
+// CertificateRevoke revokes the certificate with the serial, or all active
+// certificates of the device if serial is empty
+func (d *Device) CertificateRevoke(serial string, reason int) ([]DeviceCertificate, error) {
+	certificates, err := d.CertificateList(DeviceCertificateCriteria{Serial: serial})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var revoked []DeviceCertificate
+	for _, c := range certificates {
+		if c.Revoked() {
+			continue
+		}
+
+		if _, err := d.db.Exec("UPDATE device_certificates SET revoked_at = ?, revocation_reason = ? WHERE id = ?", now, reason, c.Id); err != nil {
+			return revoked, err
+		}
+
+		c.RevokedAt = &now
+		c.RevocationReason = &reason
+		revoked = append(revoked, c)
+	}
+
+	if serial != "" && len(revoked) == 0 {
+		return nil, fmt.Errorf("No active certificate with serial %s", serial)
+	}
+
+	return revoked, nil
+}
+
+// CertificateRevoked tells if the token is the fingerprint of a revoked
+// certificate. Tokens from before certificates were recorded are unknown,
+// and not revoked.
+func (d *Device) CertificateRevoked(token string) (bool, error) {
+	var certificate DeviceCertificate
+	err := d.db.MatchOne(&certificate, "device_certificates", DeviceCertificateCriteria{
+		DeviceId:    d.Id,
+		Fingerprint: token,
+	})
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return certificate.Revoked(), nil
+}
+
+// CertificateTokenValid tells if the device may authenticate with the
+// token: the device token, which is the fingerprint of the newest
+// certificate, or the fingerprint of an earlier certificate which is neither
+// revoked nor expired.
+func (d *Device) CertificateTokenValid(token string) (bool, error) {
+	if d.Token != nil && subtle.ConstantTimeCompare([]byte(token), []byte(*d.Token)) == 1 {
+		return true, nil
+	}
+
+	var certificate DeviceCertificate
+	err := d.db.MatchOne(&certificate, "device_certificates", DeviceCertificateCriteria{
+		DeviceId:    d.Id,
+		Fingerprint: token,
+	})
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return !certificate.Revoked() && certificate.NotAfter.After(time.Now()), nil
+}
+
+// CertificateUsed revokes the certificates issued before the newest one as
+// superseded, once the device authenticates with the newest certificate.
+// Nothing is revoked when the device uses an earlier certificate.
+func (d *Device) CertificateUsed(token string) error {
+	if d.Token == nil || subtle.ConstantTimeCompare([]byte(token), []byte(*d.Token)) != 1 {
+		return nil
+	}
+
+	var newest DeviceCertificate
+	err := d.db.MatchOne(&newest, "device_certificates", DeviceCertificateCriteria{
+		DeviceId:    d.Id,
+		Fingerprint: token,
+	})
+	if err == sql.ErrNoRows {
+		//Token not from a certificate
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec("UPDATE device_certificates SET revoked_at = ?, revocation_reason = ? WHERE device_id = ? AND id < ? AND revoked_at IS NULL",
+		time.Now().UTC(),
+		RevocationReasonSuperseded,
+		d.Id,
+		newest.Id)
+	return err
+}
+
+func (d *Device) CertificateRequestInsert(request *CertificateRequest) error {
+	request.DeviceId = d.Id
+	request.Created = time.Now().UTC()
+
+	return d.db.Insert(request, "certificate_requests")
+}
+
+func (d *Device) CertificateRequestList(c CertificateRequestCriteria) ([]CertificateRequest, error) {
+	c.DeviceId = d.Id
+
+	var requests []CertificateRequest
+	if err := d.db.Match(&requests, "certificate_requests", c); err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// CertificateRequestCount returns the number of certificate requests made by
+// the device since the given time, requests rejected before authentication
+// are not counted so others cannot use up the limit of the device
+func (d *Device) CertificateRequestCount(since time.Time) (int, error) {
+	var count int
+	if err := d.db.Get(&count, "SELECT COUNT(*) FROM certificate_requests WHERE device_id = ? AND created >= ? AND (authenticated = 1 AND status != ? OR status = ?)", d.Id, since, CertificateRequestRateLimited, CertificateRequestIssued); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
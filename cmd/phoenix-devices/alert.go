@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/cmodk/phoenix"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+func withParametricAlertRule(h func(http.ResponseWriter, *http.Request, *phoenix.AlertRule)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(mux.Vars(r)["rule"], 10, 64)
+		if err != nil {
+			app.HttpBadRequest(w, err)
+			return
+		}
+
+		rule, err := app.Devices.AlertRuleGet(phoenix.AlertRuleCriteria{Id: id})
+		if err != nil {
+			app.HttpNotFound(w, fmt.Errorf("Alert rule not found"))
+			return
+		}
+
+		h(w, r, rule)
+	}
+}
+
+func alertRuleListHandler(w http.ResponseWriter, r *http.Request) {
+	c := phoenix.AlertRuleCriteria{}
+	if err := schema.NewDecoder().Decode(&c, r.URL.Query()); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	rules, err := app.Devices.AlertRuleList(c)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, rules)
+}
+
+func alertRuleCreateHandler(w http.ResponseWriter, r *http.Request) {
+	rule := phoenix.AlertRule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := rule.Validate(); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := app.Devices.AlertRuleInsert(&rule); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, rule)
+}
+
+func alertRuleGetHandler(w http.ResponseWriter, r *http.Request, rule *phoenix.AlertRule) {
+	app.JsonResponse(w, rule)
+}
+
+// alertRuleUpdateHandler replaces the fields given in the body
+func alertRuleUpdateHandler(w http.ResponseWriter, r *http.Request, rule *phoenix.AlertRule) {
+	id := rule.Id
+	created := rule.Created
+	if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+	rule.Id = id
+	rule.Created = created
+
+	if err := rule.Validate(); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := app.Devices.AlertRuleUpdate(rule); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, rule)
+}
+
+func alertRuleDeleteHandler(w http.ResponseWriter, r *http.Request, rule *phoenix.AlertRule) {
+	if err := app.Devices.AlertRuleDelete(rule); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func alertListHandler(w http.ResponseWriter, r *http.Request) {
+	c := phoenix.AlertCriteria{}
+	if err := schema.NewDecoder().Decode(&c, r.URL.Query()); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	alerts, err := app.Devices.AlertList(c)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, alerts)
+}
+
+func alertAcknowledgeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["alert"], 10, 64)
+	if err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	var request struct {
+		By string `json:"by"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if len(request.By) == 0 {
+		app.HttpBadRequest(w, fmt.Errorf("Missing who acknowledges the alert"))
+		return
+	}
+
+	a, err := app.Devices.AlertGet(phoenix.AlertCriteria{Id: id})
+	if err != nil {
+		app.HttpNotFound(w, fmt.Errorf("Alert not found"))
+		return
+	}
+
+	if err := app.Devices.AlertAcknowledge(a, request.By); err != nil {
+		app.HttpError(w, err, http.StatusConflict)
+		return
+	}
+
+	app.JsonResponse(w, a)
+}
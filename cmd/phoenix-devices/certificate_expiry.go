@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cmodk/phoenix"
+)
+
+const (
+	certificateExpiryInterval = time.Hour
+)
+
+var (
+	certificate_renewal_window = flag.String("certificate-renewal-window", "720h", "Devices are asked to renew, and may renew, their certificate this long before it expires, default is 30 days")
+	certificate_renewal_grace  = flag.String("certificate-renewal-grace", "168h", "Devices may still renew an expired certificate for this long, default is 7 days")
+
+	certificate_renewal_window_time time.Duration
+	certificate_renewal_grace_time  time.Duration
+)
+
+// certificateRenewalAllowed applies the renewal window policy to a renewal
+// request made with the current token. Certificates issued by an earlier CA
+// may always be renewed, so devices can move to a new CA.
+func certificateRenewalAllowed(d *phoenix.Device) error {
+	if d.TokenExpiration == nil {
+		return nil
+	}
+
+	c, err := d.CertificateActive()
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if c == nil || !c.IssuedBy(app.CACertificate) {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Before(d.TokenExpiration.Add(-certificate_renewal_window_time)) {
+		return fmt.Errorf("Certificate not due for renewal before %s", d.TokenExpiration.Add(-certificate_renewal_window_time).Format(time.RFC3339))
+	}
+
+	if now.After(d.TokenExpiration.Add(certificate_renewal_grace_time)) {
+		return fmt.Errorf("Certificate expired %s, device must be provisioned again", d.TokenExpiration.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func certificateExpiringHandler(w http.ResponseWriter, r *http.Request) {
+	window := certificate_renewal_window_time
+
+	if days := r.URL.Query().Get("days"); days != "" {
+		d, err := strconv.Atoi(days)
+		if err != nil {
+			app.HttpBadRequest(w, err)
+			return
+		}
+		window = time.Duration(d) * 24 * time.Hour
+	}
+
+	certificates, err := app.Devices.CertificateExpiringList(time.Now().Add(window))
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, certificates)
+}
+
+// certificateExpiryMonitor emits DeviceCertificateExpiring once for every
+// certificate entering the renewal window
+func certificateExpiryMonitor() {
+	for {
+		if err := certificateExpiryCheck(); err != nil {
+			lg.WithField("error", err).Error("Error checking certificate expiry")
+		}
+
+		if !app.Sleep(certificateExpiryInterval) {
+			return
+		}
+	}
+}
+
+func certificateExpiryCheck() error {
+	certificates, err := app.Devices.CertificateExpiringList(time.Now().Add(certificate_renewal_window_time))
+	if err != nil {
+		return err
+	}
+
+	for _, c := range certificates {
+		if c.ExpiryNotified != nil || c.Expired {
+			continue
+		}
+
+		lg.WithField("device", c.DeviceGuid).WithField("not_after", c.NotAfter).Info("Certificate expiring")
+
+		if err := app.Event.Publish(phoenix.DeviceCertificateExpiring{
+			DeviceId:   c.DeviceId,
+			DeviceGuid: c.DeviceGuid,
+			Serial:     c.Serial,
+			NotAfter:   c.NotAfter,
+		}); err != nil {
+			return err
+		}
+
+		//Only marked once published, so a failed publish is retried on the
+		//next check
+		if _, err := app.Devices.CertificateExpiryNotified(&c.DeviceCertificate); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/cmodk/phoenix"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	crlValidity  = 24 * time.Hour
+	ocspValidity = time.Hour
+)
+
+func deviceCertificateListHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	certificates, err := d.CertificateList(phoenix.DeviceCertificateCriteria{})
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, certificates)
+}
+
+func deviceCertificateRevokeHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	var request struct {
+		Serial string `json:"serial"`
+		Reason string `json:"reason"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if request.Reason == "" {
+		request.Reason = "unspecified"
+	}
+
+	reason, ok := phoenix.RevocationReasons[request.Reason]
+	if !ok {
+		app.HttpBadRequest(w, fmt.Errorf("Unknown revocation reason: %s", request.Reason))
+		return
+	}
+
+	revoked, err := d.CertificateRevoke(request.Serial, reason)
+	if err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	for _, c := range revoked {
+		lg.WithField("device", d.Guid).WithField("serial", c.Serial).WithField("reason", request.Reason).Warning("Certificate revoked")
+
+		if err := app.Event.Publish(phoenix.DeviceCertificateRevoked{
+			DeviceId:   d.Id,
+			DeviceGuid: d.Guid,
+			Serial:     c.Serial,
+			Reason:     reason,
+			RevokedAt:  *c.RevokedAt,
+		}); err != nil {
+			app.HttpInternalError(w, err)
+			return
+		}
+	}
+
+	app.JsonResponse(w, revoked)
+}
+
+// certificateCrlHandler returns a DER encoded CRL signed by the CA issuing
+// device certificates
+func certificateCrlHandler(w http.ResponseWriter, r *http.Request) {
+	certificates, err := app.Devices.CertificateRevokedList()
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	var revoked []pkix.RevokedCertificate
+	for _, c := range certificates {
+		serial, err := c.SerialNumber()
+		if err != nil {
+			lg.WithField("error", err).Error("Skipping certificate in crl")
+			continue
+		}
+
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: *c.RevokedAt,
+		})
+	}
+
+	now := time.Now().UTC()
+
+	var crl []byte
+	if app.CACertificate.KeyUsage&x509.KeyUsageCRLSign != 0 {
+		crl, err = x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:              big.NewInt(now.Unix()),
+			ThisUpdate:          now,
+			NextUpdate:          now.Add(crlValidity),
+			RevokedCertificates: revoked,
+		}, app.CACertificate, app.CAPrivateKey)
+	} else {
+		//CAs generated before CRL support lack the crlSign key usage
+		crl, err = app.CACertificate.CreateCRL(rand.Reader, app.CAPrivateKey, revoked, now, now.Add(crlValidity))
+	}
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+// certificateOcspHandler answers OCSP requests, both POST and the base64
+// encoded GET form from RFC 6960
+func certificateOcspHandler(w http.ResponseWriter, r *http.Request) {
+	var raw []byte
+	var err error
+
+	if r.Method == http.MethodGet {
+		raw, err = base64.StdEncoding.DecodeString(mux.Vars(r)["request"])
+	} else {
+		raw, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+	}
+	if err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	request, err := ocsp.ParseRequest(raw)
+	if err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	template := ocsp.Response{
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(ocspValidity),
+		Status:       ocsp.Good,
+	}
+
+	c, err := app.Devices.CertificateGet(phoenix.DeviceCertificateCriteria{
+		Serial: phoenix.CertificateSerial(request.SerialNumber),
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		template.Status = ocsp.Unknown
+	case err != nil:
+		app.HttpInternalError(w, err)
+		return
+	case c.Revoked():
+		template.Status = ocsp.Revoked
+		template.RevokedAt = *c.RevokedAt
+		if c.RevocationReason != nil {
+			template.RevocationReason = *c.RevocationReason
+		}
+	}
+
+	response, err := ocsp.CreateResponse(app.CACertificate, app.CACertificate, template, app.CAPrivateKey)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/ocsp-response")
+	w.Write(response)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/cmodk/phoenix"
+	"github.com/gorilla/mux"
+)
+
+func deviceDerivedStreamListHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	derived, err := d.DerivedStreamList()
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, derived)
+}
+
+// deviceDerivedStreamCreateHandler creates or replaces a derived stream on
+// the device
+func deviceDerivedStreamCreateHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	var s phoenix.DerivedStream
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := s.Validate(); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := d.DerivedStreamInsert(&s); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	app.JsonResponse(w, s)
+}
+
+func deviceDerivedStreamDeleteHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	id, err := strconv.ParseUint(mux.Vars(r)["derived"], 10, 64)
+	if err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := d.DerivedStreamDelete(id); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deviceTypeDerivedStreamListHandler(w http.ResponseWriter, r *http.Request, t *phoenix.DeviceType) {
+	derived, err := app.Devices.TypeDerivedStreamList(t)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, derived)
+}
+
+// deviceTypeDerivedStreamCreateHandler creates or replaces a derived stream
+// for all devices of the type
+func deviceTypeDerivedStreamCreateHandler(w http.ResponseWriter, r *http.Request, t *phoenix.DeviceType) {
+	var s phoenix.DerivedStream
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := s.Validate(); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := app.Devices.TypeDerivedStreamInsert(t, &s); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	app.JsonResponse(w, s)
+}
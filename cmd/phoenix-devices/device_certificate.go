@@ -2,65 +2,243 @@ package main
 
 import (
 	"crypto/rand"
-	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"net/http"
 	"time"
 
 	"github.com/cmodk/phoenix"
+	phoenix_app "github.com/cmodk/phoenix/app"
+	"github.com/gorilla/schema"
 )
 
+var (
+	csr_key_algorithms = flag.String("csr-key-algorithms", "rsa,ecdsa,ed25519", "Key algorithms accepted in device certificate requests")
+	csr_rsa_min_bits   = flag.Int("csr-rsa-min-bits", 2048, "Minimum RSA key size accepted in device certificate requests")
+	csr_ecdsa_curves   = flag.String("csr-ecdsa-curves", "P-256,P-384", "ECDSA curves accepted in device certificate requests")
+
+	csr_rate_limit  = flag.Int("csr-rate-limit", 5, "Max certificate requests per device within -csr-rate-period")
+	csr_rate_period = flag.String("csr-rate-period", "1h", "Period for the certificate request rate limit")
+
+	csr_key_policy       phoenix_app.KeyPolicy
+	csr_rate_period_time time.Duration
+)
+
+const (
+	maxCertificateRequestSize = 64 * 1024
+)
+
+// certificateRequestRejection is a rejected certificate request, with the
+// status code returned to the device
+type certificateRequestRejection struct {
+	status int
+	err    error
+}
+
+func rejectCertificateRequest(status int, format string, args ...interface{}) *certificateRequestRejection {
+	return &certificateRequestRejection{status, fmt.Errorf(format, args...)}
+}
+
 func deviceCertificateRequestHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	audit := phoenix.CertificateRequest{
+		RemoteAddr: r.RemoteAddr,
+		Renewal:    d.Token != nil,
+		Status:     phoenix.CertificateRequestRejected,
+	}
+
+	csr, authenticated, rejection := validateCertificateRequest(r, d)
+	audit.Authenticated = authenticated
+	if csr != nil {
+		subject := csr.Subject.String()
+		audit.Subject = &subject
+	}
+
+	if rejection != nil {
+		reason := rejection.err.Error()
+		audit.Reason = &reason
+		if rejection.status == http.StatusTooManyRequests {
+			audit.Status = phoenix.CertificateRequestRateLimited
+		}
+		if err := d.CertificateRequestInsert(&audit); err != nil {
+			lg.WithField("device", d.Guid).WithField("error", err).Error("Error recording certificate request")
+		}
+
+		lg.WithField("device", d.Guid).WithField("remote_addr", r.RemoteAddr).WithField("error", rejection.err).Warning("Certificate request rejected")
+		app.HttpError(w, rejection.err, rejection.status)
+		return
+	}
+
+	clientCRT, err := issueDeviceCertificate(d, csr)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	serial := phoenix.CertificateSerial(clientCRT.SerialNumber)
+	fingerprint := phoenix.CertificateFingerprint(clientCRT.Raw)
+	audit.Status = phoenix.CertificateRequestIssued
+	audit.Serial = &serial
+	audit.Fingerprint = &fingerprint
+	if err := d.CertificateRequestInsert(&audit); err != nil {
+		lg.WithField("device", d.Guid).WithField("error", err).Error("Error recording certificate request")
+	}
+
+	//First certificate, the device is provisioned with the configuration of its type
+	if !audit.Renewal {
+		if err := applyDeviceType(d); err != nil {
+			lg.WithField("device", d.Guid).WithField("error", err).Error("Error applying device type configuration")
+		}
+	}
 
+	if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: clientCRT.Raw}); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	//Send the chain up to the root, devices only trust the root CA
+	for _, c := range app.CAChain {
+		if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}); err != nil {
+			app.HttpInternalError(w, err)
+			return
+		}
+	}
+
+}
+
+// validateCertificateRequest checks the renewal token, the rate limit and
+// the request itself. The parsed request is returned when available, also
+// on rejection, for the audit log, with whether the renewal token was
+// checked.
+func validateCertificateRequest(r *http.Request, d *phoenix.Device) (*x509.CertificateRequest, bool, *certificateRequestRejection) {
+	authenticated := false
+
+	//Authenticate before the rate limit, so requests without the token
+	//cannot lock the device out of renewal
 	if d.Token != nil {
 		//Check if device tries to renew a certificate
-		auth_header := r.Header["Authorization"]
-		if len(auth_header) == 0 {
-			app.HttpBadRequest(w, fmt.Errorf("Device already assigned certificate"))
-			return
+		bearer, ok := bearerToken(r)
+		if !ok {
+			return nil, false, rejectCertificateRequest(http.StatusUnauthorized, "Device already assigned certificate")
 		}
 
-		bearer := auth_header[0][7:]
+		//The device may not have received its newest certificate, so the
+		//certificate before it can renew as well
+		valid, err := d.CertificateTokenValid(bearer)
+		if err != nil {
+			return nil, false, &certificateRequestRejection{http.StatusInternalServerError, err}
+		}
 
-		if bearer != *d.Token {
-			app.HttpBadRequest(w, fmt.Errorf("Wrong token for certificate renewal"))
-			return
+		if !valid {
+			return nil, false, rejectCertificateRequest(http.StatusUnauthorized, "Wrong token for certificate renewal")
+		}
+		authenticated = true
+
+		revoked, err := d.CertificateRevoked(bearer)
+		if err != nil {
+			return nil, authenticated, &certificateRequestRejection{http.StatusInternalServerError, err}
+		}
+
+		if revoked {
+			return nil, authenticated, rejectCertificateRequest(http.StatusForbidden, "Certificate revoked, device must be provisioned again")
 		}
 	}
 
-	body, _ := ioutil.ReadAll(r.Body)
+	count, err := d.CertificateRequestCount(time.Now().Add(-csr_rate_period_time))
+	if err != nil {
+		return nil, authenticated, &certificateRequestRejection{http.StatusInternalServerError, err}
+	}
+
+	if count >= *csr_rate_limit {
+		return nil, authenticated, rejectCertificateRequest(http.StatusTooManyRequests, "Too many certificate requests, max %d per %s", *csr_rate_limit, csr_rate_period_time)
+	}
+
+	if d.Token != nil {
+		if err := certificateRenewalAllowed(d); err != nil {
+			return nil, authenticated, &certificateRequestRejection{http.StatusConflict, err}
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxCertificateRequestSize+1))
+	if err != nil {
+		return nil, authenticated, rejectCertificateRequest(http.StatusBadRequest, "Error reading certificate request: %s", err)
+	}
+
+	if len(body) > maxCertificateRequestSize {
+		return nil, authenticated, rejectCertificateRequest(http.StatusRequestEntityTooLarge, "Certificate request too large")
+	}
 
 	block, _ := pem.Decode(body)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, authenticated, rejectCertificateRequest(http.StatusBadRequest, "Body must be a PEM encoded CERTIFICATE REQUEST")
+	}
 
 	csr, err := x509.ParseCertificateRequest(block.Bytes)
 	if err != nil {
-		app.HttpBadRequest(w, err)
-		return
+		return nil, authenticated, rejectCertificateRequest(http.StatusBadRequest, "Invalid certificate request: %s", err)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return csr, authenticated, rejectCertificateRequest(http.StatusBadRequest, "Invalid certificate request signature: %s", err)
+	}
+
+	if csr.Subject.CommonName != d.Guid {
+		return csr, authenticated, rejectCertificateRequest(http.StatusBadRequest, "Certificate request common name %q does not match device %s", csr.Subject.CommonName, d.Guid)
+	}
+
+	if len(csr.EmailAddresses) > 0 || len(csr.IPAddresses) > 0 {
+		return csr, authenticated, rejectCertificateRequest(http.StatusBadRequest, "Email and IP subject alternative names are not allowed")
+	}
+
+	for _, name := range csr.DNSNames {
+		if name != d.Guid {
+			return csr, authenticated, rejectCertificateRequest(http.StatusBadRequest, "DNS subject alternative name %q not allowed", name)
+		}
+	}
+
+	for _, uri := range csr.URIs {
+		if uri.String() != deviceURI(d) {
+			return csr, authenticated, rejectCertificateRequest(http.StatusBadRequest, "URI subject alternative name %q not allowed", uri)
+		}
 	}
 
-	if err = csr.CheckSignature(); err != nil {
-		panic(err)
+	if err := csr_key_policy.Check(csr.PublicKey); err != nil {
+		return csr, authenticated, &certificateRequestRejection{http.StatusBadRequest, err}
+	}
+
+	return csr, authenticated, nil
+}
+
+// deviceURI is the only URI a device may put in its certificate
+func deviceURI(d *phoenix.Device) string {
+	return fmt.Sprintf("urn:phoenix:device:%s", d.Guid)
+}
+
+// issueDeviceCertificate signs the validated request and makes the new
+// certificate the device token
+func issueDeviceCertificate(d *phoenix.Device, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
 	}
 
 	now := time.Now()
 	not_before := now
 	not_after := now.Add(certificate_expiration_time)
 
-	// create client certificate template
+	// create client certificate template, the signature algorithm follows
+	// the CA key which may differ from the device key
 	clientCRTTemplate := x509.Certificate{
-		Signature:          csr.Signature,
-		SignatureAlgorithm: csr.SignatureAlgorithm,
-
-		PublicKeyAlgorithm: csr.PublicKeyAlgorithm,
-		PublicKey:          csr.PublicKey,
-
-		SerialNumber: big.NewInt(int64(d.Id)),
+		SerialNumber: serial,
 		Issuer:       app.CACertificate.Subject,
-		Subject:      csr.Subject,
+		Subject:      pkix.Name{CommonName: d.Guid},
+		DNSNames:     csr.DNSNames,
+		URIs:         csr.URIs,
 		NotBefore:    not_before,
 		NotAfter:     not_after,
 		KeyUsage:     x509.KeyUsageDigitalSignature,
@@ -70,26 +248,42 @@ func deviceCertificateRequestHandler(w http.ResponseWriter, r *http.Request, d *
 	// create client certificate from template and CA public key
 	clientCRTRaw, err := x509.CreateCertificate(rand.Reader, &clientCRTTemplate, app.CACertificate, csr.PublicKey, app.CAPrivateKey)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: clientCRTRaw}); err != nil {
-		app.HttpInternalError(w, err)
-		return
+	clientCRT, err := x509.ParseCertificate(clientCRTRaw)
+	if err != nil {
+		return nil, err
 	}
 
-	h := sha256.New()
-	h.Write(clientCRTRaw)
+	if _, err := d.CertificateInsert(clientCRT, app.CACertificate); err != nil {
+		return nil, err
+	}
 
-	certificate_hash := fmt.Sprintf("%x", h.Sum(nil))
+	certificate_hash := phoenix.CertificateFingerprint(clientCRTRaw)
 	if err := d.Update("token", &certificate_hash); err != nil {
-		app.HttpInternalError(w, err)
-		return
+		return nil, err
 	}
 
 	if err := d.Update("token_expiration", &not_after); err != nil {
+		return nil, err
+	}
+
+	return clientCRT, nil
+}
+
+func deviceCertificateRequestListHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	c := phoenix.CertificateRequestCriteria{}
+	if err := schema.NewDecoder().Decode(&c, r.URL.Query()); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	requests, err := d.CertificateRequestList(c)
+	if err != nil {
 		app.HttpInternalError(w, err)
 		return
 	}
 
+	app.JsonResponse(w, requests)
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/cmodk/phoenix"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+func withParametricDeviceType(h func(http.ResponseWriter, *http.Request, *phoenix.DeviceType)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(mux.Vars(r)["type"], 10, 64)
+		if err != nil {
+			app.HttpBadRequest(w, err)
+			return
+		}
+
+		t, err := app.Devices.TypeGet(phoenix.DeviceTypeCriteria{Id: id})
+		if err != nil {
+			app.HttpNotFound(w, fmt.Errorf("Device type not found"))
+			return
+		}
+
+		h(w, r, t)
+	}
+}
+
+func deviceTypeListHandler(w http.ResponseWriter, r *http.Request) {
+	c := phoenix.DeviceTypeCriteria{}
+	if err := schema.NewDecoder().Decode(&c, r.URL.Query()); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	types, err := app.Devices.TypeList(c)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, types)
+}
+
+func deviceTypeGetHandler(w http.ResponseWriter, r *http.Request, t *phoenix.DeviceType) {
+	app.JsonResponse(w, t)
+}
+
+func deviceTypeCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var t phoenix.DeviceType
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := t.Validate(); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := app.Devices.TypeInsert(&t); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, t)
+}
+
+// deviceTypeSetHandler links the device to a device type and applies the
+// configuration of the type
+func deviceTypeSetHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	var request struct {
+		DeviceTypeId uint64 `json:"device_type_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	t, err := app.Devices.TypeGet(phoenix.DeviceTypeCriteria{Id: request.DeviceTypeId})
+	if err != nil {
+		app.HttpBadRequest(w, fmt.Errorf("Device type not found"))
+		return
+	}
+
+	if err := d.SetType(t); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	if d.FirmwareFamily == nil && t.FirmwareFamily != nil {
+		if err := d.Update("firmware_family", *t.FirmwareFamily); err != nil {
+			app.HttpInternalError(w, err)
+			return
+		}
+		d.FirmwareFamily = t.FirmwareFamily
+	}
+
+	if err := applyDeviceType(d); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	app.JsonResponse(w, d)
+}
+
+// applyDeviceType renders the configuration of the device type into the
+// desired shadow, phoenix-mqtt sends the config_write commands for the delta.
+// Configuration from a previous type is left in the shadow.
+func applyDeviceType(d *phoenix.Device) error {
+	t, err := d.Type()
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		return nil
+	}
+
+	config, err := t.Render(d)
+	if err != nil {
+		return err
+	}
+
+	s, err := d.ShadowDesiredPatch(config)
+	if err != nil {
+		return err
+	}
+
+	delta := s.Delta()
+	if len(delta) == 0 {
+		return nil
+	}
+
+	lg.WithField("device", d.Guid).WithField("type", t.Name).WithField("delta", delta).Info("Applying device type configuration")
+	return app.Event.Publish(phoenix.DeviceShadowUpdated{
+		DeviceId:   d.Id,
+		DeviceGuid: d.Guid,
+		Delta:      delta,
+	})
+}
+
+// deviceTypeStreamHandler creates or replaces a stream of the device type
+func deviceTypeStreamHandler(w http.ResponseWriter, r *http.Request, t *phoenix.DeviceType) {
+	var s phoenix.DeviceTypeStream
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if len(s.Code) == 0 {
+		app.HttpBadRequest(w, fmt.Errorf("Missing stream code"))
+		return
+	}
+
+	if err := s.Validate(); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := app.Devices.TypeStreamSet(t, &s); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, s)
+}
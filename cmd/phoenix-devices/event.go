@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/cmodk/phoenix"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+func withParametricDeadLetter(h func(http.ResponseWriter, *http.Request, *phoenix.EventDeadLetter)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(mux.Vars(r)["dead"], 10, 64)
+		if err != nil {
+			app.HttpBadRequest(w, err)
+			return
+		}
+
+		dead, err := app.Devices.EventDeadLetterGet(phoenix.EventDeadLetterCriteria{Id: id})
+		if err != nil {
+			app.HttpNotFound(w, fmt.Errorf("Dead letter not found"))
+			return
+		}
+
+		h(w, r, dead)
+	}
+}
+
+// eventDeadLetterListHandler lists the events the handlers gave up on
+func eventDeadLetterListHandler(w http.ResponseWriter, r *http.Request) {
+	c := phoenix.EventDeadLetterCriteria{Limit: 100}
+	if err := schema.NewDecoder().Decode(&c, r.URL.Query()); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	dead, err := app.Devices.EventDeadLetterList(c)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, dead)
+}
+
+func eventDeadLetterGetHandler(w http.ResponseWriter, r *http.Request, dead *phoenix.EventDeadLetter) {
+	app.JsonResponse(w, dead)
+}
+
+// eventDeadLetterUpdateHandler edits the message and version of the event
+// before it is replayed, the rest of the dead letter is kept
+func eventDeadLetterUpdateHandler(w http.ResponseWriter, r *http.Request, dead *phoenix.EventDeadLetter) {
+	var update struct {
+		Version *int            `json:"version"`
+		Message json.RawMessage `json:"message"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if update.Version != nil {
+		dead.Version = *update.Version
+	}
+	if len(update.Message) > 0 {
+		dead.Message = string(update.Message)
+	}
+
+	if err := app.Devices.EventDeadLetterUpdate(dead); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	app.JsonResponse(w, dead)
+}
+
+func eventDeadLetterDeleteHandler(w http.ResponseWriter, r *http.Request, dead *phoenix.EventDeadLetter) {
+	if err := app.Devices.EventDeadLetterDelete(dead); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func eventDeadLetterReplayHandler(w http.ResponseWriter, r *http.Request, dead *phoenix.EventDeadLetter) {
+	if err := app.Devices.EventDeadLetterReplay(dead); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, dead)
+}
+
+// eventMetricsHandler returns the failures of the event handlers of all the
+// applications
+func eventMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics, err := app.Event.SharedMetrics(r.Context())
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, metrics)
+}
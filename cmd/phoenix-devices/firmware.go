@@ -0,0 +1,537 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/cmodk/go-simpleflake"
+	"github.com/cmodk/phoenix"
+	phoenix_app "github.com/cmodk/phoenix/app"
+	"github.com/cmodk/phoenix/storage"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+const (
+	maxFirmwareNameLength = 64
+)
+
+var (
+	firmware_url      = flag.String("firmware-url", "http://localhost:4010", "Public base url devices download firmware from")
+	firmware_max_size = flag.Int64("firmware-max-size", 64*1024*1024, "Max size of firmware images in bytes")
+
+	firmware_storage storage.Storage
+	firmware_key     crypto.Signer
+)
+
+// setupFirmware connects the firmware storage and loads the signing key.
+// Without a signing key firmware can be downloaded, but not uploaded.
+func setupFirmware() error {
+	config := storage.Config{Type: storage.TypeLocal, Path: "./data"}
+	if app.Config.Storage != nil {
+		config = *app.Config.Storage
+	}
+
+	var err error
+	firmware_storage, err = storage.New(config)
+	if err != nil {
+		return err
+	}
+
+	firmware_key, err = app.LoadFirmwareKey()
+	if err != nil {
+		lg.WithField("error", err).Warning("No firmware signing key, firmware upload disabled")
+	}
+
+	if *firmware_max_size > 0xFFFFFFFF {
+		return fmt.Errorf("Firmware max size %d does not fit the firmware_update command", *firmware_max_size)
+	}
+
+	return nil
+}
+
+func withParametricFirmware(h func(http.ResponseWriter, *http.Request, *phoenix.Firmware)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(mux.Vars(r)["firmware"], 10, 64)
+		if err != nil {
+			app.HttpBadRequest(w, err)
+			return
+		}
+
+		f, err := app.Devices.FirmwareGet(phoenix.FirmwareCriteria{Id: id})
+		if err != nil {
+			app.HttpNotFound(w, fmt.Errorf("Firmware not found"))
+			return
+		}
+
+		h(w, r, f)
+	}
+}
+
+func firmwareKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if firmware_key == nil {
+		app.HttpNotFound(w, fmt.Errorf("No firmware signing key"))
+		return
+	}
+
+	key, err := phoenix_app.PublicKeyPem(firmware_key.Public())
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(key)
+}
+
+// firmwareUploadHandler stores the image in the body, family and version are
+// given as query parameters
+func firmwareUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if firmware_key == nil {
+		app.HttpError(w, fmt.Errorf("No firmware signing key, run -certificate-generate"), http.StatusServiceUnavailable)
+		return
+	}
+
+	f := phoenix.Firmware{
+		Family:  r.URL.Query().Get("family"),
+		Version: r.URL.Query().Get("version"),
+		Size:    r.ContentLength,
+	}
+
+	if len(f.Family) == 0 || len(f.Family) > maxFirmwareNameLength || len(f.Version) == 0 || len(f.Version) > maxFirmwareNameLength {
+		app.HttpBadRequest(w, fmt.Errorf("Firmware needs a family and a version of at most %d characters", maxFirmwareNameLength))
+		return
+	}
+
+	if f.Size <= 0 {
+		app.HttpError(w, fmt.Errorf("Content-Length is required"), http.StatusLengthRequired)
+		return
+	}
+
+	if f.Size > *firmware_max_size {
+		app.HttpError(w, fmt.Errorf("Firmware larger than %d bytes", *firmware_max_size), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	f.Filename = fmt.Sprintf("firmware/%d.bin", simpleflake.Next())
+
+	hash := sha256.New()
+	if err := firmware_storage.Put(f.Filename, io.TeeReader(r.Body, hash), f.Size); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	digest := hash.Sum(nil)
+	signature, err := phoenix_app.SignDigest(firmware_key, digest)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	f.Sha256 = hex.EncodeToString(digest)
+	f.Signature = hex.EncodeToString(signature)
+
+	if err := app.Devices.FirmwareInsert(&f); err != nil {
+		if err := firmware_storage.Delete(f.Filename); err != nil {
+			lg.WithField("firmware", f.Filename).WithField("error", err).Error("Error deleting firmware image")
+		}
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	lg.WithField("family", f.Family).WithField("version", f.Version).WithField("sha256", f.Sha256).Info("Firmware uploaded")
+	app.JsonResponse(w, f)
+}
+
+func firmwareListHandler(w http.ResponseWriter, r *http.Request) {
+	c := phoenix.FirmwareCriteria{}
+	if err := schema.NewDecoder().Decode(&c, r.URL.Query()); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	firmwares, err := app.Devices.FirmwareList(c)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, firmwares)
+}
+
+func firmwareGetHandler(w http.ResponseWriter, r *http.Request, f *phoenix.Firmware) {
+	app.JsonResponse(w, f)
+}
+
+// deviceFirmwareDownloadHandler serves the image to the device, range
+// requests let the device resume an interrupted download
+func deviceFirmwareDownloadHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	bearer, ok := bearerToken(r)
+	if !ok {
+		app.HttpUnauthorized(w, fmt.Errorf("Missing authentication"))
+		return
+	}
+
+	if err := d.VerifyToken(bearer); err != nil {
+		app.HttpUnauthorized(w, err)
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["firmware"], 10, 64)
+	if err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	f, err := app.Devices.FirmwareGet(phoenix.FirmwareCriteria{Id: id})
+	if err != nil {
+		app.HttpNotFound(w, fmt.Errorf("Firmware not found"))
+		return
+	}
+
+	image := storage.NewReadSeeker(firmware_storage, f.Filename, f.Size)
+	defer image.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", f.Sha256))
+	http.ServeContent(w, r, fmt.Sprintf("%s-%s.bin", f.Family, f.Version), f.Created, image)
+}
+
+func deviceFirmwareUpdateListHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	updates, err := d.FirmwareUpdateList(phoenix.DeviceFirmwareUpdateCriteria{})
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, updates)
+}
+
+// deviceFirmwareUpdateHandler updates a single device outside any rollout
+func deviceFirmwareUpdateHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	var request struct {
+		FirmwareId uint64 `json:"firmware_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	f, err := app.Devices.FirmwareGet(phoenix.FirmwareCriteria{Id: request.FirmwareId})
+	if err != nil {
+		app.HttpBadRequest(w, fmt.Errorf("Firmware not found"))
+		return
+	}
+
+	update, err := startFirmwareUpdate(d, f, nil)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, update)
+}
+
+// startFirmwareUpdate sends the firmware_update command to the device and
+// tracks the update
+func startFirmwareUpdate(d *phoenix.Device, f *phoenix.Firmware, rollout_id *uint64) (*phoenix.DeviceFirmwareUpdate, error) {
+	parameters, err := json.Marshal(phoenix.FirmwareUpdateParameters{
+		Version:   f.Version,
+		Url:       fmt.Sprintf("%s/device/%s/firmware/%d", *firmware_url, d.Guid, f.Id),
+		Size:      f.Size,
+		Sha256:    f.Sha256,
+		Signature: f.Signature,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	raw_parameters := json.RawMessage(parameters)
+	command := phoenix.DeviceCommand{
+		Command:    "firmware_update",
+		Parameters: &raw_parameters,
+	}
+
+	if err := d.CommandInsert(&command); err != nil {
+		return nil, err
+	}
+
+	update := phoenix.DeviceFirmwareUpdate{
+		FirmwareId: f.Id,
+		RolloutId:  rollout_id,
+		CommandId:  command.Id,
+		Status:     phoenix.FirmwareUpdatePending,
+	}
+
+	if err := d.FirmwareUpdateInsert(&update); err != nil {
+		return nil, err
+	}
+
+	if err := app.Event.Publish(phoenix.DeviceCommandCreated(command)); err != nil {
+		return nil, err
+	}
+
+	return &update, nil
+}
+
+func groupListHandler(w http.ResponseWriter, r *http.Request) {
+	groups, err := app.Devices.GroupList(phoenix.DeviceGroupCriteria{})
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, groups)
+}
+
+func groupCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var g phoenix.DeviceGroup
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if len(g.Name) == 0 {
+		app.HttpBadRequest(w, fmt.Errorf("Group needs a name"))
+		return
+	}
+
+	if err := app.Devices.GroupInsert(&g); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, g)
+}
+
+func withParametricGroup(h func(http.ResponseWriter, *http.Request, *phoenix.DeviceGroup)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(mux.Vars(r)["group"], 10, 64)
+		if err != nil {
+			app.HttpBadRequest(w, err)
+			return
+		}
+
+		g, err := app.Devices.GroupGet(phoenix.DeviceGroupCriteria{Id: id})
+		if err != nil {
+			app.HttpNotFound(w, fmt.Errorf("Group not found"))
+			return
+		}
+
+		h(w, r, g)
+	}
+}
+
+func groupMemberListHandler(w http.ResponseWriter, r *http.Request, g *phoenix.DeviceGroup) {
+	ds, err := app.Devices.GroupMembers(g)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, ds)
+}
+
+func groupMemberAddHandler(w http.ResponseWriter, r *http.Request, g *phoenix.DeviceGroup) {
+	withParametricDevice(func(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+		if err := app.Devices.GroupMemberAdd(g, d); err != nil {
+			app.HttpInternalError(w, err)
+			return
+		}
+
+		app.JsonResponse(w, d)
+	})(w, r)
+}
+
+func groupMemberRemoveHandler(w http.ResponseWriter, r *http.Request, g *phoenix.DeviceGroup) {
+	withParametricDevice(func(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+		if err := app.Devices.GroupMemberRemove(g, d); err != nil {
+			app.HttpInternalError(w, err)
+			return
+		}
+
+		app.JsonResponse(w, d)
+	})(w, r)
+}
+
+func firmwareRolloutCreateHandler(w http.ResponseWriter, r *http.Request, f *phoenix.Firmware) {
+	var rollout phoenix.FirmwareRollout
+	if err := json.NewDecoder(r.Body).Decode(&rollout); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if rollout.Percentage < 1 || rollout.Percentage > 100 {
+		app.HttpBadRequest(w, fmt.Errorf("Percentage must be between 1 and 100"))
+		return
+	}
+
+	if _, err := app.Devices.GroupGet(phoenix.DeviceGroupCriteria{Id: rollout.GroupId}); err != nil {
+		app.HttpBadRequest(w, fmt.Errorf("Group not found"))
+		return
+	}
+
+	rollout.FirmwareId = f.Id
+	rollout.Status = phoenix.RolloutActive
+
+	if err := app.Devices.RolloutInsert(&rollout); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	if err := applyRollout(&rollout, f); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, rollout)
+}
+
+func withParametricRollout(h func(http.ResponseWriter, *http.Request, *phoenix.FirmwareRollout)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(mux.Vars(r)["rollout"], 10, 64)
+		if err != nil {
+			app.HttpBadRequest(w, err)
+			return
+		}
+
+		rollout, err := app.Devices.RolloutGet(phoenix.FirmwareRolloutCriteria{Id: id})
+		if err != nil {
+			app.HttpNotFound(w, fmt.Errorf("Rollout not found"))
+			return
+		}
+
+		h(w, r, rollout)
+	}
+}
+
+func rolloutGetHandler(w http.ResponseWriter, r *http.Request, rollout *phoenix.FirmwareRollout) {
+	updates, err := app.Devices.FirmwareUpdateList(phoenix.DeviceFirmwareUpdateCriteria{RolloutId: rollout.Id})
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, struct {
+		*phoenix.FirmwareRollout
+		Updates []phoenix.DeviceFirmwareUpdate `json:"updates"`
+	}{
+		rollout,
+		updates,
+	})
+}
+
+// rolloutUpdateHandler changes the percentage or status of a rollout, raising
+// the percentage of an active rollout updates the additional devices
+func rolloutUpdateHandler(w http.ResponseWriter, r *http.Request, rollout *phoenix.FirmwareRollout) {
+	var request struct {
+		Percentage *int    `json:"percentage"`
+		Status     *string `json:"status"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if rollout.Status == phoenix.RolloutCancelled {
+		app.HttpError(w, fmt.Errorf("Rollout is cancelled"), http.StatusConflict)
+		return
+	}
+
+	if request.Percentage != nil {
+		if *request.Percentage < rollout.Percentage || *request.Percentage > 100 {
+			app.HttpBadRequest(w, fmt.Errorf("Percentage can only be raised, up to 100"))
+			return
+		}
+		rollout.Percentage = *request.Percentage
+	}
+
+	if request.Status != nil {
+		switch *request.Status {
+		case phoenix.RolloutActive, phoenix.RolloutPaused, phoenix.RolloutCancelled:
+			rollout.Status = *request.Status
+		default:
+			app.HttpBadRequest(w, fmt.Errorf("Unknown rollout status: %s", *request.Status))
+			return
+		}
+	}
+
+	if err := app.Devices.RolloutUpdate(rollout); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	f, err := app.Devices.FirmwareGet(phoenix.FirmwareCriteria{Id: rollout.FirmwareId})
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	if err := applyRollout(rollout, f); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, rollout)
+}
+
+// applyRollout starts the update on the devices of the group included by the
+// rollout percentage, which have not been updated by the rollout already
+func applyRollout(rollout *phoenix.FirmwareRollout, f *phoenix.Firmware) error {
+	if rollout.Status != phoenix.RolloutActive {
+		return nil
+	}
+
+	g, err := app.Devices.GroupGet(phoenix.DeviceGroupCriteria{Id: rollout.GroupId})
+	if err != nil {
+		return err
+	}
+
+	ds, err := app.Devices.GroupMembers(g)
+	if err != nil {
+		return err
+	}
+
+	started := 0
+	for i := range ds {
+		d := &ds[i]
+
+		if !rollout.Includes(d.Guid) {
+			continue
+		}
+
+		if d.FirmwareFamily != nil && *d.FirmwareFamily != f.Family {
+			continue
+		}
+
+		if d.FirmwareVersion != nil && *d.FirmwareVersion == f.Version {
+			continue
+		}
+
+		_, err := d.FirmwareUpdateGet(phoenix.DeviceFirmwareUpdateCriteria{RolloutId: rollout.Id})
+		if err == nil {
+			continue
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		if _, err := startFirmwareUpdate(d, f, &rollout.Id); err != nil {
+			return err
+		}
+		started++
+	}
+
+	lg.WithField("rollout", rollout.Id).WithField("percentage", rollout.Percentage).WithField("started", started).Info("Rollout applied")
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cmodk/go-simpleflake"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/cmodk/phoenix"
 	phoenix_app "github.com/cmodk/phoenix/app"
+	"github.com/cmodk/phoenix/protocol"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 )
@@ -39,34 +41,129 @@ func main() {
 	var err error
 	certificate_expiration_time, err = time.ParseDuration(*certificate_expiration)
 	if err != nil {
-		lg.WithField("error", err).Fatal("Error parsing certificate expiration string: %s\n", certificate_expiration)
+		lg.WithField("error", err).Fatalf("Error parsing certificate expiration string: %s\n", *certificate_expiration)
+	}
+
+	csr_rate_period_time, err = time.ParseDuration(*csr_rate_period)
+	if err != nil {
+		lg.WithField("error", err).Fatalf("Error parsing certificate request rate period string: %s\n", *csr_rate_period)
+	}
+
+	csr_key_policy, err = phoenix_app.ParseKeyPolicy(*csr_key_algorithms, *csr_rsa_min_bits, *csr_ecdsa_curves)
+	if err != nil {
+		lg.WithField("error", err).Fatal("Error parsing certificate request key policy")
+	}
+
+	certificate_renewal_window_time, err = time.ParseDuration(*certificate_renewal_window)
+	if err != nil {
+		lg.WithField("error", err).Fatalf("Error parsing certificate renewal window string: %s\n", *certificate_renewal_window)
+	}
+
+	certificate_renewal_grace_time, err = time.ParseDuration(*certificate_renewal_grace)
+	if err != nil {
+		lg.WithField("error", err).Fatalf("Error parsing certificate renewal grace string: %s\n", *certificate_renewal_grace)
 	}
 
 	if err := app.App.CheckAndUpdateDatabase(phoenix.DatabaseStructure); err != nil {
 		panic(err)
 	}
 
+	if err := setupFirmware(); err != nil {
+		lg.WithField("error", err).Fatal("Error setting up firmware storage")
+	}
+
 	app.Use(phoenix_app.Cors())
 
 	app.Get("/info", infoHandler)
 
 	app.Get("/device", deviceListHandler)
 	app.Get("/device/{device}", deviceGetHandler)
+	app.Get("/certificate/expiring", certificateExpiringHandler)
+	app.Get("/certificate/crl", certificateCrlHandler)
+	app.Post("/certificate/ocsp", certificateOcspHandler)
+	app.Get("/certificate/ocsp/{request:.+}", certificateOcspHandler)
+
 	app.Post("/device/{device}/certificate", withParametricDevice(deviceCertificateRequestHandler))
+	app.Get("/device/{device}/certificate", withParametricDevice(deviceCertificateListHandler))
+	app.Post("/device/{device}/certificate/revoke", withParametricDevice(deviceCertificateRevokeHandler))
+	app.Get("/device/{device}/certificate/request", withParametricDevice(deviceCertificateRequestListHandler))
+	app.Post("/device/{device}/timestamp", withParametricDevice(deviceTimestampSettingsHandler))
+	app.Get("/device/{device}/acl", withParametricDevice(deviceTopicAclListHandler))
+	app.Post("/device/{device}/acl", withParametricDevice(deviceTopicAclCreateHandler))
+	app.Delete("/device/{device}/acl/{acl}", withParametricDevice(deviceTopicAclDeleteHandler))
 	app.Get("/device/{device}/notification", withParametricDevice(deviceNotificationListHandler))
 	app.Post("/device/{device}/notification", withParametricDevice(deviceNotificationPostHandler))
 	app.Get("/device/{device}/stream", withParametricDevice(deviceStreamListHandler))
 	app.Get("/device/{device}/stream/{stream}", withParametricDevice(withParametricStream(deviceStreamValueListHandler)))
+	app.Post("/device/{device}/stream/{stream}/metadata", withParametricDevice(deviceStreamMetadataHandler))
+	app.Get("/device/{device}/derived", withParametricDevice(deviceDerivedStreamListHandler))
+	app.Post("/device/{device}/derived", withParametricDevice(deviceDerivedStreamCreateHandler))
+	app.Delete("/device/{device}/derived/{derived}", withParametricDevice(deviceDerivedStreamDeleteHandler))
 	app.Get("/device/{device}/sample", withParametricDevice(deviceSampleListHandler))
 	app.Post("/device/{device}/command", withParametricDevice(deviceCommandCreateHandler))
 	app.Get("/device/{device}/command/{command}", withParametricDevice(deviceCommandGetHandler))
-	app.HandleEvent(phoenix.DeviceOnline{}, deviceOnline)
+	app.Get("/device/{device}/shadow", withParametricDevice(deviceShadowGetHandler))
+	app.Get("/device/{device}/shadow/delta", withParametricDevice(deviceShadowDeltaHandler))
+	app.Patch("/device/{device}/shadow/desired", withParametricDevice(deviceShadowDesiredHandler))
+	app.Get("/device/{device}/firmware", withParametricDevice(deviceFirmwareUpdateListHandler))
+	app.Post("/device/{device}/firmware", withParametricDevice(deviceFirmwareUpdateHandler))
+	app.Get("/device/{device}/firmware/{firmware:[0-9]+}", withParametricDevice(deviceFirmwareDownloadHandler))
+
+	app.Get("/firmware", firmwareListHandler)
+	app.Post("/firmware", firmwareUploadHandler)
+	app.Get("/firmware/key", firmwareKeyHandler)
+	app.Get("/firmware/{firmware:[0-9]+}", withParametricFirmware(firmwareGetHandler))
+	app.Post("/firmware/{firmware:[0-9]+}/rollout", withParametricFirmware(firmwareRolloutCreateHandler))
+	app.Get("/rollout/{rollout}", withParametricRollout(rolloutGetHandler))
+	app.Post("/rollout/{rollout}", withParametricRollout(rolloutUpdateHandler))
+
+	app.Post("/device/{device}/type", withParametricDevice(deviceTypeSetHandler))
+	app.Get("/type", deviceTypeListHandler)
+	app.Post("/type", deviceTypeCreateHandler)
+	app.Get("/type/{type}", withParametricDeviceType(deviceTypeGetHandler))
+	app.Post("/type/{type}/stream", withParametricDeviceType(deviceTypeStreamHandler))
+	app.Get("/type/{type}/derived", withParametricDeviceType(deviceTypeDerivedStreamListHandler))
+	app.Post("/type/{type}/derived", withParametricDeviceType(deviceTypeDerivedStreamCreateHandler))
+
+	app.Get("/alert", alertListHandler)
+	app.Post("/alert/{alert:[0-9]+}/acknowledge", alertAcknowledgeHandler)
+	app.Get("/alert/rule", alertRuleListHandler)
+	app.Post("/alert/rule", alertRuleCreateHandler)
+	app.Get("/alert/rule/{rule}", withParametricAlertRule(alertRuleGetHandler))
+	app.Post("/alert/rule/{rule}", withParametricAlertRule(alertRuleUpdateHandler))
+	app.Delete("/alert/rule/{rule}", withParametricAlertRule(alertRuleDeleteHandler))
+
+	app.Get("/webhook", webhookListHandler)
+	app.Post("/webhook", webhookCreateHandler)
+	app.Get("/webhook/dead", webhookDeadLetterListHandler)
+	app.Post("/webhook/delivery/{delivery}/retry", webhookDeliveryRetryHandler)
+	app.Get("/webhook/{webhook:[0-9]+}", withParametricWebhook(webhookGetHandler))
+	app.Post("/webhook/{webhook:[0-9]+}", withParametricWebhook(webhookUpdateHandler))
+	app.Delete("/webhook/{webhook:[0-9]+}", withParametricWebhook(webhookDeleteHandler))
+	app.Get("/webhook/{webhook:[0-9]+}/delivery", withParametricWebhook(webhookDeliveryListHandler))
+
+	app.Get("/event/dead", eventDeadLetterListHandler)
+	app.Get("/event/dead/{dead:[0-9]+}", withParametricDeadLetter(eventDeadLetterGetHandler))
+	app.Post("/event/dead/{dead:[0-9]+}", withParametricDeadLetter(eventDeadLetterUpdateHandler))
+	app.Delete("/event/dead/{dead:[0-9]+}", withParametricDeadLetter(eventDeadLetterDeleteHandler))
+	app.Post("/event/dead/{dead:[0-9]+}/replay", withParametricDeadLetter(eventDeadLetterReplayHandler))
+	app.Get("/event/metrics", eventMetricsHandler)
+
+	app.Get("/group", groupListHandler)
+	app.Post("/group", groupCreateHandler)
+	app.Get("/group/{group}/device", withParametricGroup(groupMemberListHandler))
+	app.Post("/group/{group}/device/{device}", withParametricGroup(groupMemberAddHandler))
+	app.Delete("/group/{group}/device/{device}", withParametricGroup(groupMemberRemoveHandler))
+	phoenix.HandleEvent(app, "deviceOnline", deviceOnline)
 
 	app.LoadCertificates(true)
+
+	app.Go(certificateExpiryMonitor)
+
 	app.Run()
 }
 
-func deviceOnline(event interface{}) error {
+func deviceOnline(e phoenix.DeviceOnline) error {
 
 	log.Printf("Device online\n")
 
@@ -128,6 +225,118 @@ func deviceGetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func deviceTimestampSettingsHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	//Only the fields in the request are updated, null resets a field to the
+	//default
+	var settings map[string]*string
+
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	precision, has_precision := settings["precision"]
+	policy, has_policy := settings["policy"]
+
+	if precision != nil {
+		if _, err := protocol.ParsePrecision(*precision); err != nil {
+			app.HttpBadRequest(w, err)
+			return
+		}
+	}
+
+	if policy != nil {
+		valid := false
+		for _, p := range phoenix.TimestampPolicies {
+			valid = valid || p == *policy
+		}
+
+		if !valid {
+			app.HttpBadRequest(w, fmt.Errorf("Unknown timestamp policy: %s", *policy))
+			return
+		}
+	}
+
+	if has_precision {
+		if err := d.Update("timestamp_precision", precision); err != nil {
+			app.HttpInternalError(w, err)
+			return
+		}
+		d.TimestampPrecision = precision
+	}
+
+	if has_policy {
+		if err := d.Update("timestamp_policy", policy); err != nil {
+			app.HttpInternalError(w, err)
+			return
+		}
+		d.TimestampPolicy = policy
+	}
+
+	app.JsonResponse(w, d)
+}
+
+func deviceTopicAclListHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	topics, err := d.SubscribeTopics()
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	acls, err := d.TopicAclList(phoenix.DeviceTopicAclCriteria{})
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	resp := struct {
+		SubscribeTopics []string                 `json:"subscribe_topics"`
+		Acls            []phoenix.DeviceTopicAcl `json:"acls"`
+	}{
+		topics,
+		acls,
+	}
+
+	app.JsonResponse(w, resp)
+}
+
+func deviceTopicAclCreateHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	var acl phoenix.DeviceTopicAcl
+
+	if err := json.NewDecoder(r.Body).Decode(&acl); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	//The mqtt server matches client subscriptions as patterns, so no wildcards
+	if len(acl.Topic) == 0 || strings.ContainsAny(acl.Topic, "+#") {
+		app.HttpBadRequest(w, fmt.Errorf("Topic must be a non empty topic without wildcards"))
+		return
+	}
+
+	if err := d.TopicAclInsert(&acl); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, acl)
+}
+
+func deviceTopicAclDeleteHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	id, err := strconv.ParseUint(mux.Vars(r)["acl"], 10, 64)
+	if err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := d.TopicAclDelete(id); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func deviceNotificationListHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
 	ns, err := d.NotificationList(phoenix.DeviceNotificationCriteria{})
 	if err != nil {
@@ -137,24 +346,27 @@ func deviceNotificationListHandler(w http.ResponseWriter, r *http.Request, d *ph
 	app.JsonResponse(w, ns)
 }
 
-func deviceNotificationPostHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
-	auth_headers := r.Header["Authorization"]
-	if len(auth_headers) == 0 {
-		app.HttpUnauthorized(w, fmt.Errorf("Missing authentication"))
-		return
+// bearerToken returns the token from a "Bearer" authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	auth_header := r.Header.Get("Authorization")
+
+	const prefix = "Bearer "
+	if len(auth_header) <= len(prefix) || !strings.EqualFold(auth_header[:len(prefix)], prefix) {
+		return "", false
 	}
 
-	auth_header := auth_headers[0]
-	bearer := auth_header[7:]
+	return auth_header[len(prefix):], true
+}
 
-	if d.Token == nil || bearer != *d.Token {
-		app.HttpUnauthorized(w, fmt.Errorf("Invalid token for device"))
+func deviceNotificationPostHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	bearer, ok := bearerToken(r)
+	if !ok {
+		app.HttpUnauthorized(w, fmt.Errorf("Missing authentication"))
 		return
 	}
 
-	if d.TokenExpiration.Before(time.Now()) {
-		err := fmt.Errorf("Token expired")
-		app.Logger.WithField("device", d).WithField("error", err).Error(err)
+	if err := d.VerifyToken(bearer); err != nil {
+		app.Logger.WithField("device", d.Guid).WithField("error", err).Error(err)
 		app.HttpUnauthorized(w, err)
 		return
 	}
@@ -182,7 +394,7 @@ func deviceNotificationPostHandler(w http.ResponseWriter, r *http.Request, d *ph
 	}
 
 	if err := app.Command.Create(cmd); err != nil {
-		app.HttpBadRequest(w, err)
+		app.HttpError(w, err, http.StatusServiceUnavailable)
 		return
 	}
 
@@ -262,6 +474,19 @@ func deviceStreamListHandler(w http.ResponseWriter, r *http.Request, d *phoenix.
 		return
 	}
 
+	metadata, err := d.StreamMetadataList()
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	for i := range *streams {
+		s := &(*streams)[i]
+		if m, ok := metadata[s.Code]; ok {
+			s.Metadata = &m
+		}
+	}
+
 	app.JsonResponse(w, streams)
 }
 
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cmodk/phoenix"
+)
+
+func deviceShadowGetHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	s, err := d.Shadow()
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, s)
+}
+
+func deviceShadowDeltaHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	s, err := d.Shadow()
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, s.Delta())
+}
+
+// deviceShadowDesiredHandler merges the body into the desired configuration,
+// null values remove a configuration from the shadow
+func deviceShadowDesiredHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	var patch phoenix.ShadowState
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := patch.Validate(); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	s, err := d.ShadowDesiredPatch(patch)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	delta := s.Delta()
+	if len(delta) > 0 {
+		if err := app.Event.Publish(phoenix.DeviceShadowUpdated{
+			DeviceId:   d.Id,
+			DeviceGuid: d.Guid,
+			Delta:      delta,
+		}); err != nil {
+			app.HttpInternalError(w, err)
+			return
+		}
+	}
+
+	app.JsonResponse(w, s)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cmodk/phoenix"
+	"github.com/gorilla/mux"
+)
+
+// deviceStreamMetadataHandler sets the metadata of a stream on the device,
+// the stream does not need to have any values yet
+func deviceStreamMetadataHandler(w http.ResponseWriter, r *http.Request, d *phoenix.Device) {
+	m := phoenix.DeviceStreamMetadata{
+		Code: mux.Vars(r)["stream"],
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&m.StreamMetadata); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := m.Validate(); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := d.StreamMetadataSet(&m); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	resolved, err := d.StreamMetadata(m.Code)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, resolved)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/cmodk/phoenix"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+func withParametricWebhook(h func(http.ResponseWriter, *http.Request, *phoenix.Webhook)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(mux.Vars(r)["webhook"], 10, 64)
+		if err != nil {
+			app.HttpBadRequest(w, err)
+			return
+		}
+
+		webhook, err := app.Devices.WebhookGet(phoenix.WebhookCriteria{Id: id})
+		if err != nil {
+			app.HttpNotFound(w, fmt.Errorf("Webhook not found"))
+			return
+		}
+
+		h(w, r, webhook)
+	}
+}
+
+// webhookListHandler lists the webhooks, secrets are only returned when the
+// webhook is created
+func webhookListHandler(w http.ResponseWriter, r *http.Request) {
+	c := phoenix.WebhookCriteria{}
+	if err := schema.NewDecoder().Decode(&c, r.URL.Query()); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	webhooks, err := app.Devices.WebhookList(c)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	app.JsonResponse(w, webhooks)
+}
+
+func webhookCreateHandler(w http.ResponseWriter, r *http.Request) {
+	webhook := phoenix.Webhook{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := webhook.Validate(); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	if err := app.Devices.WebhookInsert(&webhook); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, webhook)
+}
+
+func webhookGetHandler(w http.ResponseWriter, r *http.Request, webhook *phoenix.Webhook) {
+	webhook.Secret = ""
+	app.JsonResponse(w, webhook)
+}
+
+// webhookUpdateHandler replaces the fields given in the body, the secret is
+// kept unless a new one is given
+func webhookUpdateHandler(w http.ResponseWriter, r *http.Request, webhook *phoenix.Webhook) {
+	id := webhook.Id
+	created := webhook.Created
+	secret := webhook.Secret
+	webhook.Secret = ""
+
+	if err := json.NewDecoder(r.Body).Decode(webhook); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	webhook.Id = id
+	webhook.Created = created
+	if len(webhook.Secret) == 0 {
+		webhook.Secret = secret
+	}
+
+	if err := app.Devices.WebhookUpdate(webhook); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	webhook.Secret = ""
+	app.JsonResponse(w, webhook)
+}
+
+func webhookDeleteHandler(w http.ResponseWriter, r *http.Request, webhook *phoenix.Webhook) {
+	if err := app.Devices.WebhookDelete(webhook); err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func webhookDeliveryListHandler(w http.ResponseWriter, r *http.Request, webhook *phoenix.Webhook) {
+	c := phoenix.WebhookDeliveryCriteria{Limit: 100}
+	if err := schema.NewDecoder().Decode(&c, r.URL.Query()); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+	c.WebhookId = webhook.Id
+
+	deliveries, err := app.Devices.WebhookDeliveryList(c)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, deliveries)
+}
+
+// webhookDeadLetterListHandler lists the deliveries which were given up on
+func webhookDeadLetterListHandler(w http.ResponseWriter, r *http.Request) {
+	c := phoenix.WebhookDeliveryCriteria{Limit: 100}
+	if err := schema.NewDecoder().Decode(&c, r.URL.Query()); err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+	c.Status = phoenix.WebhookDeliveryDead
+
+	deliveries, err := app.Devices.WebhookDeliveryList(c)
+	if err != nil {
+		app.HttpInternalError(w, err)
+		return
+	}
+
+	app.JsonResponse(w, deliveries)
+}
+
+func webhookDeliveryRetryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["delivery"], 10, 64)
+	if err != nil {
+		app.HttpBadRequest(w, err)
+		return
+	}
+
+	delivery, err := app.Devices.WebhookDeliveryGet(phoenix.WebhookDeliveryCriteria{Id: id})
+	if err != nil {
+		app.HttpNotFound(w, fmt.Errorf("Delivery not found"))
+		return
+	}
+
+	if err := app.Devices.WebhookDeliveryRetry(delivery); err != nil {
+		app.HttpError(w, err, http.StatusConflict)
+		return
+	}
+
+	app.JsonResponse(w, delivery)
+}
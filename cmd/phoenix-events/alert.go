@@ -0,0 +1,297 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/cmodk/phoenix"
+)
+
+var (
+	alert_check_interval = flag.Duration("alert-check-interval", 30*time.Second, "Interval for checking missing data, offline devices and pending alerts")
+)
+
+// evaluateStreamAlerts evaluates the threshold and rate rules of the updated
+// stream
+func evaluateStreamAlerts(e phoenix.StreamUpdated) error {
+	if e.DeviceId == 0 || e.Timestamp == nil {
+		return nil
+	}
+
+	value, ok := streamFloat(e.Value)
+	if !ok {
+		return nil
+	}
+
+	d, err := app.Devices.Get(phoenix.DeviceCriteria{Id: e.DeviceId})
+	if err != nil {
+		return err
+	}
+
+	rules, err := d.AlertRules(phoenix.AlertConditionThreshold, phoenix.AlertConditionRate)
+	if err != nil {
+		return err
+	}
+
+	for i := range rules {
+		r := &rules[i]
+		if r.Stream == nil || *r.Stream != e.Code {
+			continue
+		}
+
+		breached := false
+		switch r.Condition {
+		case phoenix.AlertConditionThreshold:
+			breached = r.Compare(value)
+		case phoenix.AlertConditionRate:
+			previous, previous_timestamp, err := d.AlertRuleSample(r, value, *e.Timestamp)
+			if err != nil {
+				return err
+			}
+
+			if previous == nil {
+				continue
+			}
+
+			seconds := e.Timestamp.Sub(*previous_timestamp).Seconds()
+			if seconds <= 0 {
+				continue
+			}
+
+			breached = r.Compare((value - *previous) / seconds)
+		}
+
+		//Server time, like the pending alerts fired by the monitor, so a late
+		//sample does not fire the rule right away
+		if err := updateAlert(d, r, breached, &value, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateAlert moves the alert of the rule on the device through pending,
+// firing and resolved. The breach started at timestamp, the duration of the
+// rule is counted from there on the server clock.
+func updateAlert(d *phoenix.Device, r *phoenix.AlertRule, breached bool, value *float64, timestamp time.Time) error {
+	a, err := d.AlertOpen(r)
+	if err != nil {
+		return err
+	}
+
+	if !breached {
+		if a == nil {
+			return nil
+		}
+
+		return resolveAlert(d, r, a, value)
+	}
+
+	if a == nil {
+		a = &phoenix.Alert{
+			RuleId:  r.Id,
+			Status:  phoenix.AlertStatusPending,
+			Value:   value,
+			Started: timestamp,
+		}
+
+		if err := d.AlertInsert(a); err != nil {
+			return err
+		}
+	}
+
+	a.Value = value
+	if a.Status == phoenix.AlertStatusPending && time.Since(a.Started) >= r.Duration() {
+		return fireAlert(d, r, a)
+	}
+
+	return d.AlertUpdate(a)
+}
+
+// fireAlert fires the pending alert, AlertFiring is only published by the
+// instance which moved the alert to firing
+func fireAlert(d *phoenix.Device, r *phoenix.AlertRule, a *phoenix.Alert) error {
+	fired, err := d.AlertFire(a)
+	if err != nil {
+		return err
+	}
+
+	if !fired {
+		return nil
+	}
+
+	log.WithField("device", d.Guid).WithField("rule", r.Name).WithField("value", a.Value).Warning("Alert firing")
+
+	return app.Event.Publish(phoenix.AlertFiring{
+		AlertId:    a.Id,
+		RuleId:     r.Id,
+		Rule:       r.Name,
+		Condition:  r.Condition,
+		DeviceId:   d.Id,
+		DeviceGuid: d.Guid,
+		Stream:     r.Stream,
+		Value:      a.Value,
+		Started:    a.Started,
+		Fired:      *a.Fired,
+	})
+}
+
+// resolveAlert closes the alert, AlertResolved is only published for alerts
+// which have fired, by the instance which resolved the alert
+func resolveAlert(d *phoenix.Device, r *phoenix.AlertRule, a *phoenix.Alert, value *float64) error {
+	fired := a.Status != phoenix.AlertStatusPending
+
+	if value != nil {
+		a.Value = value
+	}
+
+	resolved, err := d.AlertResolve(a)
+	if err != nil {
+		return err
+	}
+
+	if !resolved || !fired {
+		return nil
+	}
+
+	log.WithField("device", d.Guid).WithField("rule", r.Name).Info("Alert resolved")
+
+	return app.Event.Publish(phoenix.AlertResolved{
+		AlertId:    a.Id,
+		RuleId:     r.Id,
+		Rule:       r.Name,
+		Condition:  r.Condition,
+		DeviceId:   d.Id,
+		DeviceGuid: d.Guid,
+		Stream:     r.Stream,
+		Value:      a.Value,
+		Fired:      *a.Fired,
+		Resolved:   *a.Resolved,
+	})
+}
+
+// alertMonitor fires pending alerts when their duration has passed and
+// evaluates the rules which do not depend on stream updates
+func alertMonitor() {
+	for {
+		if err := alertCheck(); err != nil {
+			log.WithField("error", err).Error("Error checking alerts")
+		}
+
+		if !app.Sleep(*alert_check_interval) {
+			return
+		}
+	}
+}
+
+// alertCheck checks the rules on every device, an error on one rule or
+// device is logged and the others are still checked
+func alertCheck() error {
+	if err := alertPendingCheck(); err != nil {
+		log.WithField("error", err).Error("Error checking pending alerts")
+	}
+
+	rules, err := app.Devices.AlertRuleList(phoenix.AlertRuleCriteria{Enabled: true})
+	if err != nil {
+		return err
+	}
+
+	for i := range rules {
+		r := &rules[i]
+		if r.Condition != phoenix.AlertConditionMissing && r.Condition != phoenix.AlertConditionOffline {
+			continue
+		}
+
+		ds, err := app.Devices.AlertRuleDevices(r)
+		if err != nil {
+			log.WithField("error", err).WithField("rule", r.Name).Error("Error listing devices of alert rule")
+			continue
+		}
+
+		for j := range *ds {
+			d := &(*ds)[j]
+			if !r.Applies(d) {
+				continue
+			}
+
+			breached, since, err := alertConditionCheck(d, r)
+			if err == nil {
+				err = updateAlert(d, r, breached, nil, since)
+			}
+			if err != nil {
+				log.WithField("error", err).WithField("rule", r.Name).WithField("device", d.Guid).Error("Error checking alert rule")
+			}
+		}
+	}
+
+	return nil
+}
+
+// alertConditionCheck returns if a missing data or offline rule is breached
+// and since when
+func alertConditionCheck(d *phoenix.Device, r *phoenix.AlertRule) (bool, time.Time, error) {
+	now := time.Now().UTC()
+
+	if r.Condition == phoenix.AlertConditionOffline {
+		if d.Online || d.StatusChanged == nil {
+			return false, now, nil
+		}
+
+		return true, *d.StatusChanged, nil
+	}
+
+	s, err := d.StreamGet(phoenix.StreamCriteria{Code: *r.Stream})
+	if err != nil || s.Timestamp == nil {
+		//A stream never seen is not missing
+		return false, now, nil
+	}
+
+	if now.Sub(*s.Timestamp) < r.Duration() {
+		return false, now, nil
+	}
+
+	return true, *s.Timestamp, nil
+}
+
+// alertPendingCheck fires the threshold and rate alerts which have been
+// pending for the duration of their rule without any new stream update. An
+// error on one alert is logged and the others are still checked.
+func alertPendingCheck() error {
+	alerts, err := app.Devices.AlertPendingList()
+	if err != nil {
+		return err
+	}
+
+	for i := range alerts {
+		a := &alerts[i]
+
+		l := log.WithField("alert", a.Id)
+
+		r, err := app.Devices.AlertRuleGet(phoenix.AlertRuleCriteria{Id: a.RuleId})
+		if err != nil {
+			l.WithField("error", err).Error("Error getting rule of pending alert")
+			continue
+		}
+
+		if !r.Enabled || time.Since(a.Started) < r.Duration() {
+			continue
+		}
+
+		if r.Condition != phoenix.AlertConditionThreshold && r.Condition != phoenix.AlertConditionRate {
+			continue
+		}
+
+		d, err := app.Devices.Get(phoenix.DeviceCriteria{Id: a.DeviceId})
+		if err != nil {
+			l.WithField("error", err).Error("Error getting device of pending alert")
+			continue
+		}
+
+		if err := fireAlert(d, r, a); err != nil {
+			l.WithField("error", err).Error("Error firing pending alert")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/cmodk/phoenix"
+)
+
+// streamFloat returns the numeric value of a stream, values read from
+// device_streams are the raw column
+func streamFloat(value interface{}) (float64, bool) {
+	switch t := value.(type) {
+	case float64:
+		return t, true
+	case []byte:
+		var f float64
+		if err := json.Unmarshal(t, &f); err != nil {
+			return 0, false
+		}
+		return f, true
+	case string:
+		f, err := strconv.ParseFloat(t, 64)
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// updateDerivedStreams computes the derived streams which have the updated
+// stream as input. The derived value is published as a StreamUpdated, so it
+// is saved like any other stream and can be input to other derived streams.
+func updateDerivedStreams(e phoenix.StreamUpdated) error {
+	if e.DeviceId == 0 || e.Timestamp == nil {
+		return nil
+	}
+
+	value, ok := streamFloat(e.Value)
+	if !ok {
+		return nil
+	}
+
+	d, err := app.Devices.Get(phoenix.DeviceCriteria{Id: e.DeviceId})
+	if err != nil {
+		return err
+	}
+
+	derived, err := d.DerivedStreamList()
+	if err != nil {
+		return err
+	}
+
+	if len(derived) == 0 {
+		return nil
+	}
+
+	if err := phoenix.CheckDerivedStreamCycles(derived); err != nil {
+		log.WithField("device", d.Guid).WithField("error", err).Error("Not computing derived streams")
+		return nil
+	}
+
+	for i := range derived {
+		s := &derived[i]
+
+		inputs, err := s.Inputs()
+		if err != nil {
+			return err
+		}
+
+		if !contains(inputs, e.Code) {
+			continue
+		}
+
+		values, aligned, err := derivedStreamInputs(d, s, inputs, e.Code, value, *e.Timestamp)
+		if err != nil {
+			return err
+		}
+
+		if !aligned {
+			log.WithField("device", d.Guid).WithField("stream", s.Code).Debug("Derived stream inputs not aligned")
+			continue
+		}
+
+		expression, err := s.Parse()
+		if err != nil {
+			return err
+		}
+
+		result, err := expression.Eval(values)
+		if err != nil {
+			log.WithField("device", d.Guid).WithField("stream", s.Code).WithField("error", err).Warning("Error computing derived stream")
+			continue
+		}
+
+		update := phoenix.Stream{
+			Code:      s.Code,
+			Timestamp: e.Timestamp,
+			Value:     result,
+		}
+
+		if err := d.StreamUpdate(update); err != nil {
+			return err
+		}
+
+		update.DeviceId = d.Id
+		update.DeviceGuid = &(d.Guid)
+
+		if err := app.Event.Publish(phoenix.StreamUpdated(update)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// derivedStreamInputs collects the last values of the inputs, aligned is
+// false if an input is missing or outside the window of the updated stream
+func derivedStreamInputs(d *phoenix.Device, s *phoenix.DerivedStream, inputs []string, code string, value float64, timestamp time.Time) (map[string]float64, bool, error) {
+	values := map[string]float64{code: value}
+	window := s.WindowDuration()
+
+	for _, input := range inputs {
+		if input == code {
+			continue
+		}
+
+		current, err := d.StreamGet(phoenix.StreamCriteria{Code: input})
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		if current.Timestamp == nil {
+			return nil, false, nil
+		}
+
+		skew := timestamp.Sub(*current.Timestamp)
+		if skew < 0 {
+			skew = -skew
+		}
+
+		if skew > window {
+			return nil, false, nil
+		}
+
+		f, ok := streamFloat(current.Value)
+		if !ok {
+			return nil, false, nil
+		}
+
+		values[input] = f
+	}
+
+	return values, true, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
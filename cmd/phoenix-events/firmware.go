@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/cmodk/phoenix"
+)
+
+// firmwareProgress is the parameters of the "firmware" notification devices
+// send while downloading and installing an update
+type firmwareProgress struct {
+	CommandId uint64 `json:"command_id"`
+	Status    string `json:"status"`
+	Progress  int    `json:"progress"`
+	Version   string `json:"version"`
+	Error     string `json:"error"`
+}
+
+func updateFirmwareProgress(e phoenix.DeviceNotificationCreated) error {
+	if e.Notification != "firmware" {
+		return nil
+	}
+
+	var p firmwareProgress
+	if err := json.Unmarshal(e.Parameters, &p); err != nil {
+		log.WithField("error", err).Warning("Ignoring bad firmware notification")
+		return nil
+	}
+
+	switch p.Status {
+	case phoenix.FirmwareUpdateDownloading, phoenix.FirmwareUpdateInstalling, phoenix.FirmwareUpdateSucceeded, phoenix.FirmwareUpdateFailed:
+	default:
+		log.WithField("status", p.Status).Warning("Ignoring unknown firmware update status")
+		return nil
+	}
+
+	d, err := app.Devices.Get(phoenix.DeviceCriteria{Id: e.DeviceId})
+	if err != nil {
+		return err
+	}
+
+	u, err := d.FirmwareUpdateGet(phoenix.DeviceFirmwareUpdateCriteria{CommandId: p.CommandId})
+	if err == sql.ErrNoRows {
+		log.WithField("device", d.Guid).WithField("command", p.CommandId).Warning("Firmware notification for unknown update")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	l := log.WithField("device", d.Guid).WithField("command", p.CommandId)
+
+	if phoenix.FirmwareUpdateFinished(u.Status) {
+		//Saving the firmware of the device may have failed the last time
+		if u.Status == phoenix.FirmwareUpdateSucceeded && p.Status == phoenix.FirmwareUpdateSucceeded {
+			return updateDeviceFirmware(d, u)
+		}
+
+		l.WithField("status", p.Status).Warning("Ignoring firmware notification for finished update")
+		return nil
+	}
+
+	u.Status = p.Status
+	u.Progress = p.Progress
+	if len(p.Error) > 0 {
+		u.Error = &p.Error
+	}
+
+	if u.Status == phoenix.FirmwareUpdateSucceeded {
+		f, err := app.Devices.FirmwareGet(phoenix.FirmwareCriteria{Id: u.FirmwareId})
+		if err != nil {
+			return err
+		}
+
+		//Redelivering the notification does not change the version, so the
+		//update is failed instead
+		if len(p.Version) > 0 && p.Version != f.Version {
+			mismatch := fmt.Sprintf("Device reports version %s after installing %s", p.Version, f.Version)
+			l.Warning(mismatch)
+
+			u.Status = phoenix.FirmwareUpdateFailed
+			u.Error = &mismatch
+		} else {
+			u.Progress = 100
+		}
+	}
+
+	//Another notification may have finished the update in the meantime
+	saved, err := d.FirmwareUpdateProgress(u)
+	if err != nil {
+		return err
+	}
+
+	if !saved {
+		l.WithField("status", u.Status).Warning("Ignoring firmware notification for finished update")
+		return nil
+	}
+
+	l.WithField("status", u.Status).WithField("progress", u.Progress).Info("Firmware update progress")
+
+	if u.Status != phoenix.FirmwareUpdateSucceeded {
+		return nil
+	}
+
+	return updateDeviceFirmware(d, u)
+}
+
+// updateDeviceFirmware saves the firmware of the succeeded update on the
+// device
+func updateDeviceFirmware(d *phoenix.Device, u *phoenix.DeviceFirmwareUpdate) error {
+	f, err := app.Devices.FirmwareGet(phoenix.FirmwareCriteria{Id: u.FirmwareId})
+	if err != nil {
+		return err
+	}
+
+	if err := d.Update("firmware_family", f.Family); err != nil {
+		return err
+	}
+
+	return d.Update("firmware_version", f.Version)
+}
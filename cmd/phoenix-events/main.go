@@ -3,11 +3,10 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"reflect"
-	"time"
+	"strconv"
 
-	"github.com/cmodk/go-simpleflake"
 	"github.com/cmodk/phoenix"
+	phoenix_app "github.com/cmodk/phoenix/app"
 	"github.com/sirupsen/logrus"
 )
 
@@ -25,34 +24,48 @@ func main() {
 		app.Logger.Level = logrus.DebugLevel
 	}
 
-	app.HandleEvent(phoenix.DeviceNotificationCreated{}, updateLastKnownValue)
-	app.HandleEvent(phoenix.DeviceNotificationCreated{}, splitBatchNotifications)
-	app.HandleEvent(phoenix.StreamUpdated{}, saveSample)
-	app.HandleEvent(phoenix.StreamUpdated{}, phoenix.StringSave)
-	app.HandleEvent(phoenix.StreamUpdated{}, pipeEvents)
-	app.HandleEvent(phoenix.DeviceNotificationCreated{}, pipeEvents)
+	if err := checkStreamRangePolicy(); err != nil {
+		log.WithField("error", err).Fatal("Invalid flags")
+	}
 
-	go app.Command.Listen()
-	app.ListenEvents()
-}
+	if app.Config.Pipes == nil {
+		log.Warning("No pipes configured, piping to the legacy fawkes.events topic")
+	}
 
-func pipeEvents(event interface{}) error {
+	if err := loadPipes(configuredPipes(app.Config.Pipes)); err != nil {
+		log.WithField("error", err).Fatal("Invalid pipes")
+	}
 
-	topics := []string{
-		"fawkes.events",
+	phoenix.HandleEvent(app, "updateLastKnownValue", updateLastKnownValue)
+	phoenix.HandleEvent(app, "splitBatchNotifications", splitBatchNotifications)
+	phoenix.HandleEvent(app, "updateFirmwareProgress", updateFirmwareProgress)
+	phoenix.HandleEvent(app, "updateReportedConfiguration", updateReportedConfiguration)
+	phoenix.HandleEvent(app, "saveSample", saveSample)
+	phoenix.HandleEvent(app, "updateDerivedStreams", updateDerivedStreams)
+	phoenix.HandleEvent(app, "evaluateStreamAlerts", evaluateStreamAlerts)
+	phoenix.HandleEvent(app, "stringSave", phoenix.StringSave)
+	for _, event := range phoenix.Events() {
+		app.HandleEvent(event, "pipeEvents", pipeEvents)
 	}
 
-	app.Logger.WithField("event", event).WithField("type", reflect.TypeOf(event).String()).Debugf("Piping event")
-	for _, topic := range topics {
-		app.Event.PublishToTopic(topic, event)
+	if err := app.Event.SubscribeDeadLetters(saveDeadLetter); err != nil {
+		log.WithField("error", err).Fatal("Could not subscribe to dead letters")
 	}
 
-	return nil
+	app.Go(alertMonitor)
+	app.Go(pipeReloader)
+	app.Go(watchStreamMetadata)
+	go app.Command.Listen()
+	app.ListenEvents()
 }
 
-func splitBatchNotifications(event interface{}) error {
-	e := event.(phoenix.DeviceNotificationCreated)
+// saveDeadLetter keeps the dead letters of all the applications, for
+// inspection and replay
+func saveDeadLetter(dead phoenix_app.DeadLetter) error {
+	return app.Devices.EventDeadLetterInsert(phoenix.NewEventDeadLetter(dead))
+}
 
+func splitBatchNotifications(e phoenix.DeviceNotificationCreated) error {
 	if e.Notification != "streams" {
 		return nil
 	}
@@ -68,17 +81,20 @@ func splitBatchNotifications(event interface{}) error {
 		return err
 	}
 
-	for _, s := range streams {
+	for i, s := range streams {
+		//The time of the batch, so splitting it again gives the same timestamps
 		if s.Timestamp == nil || s.Timestamp.IsZero() {
-			now := time.Now()
-			s.Timestamp = &now
+			timestamp := e.Timestamp
+			s.Timestamp = &timestamp
 		}
 		log.WithField("stream", s).Infof("Code: %s, Value: %f, Timestamp: %s",
 			s.Code,
 			s.Value,
 			s.Timestamp)
 
-		id := simpleflake.Next()
+		//Derived from the batch, so splitting it again saves the same
+		//notifications
+		id := phoenix_app.DeriveEventId(e.Id, strconv.Itoa(i))
 
 		stream_data, err := json.Marshal(s)
 		if err != nil {
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cmodk/phoenix"
+	phoenix_app "github.com/cmodk/phoenix/app"
+	"github.com/cmodk/phoenix/pipe"
+)
+
+var (
+	pipe_reload_interval = flag.Duration("pipe-reload-interval", 30*time.Second, "Interval for reloading the pipes from the config, 0 disables reloading")
+
+	pipes      []pipe.Config
+	pipes_lock sync.RWMutex
+
+	//The pipe to fawkes events always had, used when the config has no pipes
+	legacyPipes = []pipe.Config{
+		{
+			Name:   "fawkes",
+			Topic:  "fawkes.events",
+			Events: []string{"stream.updated", "device.notification.created"},
+		},
+	}
+)
+
+// configuredPipes returns the pipes of the config, or the legacy pipes if
+// the config does not set any. An empty list in the config disables piping.
+func configuredPipes(configs []pipe.Config) []pipe.Config {
+	if configs == nil {
+		return legacyPipes
+	}
+
+	return configs
+}
+
+// pipeEventNames returns the registered and legacy names of the events,
+// pipes can use either
+func pipeEventNames() []string {
+	names := []string{}
+	for _, e := range phoenix.Events() {
+		et, err := app.Event.Type(e)
+		if err != nil {
+			continue
+		}
+		names = append(names, et.Name, et.Legacy)
+	}
+	return names
+}
+
+// loadPipes validates the pipes and replaces the running ones, the running
+// pipes are kept if any of the new ones are invalid
+func loadPipes(configs []pipe.Config) error {
+	names := pipeEventNames()
+	for _, c := range configs {
+		if err := c.Validate(names); err != nil {
+			return err
+		}
+	}
+
+	pipes_lock.Lock()
+	pipes = configs
+	pipes_lock.Unlock()
+
+	for _, c := range configs {
+		log.WithField("pipe", c.Name).WithField("topic", c.Topic).WithField("events", c.Events).Info("Loaded pipe")
+	}
+
+	return nil
+}
+
+func currentPipes() []pipe.Config {
+	pipes_lock.RLock()
+	defer pipes_lock.RUnlock()
+	return pipes
+}
+
+// pipeReloader reloads the pipes when the config file changes
+func pipeReloader() {
+	if *pipe_reload_interval == 0 {
+		return
+	}
+
+	for app.Sleep(*pipe_reload_interval) {
+		config, err := app.ReloadConfig()
+		if err != nil {
+			log.WithField("error", err).Error("Could not reload config")
+			continue
+		}
+
+		configs := configuredPipes(config.Pipes)
+		if reflect.DeepEqual(configs, currentPipes()) {
+			continue
+		}
+
+		log.Info("Pipes changed, reloading")
+		if err := loadPipes(configs); err != nil {
+			log.WithField("error", err).Error("Invalid pipes, keeping the running ones")
+		}
+	}
+}
+
+// pipeDevice returns the device of the event for the device filters, nil if
+// the event has no device
+func pipeDevice(event interface{}) (*pipe.Device, error) {
+	v := reflect.ValueOf(event)
+
+	c := phoenix.DeviceCriteria{}
+	if id := v.FieldByName("DeviceId"); id.IsValid() && id.Kind() == reflect.Uint64 {
+		c.Id = id.Uint()
+	}
+
+	if c.Id == 0 {
+		guid := v.FieldByName("DeviceGuid")
+		switch {
+		case !guid.IsValid():
+		case guid.Kind() == reflect.String:
+			c.Guid = guid.String()
+		case guid.Kind() == reflect.Ptr && !guid.IsNil():
+			c.Guid = guid.Elem().String()
+		}
+	}
+
+	if c.Id == 0 && c.Guid == "" {
+		return nil, nil
+	}
+
+	d, err := app.Devices.Get(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pipe.Device{Id: d.Id, Guid: d.Guid, TypeId: d.DeviceTypeId}, nil
+}
+
+func pipeEvents(event interface{}) error {
+	et, err := app.Event.Type(event)
+	if err != nil {
+		return err
+	}
+
+	var payload map[string]interface{}
+	var device *pipe.Device
+	device_loaded := false
+
+	//Piped events keep the id, so consumers can skip duplicates as well
+	id := phoenix_app.EventId(event)
+
+	for _, p := range currentPipes() {
+		if !p.MatchEvent(et.Name) && !p.MatchEvent(et.Legacy) {
+			continue
+		}
+
+		if p.HasDeviceFilter() {
+			if !device_loaded {
+				device, err = pipeDevice(event)
+				if err != nil {
+					return err
+				}
+				device_loaded = true
+			}
+
+			if device == nil || !p.MatchDevice(*device) {
+				continue
+			}
+		}
+
+		if payload == nil {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+
+			//Keep numbers as is, ids do not fit in a float64
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			if err := decoder.Decode(&payload); err != nil {
+				return err
+			}
+		}
+
+		msg, err := json.Marshal(p.Project(payload))
+		if err != nil {
+			return err
+		}
+
+		name := et.Legacy
+		if p.RegisteredNames {
+			name = et.Name
+		}
+
+		log.WithField("pipe", p.Name).WithField("topic", p.Topic).WithField("type", name).Debugf("Piping event")
+		if err := app.Event.PublishNamedMessageToTopic(p.Topic, name, et, id, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -8,9 +8,7 @@ import (
 	"github.com/cmodk/phoenix"
 )
 
-func updateLastKnownValue(event interface{}) error {
-	e := event.(phoenix.DeviceNotificationCreated)
-
+func updateLastKnownValue(e phoenix.DeviceNotificationCreated) error {
 	if e.Notification != "stream" {
 		//Not a stream, ignore
 		return nil
@@ -34,6 +32,15 @@ func updateLastKnownValue(event interface{}) error {
 		stream.Timestamp = &e.Timestamp
 	}
 
+	keep, err := applyStreamMetadata(d, &stream)
+	if err != nil {
+		return err
+	}
+
+	if !keep {
+		return nil
+	}
+
 	if err := d.StreamUpdate(stream); err != nil {
 		return err
 	}
@@ -45,9 +52,7 @@ func updateLastKnownValue(event interface{}) error {
 	return app.Event.Publish(phoenix.StreamUpdated(stream))
 }
 
-func saveSample(event interface{}) error {
-	e := event.(phoenix.StreamUpdated)
-
+func saveSample(e phoenix.StreamUpdated) error {
 	value, ok := e.Value.(float64)
 	if !ok {
 		app.Logger.WithField("stream", e).Debug("Cannot save string stream as sample")
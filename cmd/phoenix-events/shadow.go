@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/cmodk/phoenix"
+)
+
+// updateReportedConfiguration stores the configuration map sent by the device
+// in the config_reported notification as the reported shadow state
+func updateReportedConfiguration(e phoenix.DeviceNotificationCreated) error {
+	if e.Notification != phoenix.NotificationConfigReported {
+		return nil
+	}
+
+	var reported phoenix.ShadowState
+	if err := json.Unmarshal(e.Parameters, &reported); err != nil {
+		log.WithField("error", err).Warning("Ignoring bad config_reported notification")
+		return nil
+	}
+
+	if err := reported.Validate(); err != nil {
+		log.WithField("error", err).Warning("Ignoring bad config_reported notification")
+		return nil
+	}
+
+	d, err := app.Devices.Get(phoenix.DeviceCriteria{Id: e.DeviceId})
+	if err != nil {
+		return err
+	}
+
+	s, err := d.ShadowReport(reported)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("device", d.Guid).WithField("delta", s.Delta()).Debug("Reported configuration updated")
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cmodk/phoenix"
+)
+
+const (
+	//Store out of range values, only publish StreamValueOutOfRange
+	RangePolicyFlag = "flag"
+	//Drop out of range values after publishing StreamValueOutOfRange
+	RangePolicyReject = "reject"
+)
+
+var (
+	stream_range_policy = flag.String("stream-range-policy", RangePolicyFlag, "What to do with stream values outside the stream metadata: flag or reject")
+	stream_metadata_ttl = flag.Duration("stream-metadata-ttl", time.Minute, "How long stream metadata is cached, changes are picked up at once when redis is configured")
+
+	typeStreamsCache    = make(map[uint64]cachedTypeStreams)
+	deviceMetadataCache = make(map[uint64]cachedDeviceMetadata)
+	streamMetadataLock  sync.Mutex
+)
+
+type cachedTypeStreams struct {
+	streams []phoenix.DeviceTypeStream
+	fetched time.Time
+}
+
+type cachedDeviceMetadata struct {
+	metadata []phoenix.DeviceStreamMetadata
+	fetched  time.Time
+}
+
+func checkStreamRangePolicy() error {
+	switch *stream_range_policy {
+	case RangePolicyFlag, RangePolicyReject:
+		return nil
+	}
+
+	return fmt.Errorf("Unknown stream range policy: %s", *stream_range_policy)
+}
+
+// applyStreamMetadata transforms the value and validates it against the
+// stream metadata, returns false if the value should be dropped
+func applyStreamMetadata(d *phoenix.Device, s *phoenix.Stream) (bool, error) {
+	m, err := cachedStreamMetadata(d, s.Code)
+	if err != nil {
+		return false, err
+	}
+
+	//Downstream handlers get the metadata with the StreamUpdated event
+	s.Metadata = m
+	if m == nil {
+		return true, nil
+	}
+
+	raw := s.Value
+	s.Value, err = m.Transform(raw)
+	if err != nil {
+		log.WithField("device", d.Guid).WithField("stream", s.Code).WithField("value", raw).WithField("error", err).Error("Dropping value which cannot be transformed")
+		return false, nil
+	}
+
+	if m.RawStream != nil && len(m.Transforms) > 0 {
+		if err := saveRawValue(d, *m.RawStream, s.Timestamp, raw); err != nil {
+			return false, err
+		}
+	}
+
+	return checkStreamValue(d, s, m)
+}
+
+// cachedStreamMetadata resolves the metadata of the stream from the cached
+// streams of the device type and metadata of the device
+func cachedStreamMetadata(d *phoenix.Device, code string) (*phoenix.StreamMetadata, error) {
+	var type_streams []phoenix.DeviceTypeStream
+	if d.DeviceTypeId != nil {
+		streams, err := cachedTypeStreamList(*d.DeviceTypeId)
+		if err != nil {
+			return nil, err
+		}
+		type_streams = streams
+	}
+
+	device_metadata, err := cachedDeviceMetadataList(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return phoenix.ResolveStreamMetadata(type_streams, device_metadata, code), nil
+}
+
+func cachedTypeStreamList(device_type_id uint64) ([]phoenix.DeviceTypeStream, error) {
+	streamMetadataLock.Lock()
+	cached, ok := typeStreamsCache[device_type_id]
+	streamMetadataLock.Unlock()
+
+	if ok && time.Since(cached.fetched) < *stream_metadata_ttl {
+		return cached.streams, nil
+	}
+
+	fetched := time.Now()
+	streams, err := app.Devices.TypeStreams(device_type_id)
+	if err != nil {
+		return nil, err
+	}
+
+	streamMetadataLock.Lock()
+	typeStreamsCache[device_type_id] = cachedTypeStreams{streams, fetched}
+	streamMetadataLock.Unlock()
+
+	return streams, nil
+}
+
+func cachedDeviceMetadataList(d *phoenix.Device) ([]phoenix.DeviceStreamMetadata, error) {
+	streamMetadataLock.Lock()
+	cached, ok := deviceMetadataCache[d.Id]
+	streamMetadataLock.Unlock()
+
+	if ok && time.Since(cached.fetched) < *stream_metadata_ttl {
+		return cached.metadata, nil
+	}
+
+	fetched := time.Now()
+	device_metadata, err := d.DeviceStreamMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	streamMetadataLock.Lock()
+	deviceMetadataCache[d.Id] = cachedDeviceMetadata{device_metadata, fetched}
+	streamMetadataLock.Unlock()
+
+	return device_metadata, nil
+}
+
+func invalidateStreamMetadata(c phoenix.StreamMetadataChange) {
+	streamMetadataLock.Lock()
+	defer streamMetadataLock.Unlock()
+
+	if c.DeviceTypeId != 0 {
+		delete(typeStreamsCache, c.DeviceTypeId)
+	}
+
+	if c.DeviceId != 0 {
+		delete(deviceMetadataCache, c.DeviceId)
+	}
+}
+
+// watchStreamMetadata drops cached metadata as soon as it changes. Without
+// redis the cached metadata is used until it expires.
+func watchStreamMetadata() {
+	if app.Redis == nil {
+		log.Warningf("Redis not configured, stream metadata changes are picked up within %s", *stream_metadata_ttl)
+		return
+	}
+
+	sub := app.Redis.Subscribe(app.Context, phoenix.StreamMetadataChannel)
+	defer sub.Close()
+
+	changes := sub.Channel()
+	for {
+		select {
+		case <-app.Context.Done():
+			return
+		case msg, ok := <-changes:
+			if !ok {
+				return
+			}
+
+			var c phoenix.StreamMetadataChange
+			if err := json.Unmarshal([]byte(msg.Payload), &c); err != nil {
+				log.WithField("error", err).Error("Ignoring bad stream metadata change")
+				continue
+			}
+
+			invalidateStreamMetadata(c)
+		}
+	}
+}
+
+func saveRawValue(d *phoenix.Device, code string, timestamp *time.Time, value interface{}) error {
+	raw := phoenix.Stream{
+		Code:      code,
+		Timestamp: timestamp,
+		Value:     value,
+	}
+
+	if err := d.StreamUpdate(raw); err != nil {
+		return err
+	}
+
+	raw.DeviceId = d.Id
+	raw.DeviceGuid = &(d.Guid)
+
+	return app.Event.Publish(phoenix.StreamUpdated(raw))
+}
+
+// checkStreamValue validates the value against the stream metadata, returns
+// false if the value should be dropped
+func checkStreamValue(d *phoenix.Device, s *phoenix.Stream, m *phoenix.StreamMetadata) (bool, error) {
+	check_err := m.Check(s.Value)
+	if check_err == nil {
+		return true, nil
+	}
+
+	rejected := *stream_range_policy == RangePolicyReject
+	log.WithField("device", d.Guid).WithField("stream", s.Code).WithField("value", s.Value).WithField("rejected", rejected).Warningf("Stream value out of range: %s", check_err)
+
+	if err := app.Event.Publish(phoenix.StreamValueOutOfRange{
+		DeviceId:   d.Id,
+		DeviceGuid: d.Guid,
+		Stream:     s.Code,
+		Value:      s.Value,
+		Timestamp:  *s.Timestamp,
+		Reason:     check_err.Error(),
+		Rejected:   rejected,
+	}); err != nil {
+		return false, err
+	}
+
+	return !rejected, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/cmodk/phoenix"
+	"github.com/cmodk/phoenix/app"
+)
+
+var (
+	certificate_new_root = flag.Bool("new-root", false, "Rotate the root CA as well as the intermediate")
+	dry_run              = flag.Bool("dry-run", false, "Only list what would be done")
+)
+
+// certificateRotate replaces the intermediate CA. Previous CAs stay in the
+// trust bundle until certificate-prune-bundle is run.
+func certificateRotate() error {
+	if err := app.RotateCertificates(*certificate_new_root); err != nil {
+		return err
+	}
+
+	log.Printf("Certificates rotated, update the phoenix-certificates secret and run certificate-reissue\n")
+	return nil
+}
+
+// staleCertificates returns the active device certificates not issued by
+// the current CA
+func staleCertificates() ([]phoenix.DeviceCertificateExpiry, error) {
+	if err := ph.LoadCertificates(false); err != nil {
+		return nil, err
+	}
+
+	certificates, err := ph.Devices.CertificateActiveList()
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []phoenix.DeviceCertificateExpiry
+	for _, c := range certificates {
+		if len(*device_guid) > 0 && c.DeviceGuid != *device_guid {
+			continue
+		}
+
+		if !c.IssuedBy(ph.CACertificate) {
+			stale = append(stale, c)
+		}
+	}
+
+	return stale, nil
+}
+
+// certificateReissue asks every device with a certificate from a previous
+// CA to renew it
+func certificateReissue() error {
+	stale, err := staleCertificates()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%d devices need a certificate from %s\n", len(stale), ph.CACertificate.Subject.CommonName)
+
+	for _, c := range stale {
+		log.Printf("%s: serial %s expires %s\n", c.DeviceGuid, c.Serial, c.NotAfter)
+		if *dry_run {
+			continue
+		}
+
+		//Marking the certificate makes phoenix-mqtt repeat the request when
+		//the device comes online
+		if _, err := ph.Devices.CertificateExpiryNotified(&c.DeviceCertificate); err != nil {
+			return err
+		}
+
+		if err := ph.Event.Publish(phoenix.DeviceCertificateReissue{
+			DeviceId:   c.DeviceId,
+			DeviceGuid: c.DeviceGuid,
+			Serial:     c.Serial,
+			NotAfter:   c.NotAfter,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// certificatePruneBundle removes the previous CAs from the trust bundle once
+// no device depends on them
+func certificatePruneBundle() error {
+	stale, err := staleCertificates()
+	if err != nil {
+		return err
+	}
+
+	if len(stale) > 0 {
+		return fmt.Errorf("%d devices still use a certificate from a previous CA, run certificate-reissue", len(stale))
+	}
+
+	if *dry_run {
+		return nil
+	}
+
+	if err := app.PruneTrustBundle(); err != nil {
+		return err
+	}
+
+	log.Printf("Trust bundle pruned, update the phoenix-certificates secret\n")
+	return nil
+}
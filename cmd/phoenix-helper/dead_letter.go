@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cmodk/phoenix"
+)
+
+var (
+	dead_letter_id      = flag.Uint64("dead-letter", 0, "Dead letter id")
+	dead_letter_handler = flag.String("handler", "", "Only dead letters of the event handler")
+	dead_letter_message = flag.String("message", "", "File with the edited json message of the dead letter")
+)
+
+func deadLetterCriteria() phoenix.EventDeadLetterCriteria {
+	return phoenix.EventDeadLetterCriteria{
+		Id:      *dead_letter_id,
+		Event:   event_arg,
+		Handler: *dead_letter_handler,
+	}
+}
+
+func deadLetterList() error {
+	dead, err := ph.Devices.EventDeadLetterList(deadLetterCriteria())
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dead {
+		replayed := "never"
+		if d.Replayed != nil {
+			replayed = d.Replayed.String()
+		}
+
+		log.Printf("%d: %s v%d from %s %s after %d attempts at %s, replayed %s\n", d.Id, d.Event, d.Version, d.Application, d.Handler, d.Attempts, d.Failed, replayed)
+		log.Printf("  Error: %s\n", d.Error)
+		log.Printf("  Message: %s\n", d.Message)
+	}
+
+	return nil
+}
+
+// deadLetterReplay replays the selected dead letter, or all the dead letters
+// matching -event and -handler which have not been replayed. Without
+// -dead-letter, -event or -handler nothing is replayed.
+func deadLetterReplay() error {
+	dead, err := ph.Devices.EventDeadLetterReplayList(deadLetterCriteria())
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dead {
+		log.Printf("Replaying %d: %s for %s %s\n", d.Id, d.Event, d.Application, d.Handler)
+		if *dry_run {
+			continue
+		}
+
+		if err := ph.Devices.EventDeadLetterReplay(&d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deadLetterEdit replaces the message of a dead letter, to fix it before it
+// is replayed
+func deadLetterEdit() error {
+	if *dead_letter_id == 0 || len(*dead_letter_message) == 0 {
+		return fmt.Errorf("Editing needs -dead-letter and -message")
+	}
+
+	d, err := ph.Devices.EventDeadLetterGet(phoenix.EventDeadLetterCriteria{Id: *dead_letter_id})
+	if err != nil {
+		return err
+	}
+
+	message, err := ioutil.ReadFile(*dead_letter_message)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Message of %d: %s -> %s\n", d.Id, d.Message, message)
+	if *dry_run {
+		return nil
+	}
+
+	d.Message = string(message)
+	return ph.Devices.EventDeadLetterUpdate(d)
+}
@@ -6,6 +6,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -57,6 +59,12 @@ var (
 		"device-migrate-data":                       PhoenixCommand{deviceMigrateData, true},
 		"device-samples-schedule-average":           PhoenixCommand{deviceSampleScheduleAverage, true},
 		"device-stream-string-reupdate":             PhoenixCommand{deviceStreamStringReUpdate, true},
+		"certificate-rotate":                        PhoenixCommand{certificateRotate, false},
+		"certificate-reissue":                       PhoenixCommand{certificateReissue, true},
+		"certificate-prune-bundle":                  PhoenixCommand{certificatePruneBundle, true},
+		"dead-letter-list":                          PhoenixCommand{deadLetterList, true},
+		"dead-letter-replay":                        PhoenixCommand{deadLetterReplay, true},
+		"dead-letter-edit":                          PhoenixCommand{deadLetterEdit, true},
 	}
 )
 
@@ -108,9 +116,10 @@ func printCommands() {
 func helperLoop() error {
 	log.Printf("No command specified, loop for the sake of kubernetes\n")
 
-	for {
-		time.Sleep(time.Second * 60)
-	}
+	//Wait for kubernetes to stop the pod
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
 
 	return nil
 }
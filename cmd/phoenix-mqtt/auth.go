@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/cmodk/phoenix"
+	"github.com/cmodk/phoenix/protocol"
+)
+
+const (
+	//Devices must present a client certificate
+	AuthCertificate = "certificate"
+	//Devices must send their guid and token as username and password
+	AuthToken = "token"
+	//Devices without a client certificate must send guid and token
+	AuthAny = "any"
+)
+
+const (
+	connectRefusedV3 = 0x05 //Not authorized
+	connectRefusedV5 = 0x87 //Not authorized
+)
+
+// clientAuth returns the tls client authentication for the auth mode
+func clientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case AuthCertificate:
+		return tls.RequireAndVerifyClientCert, nil
+	case AuthToken:
+		return tls.NoClientCert, nil
+	case AuthAny:
+		return tls.VerifyClientCertIfGiven, nil
+	}
+
+	return tls.NoClientCert, fmt.Errorf("Unknown auth mode: %s", mode)
+}
+
+// authenticateConnect checks the credentials in the CONNECT packet. A
+// session already bound to a certificate may not claim another device.
+func (s *Session) authenticateConnect(connect protocol.Connect) error {
+	if s.authenticated() {
+		if connect.Username != nil && *connect.Username != s.DeviceGuid {
+			return fmt.Errorf("Username %s does not match certificate for %s", *connect.Username, s.DeviceGuid)
+		}
+		return nil
+	}
+
+	if !s.requireCredentials {
+		return nil
+	}
+
+	if connect.Username == nil || connect.Password == nil {
+		return fmt.Errorf("Missing username or password")
+	}
+
+	d, err := app.Devices.Get(phoenix.DeviceCriteria{Guid: *connect.Username})
+	if err != nil {
+		return fmt.Errorf("Unknown device %s: %v", *connect.Username, err)
+	}
+
+	if err := d.VerifyToken(string(connect.Password)); err != nil {
+		return err
+	}
+
+	return s.authenticate(d.Guid)
+}
+
+// refuseConnect tells the device it is not authorized, before the
+// connection is closed
+func (s *Session) refuseConnect(protocolLevel uint8) {
+	connack := []byte{0x20, 0x02, 0x00, connectRefusedV3}
+	if protocolLevel >= 5 {
+		connack = []byte{0x20, 0x03, 0x00, connectRefusedV5, 0x00}
+	}
+
+	if _, err := s.Conn.Write(connack); err != nil {
+		lg.WithField("error", err).Debug("Error refusing connect")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cmodk/go-mqtt"
+	"github.com/cmodk/go-simpleflake"
+	"github.com/cmodk/phoenix"
+	"github.com/cmodk/phoenix/protocol"
+)
+
+var (
+	dictionaries     = make(map[string]protocol.Dictionary)
+	dictionariesLock sync.RWMutex
+)
+
+func getDictionary(device_guid string) protocol.Dictionary {
+	dictionariesLock.RLock()
+	defer dictionariesLock.RUnlock()
+
+	return dictionaries[device_guid]
+}
+
+func setDictionary(device_guid string, dictionary protocol.Dictionary) {
+	dictionariesLock.Lock()
+	defer dictionariesLock.Unlock()
+
+	dictionaries[device_guid] = dictionary
+}
+
+func BatchHandler(s *mqtt.Server, msg mqtt.Message) error {
+	topic, err := protocol.ParseDeviceTopic(msg.Topic)
+	if err != nil {
+		return err
+	}
+	device_id := topic.Guid
+
+	header, err := protocol.DecodeFrameHeader(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	switch header.Type {
+	case protocol.FrameTypeDictionary:
+		dictionary, err := protocol.DecodeDictionary(msg.Payload)
+		if err != nil {
+			return err
+		}
+
+		log.Debugf("Dictionary for %s: %v\n", device_id, dictionary)
+		setDictionary(device_id, dictionary)
+		return nil
+
+	case protocol.FrameTypeBatch:
+		samples, err := protocol.DecodeBatch(msg.Payload, getDictionary(device_id))
+		if err != nil {
+			return err
+		}
+
+		streams := make([]phoenix.Stream, 0, len(samples))
+		for _, sample := range samples {
+			tm, err := sampleTimestamp(device_id, sample, header.Precision())
+			if err != nil {
+				return err
+			}
+			streams = append(streams, phoenix.Stream{
+				Code:      sample.Stream,
+				Timestamp: &tm,
+				Value:     sample.Value,
+			})
+		}
+
+		log.Debugf("Batch from %s with %d samples\n", device_id, len(streams))
+
+		raw_streams, err := json.Marshal(streams)
+		if err != nil {
+			return err
+		}
+
+		cmd := phoenix.DeviceNotificationCreate{
+			Id:           simpleflake.Next(),
+			DeviceGuid:   device_id,
+			Notification: "streams",
+			Timestamp:    time.Now().UTC(),
+			Parameters:   json.RawMessage(raw_streams),
+		}
+
+		return app.Command.Create(cmd)
+	}
+
+	return protocol.NewDecodeError("batch", protocol.ReasonUnknownFrameType, fmt.Errorf("unhandled frame type 0x%02x", header.Type))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/cmodk/go-simpleflake"
+	"github.com/cmodk/phoenix"
+)
+
+// deviceCertificateExpiring asks the device to request a new certificate
+func deviceCertificateExpiring(e phoenix.DeviceCertificateExpiring) error {
+	return sendCertificateRenew(e.DeviceGuid, e.NotAfter)
+}
+
+// deviceCertificateReissue asks the device to request a certificate from
+// the new CA
+func deviceCertificateReissue(e phoenix.DeviceCertificateReissue) error {
+	return sendCertificateRenew(e.DeviceGuid, e.NotAfter)
+}
+
+// certificateRenewPending resends the renewal request to devices coming
+// online, which have been notified but not renewed yet
+func certificateRenewPending(d *phoenix.Device) error {
+	c, err := d.CertificateActive()
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.ExpiryNotified == nil {
+		return nil
+	}
+
+	return sendCertificateRenew(d.Guid, c.NotAfter)
+}
+
+func sendCertificateRenew(device_guid string, not_after time.Time) error {
+	payload := CommandPayload{
+		Id:      simpleflake.Next(),
+		Tag:     CommandCertificateRenew,
+		Length:  8,
+		Payload: make([]byte, 8),
+		Qos:     &DefaultQos,
+	}
+	binary.BigEndian.PutUint64(payload.Payload, uint64(not_after.Unix()))
+
+	device_command_topic := fmt.Sprintf("/device/%s/command", device_guid)
+	lg.WithField("device", device_guid).WithField("not_after", not_after).Info("Requesting certificate renewal")
+	return mq.Publish(device_command_topic, *payload.Qos, false, payload.ToBytes())
+}
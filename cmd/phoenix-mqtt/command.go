@@ -1,23 +1,26 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"reflect"
 
 	"github.com/cmodk/phoenix"
+	"github.com/cmodk/phoenix/protocol"
 )
 
 const (
 	CommandConfigRead = iota + 1
 	CommandConfigWrite
-	CommandSystemReboot = 10000
+	CommandSystemReboot     = 10000
+	CommandCertificateRenew = 10001
+	CommandFirmwareUpdate   = 10002
 )
 
 const (
-	ConfigTypeString uint8 = iota
-	ConfigTypeInt
-	ConfigTypeDouble
+	ConfigTypeString = protocol.ValueTypeString
+	ConfigTypeInt    = protocol.ValueTypeInt
+	ConfigTypeDouble = protocol.ValueTypeDouble
 )
 
 var (
@@ -26,6 +29,7 @@ var (
 		{"config_write", commandConfigWrite},
 		{"config_read", commandConfigRead},
 		{"reboot", commandReboot},
+		{"firmware_update", commandFirmwareUpdate},
 	}
 )
 
@@ -82,9 +86,7 @@ func (cp *CommandPayload) ToBytes() []uint8 {
 	return bs
 }
 
-func deviceCommandCreated(event interface{}) error {
-	e := event.(phoenix.DeviceCommandCreated)
-
+func deviceCommandCreated(e phoenix.DeviceCommandCreated) error {
 	log.Debugf("E: %v\n", e)
 
 	command, err := deviceCommands.GetCommand(e.Command)
@@ -122,6 +124,9 @@ func deviceCommandCreated(event interface{}) error {
 }
 
 func commandConfigWrite(parameters *ConfigurationParameter) (*CommandPayload, error) {
+	if parameters == nil || parameters.Configuration == nil || parameters.Type == nil {
+		return nil, fmt.Errorf("Missing configuration or type for config_write")
+	}
 
 	conf := []byte(*parameters.Configuration)
 	conf_len := uint16(len(conf))
@@ -141,7 +146,7 @@ func commandConfigWrite(parameters *ConfigurationParameter) (*CommandPayload, er
 	case "double":
 		payload.Payload[0] = ConfigTypeDouble
 	default:
-		return nil, fmt.Errorf("Unknown type for config_write: %s", parameters.Type)
+		return nil, fmt.Errorf("Unknown type for config_write: %s", *parameters.Type)
 	}
 	payload.Payload[1] = uint8(conf_len >> 8)
 	payload.Payload[2] = uint8(conf_len & 0xff)
@@ -157,6 +162,9 @@ func commandConfigWrite(parameters *ConfigurationParameter) (*CommandPayload, er
 }
 
 func commandConfigRead(parameters *ConfigurationParameter) (*CommandPayload, error) {
+	if parameters == nil || parameters.Configuration == nil {
+		return nil, fmt.Errorf("Missing configuration for config_read")
+	}
 
 	conf := []byte(*parameters.Configuration)
 	conf_len := uint16(len(conf))
@@ -177,7 +185,7 @@ func commandConfigRead(parameters *ConfigurationParameter) (*CommandPayload, err
 	case "double":
 		configType = ConfigTypeDouble
 	default:
-		return nil, fmt.Errorf("Unknown type for config_read: %s", parameters.Type)
+		return nil, fmt.Errorf("Unknown type for config_read: %s", *parameters.Type)
 	}
 
 	payload.Payload[0] = configType
@@ -201,10 +209,53 @@ func commandReboot(parameters *ConfigurationParameter) (*CommandPayload, error)
 	return &payload, nil
 }
 
+func commandFirmwareUpdate(parameters *ConfigurationParameter) (*CommandPayload, error) {
+	if parameters == nil {
+		return nil, fmt.Errorf("Missing parameters for firmware_update")
+	}
+
+	var firmware phoenix.FirmwareUpdateParameters
+	if err := json.Unmarshal(parameters.Raw, &firmware); err != nil {
+		return nil, err
+	}
+
+	update := protocol.FirmwareUpdate{
+		Size: uint32(firmware.Size),
+		Url:  firmware.Url,
+	}
+
+	digest, err := hex.DecodeString(firmware.Sha256)
+	if err != nil || len(digest) != protocol.FirmwareDigestSize {
+		return nil, fmt.Errorf("Invalid firmware sha256: %s", firmware.Sha256)
+	}
+	copy(update.Sha256[:], digest)
+
+	update.Signature, err = hex.DecodeString(firmware.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid firmware signature: %s", err)
+	}
+
+	data, err := update.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := CommandPayload{
+		Tag:     CommandFirmwareUpdate,
+		Length:  uint16(len(data)),
+		Payload: data,
+	}
+
+	return &payload, nil
+}
+
 type ConfigurationParameter struct {
 	Configuration *string     `json:"configuration"`
 	Type          *string     `json:"type"`
 	Value         interface{} `json:"value"`
+
+	//The parameters as sent, for commands not about configuration
+	Raw json.RawMessage `json:"-"`
 }
 
 func ParseConfigurationParameters(parameters json.RawMessage) (*ConfigurationParameter, error) {
@@ -213,6 +264,7 @@ func ParseConfigurationParameters(parameters json.RawMessage) (*ConfigurationPar
 	if err := json.Unmarshal(parameters, &config); err != nil {
 		return nil, err
 	}
+	config.Raw = parameters
 
 	return &config, nil
 }
@@ -232,7 +284,7 @@ func (cp *ConfigurationParameter) ValuePayload() ([]byte, uint16, error) {
 		value = Float64Bytes(t)
 		value_len = 8
 	default:
-		return []byte{}, 0, fmt.Errorf("Unhandled configuration type: %s", reflect.TypeOf(t).String())
+		return []byte{}, 0, fmt.Errorf("Unhandled configuration type: %T", t)
 	}
 
 	return value, value_len, nil
@@ -10,8 +10,6 @@ import (
 	"math"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -19,6 +17,7 @@ import (
 	"github.com/cmodk/go-mqtt"
 	"github.com/cmodk/go-simpleflake"
 	"github.com/cmodk/phoenix"
+	"github.com/cmodk/phoenix/protocol"
 )
 
 var (
@@ -28,8 +27,9 @@ var (
 
 	mq *mqtt.Server
 
-	no_tls = flag.Bool("disable-tls", false, "Disable tls")
-	debug  = flag.Bool("debug", false, "Enable debug information")
+	no_tls    = flag.Bool("disable-tls", false, "Disable tls")
+	auth_mode = flag.String("auth", AuthCertificate, "Device authentication: certificate, token (username/password) or any")
+	debug     = flag.Bool("debug", false, "Enable debug information")
 )
 
 func main() {
@@ -41,32 +41,50 @@ func main() {
 		app.Logger.Level = logrus.WarnLevel
 	}
 
+	if _, err := protocol.ParsePrecision(*timestamp_precision); err != nil {
+		panic(err)
+	}
+
+	if _, err := clientAuth(*auth_mode); err != nil {
+		panic(err)
+	}
+
+	var tlsConfig *tls.Config
 	if *no_tls == false {
-		tls := NewTLSConfig()
+		tlsConfig = NewTLSConfig(*auth_mode)
+	}
 
-		mq = mqtt.NewServer(tls)
-	} else {
-		mq = mqtt.NewServer(nil)
+	//Connections are accepted by listen, so the server never uses the tls config
+	mq = mqtt.NewServer(nil)
+	if err := mq.Subscribe("/device/+/sample", 2, withFrameValidation(SampleHandler)); err != nil {
+		panic(err)
 	}
-	if err := mq.Subscribe("/device/+/sample", 2, SampleHandler); err != nil {
+
+	if err := mq.Subscribe("/device/+/batch", 2, withFrameValidation(BatchHandler)); err != nil {
 		panic(err)
 	}
 
-	if err := mq.Subscribe("/device/+/status", 2, StatusHandler); err != nil {
+	if err := mq.Subscribe("/device/+/status", 2, withFrameValidation(StatusHandler)); err != nil {
 		panic(err)
 	}
 
-	if err := mq.Subscribe("/device/+/notification", 2, NotificationHandler); err != nil {
+	if err := mq.Subscribe("/device/+/notification", 2, withFrameValidation(NotificationHandler)); err != nil {
 		panic(err)
 	}
 
-	if err := mq.Subscribe("/device/+/command/+", 2, CommandResponseHandler); err != nil {
+	if err := mq.Subscribe("/device/+/command/+", 2, withFrameValidation(CommandResponseHandler)); err != nil {
 		panic(err)
 	}
 
-	app.HandleEvent(phoenix.DeviceCommandCreated{}, deviceCommandCreated)
+	phoenix.HandleEvent(app, "deviceCommandCreated", deviceCommandCreated)
+	phoenix.HandleEvent(app, "deviceCertificateRevoked", deviceCertificateRevoked)
+	phoenix.HandleEvent(app, "deviceCertificateExpiring", deviceCertificateExpiring)
+	phoenix.HandleEvent(app, "deviceCertificateReissue", deviceCertificateReissue)
+	phoenix.HandleEvent(app, "deviceShadowUpdated", deviceShadowUpdated)
 
-	go mq.Run()
+	app.Get("/frames/rejected", rejectedFramesHandler)
+
+	go listen(tlsConfig)
 
 	//Need seperate applications names for nsq
 	application_name := filepath.Base(os.Args[0])
@@ -81,13 +99,19 @@ func main() {
 
 	app.Run()
 }
-func NewTLSConfig() *tls.Config {
+func NewTLSConfig(auth_mode string) *tls.Config {
+	client_auth, err := clientAuth(auth_mode)
+	if err != nil {
+		panic(err)
+	}
+
 	if err := app.LoadCertificates(false); err != nil {
 		panic(err)
 	}
 
-	certpool := x509.NewCertPool()
-	certpool.AddCert(app.CACertificate)
+	//Trust every CA in the bundle, so devices issued by the previous CA
+	//keep working while a CA rotation is in progress
+	certpool := app.TrustBundle
 
 	for _, s := range certpool.Subjects() {
 		log.Println(string(s))
@@ -113,7 +137,7 @@ func NewTLSConfig() *tls.Config {
 		// ClientAuth = whether to request cert from server.
 		// Since the server is set up for SSL, this happens
 		// anyways.
-		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientAuth: client_auth,
 		// ClientCAs = certs used to validate client cert.
 		ClientCAs: certpool,
 		// InsecureSkipVerify = verify that cert contents
@@ -126,10 +150,6 @@ func NewTLSConfig() *tls.Config {
 }
 
 func SampleHandler(s *mqtt.Server, msg mqtt.Message) error {
-	var value float64
-	var sb strings.Builder
-	var stream string
-
 	payload := msg.Payload
 
 	if log.Level == logrus.DebugLevel {
@@ -139,42 +159,33 @@ func SampleHandler(s *mqtt.Server, msg mqtt.Message) error {
 		}
 		log.Debug(debugMessage)
 	}
-	unix_time := binary.LittleEndian.Uint64(payload[0:8])
-	value = Float64FromBytes(payload[8:16])
 
-	for i := 16; i < len(payload); i++ {
-		sb.WriteByte(payload[i])
-		if payload[i] == 0x00 {
-			break
-		}
+	//Get device id
+	topic, err := protocol.ParseDeviceTopic(msg.Topic)
+	if err != nil {
+		return err
 	}
+	device_id := topic.Guid
 
-	stream = sb.String()
+	sample, err := protocol.DecodeSample(payload)
+	if err != nil {
+		return err
+	}
 
 	log.Debugf("TOPIC: %s\n", msg.Topic)
-	log.Debugf("MSG: %s -> %d -> %f\n", stream, unix_time, value)
-
-	//Get device id
-	topic := strings.Split(msg.Topic, "/")
-	device_id := topic[2]
-
-	tm := time.Time{}
-	if unix_time > 0 {
-		//Need the milliseconds
-		ms := int64(unix_time % 1000)
+	log.Debugf("MSG: %s -> %d -> %f\n", sample.Stream, sample.Timestamp, sample.Value)
 
-		s := int64(unix_time / 1000)
-		tm = time.Unix(s, ms)
-	} else {
-		tm = time.Now()
+	tm, err := sampleTimestamp(device_id, sample, "")
+	if err != nil {
+		return err
 	}
 
-	log.Debugf("%s -> %s -> %s -> %f\n", device_id, stream, tm, value)
+	log.Debugf("%s -> %s -> %s -> %f\n", device_id, sample.Stream, tm, sample.Value)
 
 	raw_stream, err := json.Marshal(phoenix.Stream{
-		Code:      stream,
+		Code:      sample.Stream,
 		Timestamp: &tm,
-		Value:     value,
+		Value:     sample.Value,
 	})
 	if err != nil {
 		return err
@@ -196,8 +207,11 @@ func StatusHandler(server *mqtt.Server, msg mqtt.Message) error {
 
 	log.Printf("\n\n STATUS HANDLER \n\n")
 	//Get device id
-	topic := strings.Split(msg.Topic, "/")
-	device_id := topic[2]
+	topic, err := protocol.ParseDeviceTopic(msg.Topic)
+	if err != nil {
+		return err
+	}
+	device_id := topic.Guid
 
 	//Find device
 	d, err := app.Devices.Get(phoenix.DeviceCriteria{
@@ -220,6 +234,14 @@ func StatusHandler(server *mqtt.Server, msg mqtt.Message) error {
 		if err := d.UpdateOnlineStatus(true); err != nil {
 			return err
 		}
+
+		if err := certificateRenewPending(d); err != nil {
+			lg.WithField("device_id", device_id).WithField("error", err).Error("Error checking certificate renewal")
+		}
+
+		if err := shadowSync(d); err != nil {
+			lg.WithField("device_id", device_id).WithField("error", err).Error("Error sending shadow delta")
+		}
 	default:
 		lg.WithField("device_id", device_id).WithField("status", status).Error("Unknown status")
 	}
@@ -233,15 +255,18 @@ func NotificationHandler(server *mqtt.Server, msg mqtt.Message) error {
 	fmt.Printf("MSG: %s\n", msg.Payload)
 
 	//Get device id
-	topic := strings.Split(msg.Topic, "/")
+	topic, err := protocol.ParseDeviceTopic(msg.Topic)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("topic: %v\n", topic)
 
-	device_id := topic[2]
+	device_id := topic.Guid
 
 	log.Println(msg.Payload)
 	n := phoenix.DeviceNotification{}
 	if err := json.Unmarshal(msg.Payload, &n); err != nil {
-		return err
+		return protocol.NewDecodeError("notification", protocol.ReasonInvalidJson, err)
 	}
 
 	log.Printf("Got notification from device: %s -> %v\n", device_id, n)
@@ -274,11 +299,19 @@ func CommandResponseHandler(s *mqtt.Server, msg mqtt.Message) error {
 		log.Debug(debugMessage)
 	}
 
-	topic := strings.Split(msg.Topic, "/")
+	topic, err := protocol.ParseDeviceTopic(msg.Topic)
+	if err != nil {
+		return err
+	}
 
-	deviceGuid := topic[2]
+	deviceGuid := topic.Guid
 
-	commandId, err := strconv.ParseUint(topic[4], 10, 64)
+	commandId, err := topic.CommandId()
+	if err != nil {
+		return err
+	}
+
+	decoded, err := protocol.DecodeCommandResponse(payload)
 	if err != nil {
 		return err
 	}
@@ -286,13 +319,8 @@ func CommandResponseHandler(s *mqtt.Server, msg mqtt.Message) error {
 	var response struct {
 		Value interface{} `db:"value" json:"value"`
 	}
-	t := payload[0]
-	switch t {
-	case ConfigTypeDouble:
-		response.Value = Float64FromBytes(payload[1:])
-	default:
-		return fmt.Errorf("Unhandled database type: %d", t)
-	}
+	response.Value = decoded.Value
+	t := decoded.Type
 
 	log.Printf("Device: %s, Command: %d, Type: %d, Value: %v\n", deviceGuid, commandId, t, response)
 
@@ -309,14 +337,12 @@ func CommandResponseHandler(s *mqtt.Server, msg mqtt.Message) error {
 	}
 
 	log.Debugf("Updating command with response")
-	return device.CommandResponse(device_command, response)
+	if err := device.CommandResponse(device_command, response); err != nil {
+		return err
+	}
 
-}
+	return shadowReportResponse(device, device_command, response.Value)
 
-func Float64FromBytes(bytes []byte) float64 {
-	bits := binary.LittleEndian.Uint64(bytes)
-	float := math.Float64frombits(bits)
-	return float
 }
 
 func Float64Bytes(float float64) []byte {
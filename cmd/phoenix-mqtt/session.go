@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cmodk/phoenix"
+	"github.com/cmodk/phoenix/protocol"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	sessionReadSize  = 4 * 1024
+)
+
+var (
+	sessions     = make(map[*Session]struct{})
+	sessionsLock sync.Mutex
+)
+
+// Session is a device connection. It sits between the network connection
+// and the mqtt server and frames every packet read from the device, so
+// packets can be checked against the identity of the device before the mqtt
+// server sees them. The server only gets whole packets, so it is never
+// handed a truncated packet.
+type Session struct {
+	net.Conn
+
+	//Authenticated device, empty if the connection is not authenticated
+	DeviceGuid string
+	//Serial of the client certificate, if any
+	Serial string
+
+	//Set when the device must authenticate with username and password
+	requireCredentials bool
+	connected          bool
+
+	protocolLevel   uint8
+	subscribeTopics map[string]bool
+	pending         []byte
+
+	//Buffer of the mqtt server holding the packets last read, the server
+	//handles the packets in it before reading again
+	read []byte
+	//Set when a publish in the buffer failed, so it is not acknowledged
+	withholdAck bool
+	ackLock     sync.Mutex
+}
+
+func listen(tlsConfig *tls.Config) {
+	var ln net.Listener
+	var err error
+
+	if tlsConfig != nil {
+		ln, err = tls.Listen("tcp", ":8883", tlsConfig)
+	} else {
+		if *auth_mode == AuthCertificate {
+			lg.Warning("TLS disabled, devices are not authenticated and topic acls are not enforced")
+		} else {
+			lg.Warning("TLS disabled, device tokens are sent in clear text")
+		}
+		ln, err = net.Listen("tcp", ":1883")
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	//Stop accepting devices on shutdown, they reconnect to another instance
+	app.OnShutdown(func() {
+		ln.Close()
+	})
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if app.Context.Err() != nil {
+				return
+			}
+			lg.WithField("error", err).Error("Error accepting connection")
+			continue
+		}
+
+		go handleConnection(conn)
+	}
+}
+
+func handleConnection(conn net.Conn) {
+	session := &Session{Conn: conn}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			lg.WithField("error", err).WithField("remote", conn.RemoteAddr()).Warning("TLS handshake failed")
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		state := tlsConn.ConnectionState()
+		if len(state.PeerCertificates) > 0 {
+			session.Serial = phoenix.CertificateSerial(state.PeerCertificates[0].SerialNumber)
+			if err := session.authenticate(state.PeerCertificates[0].Subject.CommonName); err != nil {
+				lg.WithField("error", err).WithField("remote", conn.RemoteAddr()).Warning("Error binding certificate to session")
+				conn.Close()
+				return
+			}
+		}
+	}
+
+	session.requireCredentials = *auth_mode != AuthCertificate && !session.authenticated()
+
+	sessionsLock.Lock()
+	sessions[session] = struct{}{}
+	sessionsLock.Unlock()
+
+	mq.HandleClient(session)
+
+	sessionsLock.Lock()
+	delete(sessions, session)
+	sessionsLock.Unlock()
+}
+
+// authenticate binds the session to a device and loads the topics the
+// device is allowed to subscribe to
+func (s *Session) authenticate(device_guid string) error {
+	d, err := app.Devices.Get(phoenix.DeviceCriteria{Guid: device_guid})
+	if err != nil {
+		return err
+	}
+
+	topics, err := d.SubscribeTopics()
+	if err != nil {
+		return err
+	}
+
+	s.DeviceGuid = d.Guid
+	s.subscribeTopics = make(map[string]bool)
+	for _, topic := range topics {
+		s.subscribeTopics[topic] = true
+	}
+
+	lg.WithField("device", s.DeviceGuid).WithField("remote", s.RemoteAddr()).Debug("Session authenticated")
+
+	return nil
+}
+
+// Read only returns complete packets, and fails the connection if the device
+// tries to use a topic it is not allowed to
+func (s *Session) Read(p []byte) (int, error) {
+	for {
+		n, err := s.authorizedPackets(len(p))
+		if err != nil {
+			lg.WithField("device", s.DeviceGuid).WithField("remote", s.RemoteAddr()).WithField("error", err).Warning("Closing session")
+			return 0, err
+		}
+
+		if n > 0 {
+			copy(p, s.pending[:n])
+			s.pending = s.pending[n:]
+
+			s.ackLock.Lock()
+			s.read = p
+			s.ackLock.Unlock()
+			return n, nil
+		}
+
+		buffer := make([]byte, sessionReadSize)
+		read, err := s.Conn.Read(buffer)
+		s.pending = append(s.pending, buffer[:read]...)
+		if err != nil && read == 0 {
+			return 0, err
+		}
+	}
+}
+
+// Write sends a packet of the mqtt server to the device. The server writes
+// each packet in a single call, with a remaining length which is only valid
+// below 128 bytes, so the packet is framed again before it is sent.
+//
+// The mqtt server acknowledges every publish, even when the handler fails.
+// If the publish failed the session is closed instead of sending the ack, so
+// the device sends the publish again when it reconnects.
+func (s *Session) Write(p []byte) (int, error) {
+	if len(p) > 0 && (p[0]>>4 == protocol.PacketPubAck || p[0]>>4 == protocol.PacketPubRec) && s.takeWithheldAck() {
+		lg.WithField("device", s.DeviceGuid).WithField("remote", s.RemoteAddr()).Warning("Publish failed, closing session without ack")
+		s.Conn.Close()
+		return 0, fmt.Errorf("Publish of device %s failed, ack withheld", s.DeviceGuid)
+	}
+
+	if _, err := s.Conn.Write(protocol.FrameServerPacket(p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// authorizedPackets returns the number of pending bytes holding complete,
+// authorized packets that fit in max bytes
+func (s *Session) authorizedPackets(max int) (int, error) {
+	n := 0
+	for {
+		packet, ok, err := protocol.NextPacket(s.pending[n:])
+		if err != nil {
+			return 0, err
+		}
+
+		if !ok {
+			return n, nil
+		}
+
+		if n+packet.Size > max {
+			if n == 0 {
+				return 0, fmt.Errorf("Packet of %d bytes does not fit read buffer of %d bytes", packet.Size, max)
+			}
+			return n, nil
+		}
+
+		if err := s.authorize(packet); err != nil {
+			return 0, err
+		}
+
+		n += packet.Size
+	}
+}
+
+func (s *Session) authorize(packet protocol.Packet) error {
+	if !s.connected && packet.Type != protocol.PacketConnect {
+		return fmt.Errorf("Packet type %d before connect", packet.Type)
+	}
+
+	switch packet.Type {
+	case protocol.PacketConnect:
+		if s.connected {
+			return fmt.Errorf("Second connect on session")
+		}
+
+		connect, err := protocol.ParseConnect(packet.Body)
+		if err != nil {
+			return err
+		}
+		s.protocolLevel = connect.ProtocolLevel
+
+		if err := s.authenticateConnect(connect); err != nil {
+			s.refuseConnect(connect.ProtocolLevel)
+			return err
+		}
+		s.connected = true
+
+		if connect.WillTopic != nil {
+			return s.authorizePublish(*connect.WillTopic)
+		}
+
+	case protocol.PacketPublish:
+		topic, err := protocol.PublishTopic(packet.Body)
+		if err != nil {
+			return err
+		}
+		return s.authorizePublish(topic)
+
+	case protocol.PacketSubscribe:
+		topics, err := protocol.SubscribeTopics(packet.Body, s.protocolLevel)
+		if err != nil {
+			return err
+		}
+
+		for _, topic := range topics {
+			if err := s.authorizeSubscribe(topic); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Session) authenticated() bool {
+	return s.DeviceGuid != ""
+}
+
+func (s *Session) authorizePublish(topic string) error {
+	if !s.authenticated() {
+		return nil
+	}
+
+	t, err := protocol.ParseDeviceTopic(topic)
+	if err != nil {
+		return err
+	}
+
+	if t.Guid != s.DeviceGuid {
+		return fmt.Errorf("Device %s not allowed to publish to %s", s.DeviceGuid, topic)
+	}
+
+	return nil
+}
+
+func (s *Session) authorizeSubscribe(topic string) error {
+	if !s.authenticated() {
+		return nil
+	}
+
+	if !s.subscribeTopics[topic] {
+		return fmt.Errorf("Device %s not allowed to subscribe to %s", s.DeviceGuid, topic)
+	}
+
+	return nil
+}
+
+// withholdNextAck makes the session close instead of acknowledging the
+// publish being handled
+func (s *Session) withholdNextAck() {
+	s.ackLock.Lock()
+	s.withholdAck = true
+	s.ackLock.Unlock()
+}
+
+func (s *Session) takeWithheldAck() bool {
+	s.ackLock.Lock()
+	defer s.ackLock.Unlock()
+
+	withheld := s.withholdAck
+	s.withholdAck = false
+	return withheld
+}
+
+// readBy returns true if the payload is in the buffer the session last read
+// into
+func (s *Session) readBy(payload []byte) bool {
+	s.ackLock.Lock()
+	defer s.ackLock.Unlock()
+
+	if cap(s.read) == 0 {
+		return false
+	}
+
+	start := reflect.ValueOf(s.read).Pointer()
+	at := reflect.ValueOf(payload).Pointer()
+	return at >= start && at < start+uintptr(cap(s.read))
+}
+
+// publishingSession returns the session which read the payload of a publish
+// being handled, the payload is a slice of the buffer the session read into
+func publishingSession(payload []byte) *Session {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	for s := range sessions {
+		if s.readBy(payload) {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// deviceSessions returns the live sessions of a device
+func deviceSessions(device_guid string) []*Session {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	var device_sessions []*Session
+	for s := range sessions {
+		if s.DeviceGuid == device_guid {
+			device_sessions = append(device_sessions, s)
+		}
+	}
+
+	return device_sessions
+}
+
+// deviceCertificateRevoked disconnects the device. Sessions authenticated
+// with a token are closed as well, as the token may be the fingerprint of
+// the revoked certificate. The device can reconnect if it has other valid
+// credentials.
+func deviceCertificateRevoked(e phoenix.DeviceCertificateRevoked) error {
+	for _, s := range deviceSessions(e.DeviceGuid) {
+		if s.Serial != "" && s.Serial != e.Serial {
+			continue
+		}
+
+		lg.WithField("device", e.DeviceGuid).WithField("serial", e.Serial).Warning("Closing session for revoked certificate")
+		if err := s.Conn.Close(); err != nil {
+			lg.WithField("error", err).Error("Error closing session")
+		}
+	}
+
+	return nil
+}
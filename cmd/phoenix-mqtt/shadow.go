@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/cmodk/phoenix"
+)
+
+func deviceShadowUpdated(e phoenix.DeviceShadowUpdated) error {
+	d, err := app.Devices.Get(phoenix.DeviceCriteria{Id: e.DeviceId})
+	if err != nil {
+		return err
+	}
+
+	if !d.Online {
+		//The delta is sent when the device comes online
+		return nil
+	}
+
+	return shadowSync(d)
+}
+
+// shadowSync sends a config_write for each desired configuration which
+// differs from the reported, followed by a config_read so the response
+// updates the reported configuration
+func shadowSync(d *phoenix.Device) error {
+	s, err := d.Shadow()
+	if err != nil {
+		return err
+	}
+
+	delta := s.Delta()
+	for _, name := range delta.Names() {
+		value := delta[name]
+		value_type, err := phoenix.ShadowType(value)
+		if err != nil {
+			lg.WithField("device", d.Guid).WithField("configuration", name).WithField("error", err).Error("Skipping shadow configuration")
+			continue
+		}
+
+		if err := sendConfigCommand(d, "config_write", name, value_type, value); err != nil {
+			return err
+		}
+
+		if err := sendConfigCommand(d, "config_read", name, value_type, nil); err != nil {
+			return err
+		}
+	}
+
+	if len(delta) > 0 {
+		lg.WithField("device", d.Guid).WithField("delta", delta).Info("Shadow delta sent")
+	}
+
+	return nil
+}
+
+func sendConfigCommand(d *phoenix.Device, command string, name string, value_type string, value interface{}) error {
+	parameters, err := json.Marshal(ConfigurationParameter{
+		Configuration: &name,
+		Type:          &value_type,
+		Value:         value,
+	})
+	if err != nil {
+		return err
+	}
+
+	raw_parameters := json.RawMessage(parameters)
+	cmd := phoenix.DeviceCommand{
+		Command:    command,
+		Parameters: &raw_parameters,
+	}
+
+	if err := d.CommandInsert(&cmd); err != nil {
+		return err
+	}
+
+	return deviceCommandCreated(phoenix.DeviceCommandCreated(cmd))
+}
+
+// shadowReportResponse stores the response to a config_read as the reported
+// configuration
+func shadowReportResponse(d *phoenix.Device, cmd *phoenix.DeviceCommand, value interface{}) error {
+	if cmd.Command != "config_read" || cmd.Parameters == nil {
+		return nil
+	}
+
+	parameters, err := ParseConfigurationParameters(*cmd.Parameters)
+	if err != nil {
+		return err
+	}
+
+	if parameters.Configuration == nil {
+		return nil
+	}
+
+	_, err = d.ShadowReport(phoenix.ShadowState{*parameters.Configuration: value})
+	return err
+}
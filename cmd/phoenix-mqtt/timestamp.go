@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cmodk/phoenix"
+	"github.com/cmodk/phoenix/protocol"
+)
+
+const (
+	timestampSettingsTTL = time.Minute
+	clockSkewReportDelay = time.Minute
+)
+
+var (
+	max_clock_skew_future = flag.Duration("max-clock-skew-future", 5*time.Minute, "Samples further in the future than this are flagged as clock skew")
+	max_clock_skew_past   = flag.Duration("max-clock-skew-past", 30*24*time.Hour, "Samples further in the past than this are flagged as clock skew")
+	timestamp_precision   = flag.String("timestamp-precision", string(protocol.DefaultPrecision), "Default epoch precision of device timestamps: s, ms or us")
+
+	timestampSettingsCache = make(map[string]timestampSettings)
+	clockSkewReported      = make(map[string]time.Time)
+	timestampLock          sync.Mutex
+)
+
+type timestampSettings struct {
+	precision protocol.Precision
+	policy    string
+	fetched   time.Time
+}
+
+func deviceTimestampSettings(device_guid string) (timestampSettings, error) {
+	timestampLock.Lock()
+	settings, ok := timestampSettingsCache[device_guid]
+	timestampLock.Unlock()
+
+	if ok && time.Since(settings.fetched) < timestampSettingsTTL {
+		return settings, nil
+	}
+
+	d, err := app.Devices.Get(phoenix.DeviceCriteria{Guid: device_guid})
+	if err != nil {
+		return timestampSettings{}, err
+	}
+
+	settings = timestampSettings{
+		precision: protocol.Precision(*timestamp_precision),
+		policy:    phoenix.TimestampPolicyDevice,
+		fetched:   time.Now(),
+	}
+
+	if d.TimestampPrecision != nil {
+		precision, err := protocol.ParsePrecision(*d.TimestampPrecision)
+		if err != nil {
+			lg.WithField("device", device_guid).WithField("error", err).Warning("Bad timestamp precision for device, using default")
+		} else {
+			settings.precision = precision
+		}
+	}
+
+	if d.TimestampPolicy != nil {
+		settings.policy = *d.TimestampPolicy
+	}
+
+	timestampLock.Lock()
+	timestampSettingsCache[device_guid] = settings
+	timestampLock.Unlock()
+
+	return settings, nil
+}
+
+// sampleTimestamp resolves the time to store for a sample. The precision
+// from the frame takes priority over the device setting, and the device
+// timestamp policy decides what happens when the device clock is skewed.
+func sampleTimestamp(device_guid string, sample protocol.Sample, precision protocol.Precision) (time.Time, error) {
+	now := time.Now().UTC()
+
+	settings, err := deviceTimestampSettings(device_guid)
+	if err != nil {
+		return now, err
+	}
+
+	if sample.Timestamp == 0 || settings.policy == phoenix.TimestampPolicyServer {
+		return now, nil
+	}
+
+	if precision == "" {
+		precision = settings.precision
+	}
+
+	tm, err := precision.Time(sample.Timestamp)
+	if err != nil {
+		return now, protocol.NewDecodeError("sample", protocol.ReasonInvalidTimestamp, err)
+	}
+
+	skew := tm.Sub(now)
+	if skew <= *max_clock_skew_future && -skew <= *max_clock_skew_past {
+		return tm, nil
+	}
+
+	reportClockSkew(phoenix.DeviceClockSkewDetected{
+		DeviceGuid:      device_guid,
+		Stream:          sample.Stream,
+		DeviceTimestamp: tm,
+		ServerTimestamp: now,
+		Skew:            skew,
+		Policy:          settings.policy,
+	})
+
+	switch settings.policy {
+	case phoenix.TimestampPolicySkew:
+		return now, nil
+	case phoenix.TimestampPolicyReject:
+		return now, protocol.NewDecodeError("sample", protocol.ReasonClockSkew, fmt.Errorf("timestamp %s is %s off", tm.Format(time.RFC3339Nano), skew))
+	}
+
+	return tm, nil
+}
+
+// reportClockSkew logs every skewed sample, but only publishes an event once
+// in a while per device, a device with a wrong clock will skew every sample
+func reportClockSkew(e phoenix.DeviceClockSkewDetected) {
+	lg.WithField("device", e.DeviceGuid).WithField("stream", e.Stream).WithField("skew", e.Skew).Warning("Clock skew detected")
+
+	timestampLock.Lock()
+	last, ok := clockSkewReported[e.DeviceGuid]
+	report := !ok || time.Since(last) > clockSkewReportDelay
+	if report {
+		clockSkewReported[e.DeviceGuid] = time.Now()
+	}
+	timestampLock.Unlock()
+
+	if !report {
+		return
+	}
+
+	if err := app.Event.Publish(e); err != nil {
+		lg.WithField("error", err).Error("Error publishing clock skew event")
+	}
+}
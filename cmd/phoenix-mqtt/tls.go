@@ -1,19 +1,25 @@
 package main
 
 import (
-	"crypto/sha256"
 	"crypto/x509"
 	"fmt"
+	"time"
 
 	"github.com/cmodk/phoenix"
 )
 
 func VerifyClient(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 
+	//Only happens when client certificates are optional, see -auth
+	if len(rawCerts) == 0 {
+		return nil
+	}
+
 	cert := rawCerts[0]
 	c, err := x509.ParseCertificate(cert)
 	if err != nil {
-		log.Fatal(err)
+		lg.WithField("error", err).Error("Error parsing client certificate")
+		return fmt.Errorf("Certificate error")
 	}
 
 	log.Debugf("Name %s\n", c.Subject.CommonName)
@@ -22,20 +28,43 @@ func VerifyClient(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
 	log.Debugf("Not after %s\n", c.NotAfter.String())
 	log.Print(c.Subject.Names)
 
-	h := sha256.New()
-	h.Write(c.Raw)
-	certificate_hash := fmt.Sprintf("%x", h.Sum(nil))
+	certificate_hash := phoenix.CertificateFingerprint(c.Raw)
 	log.Debugf("Cert hash: %s\n", certificate_hash)
 
 	d, err := app.Devices.Get(phoenix.DeviceCriteria{
-		Id:    c.SerialNumber.Uint64(),
-		Guid:  c.Subject.CommonName,
-		Token: certificate_hash,
+		Guid: c.Subject.CommonName,
 	})
 	if err != nil || d.Id == 0 {
 		lg.WithField("error", err).Error("Error verifying client certificate")
 		return fmt.Errorf("Certificate error")
 	}
 
+	//The certificate before the newest is valid until the newest is used
+	valid, err := d.CertificateTokenValid(certificate_hash)
+	if err != nil || !valid {
+		lg.WithField("error", err).WithField("device", d.Guid).Error("Error verifying client certificate")
+		return fmt.Errorf("Certificate error")
+	}
+
+	if d.TokenExpiration != nil && d.TokenExpiration.Before(time.Now()) {
+		lg.WithField("device", d.Guid).WithField("token_expiration", d.TokenExpiration).Warning("Expired certificate used")
+		return fmt.Errorf("Certificate expired")
+	}
+
+	revoked, err := d.CertificateRevoked(certificate_hash)
+	if err != nil {
+		lg.WithField("error", err).Error("Error checking certificate revocation")
+		return fmt.Errorf("Certificate error")
+	}
+
+	if revoked {
+		lg.WithField("device", d.Guid).WithField("serial", phoenix.CertificateSerial(c.SerialNumber)).Warning("Revoked certificate used")
+		return fmt.Errorf("Certificate revoked")
+	}
+
+	if err := d.CertificateUsed(certificate_hash); err != nil {
+		lg.WithField("error", err).WithField("device", d.Guid).Error("Error revoking superseded certificates")
+	}
+
 	return nil
 }
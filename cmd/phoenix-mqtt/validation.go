@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/cmodk/go-mqtt"
+	"github.com/cmodk/phoenix/protocol"
+)
+
+var (
+	rejectedFrames     = make(map[string]map[protocol.Reason]uint64)
+	rejectedFramesLock sync.Mutex
+)
+
+type frameRejection struct {
+	Topic string `json:"topic"`
+	*protocol.DecodeError
+}
+
+// withFrameValidation makes sure a malformed frame never takes down the
+// client goroutine, and tells the device why its frame was rejected. A frame
+// which failed for another reason, like a full command queue, is not
+// acknowledged, so the device sends it again.
+func withFrameValidation(handler mqtt.SubscriptionHandler) mqtt.SubscriptionHandler {
+	return func(s *mqtt.Server, msg mqtt.Message) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = protocol.NewDecodeError("unknown", protocol.ReasonInternal, fmt.Errorf("%v", r))
+				lg.WithField("topic", msg.Topic).WithField("panic", r).Error("Recovered from panic in frame handler")
+			}
+
+			if err == nil {
+				return
+			}
+
+			if decodeError, ok := protocol.AsDecodeError(err); ok {
+				rejectFrame(msg.Topic, decodeError)
+				return
+			}
+
+			withholdAck(msg, err)
+		}()
+
+		return handler(s, msg)
+	}
+}
+
+func rejectFrame(topic string, decodeError *protocol.DecodeError) {
+	device_guid := ""
+	if t, err := protocol.ParseDeviceTopic(topic); err == nil {
+		device_guid = t.Guid
+	}
+
+	lg.WithField("device", device_guid).WithField("topic", topic).WithField("error", decodeError).Warning("Rejected frame")
+
+	rejectedFramesLock.Lock()
+	counters, ok := rejectedFrames[device_guid]
+	if !ok {
+		counters = make(map[protocol.Reason]uint64)
+		rejectedFrames[device_guid] = counters
+	}
+	counters[decodeError.Reason]++
+	rejectedFramesLock.Unlock()
+
+	//Without a device there is nobody to tell
+	if device_guid == "" {
+		return
+	}
+
+	feedback, err := json.Marshal(frameRejection{topic, decodeError})
+	if err != nil {
+		lg.WithField("error", err).Error("Error encoding frame rejection")
+		return
+	}
+
+	if err := mq.Publish(fmt.Sprintf("/device/%s/error", device_guid), 0, false, feedback); err != nil {
+		lg.WithField("error", err).WithField("device", device_guid).Error("Error sending frame rejection to device")
+	}
+}
+
+// withholdAck keeps the mqtt server from acknowledging a frame the device
+// has to send again. The server handles the frame on the goroutine of the
+// session it came from, so the next ack of that session is the one for the
+// frame.
+func withholdAck(msg mqtt.Message, cause error) {
+	l := lg.WithField("topic", msg.Topic).WithField("error", cause)
+
+	s := publishingSession(msg.Payload)
+	if s == nil {
+		l.Error("Error handling frame from unknown session")
+		return
+	}
+
+	l.WithField("device", s.DeviceGuid).WithField("remote", s.RemoteAddr()).Error("Error handling frame, withholding ack")
+	s.withholdNextAck()
+}
+
+func rejectedFramesHandler(w http.ResponseWriter, r *http.Request) {
+	rejectedFramesLock.Lock()
+	defer rejectedFramesLock.Unlock()
+
+	app.JsonResponse(w, rejectedFrames)
+}
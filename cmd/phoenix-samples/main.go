@@ -34,16 +34,14 @@ func main() {
 		app.Logger.Level = logrus.ErrorLevel
 	}
 
-	app.HandleEvent(phoenix.SampleSaved{}, sampleSaved)
+	phoenix.HandleEvent(app, "sampleSaved", sampleSaved)
 
-	go handleRedis()
+	app.Go(handleRedis)
 
 	app.ListenEvents()
 }
 
-func sampleSaved(event interface{}) error {
-	e := event.(phoenix.SampleSaved)
-
+func sampleSaved(e phoenix.SampleSaved) error {
 	for average_key, _ := range phoenix.AverageConfigs {
 		phoenix.ScheduleCalculation(re, ctx, e.Timestamp, average_key, e.Device, e.Stream)
 	}
@@ -55,7 +53,7 @@ func handleRedis() {
 
 	key := "averages"
 
-	for {
+	for app.Context.Err() == nil {
 
 		count, err := re.ZCount(ctx, key, "0", fmt.Sprintf("%d", time.Now().Unix())).Result()
 		if err != nil {
@@ -63,7 +61,7 @@ func handleRedis() {
 		}
 
 		if count == 0 {
-			time.Sleep(time.Second)
+			app.Sleep(time.Second)
 			continue
 		}
 
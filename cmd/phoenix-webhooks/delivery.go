@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cmodk/phoenix"
+	"github.com/cmodk/phoenix/webhook"
+)
+
+const (
+	maxDeliveryError = 1024
+	deliveryBatch    = 100
+)
+
+var (
+	delivery_interval = flag.Duration("delivery-interval", 5*time.Second, "Interval for polling deliveries which are due")
+	delivery_timeout  = flag.Duration("delivery-timeout", 10*time.Second, "Timeout for posting a delivery")
+	max_attempts      = flag.Int("max-attempts", 10, "Attempts before a delivery is moved to the dead letters")
+	retry_base        = flag.Duration("retry-base", 30*time.Second, "Delay before the first retry, doubled for every attempt")
+	retry_max         = flag.Duration("retry-max", 6*time.Hour, "Max delay between retries")
+
+	client = &http.Client{}
+)
+
+func deliveryWorker() {
+	client.Timeout = *delivery_timeout
+
+	//Hosts are checked again when connecting, the address of a host name can
+	//change after the webhook is saved
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = phoenix.WebhookHostPolicy().DialContext(&net.Dialer{Timeout: *delivery_timeout})
+	client.Transport = transport
+
+	for {
+		if err := deliverDue(); err != nil {
+			log.WithField("error", err).Error("Error delivering webhooks")
+		}
+
+		if !app.Sleep(*delivery_interval) {
+			return
+		}
+	}
+}
+
+func deliverDue() error {
+	deliveries, err := app.Devices.WebhookDeliveryDue(deliveryBatch)
+	if err != nil {
+		return err
+	}
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+
+		//Claim the delivery for the time an attempt can take
+		claimed, err := app.Devices.WebhookDeliveryClaim(delivery, time.Now().UTC().Add(2**delivery_timeout))
+		if err != nil {
+			return err
+		}
+
+		if !claimed {
+			continue
+		}
+
+		if err := deliver(delivery); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliver makes one attempt and records the result in the delivery log
+func deliver(delivery *phoenix.WebhookDelivery) error {
+	w, err := app.Devices.WebhookGet(phoenix.WebhookCriteria{Id: delivery.WebhookId})
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	delivery.Attempts++
+
+	status_code, attempt_err := post(w, delivery)
+	delivery.StatusCode = status_code
+
+	if attempt_err == nil {
+		delivery.Status = phoenix.WebhookDeliveryDelivered
+		delivery.Error = nil
+		log.WithField("webhook", w.Id).WithField("delivery", delivery.Id).Debug("Delivered")
+		return app.Devices.WebhookDeliveryUpdate(delivery)
+	}
+
+	message := attempt_err.Error()
+	if len(message) > maxDeliveryError {
+		message = message[:maxDeliveryError]
+	}
+	delivery.Error = &message
+
+	if !w.Enabled || delivery.Attempts >= *max_attempts {
+		delivery.Status = phoenix.WebhookDeliveryDead
+		log.WithField("webhook", w.Id).WithField("delivery", delivery.Id).WithField("error", message).Warning("Delivery moved to dead letters")
+	} else {
+		delivery.Status = phoenix.WebhookDeliveryRetrying
+		delivery.NextAttempt = time.Now().UTC().Add(webhook.Backoff(delivery.Attempts, *retry_base, *retry_max))
+		log.WithField("webhook", w.Id).WithField("delivery", delivery.Id).WithField("error", message).WithField("next_attempt", delivery.NextAttempt).Info("Delivery failed")
+	}
+
+	return app.Devices.WebhookDeliveryUpdate(delivery)
+}
+
+func post(w *phoenix.Webhook, delivery *phoenix.WebhookDelivery) (*int, error) {
+	if !w.Enabled {
+		return nil, fmt.Errorf("Webhook disabled")
+	}
+
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest(http.MethodPost, w.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "phoenix-webhooks/"+phoenix.Version)
+	req.Header.Set(webhook.HeaderEvent, delivery.Event)
+	req.Header.Set(webhook.HeaderDelivery, strconv.FormatUint(delivery.Id, 10))
+	req.Header.Set(webhook.HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhook.HeaderSignature, webhook.Sign(w.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	//Drain a bit of the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &resp.StatusCode, fmt.Errorf("Webhook responded %s", resp.Status)
+	}
+
+	return &resp.StatusCode, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cmodk/phoenix"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	app = phoenix.New()
+	log = app.Logger
+
+	debug             = flag.Bool("debug", false, "Enable debug information")
+	webhook_cache_ttl = flag.Duration("webhook-cache-ttl", 10*time.Second, "How long the enabled webhooks are cached, changes are picked up within this time")
+
+	webhooksCache   []phoenix.Webhook
+	webhooksFetched time.Time
+	webhooksLock    sync.Mutex
+)
+
+// webhookPayload is the body posted to the webhook
+type webhookPayload struct {
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+func main() {
+	flag.Parse()
+
+	if *debug {
+		app.Logger.Level = logrus.DebugLevel
+	}
+
+	for _, event := range phoenix.WebhookEvents {
+		et, err := app.Event.Type(event)
+		if err != nil {
+			log.WithField("error", err).Fatal("Webhook event without a registered name")
+		}
+
+		app.HandleEvent(event, "enqueueDeliveries", enqueueDeliveries(et.Name))
+	}
+
+	app.Go(deliveryWorker)
+	app.ListenEvents()
+}
+
+// eventDevice returns the device of the event, nil if the event has no
+// device id
+func eventDevice(event interface{}) (*phoenix.Device, error) {
+	field := reflect.ValueOf(event).FieldByName("DeviceId")
+	if !field.IsValid() {
+		return nil, nil
+	}
+
+	var id uint64
+	switch field.Kind() {
+	case reflect.Uint64:
+		id = field.Uint()
+	case reflect.Ptr:
+		if field.IsNil() {
+			return nil, nil
+		}
+		id = field.Elem().Uint()
+	default:
+		return nil, fmt.Errorf("Unhandled device id type: %s", field.Type())
+	}
+
+	if id == 0 {
+		return nil, nil
+	}
+
+	return app.Devices.Get(phoenix.DeviceCriteria{Id: id})
+}
+
+// enabledWebhooks returns the enabled webhooks, cached as every event is
+// matched against them
+func enabledWebhooks() ([]phoenix.Webhook, error) {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+
+	if webhooksCache != nil && time.Since(webhooksFetched) < *webhook_cache_ttl {
+		return webhooksCache, nil
+	}
+
+	fetched := time.Now()
+	webhooks, err := app.Devices.WebhookList(phoenix.WebhookCriteria{Enabled: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if webhooks == nil {
+		webhooks = []phoenix.Webhook{}
+	}
+
+	webhooksCache = webhooks
+	webhooksFetched = fetched
+	return webhooks, nil
+}
+
+// enqueueDeliveries creates a delivery for every webhook subscribing to the
+// event
+func enqueueDeliveries(name string) func(interface{}) error {
+	return func(event interface{}) error {
+		webhooks, err := enabledWebhooks()
+		if err != nil {
+			return err
+		}
+
+		var payload []byte
+		var d *phoenix.Device
+		for i := range webhooks {
+			w := &webhooks[i]
+			if !w.Subscribes(name) {
+				continue
+			}
+
+			if payload == nil {
+				d, err = eventDevice(event)
+				if err != nil {
+					return err
+				}
+
+				payload, err = json.Marshal(webhookPayload{
+					Event:     name,
+					Timestamp: time.Now().UTC(),
+					Data:      event,
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			matches, err := app.Devices.WebhookMatches(w, d)
+			if err != nil {
+				return err
+			}
+
+			if !matches {
+				continue
+			}
+
+			delivery := phoenix.WebhookDelivery{
+				WebhookId: w.Id,
+				Event:     name,
+				Payload:   string(payload),
+			}
+
+			if err := app.Devices.WebhookDeliveryInsert(&delivery); err != nil {
+				return err
+			}
+
+			log.WithField("webhook", w.Id).WithField("event", name).Debug("Delivery queued")
+		}
+
+		return nil
+	}
+}
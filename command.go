@@ -12,3 +12,8 @@ type DeviceNotificationCreate struct {
 	Timestamp    time.Time
 	Parameters   json.RawMessage
 }
+
+// CommandKey keeps the notifications of a device in order
+func (cmd DeviceNotificationCreate) CommandKey() string {
+	return cmd.DeviceGuid
+}
@@ -12,5 +12,34 @@ var (
 		"ALTER TABLE `device_commands` ADD CONSTRAINT `device_commands_device_guid_lock` FOREIGN KEY (`device_guid`) REFERENCES `devices` (`guid`);",
 		"ALTER TABLE `device_commands` ADD `pending` TINYINT NOT NULL AFTER `parameters`;",
 		"ALTER TABLE `devices` ADD `token_expiration` TIMESTAMP NULL AFTER `token`;",
+		"ALTER TABLE `devices` ADD `timestamp_precision` varchar(8) DEFAULT NULL, ADD `timestamp_policy` varchar(16) DEFAULT NULL;",
+		"CREATE TABLE `device_topic_acls`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `device_id` bigint(20) UNSIGNED NOT NULL, `topic` varchar(256) NOT NULL, UNIQUE KEY `device_topic` (`device_id`, `topic`), CONSTRAINT `device_topic_acls_device_id_lock` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `device_certificates`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `device_id` bigint(20) UNSIGNED NOT NULL, `serial` varchar(64) NOT NULL, `fingerprint` varchar(64) NOT NULL, `not_before` timestamp NULL DEFAULT NULL, `not_after` timestamp NULL DEFAULT NULL, `created` timestamp NOT NULL DEFAULT current_timestamp(), `revoked_at` timestamp NULL DEFAULT NULL, `revocation_reason` int DEFAULT NULL, UNIQUE KEY `serial` (`serial`), KEY `fingerprint` (`fingerprint`), CONSTRAINT `device_certificates_device_id_lock` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"ALTER TABLE `device_certificates` ADD `expiry_notified` timestamp NULL DEFAULT NULL, ADD KEY `not_after` (`not_after`);",
+		"ALTER TABLE `device_certificates` ADD `issuer` varchar(64) DEFAULT NULL, ADD KEY `issuer` (`issuer`);",
+		"CREATE TABLE `certificate_requests`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `device_id` bigint(20) UNSIGNED NOT NULL, `created` timestamp NOT NULL DEFAULT current_timestamp(), `remote_addr` varchar(64) NOT NULL, `renewal` tinyint NOT NULL DEFAULT 0, `subject` varchar(512) DEFAULT NULL, `status` varchar(16) NOT NULL, `reason` varchar(512) DEFAULT NULL, `serial` varchar(64) DEFAULT NULL, `fingerprint` varchar(64) DEFAULT NULL, KEY `device_created` (`device_id`, `created`), CONSTRAINT `certificate_requests_device_id_lock` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"ALTER TABLE `devices` ADD `firmware_family` varchar(128) DEFAULT NULL, ADD `firmware_version` varchar(64) DEFAULT NULL;",
+		"CREATE TABLE `firmwares`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `family` varchar(128) NOT NULL, `version` varchar(64) NOT NULL, `filename` varchar(256) NOT NULL, `size` bigint(20) NOT NULL, `sha256` varchar(64) NOT NULL, `signature` varchar(1024) NOT NULL, `created` timestamp NOT NULL DEFAULT current_timestamp(), UNIQUE KEY `family_version` (`family`, `version`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `device_groups`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `name` varchar(128) NOT NULL, `created` timestamp NOT NULL DEFAULT current_timestamp(), UNIQUE KEY `name` (`name`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `device_group_members`(`group_id` bigint(20) UNSIGNED NOT NULL, `device_id` bigint(20) UNSIGNED NOT NULL, PRIMARY KEY (`group_id`, `device_id`), CONSTRAINT `device_group_members_group_id_lock` FOREIGN KEY (`group_id`) REFERENCES `device_groups` (`id`), CONSTRAINT `device_group_members_device_id_lock` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `firmware_rollouts`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `firmware_id` bigint(20) UNSIGNED NOT NULL, `group_id` bigint(20) UNSIGNED NOT NULL, `percentage` int NOT NULL, `status` varchar(16) NOT NULL, `created` timestamp NOT NULL DEFAULT current_timestamp(), CONSTRAINT `firmware_rollouts_firmware_id_lock` FOREIGN KEY (`firmware_id`) REFERENCES `firmwares` (`id`), CONSTRAINT `firmware_rollouts_group_id_lock` FOREIGN KEY (`group_id`) REFERENCES `device_groups` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `device_firmware_updates`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `device_id` bigint(20) UNSIGNED NOT NULL, `firmware_id` bigint(20) UNSIGNED NOT NULL, `rollout_id` bigint(20) UNSIGNED DEFAULT NULL, `command_id` bigint(20) UNSIGNED NOT NULL, `status` varchar(16) NOT NULL, `progress` int NOT NULL DEFAULT 0, `error` varchar(512) DEFAULT NULL, `created` timestamp NOT NULL DEFAULT current_timestamp(), `updated` timestamp NULL DEFAULT NULL, UNIQUE KEY `device_rollout` (`device_id`, `rollout_id`), KEY `command_id` (`command_id`), CONSTRAINT `device_firmware_updates_device_id_lock` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`), CONSTRAINT `device_firmware_updates_firmware_id_lock` FOREIGN KEY (`firmware_id`) REFERENCES `firmwares` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `device_shadows`(`device_id` bigint(20) UNSIGNED NOT NULL PRIMARY KEY, `desired` text NOT NULL, `reported` text NOT NULL, `version` bigint(20) UNSIGNED NOT NULL, `updated` timestamp NULL DEFAULT NULL, CONSTRAINT `device_shadows_device_id_lock` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `device_types`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `name` varchar(128) NOT NULL, `model` varchar(128) NOT NULL, `firmware_family` varchar(128) DEFAULT NULL, `configuration` text NOT NULL, `config_template` text DEFAULT NULL, `created` timestamp NOT NULL DEFAULT current_timestamp(), UNIQUE KEY `name` (`name`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `device_type_streams`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `device_type_id` bigint(20) UNSIGNED NOT NULL, `code` varchar(256) NOT NULL, `unit` varchar(32) DEFAULT NULL, `min` double DEFAULT NULL, `max` double DEFAULT NULL, UNIQUE KEY `type_code` (`device_type_id`, `code`), CONSTRAINT `device_type_streams_device_type_id_lock` FOREIGN KEY (`device_type_id`) REFERENCES `device_types` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"ALTER TABLE `devices` ADD `device_type_id` bigint(20) UNSIGNED DEFAULT NULL, ADD CONSTRAINT `devices_device_type_id_lock` FOREIGN KEY (`device_type_id`) REFERENCES `device_types` (`id`);",
+		"ALTER TABLE `device_type_streams` ADD `display_name` varchar(128) DEFAULT NULL, ADD `type` varchar(16) DEFAULT NULL, ADD `precision` int DEFAULT NULL, ADD `enum` varchar(1024) DEFAULT NULL;",
+		"CREATE TABLE `device_stream_metadata`(`device_id` bigint(20) UNSIGNED NOT NULL, `code` varchar(256) NOT NULL, `unit` varchar(32) DEFAULT NULL, `display_name` varchar(128) DEFAULT NULL, `type` varchar(16) DEFAULT NULL, `precision` int DEFAULT NULL, `min` double DEFAULT NULL, `max` double DEFAULT NULL, `enum` varchar(1024) DEFAULT NULL, PRIMARY KEY (`device_id`, `code`), CONSTRAINT `device_stream_metadata_device_id_lock` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"ALTER TABLE `device_type_streams` ADD `transforms` text DEFAULT NULL, ADD `raw_stream` varchar(256) DEFAULT NULL;",
+		"ALTER TABLE `device_stream_metadata` ADD `transforms` text DEFAULT NULL, ADD `raw_stream` varchar(256) DEFAULT NULL;",
+		"CREATE TABLE `derived_streams`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `device_id` bigint(20) UNSIGNED DEFAULT NULL, `device_type_id` bigint(20) UNSIGNED DEFAULT NULL, `code` varchar(256) NOT NULL, `expression` varchar(1024) NOT NULL, `window_seconds` int NOT NULL DEFAULT 0, `created` timestamp NOT NULL DEFAULT current_timestamp(), UNIQUE KEY `device_code` (`device_id`, `code`), UNIQUE KEY `type_code` (`device_type_id`, `code`), CONSTRAINT `derived_streams_device_id_lock` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`), CONSTRAINT `derived_streams_device_type_id_lock` FOREIGN KEY (`device_type_id`) REFERENCES `device_types` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `alert_rules`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `name` varchar(128) NOT NULL, `device_id` bigint(20) UNSIGNED DEFAULT NULL, `device_type_id` bigint(20) UNSIGNED DEFAULT NULL, `stream` varchar(256) DEFAULT NULL, `condition_type` varchar(16) NOT NULL, `operator` varchar(2) DEFAULT NULL, `threshold` double DEFAULT NULL, `for_seconds` int NOT NULL DEFAULT 0, `enabled` tinyint NOT NULL DEFAULT 1, `created` timestamp NOT NULL DEFAULT current_timestamp(), KEY `stream` (`stream`), CONSTRAINT `alert_rules_device_id_lock` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`), CONSTRAINT `alert_rules_device_type_id_lock` FOREIGN KEY (`device_type_id`) REFERENCES `device_types` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `alerts`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `rule_id` bigint(20) UNSIGNED NOT NULL, `device_id` bigint(20) UNSIGNED NOT NULL, `status` varchar(16) NOT NULL, `value` double DEFAULT NULL, `started` timestamp NOT NULL DEFAULT current_timestamp(), `fired` timestamp NULL DEFAULT NULL, `acknowledged` timestamp NULL DEFAULT NULL, `acknowledged_by` varchar(128) DEFAULT NULL, `resolved` timestamp NULL DEFAULT NULL, `updated` timestamp NULL DEFAULT NULL, `open_key` tinyint(1) AS (IF(`status` = 'resolved', NULL, 1)) STORED, KEY `rule_device_status` (`rule_id`, `device_id`, `status`), UNIQUE KEY `rule_device_open` (`rule_id`, `device_id`, `open_key`), KEY `status` (`status`), CONSTRAINT `alerts_rule_id_lock` FOREIGN KEY (`rule_id`) REFERENCES `alert_rules` (`id`), CONSTRAINT `alerts_device_id_lock` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `alert_rule_samples`(`rule_id` bigint(20) UNSIGNED NOT NULL, `device_id` bigint(20) UNSIGNED NOT NULL, `value` double NOT NULL, `timestamp` timestamp NULL DEFAULT NULL, PRIMARY KEY (`rule_id`, `device_id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"ALTER TABLE `devices` ADD `status_changed` timestamp NULL DEFAULT NULL;",
+		"CREATE TABLE `webhooks`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `url` varchar(1024) NOT NULL, `events` varchar(1024) NOT NULL, `device_id` bigint(20) UNSIGNED DEFAULT NULL, `device_type_id` bigint(20) UNSIGNED DEFAULT NULL, `group_id` bigint(20) UNSIGNED DEFAULT NULL, `secret` varchar(128) NOT NULL, `enabled` tinyint NOT NULL DEFAULT 1, `created` timestamp NOT NULL DEFAULT current_timestamp(), CONSTRAINT `webhooks_device_id_lock` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`), CONSTRAINT `webhooks_device_type_id_lock` FOREIGN KEY (`device_type_id`) REFERENCES `device_types` (`id`), CONSTRAINT `webhooks_group_id_lock` FOREIGN KEY (`group_id`) REFERENCES `device_groups` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `webhook_deliveries`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `webhook_id` bigint(20) UNSIGNED NOT NULL, `event` varchar(64) NOT NULL, `payload` mediumtext NOT NULL, `status` varchar(16) NOT NULL, `attempts` int NOT NULL DEFAULT 0, `next_attempt` timestamp NULL DEFAULT NULL, `status_code` int DEFAULT NULL, `error` varchar(1024) DEFAULT NULL, `created` timestamp NOT NULL DEFAULT current_timestamp(), `updated` timestamp NULL DEFAULT NULL, KEY `status_next_attempt` (`status`, `next_attempt`), KEY `webhook_id` (`webhook_id`), CONSTRAINT `webhook_deliveries_webhook_id_lock` FOREIGN KEY (`webhook_id`) REFERENCES `webhooks` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"CREATE TABLE `event_dead_letters`(`id` bigint(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, `event` varchar(128) NOT NULL, `version` int NOT NULL DEFAULT 0, `message` mediumtext NOT NULL, `application` varchar(128) NOT NULL, `handler` varchar(256) NOT NULL, `error` varchar(1024) NOT NULL, `attempts` int NOT NULL, `failed` timestamp NULL DEFAULT NULL, `replayed` timestamp NULL DEFAULT NULL, `created` timestamp NOT NULL DEFAULT current_timestamp(), KEY `application_handler` (`application`, `handler`), KEY `event` (`event`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+		"ALTER TABLE `certificate_requests` ADD `authenticated` tinyint NOT NULL DEFAULT 0;",
 	}
 )
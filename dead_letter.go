@@ -0,0 +1,152 @@
+package phoenix
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cmodk/phoenix/app"
+)
+
+// EventDeadLetter is an event a handler gave up on, kept for inspection until
+// it is replayed or deleted
+type EventDeadLetter struct {
+	Id          uint64     `db:"id" json:"id" table:"event_dead_letters"`
+	Event       string     `db:"event" json:"event"`
+	Version     int        `db:"version" json:"version"`
+	Message     string     `db:"message" json:"message"`
+	Application string     `db:"application" json:"application"`
+	Handler     string     `db:"handler" json:"handler"`
+	Error       string     `db:"error" json:"error"`
+	Attempts    int        `db:"attempts" json:"attempts"`
+	Failed      time.Time  `db:"failed" json:"failed"`
+	Replayed    *time.Time `db:"replayed" json:"replayed"`
+	Created     time.Time  `db:"created" json:"created"`
+}
+
+type EventDeadLetterCriteria struct {
+	Id          uint64 `schema:"id" db:"id"`
+	Event       string `schema:"event" db:"event"`
+	Application string `schema:"application" db:"application"`
+	Handler     string `schema:"handler" db:"handler"`
+
+	Limit int `schema:"limit"`
+}
+
+func NewEventDeadLetter(dead app.DeadLetter) *EventDeadLetter {
+	return &EventDeadLetter{
+		Event:       dead.Event.Event,
+		Version:     dead.Event.Version,
+		Message:     string(dead.Event.Message),
+		Application: dead.Application,
+		Handler:     dead.Handler,
+		Error:       dead.Error,
+		Attempts:    dead.Attempts,
+		Failed:      dead.Failed,
+	}
+}
+
+// DeadLetter returns the dead letter to replay, with the possibly edited
+// message
+func (d *EventDeadLetter) DeadLetter() (app.DeadLetter, error) {
+	if !json.Valid([]byte(d.Message)) {
+		return app.DeadLetter{}, fmt.Errorf("Dead letter message is not valid json")
+	}
+
+	return app.DeadLetter{
+		Event: app.NsqEvent{
+			Event:   d.Event,
+			Version: d.Version,
+			Message: json.RawMessage(d.Message),
+		},
+		Application: d.Application,
+		Handler:     d.Handler,
+		Error:       d.Error,
+		Attempts:    d.Attempts,
+		Failed:      d.Failed,
+	}, nil
+}
+
+func (devices *Devices) EventDeadLetterInsert(d *EventDeadLetter) error {
+	d.Created = time.Now().UTC()
+	return devices.db.Insert(d, "event_dead_letters")
+}
+
+func (devices *Devices) EventDeadLetterGet(c EventDeadLetterCriteria) (*EventDeadLetter, error) {
+	var d EventDeadLetter
+	if err := devices.db.MatchOne(&d, "event_dead_letters", c); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func (devices *Devices) EventDeadLetterList(c EventDeadLetterCriteria) ([]EventDeadLetter, error) {
+	var dead []EventDeadLetter
+	if err := devices.db.Match(&dead, "event_dead_letters", c); err != nil {
+		return nil, err
+	}
+
+	return dead, nil
+}
+
+// EventDeadLetterReplayList returns the dead letters to replay: the dead
+// letter with the id, or the dead letters of the event or handler which have
+// not been replayed. Criteria without any of them are refused, so a replay
+// never picks every dead letter by accident.
+func (devices *Devices) EventDeadLetterReplayList(c EventDeadLetterCriteria) ([]EventDeadLetter, error) {
+	if c.Id == 0 && c.Event == "" && c.Handler == "" {
+		return nil, fmt.Errorf("Replaying dead letters needs an id, event or handler")
+	}
+
+	dead, err := devices.EventDeadLetterList(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Id != 0 {
+		return dead, nil
+	}
+
+	pending := []EventDeadLetter{}
+	for _, d := range dead {
+		if d.Replayed == nil {
+			pending = append(pending, d)
+		}
+	}
+
+	return pending, nil
+}
+
+// EventDeadLetterUpdate saves an edited message of the dead letter
+func (devices *Devices) EventDeadLetterUpdate(d *EventDeadLetter) error {
+	if !json.Valid([]byte(d.Message)) {
+		return fmt.Errorf("Dead letter message is not valid json")
+	}
+
+	_, err := devices.db.Exec("UPDATE event_dead_letters SET message = ?, version = ? WHERE id = ?", d.Message, d.Version, d.Id)
+	return err
+}
+
+// EventDeadLetterReplay publishes the event again for the handler which gave
+// up on it
+func (devices *Devices) EventDeadLetterReplay(d *EventDeadLetter) error {
+	dead, err := d.DeadLetter()
+	if err != nil {
+		return err
+	}
+
+	if err := phoenix.Event.Replay(dead); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	d.Replayed = &now
+	_, err = devices.db.Exec("UPDATE event_dead_letters SET replayed = ? WHERE id = ?", d.Replayed, d.Id)
+	return err
+}
+
+func (devices *Devices) EventDeadLetterDelete(d *EventDeadLetter) error {
+	_, err := devices.db.Exec("DELETE FROM event_dead_letters WHERE id = ?", d.Id)
+	return err
+}
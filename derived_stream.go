@@ -0,0 +1,207 @@
+package phoenix
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cmodk/phoenix/app"
+	"github.com/cmodk/phoenix/expression"
+)
+
+const (
+	//Default time the inputs of a derived stream may be apart
+	DerivedStreamDefaultWindow = 60
+)
+
+// DerivedStream is a stream computed from other streams of the same device.
+// It is defined for a single device or for all devices of a device type. The
+// value is computed when one of the inputs is updated, if the last values of
+// all other inputs are within window seconds of the update.
+type DerivedStream struct {
+	Id           uint64    `db:"id" json:"id" table:"derived_streams"`
+	DeviceId     *uint64   `db:"device_id" json:"device_id,omitempty"`
+	DeviceTypeId *uint64   `db:"device_type_id" json:"device_type_id,omitempty"`
+	Code         string    `db:"code" json:"code"`
+	Expression   string    `db:"expression" json:"expression"`
+	Window       int       `db:"window_seconds" json:"window"`
+	Created      time.Time `db:"created" json:"created"`
+
+	parsed *expression.Expression
+}
+
+// Parse parses the expression, the result is kept for Inputs and Eval
+func (s *DerivedStream) Parse() (*expression.Expression, error) {
+	if s.parsed == nil {
+		e, err := expression.Parse(s.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("Derived stream %s: %s", s.Code, err)
+		}
+		s.parsed = e
+	}
+
+	return s.parsed, nil
+}
+
+func (s *DerivedStream) Inputs() ([]string, error) {
+	e, err := s.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Variables(), nil
+}
+
+func (s *DerivedStream) Validate() error {
+	if len(s.Code) == 0 {
+		return fmt.Errorf("Derived stream needs a code")
+	}
+
+	if s.Window < 0 {
+		return fmt.Errorf("Window cannot be negative")
+	}
+
+	inputs, err := s.Inputs()
+	if err != nil {
+		return err
+	}
+
+	if len(inputs) == 0 {
+		return fmt.Errorf("Derived stream %s has no input streams", s.Code)
+	}
+
+	return nil
+}
+
+// WindowDuration is the time the inputs may be apart
+func (s *DerivedStream) WindowDuration() time.Duration {
+	if s.Window == 0 {
+		return DerivedStreamDefaultWindow * time.Second
+	}
+
+	return time.Duration(s.Window) * time.Second
+}
+
+// CheckDerivedStreamCycles returns an error if the derived streams depend on
+// each other in a cycle
+func CheckDerivedStreamCycles(derived []DerivedStream) error {
+	graph := map[string][]string{}
+	for i := range derived {
+		inputs, err := derived[i].Inputs()
+		if err != nil {
+			return err
+		}
+		graph[derived[i].Code] = append(graph[derived[i].Code], inputs...)
+	}
+
+	if cycle := expression.FindCycle(graph); cycle != nil {
+		return fmt.Errorf("Derived streams depend on each other: %s", strings.Join(cycle, " -> "))
+	}
+
+	return nil
+}
+
+// DerivedStreamList returns the derived streams of the device and its device
+// type, a stream defined on the device replaces one of the type with the same
+// code
+func (d *Device) DerivedStreamList() ([]DerivedStream, error) {
+	var derived []DerivedStream
+	if err := d.db.Select(&derived, "SELECT * FROM derived_streams WHERE device_id = ? ORDER BY code", d.Id); err != nil {
+		return nil, err
+	}
+
+	if d.DeviceTypeId == nil {
+		return derived, nil
+	}
+
+	var type_derived []DerivedStream
+	if err := d.db.Select(&type_derived, "SELECT * FROM derived_streams WHERE device_type_id = ? ORDER BY code", *d.DeviceTypeId); err != nil {
+		return nil, err
+	}
+
+	defined := map[string]bool{}
+	for _, s := range derived {
+		defined[s.Code] = true
+	}
+
+	for _, s := range type_derived {
+		if !defined[s.Code] {
+			derived = append(derived, s)
+		}
+	}
+
+	return derived, nil
+}
+
+// DerivedStreamInsert adds a derived stream to the device
+func (d *Device) DerivedStreamInsert(s *DerivedStream) error {
+	s.DeviceId = &d.Id
+	s.DeviceTypeId = nil
+
+	derived, err := d.DerivedStreamList()
+	if err != nil {
+		return err
+	}
+
+	return insertDerivedStream(d.db, s, derived)
+}
+
+func (d *Device) DerivedStreamDelete(id uint64) error {
+	_, err := d.db.Exec("DELETE FROM derived_streams WHERE id = ? AND device_id = ?", id, d.Id)
+	return err
+}
+
+func (devices *Devices) TypeDerivedStreamList(t *DeviceType) ([]DerivedStream, error) {
+	var derived []DerivedStream
+	if err := devices.db.Select(&derived, "SELECT * FROM derived_streams WHERE device_type_id = ? ORDER BY code", t.Id); err != nil {
+		return nil, err
+	}
+
+	return derived, nil
+}
+
+// TypeDerivedStreamInsert adds a derived stream to all devices of the type
+func (devices *Devices) TypeDerivedStreamInsert(t *DeviceType, s *DerivedStream) error {
+	s.DeviceId = nil
+	s.DeviceTypeId = &t.Id
+
+	derived, err := devices.TypeDerivedStreamList(t)
+	if err != nil {
+		return err
+	}
+
+	return insertDerivedStream(devices.db, s, derived)
+}
+
+func insertDerivedStream(db *app.Database, s *DerivedStream, existing []DerivedStream) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	derived := []DerivedStream{*s}
+	for _, e := range existing {
+		if e.Code != s.Code {
+			derived = append(derived, e)
+		}
+	}
+
+	if err := CheckDerivedStreamCycles(derived); err != nil {
+		return err
+	}
+
+	//LAST_INSERT_ID(id) returns the id of the replaced stream as well
+	s.Created = time.Now().UTC()
+	result, err := db.Exec("INSERT INTO derived_streams (device_id, device_type_id, code, expression, window_seconds, created) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), expression = VALUES(expression), window_seconds = VALUES(window_seconds)",
+		s.DeviceId, s.DeviceTypeId, s.Code, s.Expression, s.Window, s.Created)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	s.Id = uint64(id)
+
+	return nil
+}
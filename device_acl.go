@@ -0,0 +1,68 @@
+package phoenix
+
+import (
+	"fmt"
+)
+
+var (
+	//Topics every device may subscribe to, %s is the device guid
+	DefaultSubscribeTopics = []string{
+		"/device/%s/command",
+		"/device/%s/error",
+	}
+)
+
+type DeviceTopicAcl struct {
+	Id       uint64 `db:"id" json:"id" table:"device_topic_acls"`
+	DeviceId uint64 `db:"device_id" json:"-"`
+	Topic    string `db:"topic" json:"topic"`
+}
+
+type DeviceTopicAclCriteria struct {
+	Id       uint64 `schema:"id" db:"id"`
+	DeviceId uint64 `schema:"device_id" db:"device_id"`
+	Topic    string `schema:"topic" db:"topic"`
+
+	Limit int `schema:"limit"`
+}
+
+// SubscribeTopics returns the default topics for the device followed by the
+// extra topics allowed for this device
+func (d *Device) SubscribeTopics() ([]string, error) {
+	var topics []string
+	for _, topic := range DefaultSubscribeTopics {
+		topics = append(topics, fmt.Sprintf(topic, d.Guid))
+	}
+
+	acls, err := d.TopicAclList(DeviceTopicAclCriteria{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, acl := range acls {
+		topics = append(topics, acl.Topic)
+	}
+
+	return topics, nil
+}
+
+func (d *Device) TopicAclList(c DeviceTopicAclCriteria) ([]DeviceTopicAcl, error) {
+	c.DeviceId = d.Id
+
+	var acls []DeviceTopicAcl
+	if err := d.db.Match(&acls, "device_topic_acls", c); err != nil {
+		return nil, err
+	}
+
+	return acls, nil
+}
+
+func (d *Device) TopicAclInsert(acl *DeviceTopicAcl) error {
+	acl.DeviceId = d.Id
+	return d.db.Insert(acl, "device_topic_acls")
+}
+
+func (d *Device) TopicAclDelete(id uint64) error {
+	_, err := d.db.Exec("DELETE FROM device_topic_acls WHERE device_id = ? AND id = ?", d.Id, id)
+	return err
+}
@@ -0,0 +1,175 @@
+package phoenix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// DeviceType is a device model with the streams it is expected to send and
+// the configuration devices of the type get when provisioned. The config
+// template renders a JSON object which is merged over the default
+// configuration.
+type DeviceType struct {
+	Id             uint64      `db:"id" json:"id" table:"device_types"`
+	Name           string      `db:"name" json:"name"`
+	Model          string      `db:"model" json:"model"`
+	FirmwareFamily *string     `db:"firmware_family" json:"firmware_family"`
+	Configuration  ShadowState `db:"configuration" json:"configuration"`
+	ConfigTemplate *string     `db:"config_template" json:"config_template"`
+	Created        time.Time   `db:"created" json:"created"`
+
+	Streams []DeviceTypeStream `json:"streams"`
+}
+
+// DeviceTypeStream is a stream devices of the type are expected to send
+type DeviceTypeStream struct {
+	Id           uint64 `db:"id" json:"id" table:"device_type_streams"`
+	DeviceTypeId uint64 `db:"device_type_id" json:"-"`
+	Code         string `db:"code" json:"code"`
+	StreamMetadata
+}
+
+type DeviceTypeCriteria struct {
+	Id    uint64 `schema:"id" db:"id"`
+	Name  string `schema:"name" db:"name"`
+	Model string `schema:"model" db:"model"`
+
+	Limit int `schema:"limit"`
+}
+
+type deviceTypeTemplateData struct {
+	Device *Device
+	Type   *DeviceType
+}
+
+func (t *DeviceType) template() (*template.Template, error) {
+	if t.ConfigTemplate == nil {
+		return nil, nil
+	}
+
+	return template.New(t.Name).Option("missingkey=error").Parse(*t.ConfigTemplate)
+}
+
+// Validate checks the default configuration, the template syntax and the
+// stream ranges
+func (t *DeviceType) Validate() error {
+	if len(t.Name) == 0 {
+		return fmt.Errorf("Device type needs a name")
+	}
+
+	if err := t.Configuration.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := t.template(); err != nil {
+		return err
+	}
+
+	for _, s := range t.Streams {
+		if len(s.Code) == 0 {
+			return fmt.Errorf("Device type stream needs a code")
+		}
+
+		if err := s.Validate(); err != nil {
+			return fmt.Errorf("Stream %s: %s", s.Code, err)
+		}
+	}
+
+	return nil
+}
+
+// Render returns the configuration for a device of the type
+func (t *DeviceType) Render(d *Device) (ShadowState, error) {
+	config := ShadowState{}
+	config.Merge(t.Configuration)
+
+	tmpl, err := t.template()
+	if err != nil {
+		return nil, err
+	}
+
+	if tmpl == nil {
+		return config, nil
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, deviceTypeTemplateData{d, t}); err != nil {
+		return nil, err
+	}
+
+	var templated ShadowState
+	if err := json.Unmarshal(rendered.Bytes(), &templated); err != nil {
+		return nil, fmt.Errorf("Config template for %s did not render a JSON object: %s", t.Name, err)
+	}
+
+	if err := templated.Validate(); err != nil {
+		return nil, err
+	}
+
+	config.Merge(templated)
+	return config, nil
+}
+
+func (devices *Devices) TypeInsert(t *DeviceType) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	t.Created = time.Now().UTC()
+	if err := devices.db.Insert(t, "device_types"); err != nil {
+		return err
+	}
+
+	for i := range t.Streams {
+		if err := devices.TypeStreamSet(t, &t.Streams[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (devices *Devices) TypeGet(c DeviceTypeCriteria) (*DeviceType, error) {
+	var t DeviceType
+	if err := devices.db.MatchOne(&t, "device_types", c); err != nil {
+		return nil, err
+	}
+
+	streams, err := devices.TypeStreams(t.Id)
+	if err != nil {
+		return nil, err
+	}
+	t.Streams = streams
+
+	return &t, nil
+}
+
+func (devices *Devices) TypeList(c DeviceTypeCriteria) ([]DeviceType, error) {
+	var types []DeviceType
+	if err := devices.db.Match(&types, "device_types", c); err != nil {
+		return nil, err
+	}
+
+	return types, nil
+}
+
+func (d *Device) Type() (*DeviceType, error) {
+	if d.DeviceTypeId == nil {
+		return nil, nil
+	}
+
+	devices := Devices{d.db, d.ca}
+	return devices.TypeGet(DeviceTypeCriteria{Id: *d.DeviceTypeId})
+}
+
+func (d *Device) SetType(t *DeviceType) error {
+	if err := d.Update("device_type_id", t.Id); err != nil {
+		return err
+	}
+
+	d.DeviceTypeId = &t.Id
+	return nil
+}
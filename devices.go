@@ -55,19 +55,85 @@ func (devices *Devices) Get(c DeviceCriteria) (*Device, error) {
 
 }
 
+const (
+	//Use the timestamp sent by the device, skewed samples are only flagged
+	TimestampPolicyDevice = "device"
+	//Always use the time the sample was received
+	TimestampPolicyServer = "server"
+	//Use the time the sample was received if the device clock is skewed
+	TimestampPolicySkew = "skew"
+	//Reject samples from a skewed device clock
+	TimestampPolicyReject = "reject"
+)
+
+var (
+	TimestampPolicies = []string{
+		TimestampPolicyDevice,
+		TimestampPolicyServer,
+		TimestampPolicySkew,
+		TimestampPolicyReject,
+	}
+)
+
 type Device struct {
-	db              *app.Database
-	ca              *gocql.Session
-	Id              uint64     `db:"id" json:"id"`
-	Guid            string     `db:"guid" json:"guid"`
-	Created         time.Time  `db:"created" json:"created"`
-	Token           *string    `db:"token" json:"-"`
-	TokenExpiration *time.Time `db:"token_expiration" json:"token_expiration"`
-	Online          bool       `db:"online" json:"online"`
+	db                 *app.Database
+	ca                 *gocql.Session
+	Id                 uint64     `db:"id" json:"id"`
+	Guid               string     `db:"guid" json:"guid"`
+	Created            time.Time  `db:"created" json:"created"`
+	Token              *string    `db:"token" json:"-"`
+	TokenExpiration    *time.Time `db:"token_expiration" json:"token_expiration"`
+	Online             bool       `db:"online" json:"online"`
+	TimestampPrecision *string    `db:"timestamp_precision" json:"timestamp_precision"`
+	TimestampPolicy    *string    `db:"timestamp_policy" json:"timestamp_policy"`
+	FirmwareFamily     *string    `db:"firmware_family" json:"firmware_family"`
+	FirmwareVersion    *string    `db:"firmware_version" json:"firmware_version"`
+	DeviceTypeId       *uint64    `db:"device_type_id" json:"device_type_id"`
+	StatusChanged      *time.Time `db:"status_changed" json:"status_changed"`
+}
+
+// VerifyToken checks a token presented by the device against the stored
+// device token and its expiration. The token of an earlier certificate is
+// valid until the device uses its newest certificate.
+func (d *Device) VerifyToken(token string) error {
+	valid, err := d.CertificateTokenValid(token)
+	if err != nil {
+		return err
+	}
+
+	if !valid {
+		return fmt.Errorf("Invalid token for device")
+	}
+
+	if d.TokenExpiration == nil || d.TokenExpiration.Before(time.Now()) {
+		return fmt.Errorf("Token expired")
+	}
+
+	revoked, err := d.CertificateRevoked(token)
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		return fmt.Errorf("Certificate revoked")
+	}
+
+	return d.CertificateUsed(token)
 }
 
 func (d *Device) UpdateOnlineStatus(status bool) error {
-	return d.Update("online", status)
+	if d.Online == status && d.StatusChanged != nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if _, err := d.db.Exec("UPDATE devices SET online = ?, status_changed = ? WHERE id = ?", status, now, d.Id); err != nil {
+		return err
+	}
+
+	d.Online = status
+	d.StatusChanged = &now
+	return nil
 }
 
 func (d *Device) Update(column string, value interface{}) error {
@@ -332,6 +398,8 @@ type DeviceCriteria struct {
 	Token   string    `schema:"token" db:"token"`
 	Created time.Time `schema:"created" db:"created"`
 
+	DeviceTypeId uint64 `schema:"device_type_id" db:"device_type_id"`
+
 	Limit int `schema:"limit"`
 }
 
@@ -5,15 +5,28 @@ import (
 	"time"
 )
 
-var (
-	test_app = New()
-)
+// testPhoenix returns the app of the dev environment, the test is skipped
+// when its database is not available
+func testPhoenix(t *testing.T) (p *Phoenix) {
+	if testing.Short() {
+		t.Skip("Needs the database of the dev environment")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Skipf("Needs the database of the dev environment: %v", r)
+		}
+	}()
+
+	return New()
+}
 
 func TestNotificationWrite(t *testing.T) {
+	test_app := testPhoenix(t)
 
 	now := time.Now()
 	s := Stream{
-		Name:      "test.stream",
+		Code:      "test.stream",
 		Timestamp: &now,
 		Value:     12.34,
 	}
@@ -25,7 +38,8 @@ func TestNotificationWrite(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = d.NotificationInsert(s.Notification())
+	n := s.Notification()
+	err = d.NotificationInsert(&n)
 	if err != nil {
 		t.Fatal(err)
 	}
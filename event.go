@@ -1,5 +1,64 @@
 package phoenix
 
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/cmodk/phoenix/app"
+)
+
+// Events returns an event of every registered type, the registrations are
+// the list of events published by Phoenix
+func Events() []interface{} {
+	events := []interface{}{}
+	for _, et := range app.EventTypes() {
+		events = append(events, reflect.Zero(et.Type).Interface())
+	}
+
+	return events
+}
+
+var (
+	//The events the applications publish, they are checked for a registered
+	//name when the app starts. Add the event here when publishing a new one.
+	PublishedEvents = []interface{}{
+		DeviceNotificationCreated{},
+		DeviceCommandCreated{},
+		DeviceOnline{},
+		StreamUpdated{},
+		SampleSaved{},
+		StringSaved{},
+		DeviceClockSkewDetected{},
+		DeviceCertificateRevoked{},
+		DeviceCertificateExpiring{},
+		DeviceCertificateReissue{},
+		DeviceShadowUpdated{},
+		StreamValueOutOfRange{},
+		AlertFiring{},
+		AlertResolved{},
+	}
+)
+
+// The names of the events on the wire, they must never change. Bump the
+// version when the schema changes.
+func init() {
+	app.RegisterEvent[DeviceNotificationCreated]("device.notification.created", 1)
+	app.RegisterEvent[DeviceCommandCreated]("device.command.created", 1)
+	app.RegisterEvent[DeviceOnline]("device.online", 1)
+	app.RegisterEvent[StreamUpdated]("stream.updated", 1)
+	app.RegisterEvent[SampleSaved]("sample.saved", 1)
+	app.RegisterEvent[StringSaved]("string.saved", 1)
+	app.RegisterEvent[DeviceClockSkewDetected]("device.clock_skew.detected", 1)
+	app.RegisterEvent[DeviceCertificateRevoked]("device.certificate.revoked", 1)
+	app.RegisterEvent[DeviceCertificateExpiring]("device.certificate.expiring", 1)
+	app.RegisterEvent[DeviceCertificateReissue]("device.certificate.reissue", 1)
+	app.RegisterEvent[DeviceShadowUpdated]("device.shadow.updated", 1)
+	app.RegisterEvent[StreamValueOutOfRange]("stream.value_out_of_range", 1)
+	app.RegisterEvent[AlertFiring]("alert.firing", 1)
+	app.RegisterEvent[AlertResolved]("alert.resolved", 1)
+}
+
 type DeviceNotificationCreated DeviceNotification
 type DeviceCommandCreated DeviceCommand
 
@@ -8,3 +67,127 @@ type StreamUpdated Stream
 type SampleSaved Sample
 
 type StringSaved Stream
+
+// The notifications and commands keep their simpleflake ids as event ids
+func (e DeviceNotificationCreated) EventId() uint64 {
+	return e.Id
+}
+
+func (e DeviceCommandCreated) EventId() uint64 {
+	return e.Id
+}
+
+// Stream updates and samples are identified by their value, the same value
+// saved again is the same event
+func (e StreamUpdated) EventId() uint64 {
+	return streamEventId(Stream(e))
+}
+
+func (e StringSaved) EventId() uint64 {
+	return streamEventId(Stream(e))
+}
+
+func (e SampleSaved) EventId() uint64 {
+	var value interface{}
+	if e.Value != nil {
+		value = *e.Value
+	}
+
+	return app.EventIdAt(e.Timestamp, fmt.Sprintf("%s/%s/%v", e.Device, e.Stream, value))
+}
+
+func streamEventId(s Stream) uint64 {
+	if s.Timestamp == nil {
+		return 0
+	}
+
+	device := fmt.Sprintf("%d", s.DeviceId)
+	if s.DeviceGuid != nil {
+		device = *s.DeviceGuid
+	}
+
+	return app.EventIdAt(*s.Timestamp, fmt.Sprintf("%s/%s/%v", device, s.Code, s.Value))
+}
+
+type DeviceClockSkewDetected struct {
+	DeviceGuid      string        `json:"device_guid"`
+	Stream          string        `json:"stream"`
+	DeviceTimestamp time.Time     `json:"device_timestamp"`
+	ServerTimestamp time.Time     `json:"server_timestamp"`
+	Skew            time.Duration `json:"skew"`
+	Policy          string        `json:"policy"`
+}
+
+type DeviceCertificateRevoked struct {
+	DeviceId   uint64    `json:"device_id"`
+	DeviceGuid string    `json:"device_guid"`
+	Serial     string    `json:"serial"`
+	Reason     int       `json:"reason"`
+	RevokedAt  time.Time `json:"revoked_at"`
+}
+
+type DeviceCertificateExpiring struct {
+	DeviceId   uint64    `json:"device_id"`
+	DeviceGuid string    `json:"device_guid"`
+	Serial     string    `json:"serial"`
+	NotAfter   time.Time `json:"not_after"`
+}
+
+// DeviceCertificateReissue asks the device to renew a certificate issued by
+// a CA which is being rotated out
+type DeviceCertificateReissue struct {
+	DeviceId   uint64    `json:"device_id"`
+	DeviceGuid string    `json:"device_guid"`
+	Serial     string    `json:"serial"`
+	NotAfter   time.Time `json:"not_after"`
+}
+
+// DeviceShadowUpdated is published when the desired configuration of a
+// device changes
+type DeviceShadowUpdated struct {
+	DeviceId   uint64      `json:"device_id"`
+	DeviceGuid string      `json:"device_guid"`
+	Delta      ShadowState `json:"delta"`
+}
+
+// StreamValueOutOfRange is published when a stream value does not match the
+// type or range in the stream metadata
+type StreamValueOutOfRange struct {
+	DeviceId   uint64      `json:"device_id"`
+	DeviceGuid string      `json:"device_guid"`
+	Stream     string      `json:"stream"`
+	Value      interface{} `json:"value"`
+	Timestamp  time.Time   `json:"timestamp"`
+	Reason     string      `json:"reason"`
+	Rejected   bool        `json:"rejected"`
+}
+
+// AlertFiring is published when the condition of an alert rule has held for
+// the duration of the rule
+type AlertFiring struct {
+	AlertId    uint64    `json:"alert_id"`
+	RuleId     uint64    `json:"rule_id"`
+	Rule       string    `json:"rule"`
+	Condition  string    `json:"condition"`
+	DeviceId   uint64    `json:"device_id"`
+	DeviceGuid string    `json:"device_guid"`
+	Stream     *string   `json:"stream,omitempty"`
+	Value      *float64  `json:"value,omitempty"`
+	Started    time.Time `json:"started"`
+	Fired      time.Time `json:"fired"`
+}
+
+// AlertResolved is published when the condition of a fired alert no longer
+// holds
+type AlertResolved struct {
+	AlertId    uint64    `json:"alert_id"`
+	RuleId     uint64    `json:"rule_id"`
+	Rule       string    `json:"rule"`
+	Condition  string    `json:"condition"`
+	DeviceId   uint64    `json:"device_id"`
+	DeviceGuid string    `json:"device_guid"`
+	Stream     *string   `json:"stream,omitempty"`
+	Value      *float64  `json:"value,omitempty"`
+	Fired      time.Time `json:"fired"`
+	Resolved   time.Time `json:"resolved"`
+}
@@ -0,0 +1,26 @@
+package phoenix
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cmodk/phoenix/app"
+)
+
+func TestPublishedEvents(t *testing.T) {
+	if err := app.CheckEvents(PublishedEvents...); err != nil {
+		t.Error(err)
+	}
+
+	published := make(map[reflect.Type]bool)
+	for _, e := range PublishedEvents {
+		published[reflect.TypeOf(e)] = true
+	}
+
+	//Webhooks can only be sent for published events
+	for _, e := range WebhookEvents {
+		if !published[reflect.TypeOf(e)] {
+			t.Errorf("Webhook event %T is not published", e)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Package expression parses and evaluates arithmetic expressions over named
+// variables, used for derived streams.
+//
+// Supported are numbers, variables, the operators + - * / % ^, unary minus,
+// parentheses and the functions abs, sqrt, min, max, pow, round, floor and
+// ceil. Variables are stream codes, codes with characters outside
+// [A-Za-z0-9_.] can be quoted with backticks.
+package expression
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Expression is a parsed expression
+type Expression struct {
+	source string
+	root   node
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Variables returns the names of the variables used, sorted
+func (e *Expression) Variables() []string {
+	seen := map[string]bool{}
+	e.root.variables(seen)
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Eval evaluates the expression, all variables must be given
+func (e *Expression) Eval(variables map[string]float64) (float64, error) {
+	value, err := e.root.eval(variables)
+	if err != nil {
+		return 0, err
+	}
+
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("Expression %s is not a number", e.source)
+	}
+
+	return value, nil
+}
+
+type node interface {
+	eval(variables map[string]float64) (float64, error)
+	variables(seen map[string]bool)
+}
+
+type number float64
+
+func (n number) eval(map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+func (n number) variables(map[string]bool) {}
+
+type variable string
+
+func (v variable) eval(variables map[string]float64) (float64, error) {
+	value, ok := variables[string(v)]
+	if !ok {
+		return 0, fmt.Errorf("Missing value for %s", string(v))
+	}
+
+	return value, nil
+}
+
+func (v variable) variables(seen map[string]bool) {
+	seen[string(v)] = true
+}
+
+type unary struct {
+	operand node
+}
+
+func (u unary) eval(variables map[string]float64) (float64, error) {
+	value, err := u.operand.eval(variables)
+	return -value, err
+}
+
+func (u unary) variables(seen map[string]bool) {
+	u.operand.variables(seen)
+}
+
+type binary struct {
+	operator    rune
+	left, right node
+}
+
+func (b binary) eval(variables map[string]float64) (float64, error) {
+	left, err := b.left.eval(variables)
+	if err != nil {
+		return 0, err
+	}
+
+	right, err := b.right.eval(variables)
+	if err != nil {
+		return 0, err
+	}
+
+	switch b.operator {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	case '/':
+		if right == 0 {
+			return 0, fmt.Errorf("Division by zero")
+		}
+		return left / right, nil
+	case '%':
+		if right == 0 {
+			return 0, fmt.Errorf("Division by zero")
+		}
+		return math.Mod(left, right), nil
+	case '^':
+		return math.Pow(left, right), nil
+	}
+
+	return 0, fmt.Errorf("Unknown operator %c", b.operator)
+}
+
+func (b binary) variables(seen map[string]bool) {
+	b.left.variables(seen)
+	b.right.variables(seen)
+}
+
+type function struct {
+	name      string
+	arguments []node
+}
+
+var (
+	functions = map[string]struct {
+		arguments int
+		f         func(arguments []float64) float64
+	}{
+		"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+		"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+		"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+		"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+		"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+		"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+		"min":   {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+		"max":   {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+	}
+)
+
+func (f function) eval(variables map[string]float64) (float64, error) {
+	arguments := make([]float64, len(f.arguments))
+	for i, a := range f.arguments {
+		value, err := a.eval(variables)
+		if err != nil {
+			return 0, err
+		}
+		arguments[i] = value
+	}
+
+	return functions[f.name].f(arguments), nil
+}
+
+func (f function) variables(seen map[string]bool) {
+	for _, a := range f.arguments {
+		a.variables(seen)
+	}
+}
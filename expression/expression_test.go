@@ -0,0 +1,126 @@
+package expression
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	variables := map[string]float64{
+		"voltage":     230,
+		"current":     2.5,
+		"supply_temp": 55,
+		"return_temp": 40.5,
+		"phase.1":     10,
+		"a-b":         3,
+	}
+
+	tests := []struct {
+		expression string
+		expected   float64
+	}{
+		{"voltage * current", 575},
+		{"supply_temp - return_temp", 14.5},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2 ^ 2", -4},
+		{"10 - 4 - 3", 3},
+		{"7 % 4", 3},
+		{"phase.1 / 4", 2.5},
+		{"`a-b` * 2", 6},
+		{"max(current, 3) + min(1, 2)", 4},
+		{"abs(-3) + sqrt(16) + pow(2, 3)", 15},
+		{"round(2.5) + floor(1.9) + ceil(0.1)", 5},
+		{"1.5e3 + .5", 1500.5},
+	}
+
+	for _, test := range tests {
+		e, err := Parse(test.expression)
+		if err != nil {
+			t.Errorf("%s: %s", test.expression, err)
+			continue
+		}
+
+		value, err := e.Eval(variables)
+		if err != nil {
+			t.Errorf("%s: %s", test.expression, err)
+			continue
+		}
+
+		if math.Abs(value-test.expected) > 1e-9 {
+			t.Errorf("%s = %v, expected %v", test.expression, value, test.expected)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	invalid := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 + 2)",
+		"unknown(1)",
+		"max(1)",
+		"1 $ 2",
+		"`unterminated",
+		"``",
+		"a b",
+	}
+
+	for _, source := range invalid {
+		if _, err := Parse(source); err == nil {
+			t.Errorf("Invalid expression accepted: %q", source)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	for _, source := range []string{"a / 0", "missing + 1", "sqrt(-1)"} {
+		e, err := Parse(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := e.Eval(map[string]float64{"a": 1}); err == nil {
+			t.Errorf("%s evaluated without error", source)
+		}
+	}
+}
+
+func TestVariables(t *testing.T) {
+	e, err := Parse("b * a + max(c, a) - 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := e.Variables(); !reflect.DeepEqual(v, []string{"a", "b", "c"}) {
+		t.Errorf("Wrong variables: %v", v)
+	}
+}
+
+func TestFindCycle(t *testing.T) {
+	acyclic := map[string][]string{
+		"power":  {"voltage", "current"},
+		"energy": {"power"},
+	}
+
+	if cycle := FindCycle(acyclic); cycle != nil {
+		t.Errorf("Cycle found in acyclic graph: %v", cycle)
+	}
+
+	cyclic := map[string][]string{
+		"a": {"b"},
+		"b": {"c"},
+		"c": {"a"},
+	}
+
+	if cycle := FindCycle(cyclic); !reflect.DeepEqual(cycle, []string{"a", "b", "c", "a"}) {
+		t.Errorf("Wrong cycle: %v", cycle)
+	}
+
+	if cycle := FindCycle(map[string][]string{"a": {"a"}}); cycle == nil {
+		t.Errorf("Self reference not found")
+	}
+}
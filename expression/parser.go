@@ -0,0 +1,273 @@
+package expression
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxExpressionLength = 1024
+)
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenNumber
+	tokenIdentifier
+	tokenOperator
+	tokenOpen
+	tokenClose
+	tokenComma
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	index int
+}
+
+func isIdentifier(r rune, first bool) bool {
+	if r == '_' || unicode.IsLetter(r) {
+		return true
+	}
+
+	return !first && (r == '.' || unicode.IsDigit(r))
+}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	runes := []rune(source)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			//Exponent
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				i++
+				if i < len(runes) && (runes[i] == '+' || runes[i] == '-') {
+					i++
+				}
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{tokenNumber, string(runes[start:i]), start})
+		case isIdentifier(r, true):
+			start := i
+			for i < len(runes) && isIdentifier(runes[i], false) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdentifier, string(runes[start:i]), start})
+		case r == '`':
+			start := i
+			end := strings.IndexRune(string(runes[i+1:]), '`')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated quoted name at %d", start)
+			}
+			name := []rune(string(runes[i+1:])[:end])
+			if len(name) == 0 {
+				return nil, fmt.Errorf("Empty quoted name at %d", start)
+			}
+			i += len(name) + 2
+			tokens = append(tokens, token{tokenIdentifier, string(name), start})
+		case strings.ContainsRune("+-*/%^", r):
+			tokens = append(tokens, token{tokenOperator, string(r), i})
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenOpen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenClose, ")", i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokenComma, ",", i})
+			i++
+		default:
+			return nil, fmt.Errorf("Unexpected %q at %d", r, i)
+		}
+	}
+
+	return append(tokens, token{tokenEnd, "", len(runes)}), nil
+}
+
+type parser struct {
+	tokens []token
+	index  int
+}
+
+// Parse parses an expression
+func Parse(source string) (*Expression, error) {
+	if len(source) > maxExpressionLength {
+		return nil, fmt.Errorf("Expression longer than %d characters", maxExpressionLength)
+	}
+
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+	root, err := p.expression(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, fmt.Errorf("Unexpected %q at %d", t.text, t.index)
+	}
+
+	return &Expression{source, root}, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.index]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.index]
+	if t.kind != tokenEnd {
+		p.index++
+	}
+	return t
+}
+
+func precedence(operator string) (int, bool) {
+	switch operator {
+	case "+", "-":
+		return 1, false
+	case "*", "/", "%":
+		return 2, false
+	case "^":
+		//Right associative
+		return 4, true
+	}
+
+	return 0, false
+}
+
+// expression parses operators binding tighter than min_precedence
+func (p *parser) expression(min_precedence int) (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokenOperator {
+			return left, nil
+		}
+
+		prec, right_associative := precedence(t.text)
+		if prec <= min_precedence {
+			return left, nil
+		}
+		p.next()
+
+		next_precedence := prec
+		if right_associative {
+			next_precedence = prec - 1
+		}
+
+		right, err := p.expression(next_precedence)
+		if err != nil {
+			return nil, err
+		}
+
+		left = binary{rune(t.text[0]), left, right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if t := p.peek(); t.kind == tokenOperator && (t.text == "-" || t.text == "+") {
+		p.next()
+		//Unary minus binds weaker than ^, -a^2 is -(a^2)
+		operand, err := p.expression(3)
+		if err != nil {
+			return nil, err
+		}
+
+		if t.text == "+" {
+			return operand, nil
+		}
+		return unary{operand}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		value, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %q at %d", t.text, t.index)
+		}
+		return number(value), nil
+	case tokenIdentifier:
+		if p.peek().kind == tokenOpen {
+			return p.function(t)
+		}
+		return variable(t.text), nil
+	case tokenOpen:
+		inner, err := p.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokenClose {
+			return nil, fmt.Errorf("Expected ) at %d", c.index)
+		}
+		return inner, nil
+	case tokenEnd:
+		return nil, fmt.Errorf("Unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("Unexpected %q at %d", t.text, t.index)
+}
+
+func (p *parser) function(name token) (node, error) {
+	definition, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("Unknown function %s at %d", name.text, name.index)
+	}
+
+	//Opening parenthesis
+	p.next()
+
+	f := function{name: name.text}
+	if p.peek().kind != tokenClose {
+		for {
+			argument, err := p.expression(0)
+			if err != nil {
+				return nil, err
+			}
+			f.arguments = append(f.arguments, argument)
+
+			if p.peek().kind != tokenComma {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if c := p.next(); c.kind != tokenClose {
+		return nil, fmt.Errorf("Expected ) at %d", c.index)
+	}
+
+	if len(f.arguments) != definition.arguments {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", name.text, definition.arguments, len(f.arguments))
+	}
+
+	return f, nil
+}
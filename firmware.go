@@ -0,0 +1,285 @@
+package phoenix
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+const (
+	FirmwareUpdatePending     = "pending"
+	FirmwareUpdateDownloading = "downloading"
+	FirmwareUpdateInstalling  = "installing"
+	FirmwareUpdateSucceeded   = "succeeded"
+	FirmwareUpdateFailed      = "failed"
+
+	RolloutActive    = "active"
+	RolloutPaused    = "paused"
+	RolloutCancelled = "cancelled"
+)
+
+// Firmware is an uploaded firmware image, the signature is made over the
+// sha256 with the firmware signing key
+type Firmware struct {
+	Id        uint64    `db:"id" json:"id" table:"firmwares"`
+	Family    string    `db:"family" json:"family"`
+	Version   string    `db:"version" json:"version"`
+	Filename  string    `db:"filename" json:"-"`
+	Size      int64     `db:"size" json:"size"`
+	Sha256    string    `db:"sha256" json:"sha256"`
+	Signature string    `db:"signature" json:"signature"`
+	Created   time.Time `db:"created" json:"created"`
+}
+
+// FirmwareUpdateParameters are the parameters of the firmware_update device
+// command
+type FirmwareUpdateParameters struct {
+	Version   string `json:"version"`
+	Url       string `json:"url"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+type FirmwareCriteria struct {
+	Id      uint64 `schema:"id" db:"id"`
+	Family  string `schema:"family" db:"family"`
+	Version string `schema:"version" db:"version"`
+
+	Limit int `schema:"limit"`
+}
+
+type DeviceGroup struct {
+	Id      uint64    `db:"id" json:"id" table:"device_groups"`
+	Name    string    `db:"name" json:"name"`
+	Created time.Time `db:"created" json:"created"`
+}
+
+type DeviceGroupCriteria struct {
+	Id   uint64 `schema:"id" db:"id"`
+	Name string `schema:"name" db:"name"`
+
+	Limit int `schema:"limit"`
+}
+
+// FirmwareRollout ships a firmware to a percentage of the devices in a group
+type FirmwareRollout struct {
+	Id         uint64    `db:"id" json:"id" table:"firmware_rollouts"`
+	FirmwareId uint64    `db:"firmware_id" json:"firmware_id"`
+	GroupId    uint64    `db:"group_id" json:"group_id"`
+	Percentage int       `db:"percentage" json:"percentage"`
+	Status     string    `db:"status" json:"status"`
+	Created    time.Time `db:"created" json:"created"`
+}
+
+type FirmwareRolloutCriteria struct {
+	Id         uint64 `schema:"id" db:"id"`
+	FirmwareId uint64 `schema:"firmware_id" db:"firmware_id"`
+	GroupId    uint64 `schema:"group_id" db:"group_id"`
+	Status     string `schema:"status" db:"status"`
+
+	Limit int `schema:"limit"`
+}
+
+// Includes tells if the device is part of the rollout. The choice is stable
+// per device and rollout, so raising the percentage only adds devices.
+func (r *FirmwareRollout) Includes(device_guid string) bool {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d:%s", r.Id, device_guid)
+
+	return int(h.Sum32()%100) < r.Percentage
+}
+
+// DeviceFirmwareUpdate tracks the firmware update of a single device, the
+// command id links the progress notifications from the device
+type DeviceFirmwareUpdate struct {
+	Id         uint64    `db:"id" json:"id" table:"device_firmware_updates"`
+	DeviceId   uint64    `db:"device_id" json:"device_id"`
+	FirmwareId uint64    `db:"firmware_id" json:"firmware_id"`
+	RolloutId  *uint64   `db:"rollout_id" json:"rollout_id"`
+	CommandId  uint64    `db:"command_id" json:"command_id"`
+	Status     string    `db:"status" json:"status"`
+	Progress   int       `db:"progress" json:"progress"`
+	Error      *string   `db:"error" json:"error"`
+	Created    time.Time `db:"created" json:"created"`
+	Updated    time.Time `db:"updated" json:"updated"`
+}
+
+type DeviceFirmwareUpdateCriteria struct {
+	Id         uint64 `schema:"id" db:"id"`
+	DeviceId   uint64 `schema:"device_id" db:"device_id"`
+	FirmwareId uint64 `schema:"firmware_id" db:"firmware_id"`
+	RolloutId  uint64 `schema:"rollout_id" db:"rollout_id"`
+	CommandId  uint64 `schema:"command_id" db:"command_id"`
+	Status     string `schema:"status" db:"status"`
+
+	Limit int `schema:"limit"`
+}
+
+func (devices *Devices) FirmwareInsert(f *Firmware) error {
+	f.Created = time.Now().UTC()
+	return devices.db.Insert(f, "firmwares")
+}
+
+func (devices *Devices) FirmwareGet(c FirmwareCriteria) (*Firmware, error) {
+	var f Firmware
+	if err := devices.db.MatchOne(&f, "firmwares", c); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func (devices *Devices) FirmwareList(c FirmwareCriteria) ([]Firmware, error) {
+	var firmwares []Firmware
+	if err := devices.db.Match(&firmwares, "firmwares", c); err != nil {
+		return nil, err
+	}
+
+	return firmwares, nil
+}
+
+func (devices *Devices) GroupInsert(g *DeviceGroup) error {
+	g.Created = time.Now().UTC()
+	return devices.db.Insert(g, "device_groups")
+}
+
+func (devices *Devices) GroupGet(c DeviceGroupCriteria) (*DeviceGroup, error) {
+	var g DeviceGroup
+	if err := devices.db.MatchOne(&g, "device_groups", c); err != nil {
+		return nil, err
+	}
+
+	return &g, nil
+}
+
+func (devices *Devices) GroupList(c DeviceGroupCriteria) ([]DeviceGroup, error) {
+	var groups []DeviceGroup
+	if err := devices.db.Match(&groups, "device_groups", c); err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+func (devices *Devices) GroupMemberAdd(g *DeviceGroup, d *Device) error {
+	_, err := devices.db.Exec("INSERT IGNORE INTO device_group_members (group_id, device_id) VALUES (?, ?)", g.Id, d.Id)
+	return err
+}
+
+func (devices *Devices) GroupMemberRemove(g *DeviceGroup, d *Device) error {
+	_, err := devices.db.Exec("DELETE FROM device_group_members WHERE group_id = ? AND device_id = ?", g.Id, d.Id)
+	return err
+}
+
+func (devices *Devices) GroupMembers(g *DeviceGroup) ([]Device, error) {
+	var ds []Device
+	if err := devices.db.Select(&ds, "SELECT d.* FROM devices d JOIN device_group_members m ON m.device_id = d.id WHERE m.group_id = ?", g.Id); err != nil {
+		return nil, err
+	}
+
+	for i := range ds {
+		ds[i].db = devices.db
+		ds[i].ca = devices.ca
+	}
+
+	return ds, nil
+}
+
+func (devices *Devices) RolloutInsert(r *FirmwareRollout) error {
+	r.Created = time.Now().UTC()
+	return devices.db.Insert(r, "firmware_rollouts")
+}
+
+func (devices *Devices) RolloutGet(c FirmwareRolloutCriteria) (*FirmwareRollout, error) {
+	var r FirmwareRollout
+	if err := devices.db.MatchOne(&r, "firmware_rollouts", c); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func (devices *Devices) RolloutList(c FirmwareRolloutCriteria) ([]FirmwareRollout, error) {
+	var rollouts []FirmwareRollout
+	if err := devices.db.Match(&rollouts, "firmware_rollouts", c); err != nil {
+		return nil, err
+	}
+
+	return rollouts, nil
+}
+
+func (devices *Devices) RolloutUpdate(r *FirmwareRollout) error {
+	_, err := devices.db.Exec("UPDATE firmware_rollouts SET percentage = ?, status = ? WHERE id = ?", r.Percentage, r.Status, r.Id)
+	return err
+}
+
+func (devices *Devices) FirmwareUpdateList(c DeviceFirmwareUpdateCriteria) ([]DeviceFirmwareUpdate, error) {
+	var updates []DeviceFirmwareUpdate
+	if err := devices.db.Match(&updates, "device_firmware_updates", c); err != nil {
+		return nil, err
+	}
+
+	return updates, nil
+}
+
+func (d *Device) FirmwareUpdateInsert(u *DeviceFirmwareUpdate) error {
+	u.DeviceId = d.Id
+	u.Created = time.Now().UTC()
+	u.Updated = u.Created
+	return d.db.Insert(u, "device_firmware_updates")
+}
+
+func (d *Device) FirmwareUpdateGet(c DeviceFirmwareUpdateCriteria) (*DeviceFirmwareUpdate, error) {
+	c.DeviceId = d.Id
+
+	var u DeviceFirmwareUpdate
+	if err := d.db.MatchOne(&u, "device_firmware_updates", c); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+func (d *Device) FirmwareUpdateList(c DeviceFirmwareUpdateCriteria) ([]DeviceFirmwareUpdate, error) {
+	c.DeviceId = d.Id
+
+	var updates []DeviceFirmwareUpdate
+	if err := d.db.Match(&updates, "device_firmware_updates", c); err != nil {
+		return nil, err
+	}
+
+	return updates, nil
+}
+
+// FirmwareUpdateFinished returns true if the update succeeded or failed,
+// the status of a finished update never changes
+func FirmwareUpdateFinished(status string) bool {
+	return status == FirmwareUpdateSucceeded || status == FirmwareUpdateFailed
+}
+
+// FirmwareUpdateProgress saves the progress of the update. False is returned
+// if the update already finished, so a late or redelivered notification does
+// not move it back.
+func (d *Device) FirmwareUpdateProgress(u *DeviceFirmwareUpdate) (bool, error) {
+	u.Updated = time.Now().UTC()
+	result, err := d.db.Exec("UPDATE device_firmware_updates SET status = ?, progress = ?, error = ?, updated = ? WHERE id = ? AND device_id = ? AND status NOT IN (?, ?)",
+		u.Status,
+		u.Progress,
+		u.Error,
+		u.Updated,
+		u.Id,
+		d.Id,
+		FirmwareUpdateSucceeded,
+		FirmwareUpdateFailed)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
@@ -1,8 +1,6 @@
 package phoenix
 
-func deviceNotificationCreate(command interface{}) error {
-	cmd := command.(DeviceNotificationCreate)
-
+func deviceNotificationCreate(cmd DeviceNotificationCreate) error {
 	d, err := phoenix.Devices.Get(DeviceCriteria{
 		Guid: cmd.DeviceGuid,
 	})
@@ -29,11 +29,28 @@ func New() *Phoenix {
 
 	log = phoenix.Logger
 
+	//Publishing an event without a registered name fails, so refuse to
+	//start instead
+	if err := app.CheckEvents(append(PublishedEvents, WebhookEvents...)...); err != nil {
+		panic(err)
+	}
+
 	phoenix.ConnectMariadb()
 
 	phoenix.Devices = NewDevices(phoenix)
 
-	phoenix.HandleCommand(DeviceNotificationCreate{}, deviceNotificationCreate)
+	HandleCommand(phoenix, deviceNotificationCreate)
 
 	return phoenix
 }
+
+// HandleEvent registers a typed handler for events of type T under a name
+// which must not change between releases
+func HandleEvent[T any](p *Phoenix, name string, handler func(event T) error) {
+	app.HandleEvent(p.App, name, handler)
+}
+
+// HandleCommand registers a typed handler for commands of type T
+func HandleCommand[T any](p *Phoenix, handler func(cmd T) error) {
+	app.HandleCommand(p.App, handler)
+}
@@ -0,0 +1,195 @@
+// Package pipe filters and projects events which are republished to other
+// NSQ topics for downstream consumers.
+package pipe
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+type Config struct {
+	Name  string `yaml:"Name"`
+	Topic string `yaml:"Topic"`
+
+	//Event names to pipe, all piped events when empty
+	Events []string `yaml:"Events"`
+
+	//Publish the registered event names like stream.updated. Pipes publish
+	//the legacy Go type names like phoenix.StreamUpdated by default, as
+	//external consumers like fawkes only know those.
+	RegisteredNames bool `yaml:"RegisteredNames"`
+
+	//Device filters, a device must match every filter given. Devices are
+	//guid patterns as in path.Match
+	Devices     []string `yaml:"Devices"`
+	DeviceIds   []uint64 `yaml:"DeviceIds"`
+	DeviceTypes []uint64 `yaml:"DeviceTypes"`
+
+	//Payload projection, applied in the order fields, rename and set.
+	//Fields are dotted paths into the payload, all fields are kept when empty
+	Fields []string          `yaml:"Fields"`
+	Rename map[string]string `yaml:"Rename"`
+	Set    map[string]string `yaml:"Set"`
+}
+
+// Device is the device an event is about, as needed by the device filters
+type Device struct {
+	Id     uint64
+	Guid   string
+	TypeId *uint64
+}
+
+// Validate checks the pipe against the names of the events which can be piped
+func (c Config) Validate(events []string) error {
+	if c.Topic == "" {
+		return fmt.Errorf("Pipe %s has no topic", c.Name)
+	}
+
+	for _, e := range c.Events {
+		if !contains(events, e) {
+			return fmt.Errorf("Pipe %s has unknown event: %s", c.Name, e)
+		}
+	}
+
+	for _, pattern := range c.Devices {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Pipe %s has invalid device pattern %s: %s", c.Name, pattern, err)
+		}
+	}
+
+	for _, f := range c.Fields {
+		if f == "" || strings.HasPrefix(f, ".") || strings.HasSuffix(f, ".") {
+			return fmt.Errorf("Pipe %s has invalid field: '%s'", c.Name, f)
+		}
+	}
+
+	for from, to := range c.Rename {
+		if from == "" || to == "" {
+			return fmt.Errorf("Pipe %s has invalid rename: '%s' -> '%s'", c.Name, from, to)
+		}
+	}
+
+	return nil
+}
+
+func (c Config) MatchEvent(event string) bool {
+	return len(c.Events) == 0 || contains(c.Events, event)
+}
+
+// HasDeviceFilter reports whether the device needs to be looked up before
+// calling MatchDevice
+func (c Config) HasDeviceFilter() bool {
+	return len(c.Devices) > 0 || len(c.DeviceIds) > 0 || len(c.DeviceTypes) > 0
+}
+
+func (c Config) MatchDevice(d Device) bool {
+	if len(c.Devices) > 0 {
+		matched := false
+		for _, pattern := range c.Devices {
+			if ok, _ := path.Match(pattern, d.Guid); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(c.DeviceIds) > 0 && !containsId(c.DeviceIds, d.Id) {
+		return false
+	}
+
+	if len(c.DeviceTypes) > 0 && (d.TypeId == nil || !containsId(c.DeviceTypes, *d.TypeId)) {
+		return false
+	}
+
+	return true
+}
+
+// Project returns a copy of the payload with the projection of the pipe
+// applied. Fields missing in the payload are left out.
+func (c Config) Project(payload map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+
+	if len(c.Fields) == 0 {
+		for k, v := range payload {
+			result[k] = v
+		}
+	} else {
+		for _, f := range c.Fields {
+			v, ok := lookup(payload, f)
+			if ok {
+				assign(result, f, v)
+			}
+		}
+	}
+
+	for from, to := range c.Rename {
+		v, ok := result[from]
+		if !ok {
+			continue
+		}
+		delete(result, from)
+		result[to] = v
+	}
+
+	for k, v := range c.Set {
+		result[k] = v
+	}
+
+	return result
+}
+
+func lookup(payload map[string]interface{}, field string) (interface{}, bool) {
+	parts := strings.Split(field, ".")
+
+	var current interface{} = payload
+	for _, p := range parts {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		current, ok = m[p]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+func assign(result map[string]interface{}, field string, value interface{}) {
+	parts := strings.Split(field, ".")
+
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := result[p].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			result[p] = next
+		}
+		result = next
+	}
+
+	result[parts[len(parts)-1]] = value
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsId(list []uint64, id uint64) bool {
+	for _, l := range list {
+		if l == id {
+			return true
+		}
+	}
+	return false
+}
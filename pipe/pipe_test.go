@@ -0,0 +1,109 @@
+package pipe
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var events = []string{"phoenix.StreamUpdated", "phoenix.DeviceNotificationCreated"}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		config Config
+		valid  bool
+	}{
+		{Config{Topic: "fawkes.events"}, true},
+		{Config{Topic: "fawkes.events", Events: events}, true},
+		{Config{}, false},
+		{Config{Topic: "t", Events: []string{"phoenix.Unknown"}}, false},
+		{Config{Topic: "t", Devices: []string{"[abc"}}, false},
+		{Config{Topic: "t", Fields: []string{"metadata."}}, false},
+		{Config{Topic: "t", Rename: map[string]string{"code": ""}}, false},
+	}
+
+	for i, test := range tests {
+		err := test.config.Validate(events)
+		if (err == nil) != test.valid {
+			t.Errorf("%d: Validate returned %v, expected valid: %t", i, err, test.valid)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	type_id := uint64(3)
+	other_type_id := uint64(4)
+
+	c := Config{
+		Topic:       "t",
+		Events:      []string{"phoenix.StreamUpdated"},
+		Devices:     []string{"sensor-*"},
+		DeviceTypes: []uint64{type_id},
+	}
+
+	if !c.MatchEvent("phoenix.StreamUpdated") || c.MatchEvent("phoenix.DeviceNotificationCreated") {
+		t.Errorf("Wrong event match")
+	}
+
+	if !c.HasDeviceFilter() {
+		t.Errorf("Device filter not detected")
+	}
+
+	tests := []struct {
+		device  Device
+		matched bool
+	}{
+		{Device{1, "sensor-1", &type_id}, true},
+		{Device{1, "gateway-1", &type_id}, false},
+		{Device{1, "sensor-1", &other_type_id}, false},
+		{Device{1, "sensor-1", nil}, false},
+	}
+
+	for _, test := range tests {
+		if c.MatchDevice(test.device) != test.matched {
+			t.Errorf("Device %s matched: %t", test.device.Guid, !test.matched)
+		}
+	}
+
+	all := Config{Topic: "t"}
+	if !all.MatchEvent("phoenix.DeviceNotificationCreated") || all.HasDeviceFilter() || !all.MatchDevice(Device{}) {
+		t.Errorf("Pipe without filters must match everything")
+	}
+}
+
+func TestProject(t *testing.T) {
+	var payload map[string]interface{}
+	data := `{"device_id":7,"code":"temperature","value":21.5,"metadata":{"unit":"C","min":0}}`
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	c := Config{
+		Fields: []string{"code", "value", "metadata.unit", "missing"},
+		Rename: map[string]string{"code": "stream"},
+		Set:    map[string]string{"source": "phoenix"},
+	}
+
+	result, err := json.Marshal(c.Project(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"metadata":{"unit":"C"},"source":"phoenix","stream":"temperature","value":21.5}`
+	if string(result) != expected {
+		t.Errorf("Wrong projection: %s", result)
+	}
+
+	if _, ok := payload["source"]; ok {
+		t.Errorf("Payload modified by projection")
+	}
+
+	all, err := json.Marshal(Config{}.Project(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = `{"code":"temperature","device_id":7,"metadata":{"min":0,"unit":"C"},"value":21.5}`
+	if string(all) != expected {
+		t.Errorf("Wrong projection without fields: %s", all)
+	}
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	ValueTypeString uint8 = iota
+	ValueTypeInt
+	ValueTypeDouble
+)
+
+// CommandResponse is the answer from a device to a command, a type byte
+// followed by the value
+type CommandResponse struct {
+	Type  uint8
+	Value interface{}
+}
+
+func DecodeCommandResponse(payload []byte) (CommandResponse, error) {
+	if len(payload) < 1 {
+		return CommandResponse{}, newDecodeError("command_response", ReasonShortFrame, 0, "missing value type")
+	}
+
+	response := CommandResponse{Type: payload[0]}
+	value := payload[1:]
+
+	switch response.Type {
+	case ValueTypeDouble:
+		if len(value) != 8 {
+			return CommandResponse{}, newDecodeError("command_response", ReasonShortFrame, 1, "double needs 8 bytes, got %d", len(value))
+		}
+		response.Value = Float64FromBytes(value)
+	case ValueTypeString:
+		if !utf8.Valid(value) {
+			return CommandResponse{}, newDecodeError("command_response", ReasonInvalidValue, 1, "string is not valid utf-8")
+		}
+		response.Value = string(value)
+	default:
+		return CommandResponse{}, newDecodeError("command_response", ReasonUnknownValueType, 0, "unhandled value type %d", response.Type)
+	}
+
+	return response, nil
+}
+
+// DeviceTopic is a parsed /device/{guid}/{kind}[/{id}] topic
+type DeviceTopic struct {
+	Guid string
+	Kind string
+	Id   string
+}
+
+func ParseDeviceTopic(topic string) (DeviceTopic, error) {
+	parts := strings.Split(topic, "/")
+
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != "" || parts[1] != "device" {
+		return DeviceTopic{}, newDecodeError("topic", ReasonInvalidTopic, 0, "not a device topic: %q", topic)
+	}
+
+	t := DeviceTopic{
+		Guid: parts[2],
+		Kind: parts[3],
+	}
+
+	if len(parts) == 5 {
+		t.Id = parts[4]
+	}
+
+	if t.Guid == "" || t.Kind == "" {
+		return DeviceTopic{}, newDecodeError("topic", ReasonInvalidTopic, 0, "empty device or kind in topic: %q", topic)
+	}
+
+	return t, nil
+}
+
+// CommandId returns the numeric command id of a /device/{guid}/command/{id} topic
+func (t DeviceTopic) CommandId() (uint64, error) {
+	if t.Kind != "command" || t.Id == "" {
+		return 0, newDecodeError("topic", ReasonInvalidTopic, 0, "not a command response topic")
+	}
+
+	id, err := strconv.ParseUint(t.Id, 10, 64)
+	if err != nil {
+		return 0, newDecodeError("topic", ReasonInvalidTopic, 0, "bad command id %q", t.Id)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reason is a stable, machine readable code for why a frame was rejected.
+// It is sent back to the device, so existing values must not change.
+type Reason string
+
+const (
+	ReasonShortFrame         Reason = "short_frame"
+	ReasonTrailingData       Reason = "trailing_data"
+	ReasonUnknownFrameType   Reason = "unknown_frame_type"
+	ReasonMissingTerminator  Reason = "missing_terminator"
+	ReasonInvalidStream      Reason = "invalid_stream"
+	ReasonInvalidValue       Reason = "invalid_value"
+	ReasonUnknownValueType   Reason = "unknown_value_type"
+	ReasonMissingDictionary  Reason = "missing_dictionary"
+	ReasonUnknownStreamIndex Reason = "unknown_stream_index"
+	ReasonInvalidTimestamp   Reason = "invalid_timestamp"
+	ReasonClockSkew          Reason = "clock_skew"
+	ReasonInvalidTopic       Reason = "invalid_topic"
+	ReasonInvalidJson        Reason = "invalid_json"
+	ReasonInternal           Reason = "internal_error"
+)
+
+// DecodeError is returned by all decoders in this package
+type DecodeError struct {
+	Frame   string `json:"frame"`
+	Reason  Reason `json:"reason"`
+	Offset  int    `json:"offset"`
+	Message string `json:"error"`
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s frame rejected at offset %d: %s: %s", e.Frame, e.Offset, e.Reason, e.Message)
+}
+
+func newDecodeError(frame string, reason Reason, offset int, format string, args ...interface{}) *DecodeError {
+	return &DecodeError{
+		Frame:   frame,
+		Reason:  reason,
+		Offset:  offset,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// NewDecodeError wraps an error from outside this package, e.g. json decoding,
+// so it can be reported to the device like any other rejected frame
+func NewDecodeError(frame string, reason Reason, err error) *DecodeError {
+	return newDecodeError(frame, reason, 0, "%s", err.Error())
+}
+
+// AsDecodeError returns the DecodeError in the chain of err, if any
+func AsDecodeError(err error) (*DecodeError, bool) {
+	var decodeError *DecodeError
+	if errors.As(err, &decodeError) {
+		return decodeError, true
+	}
+
+	return nil, false
+}
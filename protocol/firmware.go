@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	FirmwareDigestSize = 32
+	MaxFirmwareUrl     = 1024
+)
+
+// FirmwareUpdate is the payload of the firmware_update command, big endian
+// like the command header:
+//
+//	uint32 image size | 32 byte sha256 | uint16 signature length | signature
+//	| uint16 url length | url
+//
+// The signature is made over the sha256 with the firmware signing key. The
+// device downloads the image from the url, resuming with range requests.
+type FirmwareUpdate struct {
+	Size      uint32
+	Sha256    [FirmwareDigestSize]byte
+	Signature []byte
+	Url       string
+}
+
+func (f FirmwareUpdate) Encode() ([]byte, error) {
+	if len(f.Signature) > 0xFFFF {
+		return nil, fmt.Errorf("Firmware signature too long: %d", len(f.Signature))
+	}
+
+	if len(f.Url) > MaxFirmwareUrl {
+		return nil, fmt.Errorf("Firmware url too long: %d", len(f.Url))
+	}
+
+	payload := make([]byte, 4+FirmwareDigestSize+2+len(f.Signature)+2+len(f.Url))
+	offset := 0
+	binary.BigEndian.PutUint32(payload[offset:], f.Size)
+	offset += 4
+	offset += copy(payload[offset:], f.Sha256[:])
+	binary.BigEndian.PutUint16(payload[offset:], uint16(len(f.Signature)))
+	offset += 2
+	offset += copy(payload[offset:], f.Signature)
+	binary.BigEndian.PutUint16(payload[offset:], uint16(len(f.Url)))
+	offset += 2
+	copy(payload[offset:], f.Url)
+
+	return payload, nil
+}
+
+func DecodeFirmwareUpdate(payload []byte) (FirmwareUpdate, error) {
+	var f FirmwareUpdate
+
+	offset := 0
+	if len(payload) < 4+FirmwareDigestSize+2 {
+		return f, newDecodeError("firmware_update", ReasonShortFrame, offset, "need %d bytes, got %d", 4+FirmwareDigestSize+2, len(payload))
+	}
+
+	f.Size = binary.BigEndian.Uint32(payload)
+	offset += 4
+	copy(f.Sha256[:], payload[offset:])
+	offset += FirmwareDigestSize
+
+	signature_length := int(binary.BigEndian.Uint16(payload[offset:]))
+	offset += 2
+	if len(payload) < offset+signature_length+2 {
+		return f, newDecodeError("firmware_update", ReasonShortFrame, offset, "signature of %d bytes truncated", signature_length)
+	}
+	f.Signature = payload[offset : offset+signature_length]
+	offset += signature_length
+
+	url_length := int(binary.BigEndian.Uint16(payload[offset:]))
+	offset += 2
+	if url_length > MaxFirmwareUrl || len(payload) < offset+url_length {
+		return f, newDecodeError("firmware_update", ReasonShortFrame, offset, "url of %d bytes truncated", url_length)
+	}
+
+	url := payload[offset : offset+url_length]
+	if !utf8.Valid(url) {
+		return f, newDecodeError("firmware_update", ReasonInvalidValue, offset, "url is not valid utf-8")
+	}
+	f.Url = string(url)
+	offset += url_length
+
+	if offset != len(payload) {
+		return f, newDecodeError("firmware_update", ReasonTrailingData, offset, "%d bytes after url", len(payload)-offset)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFirmwareUpdate(t *testing.T) {
+	update := FirmwareUpdate{
+		Size:      123456,
+		Signature: []byte{1, 2, 3},
+		Url:       "https://example.com/device/abc/firmware/7",
+	}
+	update.Sha256[0] = 0xAB
+
+	payload, err := update.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeFirmwareUpdate(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Size != update.Size || decoded.Sha256 != update.Sha256 || !bytes.Equal(decoded.Signature, update.Signature) || decoded.Url != update.Url {
+		t.Errorf("Round trip mismatch: %+v", decoded)
+	}
+
+	for i := 0; i < len(payload); i++ {
+		if _, err := DecodeFirmwareUpdate(payload[:i]); err == nil {
+			t.Errorf("Truncated payload of %d bytes accepted", i)
+		}
+	}
+
+	if _, err := DecodeFirmwareUpdate(append(payload, 0)); err == nil {
+		t.Errorf("Trailing data accepted")
+	}
+}
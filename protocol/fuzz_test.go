@@ -0,0 +1,156 @@
+//go:build go1.18
+// +build go1.18
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func checkDecodeError(t *testing.T, err error) {
+	if err == nil {
+		return
+	}
+
+	if _, ok := AsDecodeError(err); !ok {
+		t.Fatalf("Expected DecodeError, got %T: %v", err, err)
+	}
+}
+
+func FuzzDecodeSample(f *testing.F) {
+	f.Add(append(record(1624000000123, 21.5), []byte("temperature\x00")...))
+	f.Add(append(record(0, 1), 'a'))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		s, err := DecodeSample(payload)
+		checkDecodeError(t, err)
+		if err == nil && s.Stream == "" {
+			t.Fatalf("Decoded sample without stream")
+		}
+	})
+}
+
+func FuzzDecodeDictionary(f *testing.F) {
+	f.Add(append(header(FrameTypeDictionary, 0, 2), []byte("temperature\x00humidity\x00")...))
+	f.Add(header(FrameTypeDictionary, 0, 0xFFFF))
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		dictionary, err := DecodeDictionary(payload)
+		checkDecodeError(t, err)
+		if err == nil && len(dictionary) != int(payload[2])|int(payload[3])<<8 {
+			t.Fatalf("Dictionary length does not match header")
+		}
+	})
+}
+
+func FuzzDecodeBatch(f *testing.F) {
+	named := header(FrameTypeBatch, 0, 1)
+	named = append(named, record(1624000000123, 21.5)...)
+	named = append(named, []byte("temperature\x00")...)
+	f.Add(named)
+
+	indexed := header(FrameTypeBatch, FlagStreamIndex, 1)
+	indexed = append(indexed, record(0, 42)...)
+	indexed = append(indexed, 1, 0)
+	f.Add(indexed)
+
+	dictionary := Dictionary{"temperature", "humidity"}
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		samples, err := DecodeBatch(payload, dictionary)
+		checkDecodeError(t, err)
+		if err == nil && len(samples) != int(payload[2])|int(payload[3])<<8 {
+			t.Fatalf("Sample count does not match header")
+		}
+
+		_, err = DecodeBatch(payload, nil)
+		checkDecodeError(t, err)
+	})
+}
+
+func FuzzDecodeCommandResponse(f *testing.F) {
+	f.Add(append([]byte{ValueTypeDouble}, record(0, 1.5)[8:]...))
+	f.Add([]byte{ValueTypeString, 'o', 'k'})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		_, err := DecodeCommandResponse(payload)
+		checkDecodeError(t, err)
+	})
+}
+
+func FuzzParseDeviceTopic(f *testing.F) {
+	f.Add("/device/abc/sample")
+	f.Add("/device/abc/command/1234")
+	f.Add("/device//command/")
+
+	f.Fuzz(func(t *testing.T, topic string) {
+		dt, err := ParseDeviceTopic(topic)
+		checkDecodeError(t, err)
+		if err != nil {
+			return
+		}
+
+		if dt.Guid == "" {
+			t.Fatalf("Parsed topic without device")
+		}
+
+		_, err = dt.CommandId()
+		checkDecodeError(t, err)
+	})
+}
+
+func FuzzMqttPackets(f *testing.F) {
+	connect := mqttString("MQTT")
+	connect = append(connect, 5, 0xc4, 0, 60, 0)
+	connect = append(connect, mqttString("client")...)
+	connect = append(connect, 0)
+	connect = append(connect, mqttString("/device/abc/status")...)
+	connect = append(connect, mqttString("offline")...)
+	connect = append(connect, mqttString("abc")...)
+	connect = append(connect, mqttString("secret")...)
+	f.Add(mqttPacket(PacketConnect, 0, connect))
+	f.Add(mqttPacket(PacketSubscribe, 2, append([]byte{0, 1}, append(mqttString("/device/abc/command"), 2)...)))
+	f.Add(mqttPacket(PacketPublish, 0, mqttString("/device/abc/sample")))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, ok, err := NextPacket(data)
+		checkDecodeError(t, err)
+		if !ok {
+			return
+		}
+
+		if packet.Size > len(data) {
+			t.Fatalf("Packet size %d larger than buffer %d", packet.Size, len(data))
+		}
+
+		_, err = ParseConnect(packet.Body)
+		checkDecodeError(t, err)
+		_, err = PublishTopic(packet.Body)
+		checkDecodeError(t, err)
+		_, err = SubscribeTopics(packet.Body, 4)
+		checkDecodeError(t, err)
+		_, err = SubscribeTopics(packet.Body, 5)
+		checkDecodeError(t, err)
+	})
+}
+
+func FuzzDecodeFirmwareUpdate(f *testing.F) {
+	seed, _ := FirmwareUpdate{Size: 1, Signature: []byte{1}, Url: "http://localhost/firmware"}.Encode()
+	f.Add(seed)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		update, err := DecodeFirmwareUpdate(data)
+		checkDecodeError(t, err)
+		if err != nil {
+			return
+		}
+
+		encoded, err := update.Encode()
+		if err != nil || !bytes.Equal(encoded, data) {
+			t.Fatalf("Round trip mismatch: %v", err)
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package protocol
+
+import (
+	"encoding/binary"
+)
+
+// MQTT control packet types, only the ones phoenix needs to look at before
+// they are handed to the mqtt server
+const (
+	PacketConnect   uint8 = 1
+	PacketPublish   uint8 = 3
+	PacketPubAck    uint8 = 4
+	PacketPubRec    uint8 = 5
+	PacketSubscribe uint8 = 8
+
+	MaxPacketSize = 16 * 1024
+)
+
+// Packet is a single framed MQTT control packet
+type Packet struct {
+	Type  uint8
+	Flags uint8
+	Body  []byte
+	Size  int
+}
+
+// NextPacket frames the first MQTT packet in buffer. If the buffer does not
+// yet hold a complete packet, ok is false and more data must be read.
+func NextPacket(buffer []byte) (packet Packet, ok bool, err error) {
+	if len(buffer) < 2 {
+		return Packet{}, false, nil
+	}
+
+	length := 0
+	multiplier := 1
+	index := 1
+	for {
+		if index >= len(buffer) {
+			return Packet{}, false, nil
+		}
+
+		if index > 4 {
+			return Packet{}, false, newDecodeError("mqtt", ReasonShortFrame, index, "remaining length uses more than 4 bytes")
+		}
+
+		v := buffer[index]
+		length += int(v&0x7f) * multiplier
+		multiplier *= 128
+		index++
+
+		if v&0x80 == 0 {
+			break
+		}
+	}
+
+	if index+length > MaxPacketSize {
+		return Packet{}, false, newDecodeError("mqtt", ReasonShortFrame, 0, "packet of %d bytes exceeds maximum of %d", index+length, MaxPacketSize)
+	}
+
+	if len(buffer) < index+length {
+		return Packet{}, false, nil
+	}
+
+	return Packet{
+		Type:  buffer[0] >> 4,
+		Flags: buffer[0] & 0x0f,
+		Body:  buffer[index : index+length],
+		Size:  index + length,
+	}, true, nil
+}
+
+// Connect holds the parts of a CONNECT packet used for authentication
+type Connect struct {
+	ProtocolLevel uint8
+	ClientId      string
+	WillTopic     *string
+	Username      *string
+	Password      []byte
+}
+
+func ParseConnect(body []byte) (Connect, error) {
+	var c Connect
+	var err error
+
+	index := 0
+	if _, index, err = readMqttString("connect", body, index); err != nil {
+		return c, err
+	}
+
+	if len(body) < index+4 {
+		return c, newDecodeError("connect", ReasonShortFrame, index, "missing connect header")
+	}
+
+	c.ProtocolLevel = body[index]
+	flags := body[index+1]
+	index += 4 //level, flags and keep alive
+
+	if c.ProtocolLevel >= 5 {
+		if index, err = skipProperties("connect", body, index); err != nil {
+			return c, err
+		}
+	}
+
+	if c.ClientId, index, err = readMqttString("connect", body, index); err != nil {
+		return c, err
+	}
+
+	if flags&0x04 != 0 {
+		if c.ProtocolLevel >= 5 {
+			if index, err = skipProperties("connect", body, index); err != nil {
+				return c, err
+			}
+		}
+
+		var topic string
+		if topic, index, err = readMqttString("connect", body, index); err != nil {
+			return c, err
+		}
+		c.WillTopic = &topic
+
+		if _, index, err = readMqttBytes("connect", body, index); err != nil {
+			return c, err
+		}
+	}
+
+	if flags&0x80 != 0 {
+		var username string
+		if username, index, err = readMqttString("connect", body, index); err != nil {
+			return c, err
+		}
+		c.Username = &username
+	}
+
+	if flags&0x40 != 0 {
+		if c.Password, _, err = readMqttBytes("connect", body, index); err != nil {
+			return c, err
+		}
+	}
+
+	return c, nil
+}
+
+func PublishTopic(body []byte) (string, error) {
+	topic, _, err := readMqttString("publish", body, 0)
+	return topic, err
+}
+
+func SubscribeTopics(body []byte, protocolLevel uint8) ([]string, error) {
+	var err error
+	var topics []string
+
+	index := 2 //Packet id
+	if protocolLevel >= 5 {
+		if index, err = skipProperties("subscribe", body, index); err != nil {
+			return nil, err
+		}
+	}
+
+	for index < len(body) {
+		var topic string
+		if topic, index, err = readMqttString("subscribe", body, index); err != nil {
+			return nil, err
+		}
+
+		//Subscription options
+		index++
+		if index > len(body) {
+			return nil, newDecodeError("subscribe", ReasonShortFrame, index, "missing subscription options")
+		}
+
+		topics = append(topics, topic)
+	}
+
+	if len(topics) == 0 {
+		return nil, newDecodeError("subscribe", ReasonShortFrame, index, "no topic filters")
+	}
+
+	return topics, nil
+}
+
+func readMqttBytes(frame string, body []byte, index int) ([]byte, int, error) {
+	if len(body) < index+2 {
+		return nil, index, newDecodeError(frame, ReasonShortFrame, index, "missing length")
+	}
+
+	length := int(binary.BigEndian.Uint16(body[index : index+2]))
+	index += 2
+
+	if len(body) < index+length {
+		return nil, index, newDecodeError(frame, ReasonShortFrame, index, "need %d bytes, got %d", length, len(body)-index)
+	}
+
+	return body[index : index+length], index + length, nil
+}
+
+func readMqttString(frame string, body []byte, index int) (string, int, error) {
+	value, index, err := readMqttBytes(frame, body, index)
+	return string(value), index, err
+}
+
+func skipProperties(frame string, body []byte, index int) (int, error) {
+	length := 0
+	multiplier := 1
+	for i := 0; ; i++ {
+		if index >= len(body) || i == 4 {
+			return index, newDecodeError(frame, ReasonShortFrame, index, "bad properties length")
+		}
+
+		v := body[index]
+		length += int(v&0x7f) * multiplier
+		multiplier *= 128
+		index++
+
+		if v&0x80 == 0 {
+			break
+		}
+	}
+
+	if len(body) < index+length {
+		return index, newDecodeError(frame, ReasonShortFrame, index, "properties truncated")
+	}
+
+	return index + length, nil
+}
+
+// EncodeRemainingLength encodes the remaining length of a packet as an MQTT
+// variable byte integer
+func EncodeRemainingLength(length int) []byte {
+	var encoded []byte
+	for {
+		b := uint8(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		encoded = append(encoded, b)
+
+		if length == 0 {
+			return encoded
+		}
+	}
+}
+
+// FrameServerPacket frames a packet written by the mqtt server. The server
+// writes every packet with the remaining length truncated to a single byte,
+// so the length is encoded again from the size of the body.
+func FrameServerPacket(packet []byte) []byte {
+	if len(packet) < 2 {
+		return packet
+	}
+
+	body := packet[2:]
+	framed := append([]byte{packet[0]}, EncodeRemainingLength(len(body))...)
+	return append(framed, body...)
+}
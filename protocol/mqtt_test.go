@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/cmodk/go-mqtt"
+)
+
+func mqttString(value string) []byte {
+	return append([]byte{uint8(len(value) >> 8), uint8(len(value))}, []byte(value)...)
+}
+
+func mqttPacket(packetType uint8, flags uint8, body []byte) []byte {
+	return append([]byte{packetType<<4 | flags, uint8(len(body))}, body...)
+}
+
+func TestParseConnect(t *testing.T) {
+	body := mqttString("MQTT")
+	body = append(body, 4, 0x80|0x40|0x04, 0, 60)
+	body = append(body, mqttString("client")...)
+	body = append(body, mqttString("/device/abc/status")...)
+	body = append(body, mqttString("offline")...)
+	body = append(body, mqttString("abc")...)
+	body = append(body, mqttString("secret")...)
+
+	packet, ok, err := NextPacket(mqttPacket(PacketConnect, 0, body))
+	if err != nil || !ok {
+		t.Fatalf("Expected complete packet: %v", err)
+	}
+
+	c, err := ParseConnect(packet.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.ProtocolLevel != 4 || c.ClientId != "client" {
+		t.Errorf("Wrong connect: %+v", c)
+	}
+
+	if c.WillTopic == nil || *c.WillTopic != "/device/abc/status" {
+		t.Errorf("Wrong will topic: %v", c.WillTopic)
+	}
+
+	if c.Username == nil || *c.Username != "abc" || string(c.Password) != "secret" {
+		t.Errorf("Wrong credentials: %v -> %s", c.Username, c.Password)
+	}
+}
+
+func TestNextPacketIncomplete(t *testing.T) {
+	data := mqttPacket(PacketPublish, 0, append(mqttString("/device/abc/sample"), 1, 2, 3))
+
+	if _, ok, err := NextPacket(data[:len(data)-1]); ok || err != nil {
+		t.Errorf("Expected incomplete packet, got %t: %v", ok, err)
+	}
+
+	packet, ok, err := NextPacket(append(data, 0xc0, 0))
+	if !ok || err != nil {
+		t.Fatalf("Expected complete packet: %v", err)
+	}
+
+	if packet.Size != len(data) {
+		t.Errorf("Expected packet size %d, got %d", len(data), packet.Size)
+	}
+
+	topic, err := PublishTopic(packet.Body)
+	if err != nil || topic != "/device/abc/sample" {
+		t.Errorf("Wrong topic %s: %v", topic, err)
+	}
+}
+
+func TestSubscribeTopics(t *testing.T) {
+	body := []byte{0, 1}
+	body = append(body, mqttString("/device/abc/command")...)
+	body = append(body, 2)
+	body = append(body, mqttString("/device/abc/error")...)
+	body = append(body, 0)
+
+	topics, err := SubscribeTopics(body, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(topics) != 2 || topics[0] != "/device/abc/command" || topics[1] != "/device/abc/error" {
+		t.Errorf("Wrong topics: %v", topics)
+	}
+
+	//Version 5 has a properties length after the packet id
+	body = append([]byte{0, 1, 0}, body[2:]...)
+	topics, err = SubscribeTopics(body, 5)
+	if err != nil || len(topics) != 2 {
+		t.Errorf("Wrong v5 topics: %v: %v", topics, err)
+	}
+}
+
+func TestEncodeRemainingLength(t *testing.T) {
+	if encoded := EncodeRemainingLength(321); !bytes.Equal(encoded, []byte{0xc1, 0x02}) {
+		t.Errorf("Wrong encoding of 321: % x", encoded)
+	}
+
+	for _, length := range []int{0, 1, 127, 128, 300, 16000} {
+		data := append([]byte{PacketPublish << 4}, EncodeRemainingLength(length)...)
+		data = append(data, make([]byte, length)...)
+
+		packet, ok, err := NextPacket(data)
+		if !ok || err != nil {
+			t.Errorf("Length %d not framed: %v", length, err)
+			continue
+		}
+
+		if len(packet.Body) != length || packet.Size != len(data) {
+			t.Errorf("Length %d framed as %d bytes in %d", length, len(packet.Body), packet.Size)
+		}
+	}
+}
+
+// framingConn frames the packets of the mqtt server, like the device
+// sessions do
+type framingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *framingConn) Write(p []byte) (int, error) {
+	c.written.Write(FrameServerPacket(p))
+	return len(p), nil
+}
+
+func TestFrameServerPacket(t *testing.T) {
+	conn := &framingConn{}
+	topic := "/device/abc/command/firmware_update"
+	payload := []byte(`{"id":1,"command":"firmware_update","parameters":{"url":"https://example.com/firmware/abc.bin","sha256":"` + strings.Repeat("a", 64) + `"}}`)
+
+	s := mqtt.NewServer(nil)
+	s.ClientSubscriptions[regexp.MustCompile("^"+topic+"$")] = []*mqtt.Client{{Conn: conn}}
+	if err := s.Publish(topic, 2, false, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	packet, ok, err := NextPacket(conn.written.Bytes())
+	if !ok || err != nil {
+		t.Fatalf("Expected complete packet: %v", err)
+	}
+
+	if len(packet.Body) < 128 || packet.Size != conn.written.Len() {
+		t.Errorf("Wrong packet of %d bytes in %d, %d written", len(packet.Body), packet.Size, conn.written.Len())
+	}
+
+	published, err := PublishTopic(packet.Body)
+	if err != nil || published != topic {
+		t.Errorf("Wrong topic %s: %v", published, err)
+	}
+
+	//Topic, then an empty properties length before the payload
+	if !bytes.Equal(packet.Body[2+len(topic)+1:], payload) {
+		t.Errorf("Wrong payload: %s", packet.Body[2+len(topic)+1:])
+	}
+}
@@ -0,0 +1,251 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"math"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	FrameTypeBatch      uint8 = 0x01
+	FrameTypeDictionary uint8 = 0x02
+
+	//Records in the batch reference streams by dictionary index instead of name
+	FlagStreamIndex uint8 = 0x01
+
+	FrameHeaderSize = 4
+	sampleValueSize = 16
+
+	//Same as the code column in device_streams
+	MaxStreamLength = 256
+)
+
+// Sample is a single timestamp/value/stream record as sent by a device.
+// Timestamp is the raw epoch value from the frame, 0 means "now".
+type Sample struct {
+	Timestamp uint64
+	Value     float64
+	Stream    string
+}
+
+// Dictionary maps stream indexes to stream names for a device
+type Dictionary []string
+
+// FrameHeader is the common header for batch and dictionary frames:
+//
+//	byte 0    frame type
+//	byte 1    flags
+//	byte 2-3  record count (little endian)
+type FrameHeader struct {
+	Type  uint8
+	Flags uint8
+	Count uint16
+}
+
+// DecodeSample decodes the original single sample frame: an 8 byte
+// timestamp, an 8 byte float64 value and the stream name, optionally null
+// terminated. Only null padding is allowed after the terminator.
+func DecodeSample(payload []byte) (Sample, error) {
+	if len(payload) <= sampleValueSize {
+		return Sample{}, newDecodeError("sample", ReasonShortFrame, len(payload), "need more than %d bytes, got %d", sampleValueSize, len(payload))
+	}
+
+	s, err := decodeSampleValue("sample", payload, 0)
+	if err != nil {
+		return Sample{}, err
+	}
+
+	end := len(payload)
+	for i := sampleValueSize; i < len(payload); i++ {
+		if payload[i] == 0x00 {
+			end = i
+			break
+		}
+	}
+
+	for i := end; i < len(payload); i++ {
+		if payload[i] != 0x00 {
+			return Sample{}, newDecodeError("sample", ReasonTrailingData, i, "unexpected data after stream name")
+		}
+	}
+
+	s.Stream = string(payload[sampleValueSize:end])
+	if err := validateStream("sample", s.Stream, sampleValueSize); err != nil {
+		return Sample{}, err
+	}
+
+	return s, nil
+}
+
+func DecodeFrameHeader(payload []byte) (FrameHeader, error) {
+	if len(payload) < FrameHeaderSize {
+		return FrameHeader{}, newDecodeError("header", ReasonShortFrame, len(payload), "need %d bytes for header, got %d", FrameHeaderSize, len(payload))
+	}
+
+	header := FrameHeader{
+		Type:  payload[0],
+		Flags: payload[1],
+		Count: binary.LittleEndian.Uint16(payload[2:4]),
+	}
+
+	if header.Type != FrameTypeBatch && header.Type != FrameTypeDictionary {
+		return FrameHeader{}, newDecodeError("header", ReasonUnknownFrameType, 0, "unknown frame type 0x%02x", header.Type)
+	}
+
+	return header, nil
+}
+
+// DecodeDictionary decodes a dictionary frame, which is the header followed
+// by count null terminated stream names. Index n refers to the n'th name.
+func DecodeDictionary(payload []byte) (Dictionary, error) {
+	header, err := DecodeFrameHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Type != FrameTypeDictionary {
+		return nil, newDecodeError("dictionary", ReasonUnknownFrameType, 0, "not a dictionary frame: 0x%02x", header.Type)
+	}
+
+	//Every name is at least two bytes, so do not trust the count for allocation
+	if int(header.Count)*2 > len(payload)-FrameHeaderSize {
+		return nil, newDecodeError("dictionary", ReasonShortFrame, len(payload), "%d bytes cannot hold %d names", len(payload), header.Count)
+	}
+
+	dictionary := make(Dictionary, 0, header.Count)
+	index := FrameHeaderSize
+	for i := uint16(0); i < header.Count; i++ {
+		var name string
+		name, index, err = readString("dictionary", payload, index)
+		if err != nil {
+			return nil, err
+		}
+		dictionary = append(dictionary, name)
+	}
+
+	if index != len(payload) {
+		return nil, newDecodeError("dictionary", ReasonTrailingData, index, "%d bytes after %d names", len(payload)-index, header.Count)
+	}
+
+	return dictionary, nil
+}
+
+// DecodeBatch decodes a batch frame. Each record is an 8 byte timestamp,
+// an 8 byte float64 value and either a null terminated stream name or,
+// when FlagStreamIndex is set, a 2 byte index into the device dictionary.
+func DecodeBatch(payload []byte, dictionary Dictionary) ([]Sample, error) {
+	header, err := DecodeFrameHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Type != FrameTypeBatch {
+		return nil, newDecodeError("batch", ReasonUnknownFrameType, 0, "not a batch frame: 0x%02x", header.Type)
+	}
+
+	useIndex := header.Flags&FlagStreamIndex != 0
+	if useIndex && dictionary == nil {
+		return nil, newDecodeError("batch", ReasonMissingDictionary, 1, "batch uses stream index, but no dictionary received")
+	}
+
+	record_size := sampleValueSize + 2
+	if int(header.Count)*record_size > len(payload)-FrameHeaderSize {
+		return nil, newDecodeError("batch", ReasonShortFrame, len(payload), "%d bytes cannot hold %d records", len(payload), header.Count)
+	}
+
+	samples := make([]Sample, 0, header.Count)
+	index := FrameHeaderSize
+	for i := uint16(0); i < header.Count; i++ {
+		if len(payload) < index+sampleValueSize {
+			return nil, newDecodeError("batch", ReasonShortFrame, index, "record %d truncated", i)
+		}
+
+		s, err := decodeSampleValue("batch", payload, index)
+		if err != nil {
+			return nil, err
+		}
+		index += sampleValueSize
+
+		if useIndex {
+			if len(payload) < index+2 {
+				return nil, newDecodeError("batch", ReasonShortFrame, index, "record %d missing stream index", i)
+			}
+			stream_index := binary.LittleEndian.Uint16(payload[index : index+2])
+
+			if int(stream_index) >= len(dictionary) {
+				return nil, newDecodeError("batch", ReasonUnknownStreamIndex, index, "record %d has unknown stream index %d", i, stream_index)
+			}
+			s.Stream = dictionary[stream_index]
+			index += 2
+		} else {
+			s.Stream, index, err = readString("batch", payload, index)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		samples = append(samples, s)
+	}
+
+	if index != len(payload) {
+		return nil, newDecodeError("batch", ReasonTrailingData, index, "%d bytes after %d records", len(payload)-index, header.Count)
+	}
+
+	return samples, nil
+}
+
+func decodeSampleValue(frame string, payload []byte, index int) (Sample, error) {
+	s := Sample{
+		Timestamp: binary.LittleEndian.Uint64(payload[index : index+8]),
+		Value:     Float64FromBytes(payload[index+8 : index+16]),
+	}
+
+	//Cannot be stored or json encoded
+	if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+		return Sample{}, newDecodeError(frame, ReasonInvalidValue, index+8, "value is %f", s.Value)
+	}
+
+	return s, nil
+}
+
+func readString(frame string, payload []byte, index int) (string, int, error) {
+	for i := index; i < len(payload); i++ {
+		if payload[i] == 0x00 {
+			name := string(payload[index:i])
+			if err := validateStream(frame, name, index); err != nil {
+				return "", index, err
+			}
+			return name, i + 1, nil
+		}
+	}
+
+	return "", index, newDecodeError(frame, ReasonMissingTerminator, index, "missing null terminator for stream name")
+}
+
+func validateStream(frame string, name string, index int) error {
+	if len(name) == 0 {
+		return newDecodeError(frame, ReasonInvalidStream, index, "empty stream name")
+	}
+
+	if len(name) > MaxStreamLength {
+		return newDecodeError(frame, ReasonInvalidStream, index, "stream name longer than %d bytes", MaxStreamLength)
+	}
+
+	if !utf8.ValidString(name) {
+		return newDecodeError(frame, ReasonInvalidStream, index, "stream name is not valid utf-8")
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return newDecodeError(frame, ReasonInvalidStream, index, "stream name contains control character 0x%02x", r)
+		}
+	}
+
+	return nil
+}
+
+func Float64FromBytes(bytes []byte) float64 {
+	bits := binary.LittleEndian.Uint64(bytes)
+	return math.Float64frombits(bits)
+}
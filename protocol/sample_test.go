@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func header(frameType uint8, flags uint8, count uint16) []byte {
+	bs := []byte{frameType, flags, 0, 0}
+	binary.LittleEndian.PutUint16(bs[2:], count)
+	return bs
+}
+
+func record(timestamp uint64, value float64) []byte {
+	bs := make([]byte, 16)
+	binary.LittleEndian.PutUint64(bs[0:8], timestamp)
+	binary.LittleEndian.PutUint64(bs[8:16], math.Float64bits(value))
+	return bs
+}
+
+func TestDecodeBatchNames(t *testing.T) {
+	payload := header(FrameTypeBatch, 0, 2)
+	payload = append(payload, record(1624000000123, 21.5)...)
+	payload = append(payload, []byte("temperature\x00")...)
+	payload = append(payload, record(1624000000456, 0.5)...)
+	payload = append(payload, []byte("humidity\x00")...)
+
+	samples, err := DecodeBatch(payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(samples) != 2 {
+		t.Fatalf("Expected 2 samples, got %d", len(samples))
+	}
+
+	if samples[0].Stream != "temperature" || samples[0].Value != 21.5 || samples[0].Timestamp != 1624000000123 {
+		t.Errorf("Wrong first sample: %+v", samples[0])
+	}
+
+	if samples[1].Stream != "humidity" || samples[1].Value != 0.5 {
+		t.Errorf("Wrong second sample: %+v", samples[1])
+	}
+}
+
+func TestDecodeBatchIndex(t *testing.T) {
+	dictionary_payload := header(FrameTypeDictionary, 0, 2)
+	dictionary_payload = append(dictionary_payload, []byte("temperature\x00humidity\x00")...)
+
+	dictionary, err := DecodeDictionary(dictionary_payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := header(FrameTypeBatch, FlagStreamIndex, 1)
+	payload = append(payload, record(0, 42)...)
+	payload = append(payload, 1, 0)
+
+	samples, err := DecodeBatch(payload, dictionary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(samples) != 1 || samples[0].Stream != "humidity" || samples[0].Value != 42 {
+		t.Errorf("Wrong samples: %+v", samples)
+	}
+
+	if _, err := DecodeBatch(payload, nil); err == nil {
+		t.Errorf("Expected error for indexed batch without dictionary")
+	}
+
+	payload[len(payload)-2] = 2
+	if _, err := DecodeBatch(payload, dictionary); err == nil {
+		t.Errorf("Expected error for unknown stream index")
+	}
+}
+
+func TestDecodeBatchTruncated(t *testing.T) {
+	payload := header(FrameTypeBatch, 0, 2)
+	payload = append(payload, record(0, 1)...)
+	payload = append(payload, []byte("a\x00")...)
+
+	if _, err := DecodeBatch(payload, nil); err == nil {
+		t.Errorf("Expected error for truncated batch")
+	}
+}
+
+func TestDecodeSample(t *testing.T) {
+	payload := append(record(1624000000123, 21.5), []byte("temperature\x00\x00")...)
+
+	s, err := DecodeSample(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Stream != "temperature" || s.Value != 21.5 || s.Timestamp != 1624000000123 {
+		t.Errorf("Wrong sample: %+v", s)
+	}
+
+	_, err = DecodeSample(payload[:10])
+	decodeError, ok := AsDecodeError(err)
+	if !ok || decodeError.Reason != ReasonShortFrame {
+		t.Errorf("Expected short frame error, got %v", err)
+	}
+
+	_, err = DecodeSample(append(payload, 'x'))
+	decodeError, ok = AsDecodeError(err)
+	if !ok || decodeError.Reason != ReasonTrailingData {
+		t.Errorf("Expected trailing data error, got %v", err)
+	}
+}
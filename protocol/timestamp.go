@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Precision is the unit of the epoch timestamps sent by a device
+type Precision string
+
+const (
+	PrecisionSeconds      Precision = "s"
+	PrecisionMilliseconds Precision = "ms"
+	PrecisionMicroseconds Precision = "us"
+
+	//Original devices send milliseconds
+	DefaultPrecision = PrecisionMilliseconds
+
+	//Bits 1-2 of the batch frame flags select the precision, 0 means device default
+	FlagPrecisionMask  uint8 = 0x06
+	flagPrecisionShift       = 1
+)
+
+var (
+	flagPrecisions = []Precision{"", PrecisionSeconds, PrecisionMilliseconds, PrecisionMicroseconds}
+)
+
+func ParsePrecision(precision string) (Precision, error) {
+	switch p := Precision(precision); p {
+	case PrecisionSeconds, PrecisionMilliseconds, PrecisionMicroseconds:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("Unknown timestamp precision: %s", precision)
+}
+
+// Time converts a raw epoch value to a time, 0 is returned as the zero time
+func (p Precision) Time(raw uint64) (time.Time, error) {
+	if raw == 0 {
+		return time.Time{}, nil
+	}
+
+	if raw > math.MaxInt64 {
+		return time.Time{}, fmt.Errorf("Timestamp out of range: %d", raw)
+	}
+
+	value := int64(raw)
+
+	switch p {
+	case PrecisionSeconds:
+		return time.Unix(value, 0).UTC(), nil
+	case PrecisionMilliseconds:
+		return time.Unix(value/1000, (value%1000)*int64(time.Millisecond)).UTC(), nil
+	case PrecisionMicroseconds:
+		return time.Unix(value/1000000, (value%1000000)*int64(time.Microsecond)).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("Unknown timestamp precision: %s", p)
+}
+
+// Precision returns the precision selected in the frame flags, or an empty
+// precision if the device default should be used
+func (h FrameHeader) Precision() Precision {
+	return flagPrecisions[(h.Flags&FlagPrecisionMask)>>flagPrecisionShift]
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrecisionTime(t *testing.T) {
+	expected := time.Date(2021, 6, 18, 7, 6, 40, 123456000, time.UTC)
+
+	tests := []struct {
+		precision Precision
+		raw       uint64
+		expected  time.Time
+	}{
+		{PrecisionSeconds, 1624000000, expected.Truncate(time.Second)},
+		{PrecisionMilliseconds, 1624000000123, expected.Truncate(time.Millisecond)},
+		{PrecisionMicroseconds, 1624000000123456, expected},
+	}
+
+	for _, test := range tests {
+		tm, err := test.precision.Time(test.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !tm.Equal(test.expected) {
+			t.Errorf("%s: expected %s, got %s", test.precision, test.expected, tm)
+		}
+	}
+
+	tm, err := PrecisionMilliseconds.Time(0)
+	if err != nil || !tm.IsZero() {
+		t.Errorf("Expected zero time for 0 timestamp, got %s: %v", tm, err)
+	}
+}
+
+func TestFrameHeaderPrecision(t *testing.T) {
+	h := FrameHeader{Type: FrameTypeBatch, Flags: FlagStreamIndex | 3<<flagPrecisionShift}
+	if h.Precision() != PrecisionMicroseconds {
+		t.Errorf("Expected microseconds, got %q", h.Precision())
+	}
+
+	h.Flags = FlagStreamIndex
+	if h.Precision() != "" {
+		t.Errorf("Expected device default, got %q", h.Precision())
+	}
+}
@@ -0,0 +1,223 @@
+package phoenix
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// Notification sent by devices with a map of their current configuration
+	NotificationConfigReported = "config_reported"
+
+	shadowUpdateRetries = 5
+)
+
+// ShadowState maps configuration names to values, values are strings or
+// numbers as those are the types config_write can send
+type ShadowState map[string]interface{}
+
+func (s ShadowState) Value() (driver.Value, error) {
+	if s == nil {
+		return "{}", nil
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(data), nil
+}
+
+func (s *ShadowState) Scan(src interface{}) error {
+	var data []byte
+	switch t := src.(type) {
+	case nil:
+		*s = ShadowState{}
+		return nil
+	case []byte:
+		data = t
+	case string:
+		data = []byte(t)
+	default:
+		return fmt.Errorf("Cannot scan %T into shadow state", src)
+	}
+
+	state := ShadowState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	*s = state
+	return nil
+}
+
+// Validate checks all values can be written to the device, nil values are
+// allowed as they remove the configuration in a patch
+func (s ShadowState) Validate() error {
+	for name, value := range s {
+		if len(name) == 0 {
+			return fmt.Errorf("Configuration name is empty")
+		}
+
+		switch value.(type) {
+		case nil, string, float64:
+		default:
+			return fmt.Errorf("Unsupported value type %T for configuration %s", value, name)
+		}
+	}
+
+	return nil
+}
+
+// Merge applies a patch to the state, a nil value removes the configuration.
+// Returns true if the state changed.
+func (s ShadowState) Merge(patch ShadowState) bool {
+	changed := false
+	for name, value := range patch {
+		current, exists := s[name]
+		if value == nil {
+			if exists {
+				delete(s, name)
+				changed = true
+			}
+			continue
+		}
+
+		if !exists || current != value {
+			s[name] = value
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Names returns the configuration names in sorted order
+func (s ShadowState) Names() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ShadowType returns the config_write type of a configuration value
+func ShadowType(value interface{}) (string, error) {
+	switch value.(type) {
+	case string:
+		return "string", nil
+	case float64:
+		return "double", nil
+	}
+
+	return "", fmt.Errorf("Unsupported value type %T", value)
+}
+
+// DeviceShadow is the configuration the device should have and the
+// configuration last reported by the device
+type DeviceShadow struct {
+	DeviceId uint64      `db:"device_id" json:"-"`
+	Desired  ShadowState `db:"desired" json:"desired"`
+	Reported ShadowState `db:"reported" json:"reported"`
+	Version  uint64      `db:"version" json:"version"`
+	Updated  time.Time   `db:"updated" json:"updated"`
+}
+
+// Delta returns the desired configuration which differs from the reported
+func (s *DeviceShadow) Delta() ShadowState {
+	delta := ShadowState{}
+	for name, value := range s.Desired {
+		reported, exists := s.Reported[name]
+		if !exists || reported != value {
+			delta[name] = value
+		}
+	}
+
+	return delta
+}
+
+func (d *Device) Shadow() (*DeviceShadow, error) {
+	var s DeviceShadow
+	err := d.db.Get(&s, "SELECT * FROM device_shadows WHERE device_id = ?", d.Id)
+	if err == sql.ErrNoRows {
+		return &DeviceShadow{
+			DeviceId: d.Id,
+			Desired:  ShadowState{},
+			Reported: ShadowState{},
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// ShadowUpdate applies update to the shadow and saves it if update returns
+// true. Concurrent updates are retried using the shadow version.
+func (d *Device) ShadowUpdate(update func(*DeviceShadow) bool) (*DeviceShadow, error) {
+	for i := 0; i < shadowUpdateRetries; i++ {
+		s, err := d.Shadow()
+		if err != nil {
+			return nil, err
+		}
+
+		if !update(s) {
+			return s, nil
+		}
+
+		version := s.Version
+		s.Version++
+		s.Updated = time.Now().UTC()
+
+		var result sql.Result
+		if version == 0 {
+			result, err = d.db.Exec("INSERT IGNORE INTO device_shadows (device_id, desired, reported, version, updated) VALUES (?, ?, ?, ?, ?)",
+				d.Id, s.Desired, s.Reported, s.Version, s.Updated)
+		} else {
+			result, err = d.db.Exec("UPDATE device_shadows SET desired = ?, reported = ?, version = ?, updated = ? WHERE device_id = ? AND version = ?",
+				s.Desired, s.Reported, s.Version, s.Updated, d.Id, version)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+
+		if affected == 1 {
+			return s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Shadow for device %s updated concurrently, giving up", d.Guid)
+}
+
+func (d *Device) ShadowDesiredPatch(patch ShadowState) (*DeviceShadow, error) {
+	if err := patch.Validate(); err != nil {
+		return nil, err
+	}
+
+	return d.ShadowUpdate(func(s *DeviceShadow) bool {
+		return s.Desired.Merge(patch)
+	})
+}
+
+func (d *Device) ShadowReport(reported ShadowState) (*DeviceShadow, error) {
+	if err := reported.Validate(); err != nil {
+		return nil, err
+	}
+
+	return d.ShadowUpdate(func(s *DeviceShadow) bool {
+		return s.Reported.Merge(reported)
+	})
+}
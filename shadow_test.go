@@ -0,0 +1,86 @@
+package phoenix
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShadowStateValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		state ShadowState
+		valid bool
+	}{
+		{"empty", ShadowState{}, true},
+		{"string and number", ShadowState{"mode": "eco", "interval": 60.0}, true},
+		{"removal", ShadowState{"mode": nil}, true},
+		{"empty name", ShadowState{"": "eco"}, false},
+		{"bool", ShadowState{"enabled": true}, false},
+		{"int", ShadowState{"interval": 60}, false},
+		{"object", ShadowState{"limits": map[string]interface{}{"max": 1.0}}, false},
+		{"list", ShadowState{"channels": []interface{}{1.0, 2.0}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.state.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: expected valid, got %v", test.name, err)
+		}
+
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestShadowStateMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    ShadowState
+		patch    ShadowState
+		expected ShadowState
+		changed  bool
+	}{
+		{"add", ShadowState{}, ShadowState{"mode": "eco"}, ShadowState{"mode": "eco"}, true},
+		{"change", ShadowState{"mode": "eco"}, ShadowState{"mode": "boost"}, ShadowState{"mode": "boost"}, true},
+		{"same value", ShadowState{"mode": "eco", "interval": 60.0}, ShadowState{"mode": "eco", "interval": 60.0}, ShadowState{"mode": "eco", "interval": 60.0}, false},
+		{"remove", ShadowState{"mode": "eco", "interval": 60.0}, ShadowState{"mode": nil}, ShadowState{"interval": 60.0}, true},
+		{"remove missing", ShadowState{"interval": 60.0}, ShadowState{"mode": nil}, ShadowState{"interval": 60.0}, false},
+		{"type change", ShadowState{"interval": "60"}, ShadowState{"interval": 60.0}, ShadowState{"interval": 60.0}, true},
+		{"empty patch", ShadowState{"mode": "eco"}, ShadowState{}, ShadowState{"mode": "eco"}, false},
+	}
+
+	for _, test := range tests {
+		changed := test.state.Merge(test.patch)
+		if changed != test.changed {
+			t.Errorf("%s: expected changed %t, got %t", test.name, test.changed, changed)
+		}
+
+		if !reflect.DeepEqual(test.state, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, test.state)
+		}
+	}
+}
+
+func TestDeviceShadowDelta(t *testing.T) {
+	tests := []struct {
+		name     string
+		desired  ShadowState
+		reported ShadowState
+		expected ShadowState
+	}{
+		{"in sync", ShadowState{"mode": "eco"}, ShadowState{"mode": "eco"}, ShadowState{}},
+		{"never reported", ShadowState{"mode": "eco"}, nil, ShadowState{"mode": "eco"}},
+		{"changed", ShadowState{"mode": "eco", "interval": 60.0}, ShadowState{"mode": "boost", "interval": 60.0}, ShadowState{"mode": "eco"}},
+		{"missing", ShadowState{"mode": "eco", "interval": 60.0}, ShadowState{"mode": "eco"}, ShadowState{"interval": 60.0}},
+		{"only reported", ShadowState{}, ShadowState{"mode": "eco"}, ShadowState{}},
+		{"type differs", ShadowState{"interval": 60.0}, ShadowState{"interval": "60"}, ShadowState{"interval": 60.0}},
+	}
+
+	for _, test := range tests {
+		s := DeviceShadow{Desired: test.desired, Reported: test.reported}
+		if delta := s.Delta(); !reflect.DeepEqual(delta, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, delta)
+		}
+	}
+}
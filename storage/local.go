@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Local stores objects as files below a directory
+type Local struct {
+	path string
+}
+
+func NewLocal(path string) (*Local, error) {
+	if path == "" {
+		return nil, fmt.Errorf("Missing path for local storage")
+	}
+
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return nil, err
+	}
+
+	return &Local{path}, nil
+}
+
+func (l *Local) filename(name string) (string, error) {
+	filename := filepath.Join(l.path, filepath.FromSlash(name))
+	if !strings.HasPrefix(filename, filepath.Clean(l.path)+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid object name: %s", name)
+	}
+
+	return filename, nil
+}
+
+func (l *Local) Put(name string, data io.Reader, size int64) error {
+	filename, err := l.filename(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+		return err
+	}
+
+	//Write to a temporary file, so readers never see a partial object
+	f, err := os.CreateTemp(filepath.Dir(filename), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	written, err := io.Copy(f, io.LimitReader(data, size))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if written != size {
+		return fmt.Errorf("Short object %s, got %d of %d bytes", name, written, size)
+	}
+
+	return os.Rename(f.Name(), filename)
+}
+
+func (l *Local) Open(name string, offset int64) (io.ReadCloser, error) {
+	filename, err := l.filename(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (l *Local) Delete(name string) error {
+	filename, err := l.filename(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(filename)
+}
@@ -0,0 +1,119 @@
+// Package storage keeps binary artifacts, like firmware images, on local
+// disk or in an S3 compatible object store.
+package storage
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	TypeLocal = "local"
+	TypeS3    = "s3"
+)
+
+type Config struct {
+	Type string `yaml:"Type"`
+
+	//Local storage
+	Path string `yaml:"Path"`
+
+	//S3 compatible storage
+	Endpoint  string `yaml:"Endpoint"`
+	Region    string `yaml:"Region"`
+	Bucket    string `yaml:"Bucket"`
+	AccessKey string `yaml:"AccessKey"`
+	SecretKey string `yaml:"SecretKey"`
+}
+
+type Storage interface {
+	// Put stores size bytes read from data under name
+	Put(name string, data io.Reader, size int64) error
+	// Open reads the object from offset to the end
+	Open(name string, offset int64) (io.ReadCloser, error)
+	Delete(name string) error
+}
+
+func New(config Config) (Storage, error) {
+	switch config.Type {
+	case TypeLocal, "":
+		return NewLocal(config.Path)
+	case TypeS3:
+		return NewS3(config)
+	}
+
+	return nil, fmt.Errorf("Unknown storage type: %s", config.Type)
+}
+
+// ReadSeeker reads an object of known size with seeking, as needed by
+// http.ServeContent to serve range requests. The object is only opened when
+// read, so seeking is cheap.
+type ReadSeeker struct {
+	storage Storage
+	name    string
+	size    int64
+	offset  int64
+	reader  io.ReadCloser
+}
+
+func NewReadSeeker(s Storage, name string, size int64) *ReadSeeker {
+	return &ReadSeeker{
+		storage: s,
+		name:    name,
+		size:    size,
+	}
+}
+
+func (rs *ReadSeeker) Read(p []byte) (int, error) {
+	if rs.offset >= rs.size {
+		return 0, io.EOF
+	}
+
+	if rs.reader == nil {
+		reader, err := rs.storage.Open(rs.name, rs.offset)
+		if err != nil {
+			return 0, err
+		}
+		rs.reader = reader
+	}
+
+	n, err := rs.reader.Read(p)
+	rs.offset += int64(n)
+	return n, err
+}
+
+func (rs *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = rs.offset + offset
+	case io.SeekEnd:
+		position = rs.size + offset
+	default:
+		return 0, fmt.Errorf("Invalid whence: %d", whence)
+	}
+
+	if position < 0 {
+		return 0, fmt.Errorf("Negative position: %d", position)
+	}
+
+	if position != rs.offset && rs.reader != nil {
+		rs.reader.Close()
+		rs.reader = nil
+	}
+
+	rs.offset = position
+	return position, nil
+}
+
+func (rs *ReadSeeker) Close() error {
+	if rs.reader == nil {
+		return nil
+	}
+
+	err := rs.reader.Close()
+	rs.reader = nil
+	return err
+}
@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalRange(t *testing.T) {
+	local, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := "0123456789abcdef"
+	if err := local.Put("firmware/1.bin", strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := local.Put("../escape.bin", strings.NewReader(data), int64(len(data))); err == nil {
+		t.Errorf("Object outside storage path accepted")
+	}
+
+	rs := NewReadSeeker(local, "firmware/1.bin", int64(len(data)))
+	defer rs.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/firmware", nil)
+	req.Header.Set("Range", "bytes=10-")
+	w := httptest.NewRecorder()
+	http.ServeContent(w, req, "1.bin", time.Time{}, rs)
+
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	if w.Code != http.StatusPartialContent || string(body) != data[10:] {
+		t.Errorf("Wrong range response %d: %q", w.Code, body)
+	}
+}
@@ -12,6 +12,8 @@ type Stream struct {
 	Code       string      `db:"code" json:"code"`
 	Timestamp  *time.Time  `db:"timestamp" json:"timestamp,omitempty"`
 	Value      interface{} `db:"value" json:"value"`
+
+	Metadata *StreamMetadata `json:"metadata,omitempty"`
 }
 
 func (s *Stream) Notification() DeviceNotification {
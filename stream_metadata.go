@@ -0,0 +1,367 @@
+package phoenix
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/cmodk/phoenix/transform"
+)
+
+const (
+	StreamTypeFloat  = "float"
+	StreamTypeInt    = "int"
+	StreamTypeBool   = "bool"
+	StreamTypeString = "string"
+	StreamTypeEnum   = "enum"
+
+	//Redis channel the stream metadata changes are broadcast on
+	StreamMetadataChannel = "stream_metadata_changed"
+)
+
+var (
+	StreamTypes = []string{
+		StreamTypeFloat,
+		StreamTypeInt,
+		StreamTypeBool,
+		StreamTypeString,
+		StreamTypeEnum,
+	}
+)
+
+// StreamMetadata describes the values of a stream. It is set per device type
+// and can be overridden per device, unset fields are inherited from the type.
+type StreamMetadata struct {
+	Unit        *string  `db:"unit" json:"unit,omitempty"`
+	DisplayName *string  `db:"display_name" json:"display_name,omitempty"`
+	Type        *string  `db:"type" json:"type,omitempty"`
+	Precision   *int     `db:"precision" json:"precision,omitempty"`
+	Min         *float64 `db:"min" json:"min,omitempty"`
+	Max         *float64 `db:"max" json:"max,omitempty"`
+	//Comma separated values of an enum stream
+	Enum *string `db:"enum" json:"enum,omitempty"`
+	//Applied to numeric values on ingest, before the range check
+	Transforms transform.Chain `db:"transforms" json:"transforms,omitempty"`
+	//Stream the value is stored in before the transforms, if set
+	RawStream *string `db:"raw_stream" json:"raw_stream,omitempty"`
+}
+
+// DeviceStreamMetadata is the metadata of a stream set on a single device
+type DeviceStreamMetadata struct {
+	DeviceId uint64 `db:"device_id" json:"-"`
+	Code     string `db:"code" json:"code"`
+	StreamMetadata
+}
+
+func (m *StreamMetadata) Validate() error {
+	if m.Type != nil {
+		valid := false
+		for _, t := range StreamTypes {
+			valid = valid || t == *m.Type
+		}
+		if !valid {
+			return fmt.Errorf("Unknown stream type: %s", *m.Type)
+		}
+
+		if *m.Type == StreamTypeEnum && len(m.EnumValues()) == 0 {
+			return fmt.Errorf("Enum stream needs enum values")
+		}
+	}
+
+	if m.Precision != nil && *m.Precision < 0 {
+		return fmt.Errorf("Precision cannot be negative")
+	}
+
+	if m.Min != nil && m.Max != nil && *m.Min > *m.Max {
+		return fmt.Errorf("Min %f is above max %f", *m.Min, *m.Max)
+	}
+
+	if err := m.Transforms.Validate(); err != nil {
+		return err
+	}
+
+	if m.RawStream != nil && len(*m.RawStream) == 0 {
+		return fmt.Errorf("Raw stream code is empty")
+	}
+
+	return nil
+}
+
+func (m *StreamMetadata) EnumValues() []string {
+	if m.Enum == nil {
+		return nil
+	}
+
+	var values []string
+	for _, v := range strings.Split(*m.Enum, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// Overlay sets the fields which are set in o
+func (m *StreamMetadata) Overlay(o StreamMetadata) {
+	if o.Unit != nil {
+		m.Unit = o.Unit
+	}
+	if o.DisplayName != nil {
+		m.DisplayName = o.DisplayName
+	}
+	if o.Type != nil {
+		m.Type = o.Type
+	}
+	if o.Precision != nil {
+		m.Precision = o.Precision
+	}
+	if o.Min != nil {
+		m.Min = o.Min
+	}
+	if o.Max != nil {
+		m.Max = o.Max
+	}
+	if o.Enum != nil {
+		m.Enum = o.Enum
+	}
+	if o.Transforms != nil {
+		m.Transforms = o.Transforms
+	}
+	if o.RawStream != nil {
+		m.RawStream = o.RawStream
+	}
+}
+
+// Transform applies the transforms to a numeric value, other values are
+// returned as is
+func (m *StreamMetadata) Transform(value interface{}) (interface{}, error) {
+	f, ok := value.(float64)
+	if !ok || len(m.Transforms) == 0 {
+		return value, nil
+	}
+
+	return m.Transforms.Apply(f)
+}
+
+// Check returns an error if the value does not match the type or is outside
+// the range of the stream
+func (m *StreamMetadata) Check(value interface{}) error {
+	if m.Type != nil {
+		switch *m.Type {
+		case StreamTypeFloat, StreamTypeInt:
+			f, ok := value.(float64)
+			if !ok {
+				return fmt.Errorf("Expected a number, got %T", value)
+			}
+			if *m.Type == StreamTypeInt && f != math.Trunc(f) {
+				return fmt.Errorf("Expected an integer, got %v", f)
+			}
+		case StreamTypeBool:
+			if _, ok := value.(bool); !ok {
+				return fmt.Errorf("Expected a bool, got %T", value)
+			}
+		case StreamTypeString:
+			if _, ok := value.(string); !ok {
+				return fmt.Errorf("Expected a string, got %T", value)
+			}
+		case StreamTypeEnum:
+			s, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("Expected an enum value, got %T", value)
+			}
+			valid := false
+			for _, v := range m.EnumValues() {
+				valid = valid || v == s
+			}
+			if !valid {
+				return fmt.Errorf("Unknown enum value: %s", s)
+			}
+		}
+	}
+
+	f, ok := value.(float64)
+	if !ok {
+		return nil
+	}
+
+	if m.Min != nil && f < *m.Min {
+		return fmt.Errorf("Value %v is below min %v", f, *m.Min)
+	}
+
+	if m.Max != nil && f > *m.Max {
+		return fmt.Errorf("Value %v is above max %v", f, *m.Max)
+	}
+
+	return nil
+}
+
+const streamMetadataColumns = "`unit`, `display_name`, `type`, `precision`, `min`, `max`, `enum`, `transforms`, `raw_stream`"
+
+const streamMetadataUpdate = "`unit` = VALUES(`unit`), `display_name` = VALUES(`display_name`), `type` = VALUES(`type`), `precision` = VALUES(`precision`), `min` = VALUES(`min`), `max` = VALUES(`max`), `enum` = VALUES(`enum`), `transforms` = VALUES(`transforms`), `raw_stream` = VALUES(`raw_stream`)"
+
+func (m *StreamMetadata) values() []interface{} {
+	return []interface{}{m.Unit, m.DisplayName, m.Type, m.Precision, m.Min, m.Max, m.Enum, m.Transforms, m.RawStream}
+}
+
+// TypeStreamSet creates or replaces a stream of the device type
+func (devices *Devices) TypeStreamSet(t *DeviceType, s *DeviceTypeStream) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	s.DeviceTypeId = t.Id
+	args := append([]interface{}{s.DeviceTypeId, s.Code}, s.values()...)
+	if _, err := devices.db.Exec("INSERT INTO device_type_streams (`device_type_id`, `code`, "+streamMetadataColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE "+streamMetadataUpdate, args...); err != nil {
+		return err
+	}
+
+	streamMetadataChanged(StreamMetadataChange{DeviceTypeId: t.Id})
+	return nil
+}
+
+// TypeStreams returns the streams of the device type
+func (devices *Devices) TypeStreams(device_type_id uint64) ([]DeviceTypeStream, error) {
+	var streams []DeviceTypeStream
+	if err := devices.db.Select(&streams, "SELECT * FROM device_type_streams WHERE device_type_id = ? ORDER BY code", device_type_id); err != nil {
+		return nil, err
+	}
+
+	return streams, nil
+}
+
+// StreamMetadataSet creates or replaces the metadata of a stream on the device
+func (d *Device) StreamMetadataSet(m *DeviceStreamMetadata) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+
+	m.DeviceId = d.Id
+	args := append([]interface{}{m.DeviceId, m.Code}, m.values()...)
+	if _, err := d.db.Exec("INSERT INTO device_stream_metadata (`device_id`, `code`, "+streamMetadataColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE "+streamMetadataUpdate, args...); err != nil {
+		return err
+	}
+
+	streamMetadataChanged(StreamMetadataChange{DeviceId: d.Id})
+	return nil
+}
+
+// DeviceStreamMetadata returns the metadata set on the device itself
+func (d *Device) DeviceStreamMetadata() ([]DeviceStreamMetadata, error) {
+	var device_metadata []DeviceStreamMetadata
+	if err := d.db.Select(&device_metadata, "SELECT * FROM device_stream_metadata WHERE device_id = ?", d.Id); err != nil {
+		return nil, err
+	}
+
+	return device_metadata, nil
+}
+
+// StreamMetadataList returns the metadata of the streams of the device type
+// overlaid with the metadata set on the device, by stream code
+func (d *Device) StreamMetadataList() (map[string]StreamMetadata, error) {
+	metadata := map[string]StreamMetadata{}
+
+	t, err := d.Type()
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if t != nil {
+		for _, s := range t.Streams {
+			metadata[s.Code] = s.StreamMetadata
+		}
+	}
+
+	device_metadata, err := d.DeviceStreamMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dm := range device_metadata {
+		m := metadata[dm.Code]
+		m.Overlay(dm.StreamMetadata)
+		metadata[dm.Code] = m
+	}
+
+	return metadata, nil
+}
+
+// StreamMetadata returns the metadata of a single stream, nil if the stream
+// has no metadata
+func (d *Device) StreamMetadata(code string) (*StreamMetadata, error) {
+	var type_streams []DeviceTypeStream
+
+	t, err := d.Type()
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if t != nil {
+		type_streams = t.Streams
+	}
+
+	var dm DeviceStreamMetadata
+	err = d.db.Get(&dm, "SELECT * FROM device_stream_metadata WHERE device_id = ? AND code = ?", d.Id, code)
+	if err == sql.ErrNoRows {
+		return ResolveStreamMetadata(type_streams, nil, code), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ResolveStreamMetadata(type_streams, []DeviceStreamMetadata{dm}, code), nil
+}
+
+// ResolveStreamMetadata returns the metadata of the stream of the device type
+// overlaid with the metadata set on the device, nil if neither has the stream
+func ResolveStreamMetadata(type_streams []DeviceTypeStream, device_metadata []DeviceStreamMetadata, code string) *StreamMetadata {
+	var m *StreamMetadata
+
+	for _, s := range type_streams {
+		if s.Code == code {
+			type_metadata := s.StreamMetadata
+			m = &type_metadata
+		}
+	}
+
+	for _, dm := range device_metadata {
+		if dm.Code != code {
+			continue
+		}
+
+		if m == nil {
+			m = &StreamMetadata{}
+		}
+		m.Overlay(dm.StreamMetadata)
+	}
+
+	return m
+}
+
+// StreamMetadataChange is broadcast to every instance caching stream metadata
+// when the metadata of a device type or a device changes
+type StreamMetadataChange struct {
+	DeviceTypeId uint64 `json:"device_type_id,omitempty"`
+	DeviceId     uint64 `json:"device_id,omitempty"`
+}
+
+// streamMetadataChanged tells the caches about the change. The caches expire
+// on their own, so a lost message only delays the change.
+func streamMetadataChanged(c StreamMetadataChange) {
+	if phoenix == nil || phoenix.Redis == nil {
+		return
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		log.WithField("error", err).Error("Error encoding stream metadata change")
+		return
+	}
+
+	if err := phoenix.Redis.Publish(context.Background(), StreamMetadataChannel, data).Err(); err != nil {
+		log.WithField("error", err).Warning("Error broadcasting stream metadata change")
+	}
+}
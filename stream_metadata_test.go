@@ -0,0 +1,155 @@
+package phoenix
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cmodk/phoenix/transform"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestStreamMetadataValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata StreamMetadata
+		valid    bool
+	}{
+		{"empty", StreamMetadata{}, true},
+		{"float range", StreamMetadata{Type: stringPtr(StreamTypeFloat), Min: floatPtr(-10), Max: floatPtr(10)}, true},
+		{"enum", StreamMetadata{Type: stringPtr(StreamTypeEnum), Enum: stringPtr("off, on")}, true},
+		{"transforms", StreamMetadata{Transforms: transform.Chain{{Type: transform.TypeLinear, Scale: 0.1}}, RawStream: stringPtr("raw")}, true},
+		{"unknown type", StreamMetadata{Type: stringPtr("decimal")}, false},
+		{"enum without values", StreamMetadata{Type: stringPtr(StreamTypeEnum), Enum: stringPtr(" , ")}, false},
+		{"negative precision", StreamMetadata{Precision: intPtr(-1)}, false},
+		{"min above max", StreamMetadata{Min: floatPtr(10), Max: floatPtr(-10)}, false},
+		{"bad transform", StreamMetadata{Transforms: transform.Chain{{Type: transform.TypeLinear}}}, false},
+		{"empty raw stream", StreamMetadata{RawStream: stringPtr("")}, false},
+	}
+
+	for _, test := range tests {
+		err := test.metadata.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: expected valid, got %v", test.name, err)
+		}
+
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestStreamMetadataCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata StreamMetadata
+		value    interface{}
+		valid    bool
+	}{
+		{"no metadata", StreamMetadata{}, "anything", true},
+		{"float", StreamMetadata{Type: stringPtr(StreamTypeFloat)}, 1.5, true},
+		{"float as string", StreamMetadata{Type: stringPtr(StreamTypeFloat)}, "1.5", false},
+		{"int", StreamMetadata{Type: stringPtr(StreamTypeInt)}, 2.0, true},
+		{"int with fraction", StreamMetadata{Type: stringPtr(StreamTypeInt)}, 2.5, false},
+		{"bool", StreamMetadata{Type: stringPtr(StreamTypeBool)}, true, true},
+		{"bool as number", StreamMetadata{Type: stringPtr(StreamTypeBool)}, 1.0, false},
+		{"string", StreamMetadata{Type: stringPtr(StreamTypeString)}, "on", true},
+		{"string as number", StreamMetadata{Type: stringPtr(StreamTypeString)}, 1.0, false},
+		{"enum", StreamMetadata{Type: stringPtr(StreamTypeEnum), Enum: stringPtr("off,on")}, "on", true},
+		{"unknown enum", StreamMetadata{Type: stringPtr(StreamTypeEnum), Enum: stringPtr("off,on")}, "auto", false},
+		{"enum as number", StreamMetadata{Type: stringPtr(StreamTypeEnum), Enum: stringPtr("off,on")}, 1.0, false},
+		{"in range", StreamMetadata{Min: floatPtr(0), Max: floatPtr(10)}, 10.0, true},
+		{"below min", StreamMetadata{Min: floatPtr(0)}, -0.1, false},
+		{"above max", StreamMetadata{Max: floatPtr(10)}, 10.1, false},
+		{"range ignores strings", StreamMetadata{Min: floatPtr(0)}, "-1", true},
+	}
+
+	for _, test := range tests {
+		err := test.metadata.Check(test.value)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected valid, got %v", test.name, err)
+		}
+
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestStreamMetadataOverlay(t *testing.T) {
+	m := StreamMetadata{
+		Unit:        stringPtr("C"),
+		DisplayName: stringPtr("Temperature"),
+		Type:        stringPtr(StreamTypeFloat),
+		Min:         floatPtr(-40),
+		Max:         floatPtr(85),
+	}
+
+	m.Overlay(StreamMetadata{
+		Unit:      stringPtr("F"),
+		Max:       floatPtr(100),
+		Precision: intPtr(1),
+	})
+
+	expected := StreamMetadata{
+		Unit:        stringPtr("F"),
+		DisplayName: stringPtr("Temperature"),
+		Type:        stringPtr(StreamTypeFloat),
+		Precision:   intPtr(1),
+		Min:         floatPtr(-40),
+		Max:         floatPtr(100),
+	}
+
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m)
+	}
+
+	//Nothing set overlays nothing
+	m.Overlay(StreamMetadata{})
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Empty overlay changed metadata to %+v", m)
+	}
+}
+
+func TestResolveStreamMetadata(t *testing.T) {
+	type_streams := []DeviceTypeStream{
+		{Code: "temperature", StreamMetadata: StreamMetadata{Unit: stringPtr("C"), Max: floatPtr(85)}},
+		{Code: "humidity", StreamMetadata: StreamMetadata{Unit: stringPtr("%")}},
+	}
+	device_metadata := []DeviceStreamMetadata{
+		{Code: "temperature", StreamMetadata: StreamMetadata{Max: floatPtr(60)}},
+		{Code: "pressure", StreamMetadata: StreamMetadata{Unit: stringPtr("hPa")}},
+	}
+
+	tests := []struct {
+		code     string
+		expected *StreamMetadata
+	}{
+		{"temperature", &StreamMetadata{Unit: stringPtr("C"), Max: floatPtr(60)}},
+		{"humidity", &StreamMetadata{Unit: stringPtr("%")}},
+		{"pressure", &StreamMetadata{Unit: stringPtr("hPa")}},
+		{"voltage", nil},
+	}
+
+	for _, test := range tests {
+		m := ResolveStreamMetadata(type_streams, device_metadata, test.code)
+		if !reflect.DeepEqual(m, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.code, test.expected, m)
+		}
+	}
+
+	//The type streams are not changed by the device metadata
+	if *type_streams[0].Max != 85 {
+		t.Errorf("Type stream changed: %v", *type_streams[0].Max)
+	}
+}
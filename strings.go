@@ -4,9 +4,7 @@ import (
 	"fmt"
 )
 
-func StringSave(event interface{}) error {
-	e := event.(StreamUpdated)
-
+func StringSave(e StreamUpdated) error {
 	value, ok := e.Value.(string)
 	if !ok {
 		log.WithField("stream", e).Debug("Cannot save string string as sample")
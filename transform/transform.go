@@ -0,0 +1,165 @@
+// Package transform converts raw stream values on ingest, for calibration
+// and unit conversion
+package transform
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	TypeLinear     = "linear"
+	TypePolynomial = "polynomial"
+	TypeLookup     = "lookup"
+	TypeUnit       = "unit"
+)
+
+// Transform is a single conversion of a value
+//
+//	linear:     value*scale + offset
+//	polynomial: c0 + c1*value + c2*value^2 ...
+//	lookup:     linear interpolation in a table of [raw, value] points,
+//	            clamped to the first and last point
+//	unit:       conversion between the units from and to
+type Transform struct {
+	Type         string       `json:"type"`
+	Scale        float64      `json:"scale,omitempty"`
+	Offset       float64      `json:"offset,omitempty"`
+	Coefficients []float64    `json:"coefficients,omitempty"`
+	Table        [][2]float64 `json:"table,omitempty"`
+	From         string       `json:"from,omitempty"`
+	To           string       `json:"to,omitempty"`
+}
+
+// Chain is a list of transforms applied in order
+type Chain []Transform
+
+func (t *Transform) Validate() error {
+	switch t.Type {
+	case TypeLinear:
+		if t.Scale == 0 {
+			return fmt.Errorf("Linear transform needs a scale")
+		}
+	case TypePolynomial:
+		if len(t.Coefficients) == 0 {
+			return fmt.Errorf("Polynomial transform needs coefficients")
+		}
+	case TypeLookup:
+		if len(t.Table) < 2 {
+			return fmt.Errorf("Lookup transform needs at least 2 points")
+		}
+		for i := 1; i < len(t.Table); i++ {
+			if t.Table[i][0] <= t.Table[i-1][0] {
+				return fmt.Errorf("Lookup table must be sorted by raw value")
+			}
+		}
+	case TypeUnit:
+		if _, err := unitConversion(t.From, t.To); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown transform type: %s", t.Type)
+	}
+
+	return nil
+}
+
+func (t *Transform) Apply(value float64) (float64, error) {
+	switch t.Type {
+	case TypeLinear:
+		return value*t.Scale + t.Offset, nil
+	case TypePolynomial:
+		//Horner's method
+		result := 0.0
+		for i := len(t.Coefficients) - 1; i >= 0; i-- {
+			result = result*value + t.Coefficients[i]
+		}
+		return result, nil
+	case TypeLookup:
+		return lookup(t.Table, value), nil
+	case TypeUnit:
+		c, err := unitConversion(t.From, t.To)
+		if err != nil {
+			return 0, err
+		}
+		return c(value), nil
+	}
+
+	return 0, fmt.Errorf("Unknown transform type: %s", t.Type)
+}
+
+func lookup(table [][2]float64, value float64) float64 {
+	if value <= table[0][0] {
+		return table[0][1]
+	}
+
+	last := len(table) - 1
+	if value >= table[last][0] {
+		return table[last][1]
+	}
+
+	i := sort.Search(len(table), func(i int) bool { return table[i][0] >= value })
+	x0, y0 := table[i-1][0], table[i-1][1]
+	x1, y1 := table[i][0], table[i][1]
+
+	return y0 + (value-x0)*(y1-y0)/(x1-x0)
+}
+
+func (c Chain) Validate() error {
+	for i := range c {
+		if err := c[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c Chain) Apply(value float64) (float64, error) {
+	var err error
+	for i := range c {
+		value, err = c[i].Apply(value)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("Transform result is not a number")
+	}
+
+	return value, nil
+}
+
+func (c Chain) Value() (driver.Value, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(data), nil
+}
+
+func (c *Chain) Scan(src interface{}) error {
+	var data []byte
+	switch t := src.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case []byte:
+		data = t
+	case string:
+		data = []byte(t)
+	default:
+		return fmt.Errorf("Cannot scan %T into transform chain", src)
+	}
+
+	return json.Unmarshal(data, c)
+}
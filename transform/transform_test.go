@@ -0,0 +1,65 @@
+package transform
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		transform string
+		value     float64
+		expected  float64
+	}{
+		{`[{"type":"linear","scale":0.1,"offset":-40}]`, 650, 25},
+		{`[{"type":"polynomial","coefficients":[1,2,3]}]`, 2, 17},
+		{`[{"type":"lookup","table":[[0,0],[100,10],[200,40]]}]`, 150, 25},
+		{`[{"type":"lookup","table":[[0,0],[100,10]]}]`, -5, 0},
+		{`[{"type":"lookup","table":[[0,0],[100,10]]}]`, 500, 10},
+		{`[{"type":"unit","from":"F","to":"C"}]`, 212, 100},
+		{`[{"type":"unit","from":"C","to":"K"}]`, 0, 273.15},
+		{`[{"type":"unit","from":"kWh","to":"Wh"}]`, 1.5, 1500},
+		{`[{"type":"linear","scale":0.1},{"type":"unit","from":"F","to":"C"}]`, 320, 0},
+	}
+
+	for _, test := range tests {
+		var c Chain
+		if err := json.Unmarshal([]byte(test.transform), &c); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Validate(); err != nil {
+			t.Errorf("%s: %s", test.transform, err)
+			continue
+		}
+
+		value, err := c.Apply(test.value)
+		if err != nil {
+			t.Errorf("%s: %s", test.transform, err)
+			continue
+		}
+
+		if math.Abs(value-test.expected) > 1e-9 {
+			t.Errorf("%s(%v) = %v, expected %v", test.transform, test.value, value, test.expected)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := []Transform{
+		{Type: "unknown"},
+		{Type: TypeLinear},
+		{Type: TypePolynomial},
+		{Type: TypeLookup, Table: [][2]float64{{1, 1}}},
+		{Type: TypeLookup, Table: [][2]float64{{2, 1}, {1, 2}}},
+		{Type: TypeUnit, From: "C", To: "kW"},
+		{Type: TypeUnit, From: "C", To: "unknown"},
+	}
+
+	for _, transform := range invalid {
+		if err := transform.Validate(); err == nil {
+			t.Errorf("Invalid transform accepted: %+v", transform)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package transform
+
+import (
+	"fmt"
+)
+
+// unit is a unit as a linear function of the base unit of its quantity
+type unit struct {
+	quantity string
+	scale    float64
+	offset   float64
+}
+
+var (
+	units = map[string]unit{
+		"C": {"temperature", 1, 0},
+		"F": {"temperature", 5.0 / 9.0, -32 * 5.0 / 9.0},
+		"K": {"temperature", 1, -273.15},
+
+		"Pa":  {"pressure", 1, 0},
+		"kPa": {"pressure", 1000, 0},
+		"hPa": {"pressure", 100, 0},
+		"bar": {"pressure", 100000, 0},
+		"psi": {"pressure", 6894.757293168, 0},
+
+		"W":  {"power", 1, 0},
+		"kW": {"power", 1000, 0},
+		"MW": {"power", 1000000, 0},
+
+		"Wh":  {"energy", 1, 0},
+		"kWh": {"energy", 1000, 0},
+		"MWh": {"energy", 1000000, 0},
+		"J":   {"energy", 1.0 / 3600, 0},
+
+		"mV": {"voltage", 0.001, 0},
+		"V":  {"voltage", 1, 0},
+
+		"mA": {"current", 0.001, 0},
+		"A":  {"current", 1, 0},
+
+		"mm": {"length", 0.001, 0},
+		"cm": {"length", 0.01, 0},
+		"m":  {"length", 1, 0},
+		"in": {"length", 0.0254, 0},
+		"ft": {"length", 0.3048, 0},
+
+		"l":   {"volume", 1, 0},
+		"m3":  {"volume", 1000, 0},
+		"gal": {"volume", 3.785411784, 0},
+
+		"%":  {"ratio", 0.01, 0},
+		"pu": {"ratio", 1, 0},
+	}
+)
+
+func unitConversion(from, to string) (func(float64) float64, error) {
+	f, ok := units[from]
+	if !ok {
+		return nil, fmt.Errorf("Unknown unit: %s", from)
+	}
+
+	t, ok := units[to]
+	if !ok {
+		return nil, fmt.Errorf("Unknown unit: %s", to)
+	}
+
+	if f.quantity != t.quantity {
+		return nil, fmt.Errorf("Cannot convert %s %s to %s %s", f.quantity, from, t.quantity, to)
+	}
+
+	return func(value float64) float64 {
+		base := value*f.scale + f.offset
+		return (base - t.offset) / t.scale
+	}, nil
+}
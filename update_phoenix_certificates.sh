@@ -15,8 +15,12 @@ $KUBECTL delete secret $SECRET
 $KUBECTL create secret generic $SECRET \
   --from-file=./certificates/ca.pem \
   --from-file=./certificates/ca.key.pem \
+  --from-file=./certificates/ca-bundle.pem \
+  --from-file=./certificates/intermediate.pem \
+  --from-file=./certificates/intermediate.key.pem \
   --from-file=./certificates/server.pem \
-  --from-file=./certificates/server.key.pem
+  --from-file=./certificates/server.key.pem \
+  --from-file=./certificates/firmware.key.pem
 
 #Refresh pods to load new certificate
 $KUBECTL -nphoenix-production get pods -o name |grep phoenix  |xargs $KUBECTL delete  
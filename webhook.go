@@ -0,0 +1,341 @@
+package phoenix
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+
+	"github.com/cmodk/phoenix/app"
+	"github.com/cmodk/phoenix/webhook"
+)
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryRetrying  = "retrying"
+	//Dead letters, gave up after the max number of attempts
+	WebhookDeliveryDead = "dead"
+)
+
+var (
+	// Events webhooks can subscribe to, by the registered name of the event
+	WebhookEvents = []interface{}{
+		DeviceNotificationCreated{},
+		StreamUpdated{},
+		StreamValueOutOfRange{},
+		DeviceCertificateRevoked{},
+		DeviceCertificateExpiring{},
+		DeviceShadowUpdated{},
+		AlertFiring{},
+		AlertResolved{},
+	}
+)
+
+// WebhookEventNames returns the registered names of the webhook events
+func WebhookEventNames() []string {
+	names := []string{}
+	for _, e := range WebhookEvents {
+		if et, err := app.LookupEventType(e); err == nil {
+			names = append(names, et.Name)
+		}
+	}
+
+	return names
+}
+
+// WebhookHostPolicy returns the hosts webhooks may post to from the config,
+// internal hosts are denied if none is configured
+func WebhookHostPolicy() webhook.HostPolicy {
+	if phoenix == nil || phoenix.Config == nil || phoenix.Config.Webhooks == nil {
+		return webhook.HostPolicy{}
+	}
+
+	return *phoenix.Config.Webhooks
+}
+
+// Webhook posts the selected events to an url. Events can be filtered to a
+// single device, a device type or the devices of a group.
+type Webhook struct {
+	Id           uint64    `db:"id" json:"id" table:"webhooks"`
+	Url          string    `db:"url" json:"url"`
+	Events       string    `db:"events" json:"events"`
+	DeviceId     *uint64   `db:"device_id" json:"device_id,omitempty"`
+	DeviceTypeId *uint64   `db:"device_type_id" json:"device_type_id,omitempty"`
+	GroupId      *uint64   `db:"group_id" json:"group_id,omitempty"`
+	Secret       string    `db:"secret" json:"secret,omitempty"`
+	Enabled      bool      `db:"enabled" json:"enabled"`
+	Created      time.Time `db:"created" json:"created"`
+}
+
+type WebhookCriteria struct {
+	Id       uint64 `schema:"id" db:"id"`
+	DeviceId uint64 `schema:"device_id" db:"device_id"`
+	Enabled  bool   `schema:"enabled" db:"enabled"`
+
+	Limit int `schema:"limit"`
+}
+
+// WebhookDelivery is an event delivered to a webhook, the delivery log keeps
+// the result of the last attempt
+type WebhookDelivery struct {
+	Id          uint64    `db:"id" json:"id" table:"webhook_deliveries"`
+	WebhookId   uint64    `db:"webhook_id" json:"webhook_id"`
+	Event       string    `db:"event" json:"event"`
+	Payload     string    `db:"payload" json:"payload"`
+	Status      string    `db:"status" json:"status"`
+	Attempts    int       `db:"attempts" json:"attempts"`
+	NextAttempt time.Time `db:"next_attempt" json:"next_attempt"`
+	StatusCode  *int      `db:"status_code" json:"status_code"`
+	Error       *string   `db:"error" json:"error"`
+	Created     time.Time `db:"created" json:"created"`
+	Updated     time.Time `db:"updated" json:"updated"`
+}
+
+type WebhookDeliveryCriteria struct {
+	Id        uint64 `schema:"id" db:"id"`
+	WebhookId uint64 `schema:"webhook_id" db:"webhook_id"`
+	Event     string `schema:"event" db:"event"`
+	Status    string `schema:"status" db:"status"`
+
+	Limit int `schema:"limit"`
+}
+
+// EventNames returns the events of the webhook
+func (w *Webhook) EventNames() []string {
+	var names []string
+	for _, name := range strings.Split(w.Events, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func (w *Webhook) Subscribes(event string) bool {
+	for _, name := range w.EventNames() {
+		if name == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("Webhook needs an http or https url")
+	}
+
+	if err := WebhookHostPolicy().CheckHost(u.Hostname()); err != nil {
+		return err
+	}
+
+	names := w.EventNames()
+	if len(names) == 0 {
+		return fmt.Errorf("Webhook needs at least one event")
+	}
+
+	events := WebhookEventNames()
+	for _, name := range names {
+		valid := false
+		for _, event := range events {
+			valid = valid || event == name
+		}
+		if !valid {
+			return fmt.Errorf("Unknown webhook event: %s", name)
+		}
+	}
+
+	return nil
+}
+
+func (devices *Devices) WebhookInsert(w *Webhook) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	if len(w.Secret) == 0 {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		w.Secret = hex.EncodeToString(secret)
+	}
+
+	w.Created = time.Now().UTC()
+	return devices.db.Insert(w, "webhooks")
+}
+
+func (devices *Devices) WebhookUpdate(w *Webhook) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	_, err := devices.db.Update(*w)
+	return err
+}
+
+func (devices *Devices) WebhookDelete(w *Webhook) error {
+	if _, err := devices.db.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", w.Id); err != nil {
+		return err
+	}
+
+	_, err := devices.db.Exec("DELETE FROM webhooks WHERE id = ?", w.Id)
+	return err
+}
+
+func (devices *Devices) WebhookGet(c WebhookCriteria) (*Webhook, error) {
+	var w Webhook
+	if err := devices.db.MatchOne(&w, "webhooks", c); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+func (devices *Devices) WebhookList(c WebhookCriteria) ([]Webhook, error) {
+	var webhooks []Webhook
+	if err := devices.db.Match(&webhooks, "webhooks", c); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// WebhookMatches returns true if the webhook filters include the device, a
+// nil device only matches webhooks without filters
+func (devices *Devices) WebhookMatches(w *Webhook, d *Device) (bool, error) {
+	if w.DeviceId == nil && w.DeviceTypeId == nil && w.GroupId == nil {
+		return true, nil
+	}
+
+	if d == nil {
+		return false, nil
+	}
+
+	if w.DeviceId != nil && *w.DeviceId != d.Id {
+		return false, nil
+	}
+
+	if w.DeviceTypeId != nil && (d.DeviceTypeId == nil || *d.DeviceTypeId != *w.DeviceTypeId) {
+		return false, nil
+	}
+
+	if w.GroupId != nil {
+		var members int
+		if err := devices.db.Get(&members, "SELECT COUNT(*) FROM device_group_members WHERE group_id = ? AND device_id = ?", *w.GroupId, d.Id); err != nil {
+			return false, err
+		}
+
+		if members == 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (devices *Devices) WebhookDeliveryInsert(delivery *WebhookDelivery) error {
+	delivery.Created = time.Now().UTC()
+	delivery.Updated = delivery.Created
+	delivery.NextAttempt = delivery.Created
+	delivery.Status = WebhookDeliveryPending
+
+	return devices.db.Insert(delivery, "webhook_deliveries")
+}
+
+func (devices *Devices) WebhookDeliveryGet(c WebhookDeliveryCriteria) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	if err := devices.db.MatchOne(&delivery, "webhook_deliveries", c); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+func (devices *Devices) WebhookDeliveryList(c WebhookDeliveryCriteria) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	if err := devices.db.Match(&deliveries, "webhook_deliveries", c); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// WebhookDeliveryDue returns the deliveries waiting for an attempt
+func (devices *Devices) WebhookDeliveryDue(limit uint64) ([]WebhookDelivery, error) {
+	query, args, err := squirrel.Select("*").From("webhook_deliveries").Where(squirrel.And{
+		squirrel.Eq{"status": []string{WebhookDeliveryPending, WebhookDeliveryRetrying}},
+		squirrel.LtOrEq{"next_attempt": time.Now().UTC()},
+	}).OrderBy("next_attempt").Limit(limit).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var deliveries []WebhookDelivery
+	if err := devices.db.Select(&deliveries, query, args...); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// WebhookDeliveryClaim moves the next attempt of a due delivery to until,
+// returns false if another worker claimed the delivery first
+func (devices *Devices) WebhookDeliveryClaim(delivery *WebhookDelivery, until time.Time) (bool, error) {
+	query, args, err := squirrel.Update("webhook_deliveries").Set("next_attempt", until).Where(squirrel.And{
+		squirrel.Eq{"id": delivery.Id},
+		squirrel.Eq{"status": []string{WebhookDeliveryPending, WebhookDeliveryRetrying}},
+		squirrel.LtOrEq{"next_attempt": time.Now().UTC()},
+	}).ToSql()
+	if err != nil {
+		return false, err
+	}
+
+	result, err := devices.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	delivery.NextAttempt = until
+	return affected == 1, nil
+}
+
+func (devices *Devices) WebhookDeliveryUpdate(delivery *WebhookDelivery) error {
+	delivery.Updated = time.Now().UTC()
+	_, err := devices.db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt = ?, status_code = ?, error = ?, updated = ? WHERE id = ?",
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttempt,
+		delivery.StatusCode,
+		delivery.Error,
+		delivery.Updated,
+		delivery.Id)
+	return err
+}
+
+// WebhookDeliveryRetry schedules a dead or failed delivery for a new round
+// of attempts
+func (devices *Devices) WebhookDeliveryRetry(delivery *WebhookDelivery) error {
+	if delivery.Status == WebhookDeliveryDelivered {
+		return fmt.Errorf("Delivery %d was delivered", delivery.Id)
+	}
+
+	delivery.Status = WebhookDeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttempt = time.Now().UTC()
+
+	return devices.WebhookDeliveryUpdate(delivery)
+}
@@ -0,0 +1,153 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	//Shared address space of carrier grade NAT, not covered by IsPrivate
+	sharedAddressSpace = mustParseCIDR("100.64.0.0/10")
+)
+
+// HostPolicy decides which hosts webhooks may post to. Loopback, private,
+// link-local and other internal addresses are denied unless allowed. Entries
+// are host names, which match the host and its subdomains, or CIDR ranges.
+type HostPolicy struct {
+	Allow []string `yaml:"Allow"`
+	Deny  []string `yaml:"Deny"`
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func matchesName(entries []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSuffix(entry, "."))
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesIP(entries []string, ip net.IP) bool {
+	for _, entry := range entries {
+		if _, n, err := net.ParseCIDR(entry); err == nil && n.Contains(ip) {
+			return true
+		}
+
+		if e := net.ParseIP(entry); e != nil && e.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func internal(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// CheckIP returns an error if webhooks may not post to the address
+func (p HostPolicy) CheckIP(ip net.IP) error {
+	if matchesIP(p.Deny, ip) {
+		return fmt.Errorf("Webhook address %s is denied", ip)
+	}
+
+	if matchesIP(p.Allow, ip) {
+		return nil
+	}
+
+	if internal(ip) {
+		return fmt.Errorf("Webhook address %s is internal", ip)
+	}
+
+	return nil
+}
+
+// CheckHost returns an error if webhooks may not post to the host. Host
+// names are only checked against the lists, the addresses they resolve to
+// are checked when connecting.
+func (p HostPolicy) CheckHost(host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+
+	if matchesName(p.Deny, host) {
+		return fmt.Errorf("Webhook host %s is denied", host)
+	}
+
+	if matchesName(p.Allow, host) {
+		return nil
+	}
+
+	if matchesName([]string{"localhost"}, host) {
+		return fmt.Errorf("Webhook host %s is internal", host)
+	}
+
+	return nil
+}
+
+// DialContext connects like the dialer, after checking the host and every
+// address it resolves to. Checking when connecting covers redirects and
+// names which resolve to an internal address after the webhook is saved.
+func (p HostPolicy) DialContext(dialer *net.Dialer) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.CheckHost(host); err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(host) != nil || matchesName(p.Allow, host) {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			if err := p.CheckIP(addr.IP); err != nil {
+				return nil, fmt.Errorf("Webhook host %s resolves to %s: %s", host, addr.IP, err)
+			}
+		}
+
+		//Connect to the checked address, so a second lookup cannot change it
+		var dial_err error
+		for _, addr := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			dial_err = err
+		}
+
+		if dial_err == nil {
+			dial_err = fmt.Errorf("Webhook host %s has no addresses", host)
+		}
+
+		return nil, dial_err
+	}
+}
@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckHost(t *testing.T) {
+	policy := HostPolicy{
+		Allow: []string{"hooks.internal.example", "10.1.0.0/16"},
+		Deny:  []string{"blocked.example", "203.0.113.7"},
+	}
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"example.com", true},
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"localhost", false},
+		{"api.localhost", false},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"10.1.2.3", true},
+		{"hooks.internal.example", true},
+		{"eu.hooks.internal.example", true},
+		{"blocked.example", false},
+		{"api.blocked.example", false},
+		{"203.0.113.7", false},
+	}
+
+	for _, test := range tests {
+		err := policy.CheckHost(test.host)
+		if test.allowed && err != nil {
+			t.Errorf("%s: expected allowed, got %v", test.host, err)
+		}
+
+		if !test.allowed && err == nil {
+			t.Errorf("%s: expected denied", test.host)
+		}
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	address := server.Listener.Addr().String()
+
+	if _, err := (HostPolicy{}).DialContext(&net.Dialer{})(context.Background(), "tcp", address); err == nil {
+		t.Errorf("Dialed internal address %s", address)
+	}
+
+	conn, err := (HostPolicy{Allow: []string{"127.0.0.0/8"}}).DialContext(&net.Dialer{})(context.Background(), "tcp", address)
+	if err != nil {
+		t.Fatalf("Allowed address %s not dialed: %v", address, err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,58 @@
+// Package webhook signs webhook deliveries and computes the retry schedule
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+const (
+	HeaderEvent     = "X-Phoenix-Event"
+	HeaderDelivery  = "X-Phoenix-Delivery"
+	HeaderTimestamp = "X-Phoenix-Timestamp"
+	HeaderSignature = "X-Phoenix-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+// Sign returns the signature of a delivery, a HMAC-SHA256 with the secret
+// over the unix timestamp, a dot and the body. The timestamp is sent in the
+// timestamp header so receivers can reject replayed deliveries.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature made by Sign
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Backoff returns the time to wait before the next attempt after the given
+// number of failed attempts, doubling from base up to max
+func Backoff(attempts int, base time.Duration, max time.Duration) time.Duration {
+	if attempts < 1 {
+		return base
+	}
+
+	delay := base
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+
+	if delay > max {
+		return max
+	}
+
+	return delay
+}
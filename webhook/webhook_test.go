@@ -0,0 +1,57 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"device_guid":"abc"}`)
+
+	//echo -n '1600000000.{"device_guid":"abc"}' | openssl dgst -sha256 -hmac secret
+	expected := "sha256=b887dc8307c2799b8370a925ea26fd0579658cc31f9965c74f40dc1c0c8bbd2a"
+	signature := Sign("secret", 1600000000, body)
+	if signature != expected {
+		t.Fatalf("Wrong signature: %s", signature)
+	}
+
+	if !Verify("secret", 1600000000, body, signature) {
+		t.Errorf("Signature not verified")
+	}
+
+	if Verify("other", 1600000000, body, signature) {
+		t.Errorf("Signature verified with wrong secret")
+	}
+
+	if Verify("secret", 1600000001, body, signature) {
+		t.Errorf("Signature verified with wrong timestamp")
+	}
+
+	if Verify("secret", 1600000000, []byte(`{}`), signature) {
+		t.Errorf("Signature verified with wrong body")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base := 30 * time.Second
+	max := time.Hour
+
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{100, time.Hour},
+	}
+
+	for _, test := range tests {
+		if delay := Backoff(test.attempts, base, max); delay != test.expected {
+			t.Errorf("Backoff(%d) = %s, expected %s", test.attempts, delay, test.expected)
+		}
+	}
+}